@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Access control. The server's API_KEY opens every session. A session can be
+// created with its own API key, which is then required for it and opens every
+// session created with the same key. Sessions without a key are open to all
+// callers when the server has no API_KEY, and to the server key only
+// otherwise. Session-qualified goals, session(S):Goal, are checked against the
+// same rules with the key of the request running the query, and may only
+// read the session they run in. Routes that are not scoped to a session,
+// such as creating sessions or clearing the cache, take the server key only.
+
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// requestKey returns the API key presented with a request, if any.
+func requestKey(c *gin.Context) string {
+	return strings.TrimSpace(strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer "))
+}
+
+// isSessionKey reports whether key was given to some session.
+func (e *Engine) isSessionKey(key string) bool {
+	var exists bool
+	err := e.db.QueryRow("SELECT EXISTS(SELECT 1 FROM sessions WHERE api_key_hash = ?)", hashKey(key)).Scan(&exists)
+	return err == nil && exists
+}
+
+// authorize reports whether a caller presenting key may use a session that
+// exists; exists is false when there is no such session.
+func (e *Engine) authorize(sessionID, key string) (allowed, exists bool) {
+	var hash string
+	if err := e.db.QueryRow("SELECT api_key_hash FROM sessions WHERE id = ?", sessionID).Scan(&hash); err != nil {
+		return false, false
+	}
+	if e.apiKey != "" && subtle.ConstantTimeCompare([]byte(key), []byte(e.apiKey)) == 1 {
+		return true, true
+	}
+	if hash == "" {
+		return e.apiKey == "", true
+	}
+	return key != "" && hashKey(key) == hash, true
+}
+
+// serverKeyMiddleware rejects requests not made with the server's API_KEY,
+// when the server has one.
+func (e *Engine) serverKeyMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if e.apiKey != "" && subtle.ConstantTimeCompare([]byte(requestKey(c)), []byte(e.apiKey)) != 1 {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Server API key required"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// sessionAccessMiddleware rejects requests for a session the caller's key
+// does not open. Unknown sessions are left to the handlers.
+func (e *Engine) sessionAccessMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Param("id")
+		if id == "" {
+			id = c.Param("sessionId")
+		}
+		if id != "" {
+			if allowed, exists := e.authorize(id, requestKey(c)); exists && !allowed {
+				c.JSON(http.StatusForbidden, gin.H{"error": "Access to session denied"})
+				c.Abort()
+				return
+			}
+		}
+		c.Next()
+	}
+}
+
+// QueryAs runs a query with the API key of the caller, which decides the
+// sessions its session-qualified goals may reach.
+func (e *Engine) QueryAs(query Query, sessionID, key string) QueryResult {
+	return e.StreamQuery(query, sessionID, key, nil)
+}
+
+// StreamQuery runs a traced query like QueryAs, passing each trace event to
+// stream as it happens.
+func (e *Engine) StreamQuery(query Query, sessionID, key string, stream func(TraceEvent)) QueryResult {
+	subst := make(Substitution)
+	setContext(subst, solveContext{access: key})
+	return e.runQuery(query, sessionID, subst, stream)
+}
+
+// solveInSession solves goal against the clauses of another session, for
+// session(S):Goal. S is a session ID or name.
+func (e *Engine) solveInSession(ref, goal Term, subst Substitution) []Substitution {
+	ref = e.deref(ref, subst)
+	if ref.Type != "atom" {
+		return []Substitution{}
+	}
+	id := ref.Value.(string)
+	if _, err := e.GetSession(id); err != nil {
+		session, err := e.GetSessionByName(id)
+		if err != nil {
+			return []Substitution{}
+		}
+		id = session.ID
+	}
+
+	ctx := contextOf(subst)
+	if allowed, _ := e.authorize(id, ctx.access); !allowed {
+		return []Substitution{}
+	}
+	inner := ctx
+	inner.readOnly = true
+	var results []Substitution
+	for _, sol := range e.solve([]Term{goal}, withContext(subst, inner), id) {
+		back := contextOf(sol)
+		back.readOnly = ctx.readOnly
+		results = append(results, withContext(sol, back))
+	}
+	return results
+}
+
+// sessionChanges are the builtins that change the session they run in, which
+// goals run through session(S):Goal may not call.
+var sessionChanges = map[string]bool{
+	"op": true, "module": true, "use_module": true, "multifile": true,
+	"trace": true, "notrace": true, "spy": true, "nospy": true,
+	"materialize": true, "retract": true,
+}
+
+func changesSession(goal Term) bool {
+	return (goal.Type == "atom" || goal.Type == "compound") && sessionChanges[goal.Value.(string)]
+}
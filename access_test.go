@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSessionQualifiedGoals(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+
+	catalog, _ := engine.CreateSession(CreateSessionRequest{Name: "catalog"})
+	if _, err := engine.Consult(catalog.ID, `
+category(dune, books).
+category(tent, outdoor).
+price(dune, 12).
+price(tent, 150).
+`); err != nil {
+		t.Fatalf("Consult failed: %v", err)
+	}
+
+	sessionID := createTestSession(t, engine)
+	if _, err := engine.Consult(sessionID, `
+likes(ann, books).
+suggestion(P, Item, Price) :- likes(P, C), session(catalog):(category(Item, C), price(Item, Price)).
+`); err != nil {
+		t.Fatalf("Consult failed: %v", err)
+	}
+
+	solutions := queryAll(engine, sessionID, Compound("suggestion", []Term{Atom("ann"), Variable("Item"), Variable("Price")}))
+	if len(solutions) != 1 || solutions[0].Bindings["Item"].Value != "dune" || solutions[0].Bindings["Price"].Value != 12.0 {
+		t.Errorf("Expected dune at 12, got %v", solutions)
+	}
+
+	// Sessions can be named by ID too, and their clauses stay where they are
+	goals, _ := engine.ParseQuery(sessionID, "session('"+catalog.ID+"'):price(tent, P)")
+	if solutions = queryAll(engine, sessionID, goals...); len(solutions) != 1 || solutions[0].Bindings["P"].Value != 150.0 {
+		t.Errorf("Expected the tent price by session ID, got %v", solutions)
+	}
+	if len(queryAll(engine, sessionID, Compound("price", []Term{Variable("I"), Variable("P")}))) != 0 {
+		t.Error("Expected price/2 not to be visible without qualification")
+	}
+	goals, _ = engine.ParseQuery(sessionID, "session(missing):price(tent, P)")
+	if len(queryAll(engine, sessionID, goals...)) != 0 {
+		t.Error("Expected an unknown session to fail")
+	}
+
+	// The key a query runs with cannot be set from the query
+	vault, _ := engine.CreateSession(CreateSessionRequest{Name: "vault", APIKey: "secret"})
+	engine.AddFact(Fact{SessionID: vault.ID, Predicate: Compound("code", []Term{Number(42)})})
+	if len(queryAll(engine, sessionID,
+		Compound("=", []Term{Variable("$access"), Atom("secret")}),
+		Compound(":", []Term{Compound("session", []Term{Atom("vault")}), Compound("code", []Term{Variable("C")})}),
+	)) != 0 {
+		t.Error("Expected $access not to open a session")
+	}
+
+	// Qualified goals only read the other session
+	goals, _ = engine.ParseQuery(sessionID, "session(catalog):op(700, xfx, ===>)")
+	if len(queryAll(engine, sessionID, goals...)) != 0 {
+		t.Error("Expected op/3 to fail in another session")
+	}
+	if _, defined := engine.sessionOps(catalog.ID).infix["===>"]; defined {
+		t.Error("Expected the catalog's operators to be unchanged")
+	}
+	for _, text := range []string{"session(catalog):(m:use_module(lib))", "session(catalog):(m:multifile(q/1))", "session(catalog):(m:materialize(p/1))"} {
+		goals, _ = engine.ParseQuery(sessionID, text)
+		if len(queryAll(engine, sessionID, goals...)) != 0 {
+			t.Errorf("Expected %s to fail", text)
+		}
+	}
+	for _, text := range []string{"session(catalog):notrace", "session(catalog):nospy(price/2)", "session(catalog):spy(price/2)", "session(catalog):trace"} {
+		goals, _ = engine.ParseQuery(sessionID, text)
+		if len(queryAll(engine, sessionID, goals...)) != 0 {
+			t.Errorf("Expected %s to fail", text)
+		}
+	}
+	if spies := engine.sessionSpyPoints(catalog.ID); len(spies) != 0 {
+		t.Errorf("Expected no spy points in the catalog, got %v", spies)
+	}
+	for _, table := range []string{"session_imports", "session_multifile", "session_materialized"} {
+		var rows int
+		engine.db.QueryRow("SELECT COUNT(*) FROM "+table+" WHERE session_id = ?", catalog.ID).Scan(&rows)
+		if rows != 0 {
+			t.Errorf("Expected no %s rows for the catalog, got %d", table, rows)
+		}
+	}
+	goals, _ = engine.ParseQuery(sessionID, "session(catalog):price(dune, _), op(700, xfx, ===>)")
+	if len(queryAll(engine, sessionID, goals...)) != 1 {
+		t.Error("Expected the session to change itself after a qualified goal")
+	}
+}
+
+func TestServerKeyFromEnvironment(t *testing.T) {
+	t.Setenv("API_KEY", "admin-key")
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+
+	// The server key applies whether or not routes were set up
+	session, _ := engine.CreateSession(CreateSessionRequest{Name: "open"})
+	if allowed, _ := engine.authorize(session.ID, ""); allowed {
+		t.Error("Expected a session without a key to need the server key")
+	}
+	if allowed, _ := engine.authorize(session.ID, "admin-key"); !allowed {
+		t.Error("Expected the server key to open the session")
+	}
+}
+
+func TestSessionQualifiedGoalPermissions(t *testing.T) {
+	t.Setenv("API_KEY", "admin-key")
+	router, engine := setupTestRouter(t)
+	defer teardownTestEngine(engine)
+
+	profile, _ := engine.CreateSession(CreateSessionRequest{Name: "profile", APIKey: "tenant-a"})
+	catalog, _ := engine.CreateSession(CreateSessionRequest{Name: "catalog", APIKey: "tenant-a"})
+	payroll, _ := engine.CreateSession(CreateSessionRequest{Name: "payroll", APIKey: "tenant-b"})
+	engine.AddFact(Fact{SessionID: catalog.ID, Predicate: Compound("price", []Term{Atom("dune"), Number(12)})})
+	engine.AddFact(Fact{SessionID: payroll.ID, Predicate: Compound("salary", []Term{Atom("ann"), Number(5000)})})
+
+	query := func(key, text string) (int, QueryResult) {
+		body, _ := json.Marshal(Query{Text: text})
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1/sessions/"+profile.ID+"/query", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+key)
+		router.ServeHTTP(w, req)
+		var result QueryResult
+		json.Unmarshal(w.Body.Bytes(), &result)
+		return w.Code, result
+	}
+
+	code, result := query("tenant-a", "session(catalog):price(dune, P)")
+	if code != http.StatusOK || !result.Solutions[0].Success {
+		t.Errorf("Expected tenant-a to reach its catalog, got %d %v", code, result.Solutions)
+	}
+	code, result = query("tenant-a", "session(payroll):salary(ann, S)")
+	if code != http.StatusOK || result.Solutions[0].Success {
+		t.Errorf("Expected tenant-a not to reach payroll, got %d %v", code, result.Solutions)
+	}
+	code, result = query("admin-key", "session(payroll):salary(ann, S)")
+	if code != http.StatusOK || !result.Solutions[0].Success {
+		t.Errorf("Expected the server key to reach payroll, got %d %v", code, result.Solutions)
+	}
+	if code, _ = query("tenant-b", "true"); code != http.StatusForbidden {
+		t.Errorf("Expected status %d for another tenant's session, got %d", http.StatusForbidden, code)
+	}
+	if code, _ = query("wrong", "true"); code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d for an unknown key, got %d", http.StatusUnauthorized, code)
+	}
+
+	// Routes not scoped to a session take the server key only
+	for _, c := range []struct {
+		key  string
+		code int
+	}{{"tenant-a", http.StatusForbidden}, {"admin-key", http.StatusOK}} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1/cache/clear", nil)
+		req.Header.Set("Authorization", "Bearer "+c.key)
+		router.ServeHTTP(w, req)
+		if w.Code != c.code {
+			t.Errorf("Clearing the cache with %s: expected status %d, got %d", c.key, c.code, w.Code)
+		}
+	}
+
+	// Session listings only show what the key opens
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/v1/sessions", nil)
+	req.Header.Set("Authorization", "Bearer tenant-b")
+	router.ServeHTTP(w, req)
+	var listed struct {
+		Sessions []Session `json:"sessions"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &listed)
+	if len(listed.Sessions) != 1 || listed.Sessions[0].ID != payroll.ID {
+		t.Errorf("Expected tenant-b to see payroll only, got %s", w.Body.String())
+	}
+}
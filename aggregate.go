@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"sort"
+)
+
+// stripExistential removes Var^Goal prefixes from a goal, returning the inner
+// goal and the variables quantified away.
+func (e *Engine) stripExistential(goal Term, subst Substitution) (Term, map[string]bool) {
+	bound := make(map[string]bool)
+	goal = e.deref(goal, subst)
+	for goal.Type == "compound" && goal.Value == "^" && len(goal.Args) == 2 {
+		e.collectVars(e.instantiate(goal.Args[0], subst), bound)
+		goal = e.deref(goal.Args[1], subst)
+	}
+	return goal, bound
+}
+
+// handleAggregateAll implements aggregate_all(+Spec, :Goal, -Result). It
+// aggregates over every solution of Goal and succeeds once; count, sum, bag
+// and set succeed with 0 or [] when Goal has no solutions.
+func (e *Engine) handleAggregateAll(goal Term, subst Substitution, sessionID string) ([]Substitution, bool) {
+	if len(goal.Args) != 3 {
+		return []Substitution{}, true
+	}
+
+	inner, _ := e.stripExistential(goal.Args[1], subst)
+	solutions := e.solve([]Term{inner}, subst, sessionID)
+
+	result, ok := e.aggregateSolutions(e.instantiate(goal.Args[0], subst), solutions)
+	if !ok {
+		return []Substitution{}, true
+	}
+	return e.unifyResult(goal.Args[2], result, subst)
+}
+
+type aggregateGroup struct {
+	witness   Term
+	solutions []Substitution
+}
+
+// handleAggregate implements aggregate(+Spec, :Goal, -Result). Like bagof/3
+// it groups solutions by the free variables of Goal (those not in Spec and
+// not quantified with ^), yields one answer per group in standard order, and
+// fails when Goal has no solutions.
+func (e *Engine) handleAggregate(goal Term, subst Substitution, sessionID string) ([]Substitution, bool) {
+	if len(goal.Args) != 3 {
+		return []Substitution{}, true
+	}
+
+	spec := e.instantiate(goal.Args[0], subst)
+	inner, bound := e.stripExistential(e.instantiate(goal.Args[1], subst), subst)
+
+	specVars := make(map[string]bool)
+	e.collectVars(spec, specVars)
+	goalVars := make(map[string]bool)
+	e.collectVars(inner, goalVars)
+
+	var free []string
+	for v := range goalVars {
+		if !specVars[v] && !bound[v] {
+			free = append(free, v)
+		}
+	}
+	sort.Strings(free)
+	freeTerms := make([]Term, len(free))
+	for i, v := range free {
+		freeTerms[i] = Variable(v)
+	}
+	witness := Compound("group", freeTerms)
+
+	groups := make(map[string]*aggregateGroup)
+	var order []*aggregateGroup
+	for _, sol := range e.solve([]Term{inner}, subst, sessionID) {
+		value := e.instantiate(witness, sol)
+		data, _ := json.Marshal(value)
+		group, exists := groups[string(data)]
+		if !exists {
+			group = &aggregateGroup{witness: value}
+			groups[string(data)] = group
+			order = append(order, group)
+		}
+		group.solutions = append(group.solutions, sol)
+	}
+	sort.SliceStable(order, func(i, j int) bool { return compareTerms(order[i].witness, order[j].witness) < 0 })
+
+	results := []Substitution{}
+	for _, group := range order {
+		result, ok := e.aggregateSolutions(spec, group.solutions)
+		if !ok {
+			continue
+		}
+		newSubst, ok := e.unify(witness, group.witness, subst)
+		if !ok {
+			continue
+		}
+		if newSubst, ok = e.unify(goal.Args[2], result, newSubst); ok {
+			results = append(results, newSubst)
+		}
+	}
+	return results, true
+}
+
+// aggregateSolutions computes one aggregate Spec over a set of solutions.
+// Supported specs are count, count(X), sum(X), avg(X), max(X), min(X),
+// max(X, W), min(X, W), bag(X), set(X), median(X), stddev(X) and
+// percentile(X, P). Numeric aggregates skip non-numeric values, as sum/3
+// does; max and min compare in the standard order of terms, so they also
+// work on dates and atoms.
+func (e *Engine) aggregateSolutions(spec Term, solutions []Substitution) (Term, bool) {
+	if spec.Type == "atom" && spec.Value == "count" {
+		return Number(float64(len(solutions))), true
+	}
+	if spec.Type != "compound" || len(spec.Args) == 0 {
+		return Term{}, false
+	}
+
+	template := spec.Args[0]
+	values := make([]Term, len(solutions))
+	for i, sol := range solutions {
+		values[i] = e.instantiate(template, sol)
+	}
+
+	switch {
+	case spec.Value == "count" && len(spec.Args) == 1:
+		return Number(float64(len(solutions))), true
+
+	case spec.Value == "sum" && len(spec.Args) == 1:
+		var total float64
+		for _, n := range numericValues(values) {
+			total += n
+		}
+		return Number(total), true
+
+	case spec.Value == "avg" && len(spec.Args) == 1:
+		numbers := numericValues(values)
+		if len(numbers) == 0 {
+			return Term{}, false
+		}
+		var total float64
+		for _, n := range numbers {
+			total += n
+		}
+		return Number(total / float64(len(numbers))), true
+
+	case (spec.Value == "max" || spec.Value == "min") && (len(spec.Args) == 1 || len(spec.Args) == 2):
+		if len(values) == 0 {
+			return Term{}, false
+		}
+		best := 0
+		for i := 1; i < len(values); i++ {
+			c := compareTerms(values[i], values[best])
+			if (spec.Value == "max" && c > 0) || (spec.Value == "min" && c < 0) {
+				best = i
+			}
+		}
+		if len(spec.Args) == 1 {
+			return values[best], true
+		}
+		witness := e.instantiate(spec.Args[1], solutions[best])
+		return Compound(spec.Value.(string), []Term{values[best], witness}), true
+
+	case spec.Value == "bag" && len(spec.Args) == 1:
+		return List(values), true
+
+	case spec.Value == "set" && len(spec.Args) == 1:
+		return List(sortUnique(values)), true
+
+	case spec.Value == "median" && len(spec.Args) == 1:
+		return percentile(numericValues(values), 50)
+
+	case spec.Value == "percentile" && len(spec.Args) == 2:
+		p, ok := e.numberValue(spec.Args[1], make(Substitution))
+		if !ok || p < 0 || p > 100 {
+			return Term{}, false
+		}
+		return percentile(numericValues(values), p)
+
+	case spec.Value == "stddev" && len(spec.Args) == 1:
+		numbers := numericValues(values)
+		if len(numbers) == 0 {
+			return Term{}, false
+		}
+		var mean float64
+		for _, n := range numbers {
+			mean += n
+		}
+		mean /= float64(len(numbers))
+		var variance float64
+		for _, n := range numbers {
+			variance += (n - mean) * (n - mean)
+		}
+		// Population standard deviation
+		return Number(math.Sqrt(variance / float64(len(numbers)))), true
+	}
+
+	return Term{}, false
+}
+
+func numericValues(values []Term) []float64 {
+	var numbers []float64
+	for _, v := range values {
+		if v.Type == "number" {
+			if n, ok := v.Value.(float64); ok {
+				numbers = append(numbers, n)
+			}
+		}
+	}
+	return numbers
+}
+
+// percentile returns the p-th percentile using linear interpolation between
+// the closest ranks.
+func percentile(numbers []float64, p float64) (Term, bool) {
+	if len(numbers) == 0 {
+		return Term{}, false
+	}
+	sorted := append([]float64{}, numbers...)
+	sort.Float64s(sorted)
+
+	rank := p / 100 * float64(len(sorted)-1)
+	lo, hi := int(math.Floor(rank)), int(math.Ceil(rank))
+	return Number(sorted[lo] + (sorted[hi]-sorted[lo])*(rank-float64(lo))), true
+}
+
+// sortUnique sorts terms in the standard order and removes duplicates.
+func sortUnique(terms []Term) []Term {
+	sorted := append([]Term{}, terms...)
+	sort.SliceStable(sorted, func(i, j int) bool { return compareTerms(sorted[i], sorted[j]) < 0 })
+
+	var unique []Term
+	for _, t := range sorted {
+		if len(unique) == 0 || compareTerms(t, unique[len(unique)-1]) != 0 {
+			unique = append(unique, t)
+		}
+	}
+	return unique
+}
@@ -4,7 +4,7 @@ import (
 	"testing"
 )
 
-func setupAggregationTestData(t *testing.T, engine *Engine, sessionID int) {
+func setupAggregationTestData(t *testing.T, engine *Engine, sessionID string) {
 	// Add some test facts: score(john, 85), score(mary, 92), score(bob, 78)
 	facts := []Fact{
 		{SessionID: sessionID, Predicate: Compound("score", []Term{Atom("john"), Number(85)})},
@@ -220,4 +220,149 @@ func TestAggregationWrongArity(t *testing.T) {
 	if len(solutions) != 0 {
 		t.Errorf("Expected 0 solutions for count with wrong arity, got %d", len(solutions))
 	}
-}
\ No newline at end of file
+}
+
+func setupSalesTestData(t *testing.T, engine *Engine, sessionID string) {
+	// sale(Region, Rep, Amount)
+	sales := []struct {
+		region, rep string
+		amount      float64
+	}{
+		{"north", "ann", 100},
+		{"north", "bob", 300},
+		{"north", "ann", 200},
+		{"south", "cid", 50},
+		{"south", "dan", 150},
+	}
+	for _, s := range sales {
+		fact := Fact{SessionID: sessionID, Predicate: Compound("sale", []Term{Atom(s.region), Atom(s.rep), Number(s.amount)})}
+		if err := engine.AddFact(fact); err != nil {
+			t.Fatalf("Failed to add test fact: %v", err)
+		}
+	}
+}
+
+func TestAggregateAll(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+	setupSalesTestData(t, engine, sessionID)
+
+	sale := Compound("sale", []Term{Variable("R"), Variable("P"), Variable("A")})
+	amount := Variable("A")
+
+	cases := []struct {
+		spec     Term
+		expected float64
+	}{
+		{Atom("count"), 5},
+		{Compound("sum", []Term{amount}), 800},
+		{Compound("avg", []Term{amount}), 160},
+		{Compound("max", []Term{amount}), 300},
+		{Compound("min", []Term{amount}), 50},
+		{Compound("median", []Term{amount}), 150},
+		{Compound("percentile", []Term{amount, Number(25)}), 100},
+	}
+
+	for _, c := range cases {
+		goal := Compound("aggregate_all", []Term{c.spec, sale, Variable("Result")})
+		solutions, handled := engine.evalBuiltin(goal, make(Substitution), sessionID)
+		if !handled {
+			t.Fatal("Expected aggregate_all predicate to be handled")
+		}
+		if len(solutions) != 1 || solutions[0]["Result"].Value != c.expected {
+			t.Errorf("aggregate_all(%v): expected %v, got %v", c.spec, c.expected, solutions)
+		}
+	}
+
+	// Population standard deviation of the southern sales (50 and 150)
+	south := Compound("sale", []Term{Atom("south"), Variable("P"), Variable("A")})
+	goal := Compound("aggregate_all", []Term{Compound("stddev", []Term{amount}), south, Variable("SD")})
+	solutions, _ := engine.evalBuiltin(goal, make(Substitution), sessionID)
+	if len(solutions) != 1 || solutions[0]["SD"].Value != 50.0 {
+		t.Errorf("Expected stddev of 50, got %v", solutions)
+	}
+
+	// The percentile can be given through a bound variable
+	subst := Substitution{"Pct": Number(75)}
+	goal = Compound("aggregate_all", []Term{Compound("percentile", []Term{amount, Variable("Pct")}), sale, Variable("Result")})
+	solutions, _ = engine.evalBuiltin(goal, subst, sessionID)
+	if len(solutions) != 1 || solutions[0]["Result"].Value != 200.0 {
+		t.Errorf("Expected the 75th percentile of 200, got %v", solutions)
+	}
+
+	// max(X, Witness) reports which solution produced the maximum
+	goal = Compound("aggregate_all", []Term{Compound("max", []Term{amount, Variable("P")}), sale, Variable("Result")})
+	solutions, _ = engine.evalBuiltin(goal, make(Substitution), sessionID)
+	if len(solutions) != 1 {
+		t.Fatalf("Expected 1 solution for max with witness, got %d", len(solutions))
+	}
+	result := solutions[0]["Result"]
+	if result.Value != "max" || result.Args[0].Value != 300.0 || result.Args[1].Value != "bob" {
+		t.Errorf("Expected max(300, bob), got %v", result)
+	}
+
+	// set(X) returns sorted unique values
+	goal = Compound("aggregate_all", []Term{Compound("set", []Term{Variable("P")}), sale, Variable("Reps")})
+	solutions, _ = engine.evalBuiltin(goal, make(Substitution), sessionID)
+	reps, ok := engine.listElements(solutions[0]["Reps"], solutions[0])
+	if !ok || len(reps) != 4 || reps[0].Value != "ann" || reps[3].Value != "dan" {
+		t.Errorf("Expected [ann, bob, cid, dan], got %v", solutions[0]["Reps"])
+	}
+
+	// count and bag succeed on no solutions, max fails
+	missing := Compound("nonexistent", []Term{Variable("X")})
+	goal = Compound("aggregate_all", []Term{Atom("count"), missing, Variable("N")})
+	solutions, _ = engine.evalBuiltin(goal, make(Substitution), sessionID)
+	if len(solutions) != 1 || solutions[0]["N"].Value != 0.0 {
+		t.Errorf("Expected count of 0, got %v", solutions)
+	}
+	goal = Compound("aggregate_all", []Term{Compound("max", []Term{Variable("X")}), missing, Variable("M")})
+	solutions, _ = engine.evalBuiltin(goal, make(Substitution), sessionID)
+	if len(solutions) != 0 {
+		t.Errorf("Expected max over no solutions to fail, got %v", solutions)
+	}
+}
+
+func TestAggregateGroupBy(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+	setupSalesTestData(t, engine, sessionID)
+
+	// aggregate(sum(A), P^sale(R, P, A), Total) groups by region R
+	goal := Compound("aggregate", []Term{
+		Compound("sum", []Term{Variable("A")}),
+		Compound("^", []Term{Variable("P"), Compound("sale", []Term{Variable("R"), Variable("P"), Variable("A")})}),
+		Variable("Total"),
+	})
+	result := engine.Query(Query{Goals: []Term{goal}}, sessionID)
+	if len(result.Solutions) != 2 {
+		t.Fatalf("Expected 2 groups, got %d", len(result.Solutions))
+	}
+	if result.Solutions[0].Bindings["R"].Value != "north" || result.Solutions[0].Bindings["Total"].Value != 600.0 {
+		t.Errorf("Expected north total 600, got %v", result.Solutions[0].Bindings)
+	}
+	if result.Solutions[1].Bindings["R"].Value != "south" || result.Solutions[1].Bindings["Total"].Value != 200.0 {
+		t.Errorf("Expected south total 200, got %v", result.Solutions[1].Bindings)
+	}
+
+	// Without ^, groups are per region and rep
+	goal = Compound("aggregate", []Term{
+		Atom("count"),
+		Compound("sale", []Term{Variable("R"), Variable("P"), Variable("A2")}),
+		Variable("N"),
+	})
+	result = engine.Query(Query{Goals: []Term{goal}}, sessionID)
+	// A2 is free too, so every sale is its own group
+	if len(result.Solutions) != 5 {
+		t.Errorf("Expected 5 groups, got %d", len(result.Solutions))
+	}
+
+	// aggregate/3 fails when there are no solutions
+	goal = Compound("aggregate", []Term{Atom("count"), Compound("nonexistent", []Term{Variable("X")}), Variable("N")})
+	result = engine.Query(Query{Goals: []Term{goal}}, sessionID)
+	if result.Solutions[0].Success {
+		t.Error("Expected aggregate/3 to fail with no solutions")
+	}
+}
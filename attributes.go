@@ -0,0 +1,191 @@
+package main
+
+import "sort"
+
+// Attributed variables. Attributes live in the solve context next to the
+// bindings, so they follow backtracking for free: each unbound variable may
+// have a list of Module=Value pairs, and bind queues wake-up goals when it
+// binds a variable that has some.
+//
+// solve runs queued wake-up goals before the next goal, which lets
+// coroutining (freeze/2, dif/2, when/2) and constraint modules react to
+// bindings made anywhere, including head unification.
+
+// getAttr returns the value of a variable's attribute for module.
+func (e *Engine) getAttr(varName, module string, subst Substitution) (Term, bool) {
+	for _, pair := range contextOf(subst).attrs[varName].Args {
+		if pair.Args[0].Value == module {
+			return pair.Args[1], true
+		}
+	}
+	return Term{}, false
+}
+
+// putAttr sets a variable's attribute for module, returning a new
+// substitution.
+func (e *Engine) putAttr(varName, module string, value Term, subst Substitution) Substitution {
+	ctx := contextOf(subst)
+	pairs := []Term{Compound("=", []Term{Atom(module), value})}
+	for _, pair := range ctx.attrs[varName].Args {
+		if pair.Args[0].Value != module {
+			pairs = append(pairs, pair)
+		}
+	}
+	attrs := make(map[string]Term, len(ctx.attrs)+1)
+	for k, v := range ctx.attrs {
+		attrs[k] = v
+	}
+	attrs[varName] = List(pairs)
+	ctx.attrs = attrs
+	return withContext(subst, ctx)
+}
+
+// appendAttr adds items to a list-valued attribute.
+func (e *Engine) appendAttr(varName, module string, items []Term, subst Substitution) Substitution {
+	existing, _ := e.getAttr(varName, module, subst)
+	return e.putAttr(varName, module, List(append(append([]Term{}, existing.Args...), items...)), subst)
+}
+
+func copySubst(subst Substitution) Substitution {
+	newSubst := make(Substitution, len(subst)+1)
+	for k, v := range subst {
+		newSubst[k] = v
+	}
+	return newSubst
+}
+
+// attrUnify is the goal that hands the binding of an attributed variable to
+// the module of one of its attributes. Like the other goals the engine adds
+// itself, its name starts with contextKey so no query can call it.
+const attrUnify = contextKey + "attr_unify"
+
+// queueWakeups records, after varName has been bound in subst, one
+// attrUnify(Module, Value, Var) goal per attribute of the variable.
+func (e *Engine) queueWakeups(varName string, subst Substitution) {
+	ctx := contextOf(subst)
+	attrs, ok := ctx.attrs[varName]
+	if !ok {
+		return
+	}
+	queued := append([]Term{}, ctx.wake...)
+	for _, pair := range attrs.Args {
+		queued = append(queued, Compound(attrUnify, []Term{pair.Args[0], pair.Args[1], Variable(varName)}))
+	}
+	ctx.wake = queued
+	setContext(subst, ctx)
+}
+
+// takeWakeups removes the queued wake-up goals from subst.
+func takeWakeups(subst Substitution) ([]Term, Substitution) {
+	ctx := contextOf(subst)
+	if ctx.wake == nil {
+		return nil, subst
+	}
+	queued := ctx.wake
+	ctx.wake = nil
+	return queued, withContext(subst, ctx)
+}
+
+// newBindings returns the variables bound in after but not in before.
+func newBindings(before, after Substitution) []string {
+	var vars []string
+	for k := range after {
+		if _, exists := before[k]; !exists && k != contextKey {
+			vars = append(vars, k)
+		}
+	}
+	sort.Strings(vars)
+	return vars
+}
+
+// handleAttrUnify runs the unification hook of an attribute module after
+// the variable carrying the attribute was bound.
+func (e *Engine) handleAttrUnify(goal Term, subst Substitution, sessionID string) ([]Substitution, bool) {
+	if len(goal.Args) != 3 {
+		return []Substitution{}, true
+	}
+	module, value, bound := goal.Args[0].Value, goal.Args[1], goal.Args[2]
+
+	switch module {
+	case "freeze":
+		// Bound to another variable: the frozen goal moves to it
+		if target := e.deref(bound, subst); target.Type == "variable" {
+			existing, ok := e.getAttr(target.Value.(string), "freeze", subst)
+			if ok {
+				value = Compound(",", []Term{existing, value})
+			}
+			return []Substitution{e.putAttr(target.Value.(string), "freeze", value, subst)}, true
+		}
+		return e.solve([]Term{value}, subst, sessionID), true
+
+	case "dif", "when":
+		// Re-post every suspended constraint; each one re-checks itself
+		return e.solve(value.Args, subst, sessionID), true
+
+	case "clpfd":
+		if newSubst, ok := e.wakeFD(value, bound, subst); ok {
+			return []Substitution{newSubst}, true
+		}
+		return []Substitution{}, true
+	}
+
+	return []Substitution{subst}, true
+}
+
+// residualGoals returns the constraints still pending on the unbound
+// variables reachable from the query, for reporting with the answer.
+func (e *Engine) residualGoals(goals []Term, subst Substitution) []Term {
+	vars := make(map[string]bool)
+	for _, goal := range goals {
+		e.collectVars(e.instantiate(goal, subst), vars)
+	}
+	names := make([]string, 0, len(vars))
+	for v := range vars {
+		names = append(names, v)
+	}
+	sort.Strings(names)
+
+	var residuals []Term
+	add := func(goal Term) {
+		goal = e.instantiate(goal, subst)
+		for _, r := range residuals {
+			if compareTerms(r, goal) == 0 {
+				return
+			}
+		}
+		residuals = append(residuals, goal)
+	}
+
+	for _, v := range names {
+		for _, pair := range contextOf(subst).attrs[v].Args {
+			value := pair.Args[1]
+			switch pair.Args[0].Value {
+			case "freeze":
+				add(Compound("freeze", []Term{Variable(v), value}))
+			case "dif":
+				for _, dif := range value.Args {
+					if e.difPending(dif.Args[0], dif.Args[1], subst) {
+						add(dif)
+					}
+				}
+			case "when":
+				for _, when := range value.Args {
+					if e.deref(when.Args[0], subst).Type == "variable" {
+						add(Compound("when", when.Args[1:]))
+					}
+				}
+			case "clpfd":
+				if _, dom, _, _ := e.fdVar(Variable(v), subst); !dom.equal(fdFull) {
+					add(Compound("in", []Term{Variable(v), domainToTerm(dom)}))
+				}
+				for _, p := range value.Args[1].Args {
+					unbound := make(map[string]bool)
+					if e.collectVars(e.instantiate(p, subst), unbound); len(unbound) > 0 {
+						add(p)
+					}
+				}
+			}
+		}
+	}
+	return residuals
+}
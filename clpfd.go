@@ -0,0 +1,881 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// Finite-domain constraints over integers. Each constrained variable carries
+// a clpfd attribute fd(Domain, Propagators), where Domain is a domain term
+// such as 1..3 \/ 5..9 and Propagators lists the constraints mentioning the
+// variable. Linear constraints (+, -, and multiplication by a constant)
+// propagate bounds; all_different/1 removes the values of fixed variables
+// from the others; other arithmetic is checked once it is ground.
+
+// fdInterval is an inclusive range of integers; bounds may be infinite.
+type fdInterval struct {
+	lo, hi float64
+}
+
+// fdDomain is a sorted list of disjoint, non-adjacent intervals.
+type fdDomain []fdInterval
+
+var fdFull = fdDomain{{math.Inf(-1), math.Inf(1)}}
+
+func normalizeDomain(d fdDomain) fdDomain {
+	sorted := append(fdDomain{}, d...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].lo < sorted[j].lo })
+	var result fdDomain
+	for _, iv := range sorted {
+		if iv.lo > iv.hi {
+			continue
+		}
+		if n := len(result); n > 0 && iv.lo <= result[n-1].hi+1 {
+			result[n-1].hi = math.Max(result[n-1].hi, iv.hi)
+			continue
+		}
+		result = append(result, iv)
+	}
+	return result
+}
+
+func (d fdDomain) min() float64 { return d[0].lo }
+func (d fdDomain) max() float64 { return d[len(d)-1].hi }
+
+func (d fdDomain) singleton() (float64, bool) {
+	if len(d) == 1 && d[0].lo == d[0].hi {
+		return d[0].lo, true
+	}
+	return 0, false
+}
+
+func (d fdDomain) size() float64 {
+	var n float64
+	for _, iv := range d {
+		n += iv.hi - iv.lo + 1
+	}
+	return n
+}
+
+func (d fdDomain) contains(v float64) bool {
+	for _, iv := range d {
+		if v >= iv.lo && v <= iv.hi {
+			return true
+		}
+	}
+	return false
+}
+
+func (d fdDomain) intersect(o fdDomain) fdDomain {
+	var result fdDomain
+	for _, a := range d {
+		for _, b := range o {
+			if lo, hi := math.Max(a.lo, b.lo), math.Min(a.hi, b.hi); lo <= hi {
+				result = append(result, fdInterval{lo, hi})
+			}
+		}
+	}
+	return normalizeDomain(result)
+}
+
+func (d fdDomain) restrict(lo, hi float64) fdDomain {
+	return d.intersect(fdDomain{{lo, hi}})
+}
+
+func (d fdDomain) remove(v float64) fdDomain {
+	var result fdDomain
+	for _, iv := range d {
+		if v < iv.lo || v > iv.hi {
+			result = append(result, iv)
+			continue
+		}
+		result = append(result, fdInterval{iv.lo, v - 1}, fdInterval{v + 1, iv.hi})
+	}
+	return normalizeDomain(result)
+}
+
+func (d fdDomain) equal(o fdDomain) bool {
+	if len(d) != len(o) {
+		return false
+	}
+	for i := range d {
+		if d[i] != o[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (d fdDomain) values() []float64 {
+	var values []float64
+	for _, iv := range d {
+		for v := iv.lo; v <= iv.hi; v++ {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+func isInteger(n float64) bool {
+	return n == math.Trunc(n) && !math.IsInf(n, 0)
+}
+
+func fdBound(t Term) (float64, bool) {
+	switch {
+	case t.Type == "number" && isInteger(t.Value.(float64)):
+		return t.Value.(float64), true
+	case t.Type == "atom" && t.Value == "inf":
+		return math.Inf(-1), true
+	case t.Type == "atom" && t.Value == "sup":
+		return math.Inf(1), true
+	}
+	return 0, false
+}
+
+// termToDomain parses a domain: N, L..H or D1 \/ D2.
+func (e *Engine) termToDomain(t Term, subst Substitution) (fdDomain, bool) {
+	t = e.deref(t, subst)
+	if n, ok := fdBound(t); ok && t.Type == "number" {
+		return fdDomain{{n, n}}, true
+	}
+	if t.Type != "compound" || len(t.Args) != 2 {
+		return nil, false
+	}
+	switch t.Value {
+	case "..":
+		lo, ok1 := fdBound(e.deref(t.Args[0], subst))
+		hi, ok2 := fdBound(e.deref(t.Args[1], subst))
+		if !ok1 || !ok2 {
+			return nil, false
+		}
+		return normalizeDomain(fdDomain{{lo, hi}}), true
+	case "\\/":
+		a, ok1 := e.termToDomain(t.Args[0], subst)
+		b, ok2 := e.termToDomain(t.Args[1], subst)
+		if !ok1 || !ok2 {
+			return nil, false
+		}
+		return normalizeDomain(append(a, b...)), true
+	}
+	return nil, false
+}
+
+func boundTerm(v float64) Term {
+	switch {
+	case math.IsInf(v, -1):
+		return Atom("inf")
+	case math.IsInf(v, 1):
+		return Atom("sup")
+	}
+	return Number(v)
+}
+
+func domainToTerm(d fdDomain) Term {
+	var result Term
+	for i, iv := range d {
+		part := Compound("..", []Term{boundTerm(iv.lo), boundTerm(iv.hi)})
+		if iv.lo == iv.hi {
+			part = Number(iv.lo)
+		}
+		if i == 0 {
+			result = part
+		} else {
+			result = Compound("\\/", []Term{result, part})
+		}
+	}
+	return result
+}
+
+// fdVar returns the domain and propagators of a term: a variable's clpfd
+// attribute, or a singleton domain for an integer. name is empty for
+// integers; ok is false for anything else.
+func (e *Engine) fdVar(t Term, subst Substitution) (name string, dom fdDomain, props []Term, ok bool) {
+	t = e.deref(t, subst)
+	switch t.Type {
+	case "number":
+		n := t.Value.(float64)
+		if !isInteger(n) {
+			return "", nil, nil, false
+		}
+		return "", fdDomain{{n, n}}, nil, true
+	case "variable":
+		name = t.Value.(string)
+		attr, exists := e.getAttr(name, "clpfd", subst)
+		if !exists {
+			return name, fdFull, nil, true
+		}
+		dom, _ = e.termToDomain(attr.Args[0], subst)
+		return name, dom, attr.Args[1].Args, true
+	}
+	return "", nil, nil, false
+}
+
+func (e *Engine) setFdVar(name string, dom fdDomain, props []Term, subst Substitution) Substitution {
+	return e.putAttr(name, "clpfd", Compound("fd", []Term{domainToTerm(dom), List(props)}), subst)
+}
+
+// fdSolver runs propagation to a fixpoint on a copy of the substitution.
+type fdSolver struct {
+	e       *Engine
+	subst   Substitution
+	changed map[string]bool
+}
+
+func (s *fdSolver) domain(t Term) (string, fdDomain, bool) {
+	name, dom, _, ok := s.e.fdVar(t, s.subst)
+	return name, dom, ok
+}
+
+// narrow replaces a variable's domain, reporting failure when it empties.
+func (s *fdSolver) narrow(name string, dom fdDomain) bool {
+	if len(dom) == 0 {
+		return false
+	}
+	_, old, props, _ := s.e.fdVar(Variable(name), s.subst)
+	if old.equal(dom) {
+		return true
+	}
+	s.subst = s.e.setFdVar(name, dom, props, s.subst)
+	s.changed[name] = true
+	return true
+}
+
+// propagate runs the queued propagators, re-queueing the propagators of
+// every variable whose domain changes, then binds variables whose domain
+// has become a single value.
+func (s *fdSolver) propagate(queue []Term) bool {
+	for steps := 0; len(queue) > 0; steps++ {
+		if steps > 10000 {
+			break
+		}
+		c := queue[0]
+		queue = queue[1:]
+		s.changed = make(map[string]bool)
+		if !s.run(c) {
+			return false
+		}
+		for name := range s.changed {
+			_, _, props, _ := s.e.fdVar(Variable(name), s.subst)
+			for _, p := range props {
+				if !containsTerm(queue, p) {
+					queue = append(queue, p)
+				}
+			}
+		}
+	}
+	return true
+}
+
+func containsTerm(terms []Term, t Term) bool {
+	for _, u := range terms {
+		if compareTerms(u, t) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// bindFixed binds every variable with a singleton domain among vars.
+func (s *fdSolver) bindFixed(vars map[string]bool) bool {
+	names := make([]string, 0, len(vars))
+	for v := range vars {
+		names = append(names, v)
+	}
+	sort.Strings(names)
+	for _, v := range names {
+		name, dom, ok := s.domain(Variable(v))
+		if !ok || name == "" {
+			continue
+		}
+		if value, fixed := dom.singleton(); fixed {
+			if s.subst, ok = s.e.unify(Variable(name), Number(value), s.subst); !ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// linear is sum(coef[v] * v) + constant.
+type linear struct {
+	coef     map[string]float64
+	constant float64
+}
+
+// linearize returns the linear form of an arithmetic expression, or
+// ok=false when it is not linear or not arithmetic.
+func (e *Engine) linearize(t Term, subst Substitution) (linear, bool) {
+	t = e.deref(t, subst)
+	switch t.Type {
+	case "number":
+		if !isInteger(t.Value.(float64)) {
+			return linear{}, false
+		}
+		return linear{coef: map[string]float64{}, constant: t.Value.(float64)}, true
+	case "variable":
+		return linear{coef: map[string]float64{t.Value.(string): 1}}, true
+	case "compound":
+		if t.Value == "-" && len(t.Args) == 1 {
+			a, ok := e.linearize(t.Args[0], subst)
+			return a.scale(-1), ok
+		}
+		if len(t.Args) != 2 {
+			return linear{}, false
+		}
+		a, ok1 := e.linearize(t.Args[0], subst)
+		b, ok2 := e.linearize(t.Args[1], subst)
+		if !ok1 || !ok2 {
+			return linear{}, false
+		}
+		switch t.Value {
+		case "+":
+			return a.add(b, 1), true
+		case "-":
+			return a.add(b, -1), true
+		case "*":
+			if len(a.coef) == 0 {
+				return b.scale(a.constant), true
+			}
+			if len(b.coef) == 0 {
+				return a.scale(b.constant), true
+			}
+		}
+	}
+	return linear{}, false
+}
+
+func (l linear) scale(k float64) linear {
+	result := linear{coef: make(map[string]float64), constant: l.constant * k}
+	for v, c := range l.coef {
+		if c*k != 0 {
+			result.coef[v] = c * k
+		}
+	}
+	return result
+}
+
+func (l linear) add(o linear, sign float64) linear {
+	result := l.scale(1)
+	result.constant += sign * o.constant
+	for v, c := range o.coef {
+		result.coef[v] += sign * c
+		if result.coef[v] == 0 {
+			delete(result.coef, v)
+		}
+	}
+	return result
+}
+
+// evalFD evaluates a ground integer expression.
+func (e *Engine) evalFD(t Term, subst Substitution) (float64, bool) {
+	t = e.deref(t, subst)
+	if t.Type == "number" {
+		n := t.Value.(float64)
+		return n, isInteger(n)
+	}
+	if t.Type != "compound" {
+		return 0, false
+	}
+	if len(t.Args) == 1 {
+		a, ok := e.evalFD(t.Args[0], subst)
+		switch t.Value {
+		case "-":
+			return -a, ok
+		case "abs":
+			return math.Abs(a), ok
+		}
+		return 0, false
+	}
+	if len(t.Args) != 2 {
+		return 0, false
+	}
+	a, ok1 := e.evalFD(t.Args[0], subst)
+	b, ok2 := e.evalFD(t.Args[1], subst)
+	if !ok1 || !ok2 {
+		return 0, false
+	}
+	switch t.Value {
+	case "+":
+		return a + b, true
+	case "-":
+		return a - b, true
+	case "*":
+		return a * b, true
+	case "//":
+		if b == 0 {
+			return 0, false
+		}
+		return math.Trunc(a / b), true
+	case "mod":
+		if b == 0 {
+			return 0, false
+		}
+		m := math.Mod(a, b)
+		if m != 0 && (m < 0) != (b < 0) {
+			m += b
+		}
+		return m, true
+	case "min":
+		return math.Min(a, b), true
+	case "max":
+		return math.Max(a, b), true
+	}
+	return 0, false
+}
+
+var fdRelations = map[string]bool{"#=": true, "#\\=": true, "#<": true, "#=<": true, "#>": true, "#>=": true}
+
+// run applies one propagator.
+func (s *fdSolver) run(c Term) bool {
+	switch {
+	case fdRelations[c.Value.(string)] && len(c.Args) == 2:
+		l, ok := s.e.linearize(Compound("-", c.Args), s.subst)
+		if !ok {
+			// Non-linear: check once ground
+			a, ok1 := s.e.evalFD(c.Args[0], s.subst)
+			b, ok2 := s.e.evalFD(c.Args[1], s.subst)
+			if !ok1 || !ok2 {
+				return true
+			}
+			return compareFD(c.Value.(string), a, b)
+		}
+		switch c.Value {
+		case "#=":
+			return s.linearEqual(l)
+		case "#\\=":
+			return s.linearNotEqual(l)
+		case "#=<":
+			return s.linearAtMost(l)
+		case "#<":
+			l.constant++
+			return s.linearAtMost(l)
+		case "#>=":
+			return s.linearAtMost(l.scale(-1))
+		case "#>":
+			l = l.scale(-1)
+			l.constant++
+			return s.linearAtMost(l)
+		}
+
+	case c.Value == "all_different" && len(c.Args) == 1:
+		return s.allDifferent(c.Args[0])
+	}
+	return true
+}
+
+func compareFD(rel string, a, b float64) bool {
+	switch rel {
+	case "#=":
+		return a == b
+	case "#\\=":
+		return a != b
+	case "#<":
+		return a < b
+	case "#=<":
+		return a <= b
+	case "#>":
+		return a > b
+	case "#>=":
+		return a >= b
+	}
+	return false
+}
+
+// termRange returns the minimum and maximum of c*v.
+func termRange(c float64, dom fdDomain) (float64, float64) {
+	if c > 0 {
+		return c * dom.min(), c * dom.max()
+	}
+	return c * dom.max(), c * dom.min()
+}
+
+// restRange returns the range of the linear form without variable skip.
+func (s *fdSolver) restRange(l linear, skip string) (float64, float64) {
+	lo, hi := l.constant, l.constant
+	for v, c := range l.coef {
+		if v == skip {
+			continue
+		}
+		_, dom, _ := s.domain(Variable(v))
+		tlo, thi := termRange(c, dom)
+		lo, hi = lo+tlo, hi+thi
+	}
+	return lo, hi
+}
+
+// sortedVars returns the variables of a linear form in a stable order.
+func (l linear) sortedVars() []string {
+	vars := make([]string, 0, len(l.coef))
+	for v := range l.coef {
+		vars = append(vars, v)
+	}
+	sort.Strings(vars)
+	return vars
+}
+
+// linearEqual narrows bounds for sum = 0 until nothing changes.
+func (s *fdSolver) linearEqual(l linear) bool {
+	for changed := true; changed; {
+		changed = false
+		if len(l.coef) == 0 {
+			return l.constant == 0
+		}
+		for _, v := range l.sortedVars() {
+			c := l.coef[v]
+			restLo, restHi := s.restRange(l, v)
+			// c*v lies in [-restHi, -restLo]
+			lo, hi := -restHi/c, -restLo/c
+			if c < 0 {
+				lo, hi = hi, lo
+			}
+			_, dom, _ := s.domain(Variable(v))
+			narrowed := dom.restrict(math.Ceil(lo), math.Floor(hi))
+			if !narrowed.equal(dom) {
+				if !s.narrow(v, narrowed) {
+					return false
+				}
+				changed = true
+			}
+		}
+	}
+	return true
+}
+
+// linearAtMost narrows bounds for sum =< 0.
+func (s *fdSolver) linearAtMost(l linear) bool {
+	if len(l.coef) == 0 {
+		return l.constant <= 0
+	}
+	for _, v := range l.sortedVars() {
+		c := l.coef[v]
+		restLo, _ := s.restRange(l, v)
+		_, dom, _ := s.domain(Variable(v))
+		bound := -restLo / c
+		var narrowed fdDomain
+		if c > 0 {
+			narrowed = dom.restrict(math.Inf(-1), math.Floor(bound))
+		} else {
+			narrowed = dom.restrict(math.Ceil(bound), math.Inf(1))
+		}
+		if !s.narrow(v, narrowed) {
+			return false
+		}
+	}
+	return true
+}
+
+// linearNotEqual removes the one forbidden value once a single variable is
+// left unfixed.
+func (s *fdSolver) linearNotEqual(l linear) bool {
+	var open []string
+	total := l.constant
+	for _, v := range l.sortedVars() {
+		_, dom, _ := s.domain(Variable(v))
+		if value, fixed := dom.singleton(); fixed {
+			total += l.coef[v] * value
+		} else {
+			open = append(open, v)
+		}
+	}
+	switch len(open) {
+	case 0:
+		return total != 0
+	case 1:
+		forbidden := -total / l.coef[open[0]]
+		if !isInteger(forbidden) {
+			return true
+		}
+		_, dom, _ := s.domain(Variable(open[0]))
+		return s.narrow(open[0], dom.remove(forbidden))
+	}
+	return true
+}
+
+// allDifferent removes the value of every fixed element from the others.
+func (s *fdSolver) allDifferent(list Term) bool {
+	items, ok := s.e.listElements(list, s.subst)
+	if !ok {
+		return false
+	}
+	for changed := true; changed; {
+		changed = false
+		for i, item := range items {
+			_, dom, ok := s.domain(item)
+			if !ok {
+				return false
+			}
+			value, fixed := dom.singleton()
+			if !fixed {
+				continue
+			}
+			for j, other := range items {
+				if i == j {
+					continue
+				}
+				name, otherDom, _ := s.domain(other)
+				if !otherDom.contains(value) {
+					continue
+				}
+				if name == "" {
+					return false
+				}
+				if !s.narrow(name, otherDom.remove(value)) {
+					return false
+				}
+				changed = true
+			}
+		}
+	}
+	return true
+}
+
+// postFD attaches a propagator to the variables of c and propagates.
+func (e *Engine) postFD(c Term, subst Substitution) (Substitution, bool) {
+	c = e.instantiate(c, subst)
+	vars := make(map[string]bool)
+	e.collectVars(c, vars)
+
+	s := &fdSolver{e: e, subst: subst}
+	for _, v := range sortedKeys(vars) {
+		_, dom, props, _ := e.fdVar(Variable(v), s.subst)
+		s.subst = e.setFdVar(v, dom, append(append([]Term{}, props...), c), s.subst)
+	}
+	if !s.propagate([]Term{c}) {
+		return subst, false
+	}
+	if !s.bindFixed(vars) {
+		return subst, false
+	}
+	return s.subst, true
+}
+
+// wakeFD re-runs a variable's propagators after it was bound.
+func (e *Engine) wakeFD(value Term, bound Term, subst Substitution) (Substitution, bool) {
+	dom, _ := e.termToDomain(value.Args[0], subst)
+	props := value.Args[1].Args
+
+	target := e.deref(bound, subst)
+	switch target.Type {
+	case "number":
+		if !dom.contains(target.Value.(float64)) {
+			return subst, false
+		}
+	case "variable":
+		// Aliased to another variable: merge domains and propagators
+		name, otherDom, otherProps, _ := e.fdVar(target, subst)
+		merged := otherDom.intersect(dom)
+		if len(merged) == 0 {
+			return subst, false
+		}
+		subst = e.setFdVar(name, merged, append(append([]Term{}, otherProps...), props...), subst)
+	default:
+		return subst, false
+	}
+
+	s := &fdSolver{e: e, subst: subst}
+	if !s.propagate(append([]Term{}, props...)) {
+		return subst, false
+	}
+	vars := make(map[string]bool)
+	for _, p := range props {
+		e.collectVars(e.instantiate(p, s.subst), vars)
+	}
+	if !s.bindFixed(vars) {
+		return subst, false
+	}
+	return s.subst, true
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// sumExpression folds a list into V1 + V2 + ... + Vn.
+func sumExpression(items []Term) Term {
+	if len(items) == 0 {
+		return Number(0)
+	}
+	sum := items[0]
+	for _, item := range items[1:] {
+		sum = Compound("+", []Term{sum, item})
+	}
+	return sum
+}
+
+// handleFD implements in/2, ins/2, the arithmetic comparisons #=, #\=,
+// #<, #=<, #>, #>=, all_different/1, all_distinct/1, sum/3, label/1,
+// labeling/2 and fd_dom/2, fd_inf/2, fd_sup/2, fd_size/2.
+func (e *Engine) handleFD(goal Term, subst Substitution, sessionID string) ([]Substitution, bool) {
+	args := goal.Args
+	fail := []Substitution{}
+
+	post := func(c Term, subst Substitution) ([]Substitution, bool) {
+		if newSubst, ok := e.postFD(c, subst); ok {
+			return []Substitution{newSubst}, true
+		}
+		return fail, true
+	}
+
+	switch {
+	case (goal.Value == "in" || goal.Value == "ins") && len(args) == 2:
+		dom, ok := e.termToDomain(args[1], subst)
+		if !ok || len(dom) == 0 {
+			return fail, true
+		}
+		items := []Term{args[0]}
+		if goal.Value == "ins" {
+			if items, ok = e.listElements(args[0], subst); !ok {
+				return fail, true
+			}
+		}
+		s := &fdSolver{e: e, subst: subst, changed: make(map[string]bool)}
+		vars := make(map[string]bool)
+		for _, item := range items {
+			name, current, ok := s.domain(item)
+			if !ok {
+				return fail, true
+			}
+			narrowed := current.intersect(dom)
+			if name == "" {
+				if len(narrowed) == 0 {
+					return fail, true
+				}
+				continue
+			}
+			if !s.narrow(name, narrowed) {
+				return fail, true
+			}
+			vars[name] = true
+		}
+		var queue []Term
+		for name := range s.changed {
+			_, _, props, _ := e.fdVar(Variable(name), s.subst)
+			queue = append(queue, props...)
+		}
+		if !s.propagate(queue) || !s.bindFixed(vars) {
+			return fail, true
+		}
+		return []Substitution{s.subst}, true
+
+	case fdRelations[goal.Value.(string)] && len(args) == 2:
+		return post(goal, subst)
+
+	case (goal.Value == "all_different" || goal.Value == "all_distinct") && len(args) == 1:
+		if _, ok := e.listElements(args[0], subst); !ok {
+			return fail, true
+		}
+		return post(Compound("all_different", args), subst)
+
+	case goal.Value == "sum" && len(args) == 3:
+		items, ok := e.listElements(args[0], subst)
+		op := e.deref(args[1], subst)
+		if !ok || op.Type != "atom" || !fdRelations[op.Value.(string)] {
+			return fail, true
+		}
+		return post(Compound(op.Value.(string), []Term{sumExpression(items), args[2]}), subst)
+
+	case goal.Value == "label" && len(args) == 1:
+		return e.handleFD(Compound("labeling", []Term{List(nil), args[0]}), subst, sessionID)
+
+	case goal.Value == "labeling" && len(args) == 2:
+		return e.labeling(args[0], args[1], subst, sessionID), true
+
+	case (goal.Value == "fd_dom" || goal.Value == "fd_inf" || goal.Value == "fd_sup" || goal.Value == "fd_size") && len(args) == 2:
+		_, dom, _, ok := e.fdVar(args[0], subst)
+		if !ok {
+			return fail, true
+		}
+		var result Term
+		switch goal.Value {
+		case "fd_dom":
+			result = domainToTerm(dom)
+		case "fd_inf":
+			result = boundTerm(dom.min())
+		case "fd_sup":
+			result = boundTerm(dom.max())
+		case "fd_size":
+			result = boundTerm(dom.size())
+		}
+		return e.unifyResult(args[1], result, subst)
+	}
+
+	return fail, true
+}
+
+// labeling enumerates values for the variables in vars. Options select the
+// variable (leftmost, ff, ffc, min, max) and the value order (up, down).
+func (e *Engine) labeling(options, vars Term, subst Substitution, sessionID string) []Substitution {
+	opts, ok := e.listElements(options, subst)
+	items, ok2 := e.listElements(vars, subst)
+	if !ok || !ok2 {
+		return []Substitution{}
+	}
+	selection, order := "leftmost", "up"
+	for _, opt := range opts {
+		opt = e.deref(opt, subst)
+		switch opt.Value {
+		case "leftmost", "ff", "ffc", "min", "max":
+			selection = opt.Value.(string)
+		case "up", "down":
+			order = opt.Value.(string)
+		default:
+			return []Substitution{}
+		}
+	}
+
+	// Pick the next unbound variable
+	chosen, chosenDom := "", fdDomain(nil)
+	for _, item := range items {
+		name, dom, _, ok := e.fdVar(item, subst)
+		if !ok {
+			return []Substitution{}
+		}
+		if name == "" {
+			continue
+		}
+		if math.IsInf(dom.min(), 0) || math.IsInf(dom.max(), 0) {
+			// Cannot enumerate an infinite domain
+			return []Substitution{}
+		}
+		better := chosen == ""
+		switch {
+		case chosen == "":
+		case selection == "ff" || selection == "ffc":
+			better = dom.size() < chosenDom.size()
+		case selection == "min":
+			better = dom.min() < chosenDom.min()
+		case selection == "max":
+			better = dom.max() > chosenDom.max()
+		}
+		if better {
+			chosen, chosenDom = name, dom
+		}
+		if selection == "leftmost" {
+			break
+		}
+	}
+	if chosen == "" {
+		return []Substitution{subst}
+	}
+
+	values := chosenDom.values()
+	if order == "down" {
+		for i, j := 0, len(values)-1; i < j; i, j = i+1, j-1 {
+			values[i], values[j] = values[j], values[i]
+		}
+	}
+	var results []Substitution
+	for _, v := range values {
+		goals := []Term{
+			Compound("=", []Term{Variable(chosen), Number(v)}),
+			Compound("labeling", []Term{options, vars}),
+		}
+		results = append(results, e.solve(goals, subst, sessionID)...)
+	}
+	return results
+}
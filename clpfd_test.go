@@ -0,0 +1,200 @@
+package main
+
+import "testing"
+
+func fdRange(lo, hi float64) Term {
+	return Compound("..", []Term{Number(lo), Number(hi)})
+}
+
+func TestFDPropagation(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+
+	// Domains narrow without labeling and are reported with the answer
+	result := engine.Query(Query{Goals: []Term{
+		Compound("in", []Term{Variable("X"), fdRange(1, 10)}),
+		Compound("#>", []Term{Variable("X"), Number(7)}),
+	}}, sessionID)
+	sol := result.Solutions[0]
+	if !sol.Success || len(sol.Residuals) == 0 {
+		t.Fatalf("Expected a constrained answer, got %v", sol)
+	}
+	if got := formatTerm(sol.Residuals[0], true); got != "X in 8..10" {
+		t.Errorf("Expected X in 8..10, got %s", got)
+	}
+
+	// A constraint that fixes a variable binds it
+	solutions := queryAll(engine, sessionID, Compound("#=", []Term{Variable("X"), Compound("+", []Term{Number(3), Compound("*", []Term{Number(2), Number(4)})})}))
+	if len(solutions) != 1 || solutions[0].Bindings["X"].Value != 11.0 {
+		t.Errorf("Expected X = 11, got %v", solutions)
+	}
+
+	// Propagation runs in both directions
+	solutions = queryAll(engine, sessionID,
+		Compound("ins", []Term{List([]Term{Variable("X"), Variable("Y")}), fdRange(0, 5)}),
+		Compound("#=", []Term{Compound("+", []Term{Variable("X"), Variable("Y")}), Number(10)}),
+	)
+	if len(solutions) != 1 || solutions[0].Bindings["X"].Value != 5.0 || solutions[0].Bindings["Y"].Value != 5.0 {
+		t.Errorf("Expected X = Y = 5, got %v", solutions)
+	}
+
+	// Inconsistent constraints fail without labeling
+	if len(queryAll(engine, sessionID,
+		Compound("in", []Term{Variable("X"), fdRange(1, 3)}),
+		Compound("#>", []Term{Variable("X"), Number(5)}),
+	)) != 0 {
+		t.Error("Expected X in 1..3, X #> 5 to fail")
+	}
+
+	// Binding a constrained variable checks its domain
+	if len(queryAll(engine, sessionID,
+		Compound("in", []Term{Variable("X"), fdRange(1, 3)}),
+		Compound("=", []Term{Variable("X"), Number(4)}),
+	)) != 0 {
+		t.Error("Expected X in 1..3, X = 4 to fail")
+	}
+
+	// Sessions keep their own in/2
+	session, _ := engine.CreateSession(CreateSessionRequest{Name: "own-in"})
+	engine.AddFact(Fact{SessionID: session.ID, Predicate: Compound("in", []Term{Atom("alice"), Atom("kitchen")})})
+	solutions = queryAll(engine, session.ID, Compound("in", []Term{Variable("X"), Atom("kitchen")}))
+	if len(solutions) != 1 || solutions[0].Bindings["X"].Value != "alice" {
+		t.Errorf("Expected the session's in/2, got %v", solutions)
+	}
+}
+
+func TestFDLabeling(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+
+	vars := List([]Term{Variable("X"), Variable("Y")})
+	solutions := queryAll(engine, sessionID,
+		Compound("ins", []Term{vars, fdRange(1, 3)}),
+		Compound("#<", []Term{Variable("X"), Variable("Y")}),
+		Compound("label", []Term{vars}),
+	)
+	if len(solutions) != 3 {
+		t.Fatalf("Expected 3 solutions, got %d", len(solutions))
+	}
+	if solutions[0].Bindings["X"].Value != 1.0 || solutions[0].Bindings["Y"].Value != 2.0 {
+		t.Errorf("Expected the first solution to be X = 1, Y = 2, got %v", solutions[0].Bindings)
+	}
+
+	solutions = queryAll(engine, sessionID,
+		Compound("in", []Term{Variable("X"), fdRange(1, 5)}),
+		Compound("labeling", []Term{List([]Term{Atom("down")}), List([]Term{Variable("X")})}),
+	)
+	if len(solutions) != 5 || solutions[0].Bindings["X"].Value != 5.0 {
+		t.Errorf("Expected labeling down to start at 5, got %v", solutions)
+	}
+
+	// Labeling an unbounded variable fails rather than looping
+	if len(queryAll(engine, sessionID, Compound("label", []Term{List([]Term{Variable("X")})}))) != 0 {
+		t.Error("Expected label/1 on an unbounded variable to fail")
+	}
+}
+
+func TestFDScheduling(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+
+	// Five people on three shifts: ann and bob on different shifts, cat on
+	// the shift after dan, eve on shift 3, shift numbers summing to 9.
+	people := []Term{Variable("Ann"), Variable("Bob"), Variable("Cat"), Variable("Dan"), Variable("Eve")}
+	solutions := queryAll(engine, sessionID,
+		Compound("ins", []Term{List(people), fdRange(1, 3)}),
+		Compound("#\\=", []Term{Variable("Ann"), Variable("Bob")}),
+		Compound("#=", []Term{Variable("Cat"), Compound("+", []Term{Variable("Dan"), Number(1)})}),
+		Compound("#=", []Term{Variable("Eve"), Number(3)}),
+		Compound("sum", []Term{List(people), Atom("#="), Number(9)}),
+		Compound("labeling", []Term{List([]Term{Atom("ff")}), List(people)}),
+	)
+	if len(solutions) == 0 {
+		t.Fatal("Expected at least one schedule")
+	}
+	for _, sol := range solutions {
+		b := sol.Bindings
+		total := 0.0
+		for _, p := range []string{"Ann", "Bob", "Cat", "Dan", "Eve"} {
+			total += b[p].Value.(float64)
+		}
+		if b["Ann"].Value == b["Bob"].Value || b["Cat"].Value.(float64) != b["Dan"].Value.(float64)+1 || b["Eve"].Value != 3.0 || total != 9 {
+			t.Errorf("Schedule violates the constraints: %v", b)
+		}
+	}
+
+	// all_different over three variables with three values
+	row := List([]Term{Variable("A"), Variable("B"), Variable("C")})
+	solutions = queryAll(engine, sessionID,
+		Compound("ins", []Term{row, fdRange(1, 3)}),
+		Compound("all_different", []Term{row}),
+		Compound("label", []Term{row}),
+	)
+	if len(solutions) != 6 {
+		t.Errorf("Expected 6 permutations, got %d", len(solutions))
+	}
+
+	// sum/3 with a plain goal is still the aggregation builtin
+	engine.AddFact(Fact{SessionID: sessionID, Predicate: Compound("cost", []Term{Number(2)})})
+	engine.AddFact(Fact{SessionID: sessionID, Predicate: Compound("cost", []Term{Number(3)})})
+	solutions = queryAll(engine, sessionID, Compound("sum", []Term{Variable("C"), Compound("cost", []Term{Variable("C")}), Variable("S")}))
+	if len(solutions) != 1 || solutions[0].Bindings["S"].Value != 5.0 {
+		t.Errorf("Expected sum/3 aggregation to give 5, got %v", solutions)
+	}
+}
+
+func TestFDSendMoreMoney(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+
+	letters := []string{"S", "E", "N", "D", "M", "O", "R", "Y"}
+	vars := make([]Term, len(letters))
+	for i, l := range letters {
+		vars[i] = Variable(l)
+	}
+	word := func(ls ...string) Term {
+		var expr Term
+		for i, l := range ls {
+			place := Compound("*", []Term{Number(pow10(len(ls) - 1 - i)), Variable(l)})
+			if i == 0 {
+				expr = place
+			} else {
+				expr = Compound("+", []Term{expr, place})
+			}
+		}
+		return expr
+	}
+
+	solutions := queryAll(engine, sessionID,
+		Compound("ins", []Term{List(vars), fdRange(0, 9)}),
+		Compound("all_different", []Term{List(vars)}),
+		Compound("#\\=", []Term{Variable("S"), Number(0)}),
+		Compound("#\\=", []Term{Variable("M"), Number(0)}),
+		Compound("#=", []Term{
+			Compound("+", []Term{word("S", "E", "N", "D"), word("M", "O", "R", "E")}),
+			word("M", "O", "N", "E", "Y"),
+		}),
+		Compound("labeling", []Term{List([]Term{Atom("ff")}), List(vars)}),
+	)
+	if len(solutions) != 1 {
+		t.Fatalf("Expected a unique solution, got %d", len(solutions))
+	}
+	expected := map[string]float64{"S": 9, "E": 5, "N": 6, "D": 7, "M": 1, "O": 0, "R": 8, "Y": 2}
+	for l, v := range expected {
+		if solutions[0].Bindings[l].Value != v {
+			t.Errorf("Expected %s = %v, got %v", l, v, solutions[0].Bindings[l].Value)
+		}
+	}
+}
+
+func pow10(n int) float64 {
+	p := 1.0
+	for i := 0; i < n; i++ {
+		p *= 10
+	}
+	return p
+}
@@ -0,0 +1,85 @@
+package main
+
+import "fmt"
+
+// Consult loads Prolog source text into a session. Clauses become facts and
+// rules (after term and goal expansion; grammar rules are translated), and
+// directives (:- Goal) run as queries in order, so operators declared by
+// op/3 apply to the clauses that follow, and after :- module(M, Exports)
+// the remaining clauses belong to M. A syntax error stops the load; failed
+// directives, including those term_expansion/2 expands a clause to, are
+// reported as warnings.
+func (e *Engine) Consult(sessionID, text string) (ConsultResult, error) {
+	var result ConsultResult
+	module := userModule
+
+	r := newTermReader(text, e.sessionOps(sessionID))
+	for {
+		term, ok, err := r.readClause()
+		if err != nil {
+			return result, err
+		}
+		if !ok {
+			return result, nil
+		}
+
+		switch {
+		case term.Type == "compound" && term.Value == ":-" && len(term.Args) == 1:
+			goals := qualifyGoals(module, e.expandGoals(sessionID, flattenConjunction(term.Args[0])))
+			solutions := e.Query(Query{Goals: goals}, sessionID)
+			if !solutions.Solutions[0].Success {
+				result.Warnings = append(result.Warnings, fmt.Sprintf("directive failed: %s", r.ops.format(term.Args[0], true)))
+			} else if d := term.Args[0]; d.Type == "compound" && d.Value == "module" && len(d.Args) == 2 {
+				module = d.Args[0].Value.(string)
+			}
+			result.Directives++
+			r.ops = e.sessionOps(sessionID)
+
+		case term.Type == "compound" && term.Value == ":-" && len(term.Args) == 2:
+			rule := Rule{SessionID: sessionID, Head: qualify(module, term.Args[0]), Body: flattenConjunction(term.Args[1])}
+			if err := result.added(e.AddRule(rule)); err != nil {
+				return result, err
+			}
+
+		case term.Type == "compound" && term.Value == "-->" && len(term.Args) == 2:
+			if err := result.added(e.AddRule(Rule{SessionID: sessionID, Head: qualify(module, term), Body: []Term{}})); err != nil {
+				return result, err
+			}
+
+		case term.Type == "atom" || term.Type == "compound":
+			if err := result.added(e.AddFact(Fact{SessionID: sessionID, Predicate: qualify(module, term)})); err != nil {
+				return result, err
+			}
+
+		default:
+			return result, fmt.Errorf("cannot add %s as a clause", r.ops.format(term, true))
+		}
+	}
+}
+
+// added counts a clause Consult added, keeping the directives it expanded
+// to that failed as warnings rather than stopping the load.
+func (result *ConsultResult) added(err error) error {
+	if failed, ok := err.(directiveFailures); ok {
+		result.Warnings = append(result.Warnings, failed...)
+		err = nil
+	}
+	if err == nil {
+		result.Clauses++
+	}
+	return err
+}
+
+// ParseQuery reads the goals of a query written as Prolog text, using the
+// session's operators. A leading ?- is optional.
+func (e *Engine) ParseQuery(sessionID, text string) ([]Term, error) {
+	ops := e.sessionOps(sessionID)
+	goal, err := parseTerm(text, ops)
+	if err != nil {
+		return nil, err
+	}
+	if goal.Type == "compound" && goal.Value == "?-" && len(goal.Args) == 1 {
+		goal = goal.Args[0]
+	}
+	return flattenConjunction(goal), nil
+}
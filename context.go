@@ -0,0 +1,45 @@
+package main
+
+// Solve context. Besides its bindings, each branch of a query carries state
+// of the engine's own, such as the output written so far or the proof steps
+// recorded. It is a solveContext held in the branch's substitution under
+// contextKey, so it follows backtracking like the bindings do. The key is
+// not valid UTF-8, and no variable decoded from JSON or read from Prolog
+// text can have it as its name: queries can neither see nor set the
+// context. For the same reason the goals the engine adds to a branch for
+// itself, such as traceExit, have names starting with contextKey.
+
+const contextKey = "\xff"
+
+type solveContext struct {
+	access   string // API key of the request running the query
+	readOnly bool   // running in another session, through session(S):Goal
+	sql      bool   // rule-defined predicates are compiled to SQL
+	proof    bool   // proof steps are recorded
+	steps    Term   // recorded proof steps, newest first
+	tracer   *tracer
+	frame    int // tracer invocation the branch is running in
+	output   string
+	attrs    map[string]Term // Module=Value pairs by variable; copied on write
+	wake     []Term          // goals queued by bind for attributed variables
+	events   []*eventIndex   // event indexes being built by the branch
+}
+
+// contextOf returns the solve context of the branch described by subst.
+func contextOf(subst Substitution) solveContext {
+	ctx, _ := subst[contextKey].Value.(solveContext)
+	return ctx
+}
+
+// setContext stores ctx in subst, which must not be shared with other
+// branches.
+func setContext(subst Substitution, ctx solveContext) {
+	subst[contextKey] = Term{Type: "context", Value: ctx}
+}
+
+// withContext returns a copy of subst carrying ctx.
+func withContext(subst Substitution, ctx solveContext) Substitution {
+	newSubst := copySubst(subst)
+	setContext(newSubst, ctx)
+	return newSubst
+}
@@ -0,0 +1,106 @@
+package main
+
+import "strings"
+
+// callGoal builds the goal for call/N by appending extra arguments to a
+// closure: call(foo(a), b) calls foo(a, b).
+func (e *Engine) callGoal(closure Term, extra []Term, subst Substitution) (Term, bool) {
+	closure = e.deref(closure, subst)
+	switch closure.Type {
+	case "atom":
+		if len(extra) == 0 {
+			return closure, true
+		}
+		return Compound(closure.Value.(string), extra), true
+	case "compound":
+		if closure.Value == ":" && len(closure.Args) == 2 {
+			// A module-qualified closure keeps its module
+			goal, ok := e.callGoal(closure.Args[1], extra, subst)
+			return Compound(":", []Term{closure.Args[0], goal}), ok
+		}
+		args := append(append([]Term{}, closure.Args...), extra...)
+		return Compound(closure.Value.(string), args), true
+	}
+	return Term{}, false
+}
+
+// innerOutput returns the text written by a sub-proof that started from
+// subst and ended in sol.
+func innerOutput(subst, sol Substitution) string {
+	return strings.TrimPrefix(solutionOutput(sol), solutionOutput(subst))
+}
+
+// handleControl implements the control constructs and meta-calls:
+// ','/2, ';'/2, '->'/2, '\+'/1, call/1..8, once/1, ignore/1, forall/2 and
+// findall/3.
+func (e *Engine) handleControl(goal Term, subst Substitution, sessionID string) ([]Substitution, bool) {
+	args := goal.Args
+
+	switch {
+	case goal.Value == "," && len(args) == 2:
+		return e.solve(args, subst, sessionID), true
+
+	case goal.Value == ";" && len(args) == 2:
+		if cond := e.deref(args[0], subst); cond.Type == "compound" && cond.Value == "->" && len(cond.Args) == 2 {
+			// (If -> Then ; Else) commits to the first solution of If
+			if condSols := e.solve(cond.Args[:1], subst, sessionID); len(condSols) > 0 {
+				return e.solve(cond.Args[1:], condSols[0], sessionID), true
+			}
+			return e.solve(args[1:], subst, sessionID), true
+		}
+		return append(e.solve(args[:1], subst, sessionID), e.solve(args[1:], subst, sessionID)...), true
+
+	case goal.Value == "->" && len(args) == 2:
+		if condSols := e.solve(args[:1], subst, sessionID); len(condSols) > 0 {
+			return e.solve(args[1:], condSols[0], sessionID), true
+		}
+		return []Substitution{}, true
+
+	case goal.Value == "\\+" && len(args) == 1:
+		if len(e.solve(args, subst, sessionID)) == 0 {
+			return []Substitution{subst}, true
+		}
+		return []Substitution{}, true
+
+	case goal.Value == "call" && len(args) >= 1 && len(args) <= 8:
+		called, ok := e.callGoal(args[0], args[1:], subst)
+		if !ok {
+			return []Substitution{}, true
+		}
+		return e.solve([]Term{called}, subst, sessionID), true
+
+	case goal.Value == "once" && len(args) == 1:
+		if sols := e.solve(args, subst, sessionID); len(sols) > 0 {
+			return sols[:1], true
+		}
+		return []Substitution{}, true
+
+	case goal.Value == "ignore" && len(args) == 1:
+		if sols := e.solve(args, subst, sessionID); len(sols) > 0 {
+			return sols[:1], true
+		}
+		return []Substitution{subst}, true
+
+	case goal.Value == "forall" && len(args) == 2:
+		var output strings.Builder
+		for _, sol := range e.solve(args[:1], subst, sessionID) {
+			actionSols := e.solve(args[1:], sol, sessionID)
+			if len(actionSols) == 0 {
+				return []Substitution{}, true
+			}
+			output.WriteString(innerOutput(subst, actionSols[0]))
+		}
+		return []Substitution{e.withOutput(subst, output.String())}, true
+
+	case goal.Value == "findall" && len(args) == 3:
+		var items []Term
+		var output strings.Builder
+		for _, sol := range e.solve(args[1:2], subst, sessionID) {
+			items = append(items, e.instantiate(args[0], sol))
+			output.WriteString(innerOutput(subst, sol))
+		}
+		return e.unifyResult(args[2], List(items), e.withOutput(subst, output.String()))
+	}
+
+	return []Substitution{}, true
+}
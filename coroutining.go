@@ -0,0 +1,138 @@
+package main
+
+// whenCheck is the internal goal that re-checks a suspended when/2.
+const whenCheck = contextKey + "when"
+
+// handleCoroutining implements freeze/2, dif/2 and when/2 on top of
+// attributed variables, plus the internal whenCheck/3 that re-checks a
+// suspended when/2.
+func (e *Engine) handleCoroutining(goal Term, subst Substitution, sessionID string) ([]Substitution, bool) {
+	args := goal.Args
+
+	switch {
+	case goal.Value == "freeze" && len(args) == 2:
+		v := e.deref(args[0], subst)
+		if v.Type != "variable" {
+			return e.solve(args[1:], subst, sessionID), true
+		}
+		value := args[1]
+		if existing, ok := e.getAttr(v.Value.(string), "freeze", subst); ok {
+			value = Compound(",", []Term{existing, value})
+		}
+		return []Substitution{e.putAttr(v.Value.(string), "freeze", value, subst)}, true
+
+	case goal.Value == "dif" && len(args) == 2:
+		unifier, ok := e.unify(args[0], args[1], subst)
+		if !ok {
+			return []Substitution{subst}, true
+		}
+		vars := newBindings(subst, unifier)
+		if len(vars) == 0 {
+			// Already identical
+			return []Substitution{}, true
+		}
+		// Suspend on every variable the unifier would bind, including
+		// variables it would alias them to
+		suspended := Compound("dif", args)
+		for _, v := range e.suspensionVars(vars, unifier) {
+			subst = e.appendAttr(v, "dif", []Term{suspended}, subst)
+		}
+		return []Substitution{subst}, true
+
+	case goal.Value == "when" && len(args) == 2:
+		return e.solve([]Term{Compound(whenCheck, []Term{e.freshVar(), args[0], args[1]})}, subst, sessionID), true
+
+	case goal.Value == whenCheck && len(args) == 3:
+		if e.deref(args[0], subst).Type != "variable" {
+			// Already fired from another variable
+			return []Substitution{subst}, true
+		}
+		satisfied, vars, ok := e.whenCondition(args[1], subst)
+		if !ok {
+			return []Substitution{}, true
+		}
+		if satisfied {
+			fired, _ := e.unify(args[0], Atom("true"), subst)
+			return e.solve(args[2:], fired, sessionID), true
+		}
+		for _, v := range vars {
+			subst = e.appendAttr(v, "when", []Term{goal}, subst)
+		}
+		return []Substitution{subst}, true
+	}
+
+	return []Substitution{}, true
+}
+
+// suspensionVars extends the variables bound by a tentative unifier with
+// the unbound variables they were bound to.
+func (e *Engine) suspensionVars(vars []string, unifier Substitution) []string {
+	seen := make(map[string]bool)
+	var result []string
+	add := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			result = append(result, name)
+		}
+	}
+	for _, v := range vars {
+		add(v)
+		if target := e.deref(Variable(v), unifier); target.Type == "variable" {
+			add(target.Value.(string))
+		}
+	}
+	return result
+}
+
+// difPending reports whether dif(A, B) is still undecided under subst.
+func (e *Engine) difPending(a, b Term, subst Substitution) bool {
+	unifier, ok := e.unify(a, b, subst)
+	return ok && len(newBindings(subst, unifier)) > 0
+}
+
+// whenCondition evaluates a when/2 condition: nonvar(X), ground(X),
+// ?=(X, Y), (C1, C2) or (C1 ; C2). When it is not yet satisfied it returns
+// the variables to suspend on; ok is false for an invalid condition.
+func (e *Engine) whenCondition(cond Term, subst Substitution) (satisfied bool, vars []string, ok bool) {
+	cond = e.deref(cond, subst)
+	if cond.Type != "compound" {
+		return false, nil, false
+	}
+
+	switch {
+	case cond.Value == "nonvar" && len(cond.Args) == 1:
+		if v := e.deref(cond.Args[0], subst); v.Type == "variable" {
+			return false, []string{v.Value.(string)}, true
+		}
+		return true, nil, true
+
+	case cond.Value == "ground" && len(cond.Args) == 1:
+		unbound := make(map[string]bool)
+		e.collectVars(e.instantiate(cond.Args[0], subst), unbound)
+		for v := range unbound {
+			vars = append(vars, v)
+		}
+		return len(vars) == 0, vars, true
+
+	case cond.Value == "?=" && len(cond.Args) == 2:
+		unifier, unifies := e.unify(cond.Args[0], cond.Args[1], subst)
+		if !unifies {
+			return true, nil, true
+		}
+		bound := newBindings(subst, unifier)
+		return len(bound) == 0, e.suspensionVars(bound, unifier), true
+
+	case (cond.Value == "," || cond.Value == ";") && len(cond.Args) == 2:
+		s1, v1, ok1 := e.whenCondition(cond.Args[0], subst)
+		s2, v2, ok2 := e.whenCondition(cond.Args[1], subst)
+		if !ok1 || !ok2 {
+			return false, nil, false
+		}
+		if cond.Value == "," && s1 && s2 || cond.Value == ";" && (s1 || s2) {
+			return true, nil, true
+		}
+		return false, append(v1, v2...), true
+	}
+
+	return false, nil, false
+}
@@ -0,0 +1,134 @@
+package main
+
+import "testing"
+
+func TestDif(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+
+	for _, color := range []string{"red", "green"} {
+		engine.AddFact(Fact{SessionID: sessionID, Predicate: Compound("color", []Term{Atom(color)})})
+	}
+
+	// dif/2 posted before its arguments are bound still prunes answers
+	solutions := queryAll(engine, sessionID,
+		Compound("dif", []Term{Variable("X"), Variable("Y")}),
+		Compound("color", []Term{Variable("X")}),
+		Compound("color", []Term{Variable("Y")}),
+	)
+	if len(solutions) != 2 {
+		t.Fatalf("Expected 2 pairs of different colors, got %d", len(solutions))
+	}
+	for _, sol := range solutions {
+		if sol.Bindings["X"].Value == sol.Bindings["Y"].Value {
+			t.Errorf("dif/2 let through X = Y = %v", sol.Bindings["X"].Value)
+		}
+	}
+
+	// Aliasing the two variables violates the constraint
+	if len(queryAll(engine, sessionID, Compound("dif", []Term{Variable("X"), Variable("Y")}), Compound("=", []Term{Variable("Y"), Variable("X")}))) != 0 {
+		t.Error("Expected dif(X, Y), Y = X to fail")
+	}
+
+	if len(queryAll(engine, sessionID, Compound("dif", []Term{Atom("a"), Atom("a")}))) != 0 {
+		t.Error("Expected dif(a, a) to fail")
+	}
+
+	// Unresolved constraints are reported with the answer
+	result := engine.Query(Query{Goals: []Term{
+		Compound("dif", []Term{Compound("f", []Term{Variable("X")}), Compound("f", []Term{Atom("a")})}),
+	}}, sessionID)
+	if len(result.Solutions[0].Residuals) != 1 || result.Solutions[0].Residuals[0].Value != "dif" {
+		t.Errorf("Expected a residual dif/2, got %v", result.Solutions[0].Residuals)
+	}
+}
+
+func TestFreeze(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+
+	engine.AddFact(Fact{SessionID: sessionID, Predicate: Compound("value", []Term{Number(1)})})
+	engine.AddFact(Fact{SessionID: sessionID, Predicate: Compound("value", []Term{Number(2)})})
+	engine.AddFact(Fact{SessionID: sessionID, Predicate: Compound("odd", []Term{Number(1)})})
+
+	// freeze(X, odd(X)), value(X) resumes the test when X is bound
+	solutions := queryAll(engine, sessionID,
+		Compound("freeze", []Term{Variable("X"), Compound("odd", []Term{Variable("X")})}),
+		Compound("value", []Term{Variable("X")}),
+	)
+	if len(solutions) != 1 || solutions[0].Bindings["X"].Value != 1.0 {
+		t.Errorf("Expected X = 1, got %v", solutions)
+	}
+
+	// The goal follows the variable through aliasing
+	solutions = queryAll(engine, sessionID,
+		Compound("freeze", []Term{Variable("X"), Compound("writeln", []Term{Atom("woken")})}),
+		Compound("=", []Term{Variable("X"), Variable("Y")}),
+		Compound("=", []Term{Variable("Y"), Atom("go")}),
+	)
+	if len(solutions) != 1 || solutions[0].Output != "woken\n" {
+		t.Errorf("Expected the frozen goal to run once, got %v", solutions)
+	}
+
+	result := engine.Query(Query{Goals: []Term{Compound("freeze", []Term{Variable("X"), Atom("true")})}}, sessionID)
+	if len(result.Solutions[0].Residuals) != 1 || result.Solutions[0].Residuals[0].Value != "freeze" {
+		t.Errorf("Expected a residual freeze/2, got %v", result.Solutions[0].Residuals)
+	}
+
+	// Binding a variable named like engine state queues no goals
+	solutions = queryAll(engine, sessionID,
+		Compound("=", []Term{Variable("$wake"), List([]Term{Atom("fail")})}),
+		Atom("true"))
+	if len(solutions) != 1 {
+		t.Errorf("Expected $wake to be an ordinary variable, got %v", solutions)
+	}
+}
+
+func TestWhen(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+
+	say := func(word string) Term { return Compound("write", []Term{Atom(word)}) }
+
+	cases := []struct {
+		goals  []Term
+		output string
+	}{
+		// ground/1 waits for both variables
+		{[]Term{
+			Compound("when", []Term{Compound("ground", []Term{Compound("f", []Term{Variable("X"), Variable("Y")})}), say("fired")}),
+			Compound("=", []Term{Variable("X"), Atom("a")}),
+			say("-"),
+			Compound("=", []Term{Variable("Y"), Atom("b")}),
+		}, "-fired"},
+		// A disjunction fires once, on the first binding
+		{[]Term{
+			Compound("when", []Term{Compound(";", []Term{
+				Compound("nonvar", []Term{Variable("X")}),
+				Compound("nonvar", []Term{Variable("Y")}),
+			}), say("once")}),
+			Compound("=", []Term{Variable("Y"), Atom("b")}),
+			Compound("=", []Term{Variable("X"), Atom("a")}),
+		}, "once"},
+		// ?=/2 fires as soon as the terms are known to differ
+		{[]Term{
+			Compound("when", []Term{Compound("?=", []Term{Variable("X"), Variable("Y")}), say("decided")}),
+			Compound("=", []Term{Variable("X"), Atom("a")}),
+			Compound("=", []Term{Variable("Y"), Atom("b")}),
+		}, "decided"},
+	}
+	for i, c := range cases {
+		solutions := queryAll(engine, sessionID, c.goals...)
+		if len(solutions) != 1 || solutions[0].Output != c.output {
+			t.Errorf("case %d: expected output %q, got %v", i, c.output, solutions)
+		}
+	}
+
+	result := engine.Query(Query{Goals: []Term{Compound("when", []Term{Compound("nonvar", []Term{Variable("X")}), Atom("true")})}}, sessionID)
+	if len(result.Solutions[0].Residuals) != 1 || result.Solutions[0].Residuals[0].Value != "when" {
+		t.Errorf("Expected a residual when/2, got %v", result.Solutions[0].Residuals)
+	}
+}
@@ -0,0 +1,688 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Bottom-up evaluation. A session whose clauses are Datalog — facts of
+// constants and rules whose bodies are predicate calls, their negation with
+// \+, =/2 and dif/2 — can have its queries answered from the program's
+// model instead of by resolution. The predicates a query reaches are split
+// into strata, each evaluated to a fixpoint with semi-naive iteration once
+// the strata it depends on are complete, so recursion terminates and \+
+// only ever tests a finished relation. Queries run bottom-up when they ask
+// for it with "evaluation": "bottom_up" or when the session has enabled the
+// datalog library.
+
+const datalogLibrary = "datalog"
+
+// DatalogStats describes a bottom-up evaluation.
+type DatalogStats struct {
+	Strata     [][]string `json:"strata"`     // derived predicates evaluated together, lowest first
+	Iterations int        `json:"iterations"` // rule passes over all strata
+	Facts      int        `json:"facts"`      // stored facts loaded
+	Derived    int        `json:"derived"`    // facts derived by rules
+}
+
+// literal kinds
+const (
+	positiveLiteral = iota
+	negatedLiteral
+	unifyLiteral
+	difLiteral
+)
+
+type datalogLiteral struct {
+	kind int
+	goal Term
+	key  string // predicate of positive and negated literals
+	args []Term
+}
+
+type datalogRule struct {
+	head Term
+	key  string
+	body []datalogLiteral // ordered so filters run once their variables are bound
+}
+
+// relation is the set of tuples of a predicate, with indexes on single
+// arguments built as lookups need them.
+type relation struct {
+	tuples  [][]Term
+	keys    [][]string
+	seen    map[string]bool
+	indexes map[int]map[string][]int
+}
+
+func newRelation() *relation {
+	return &relation{seen: make(map[string]bool), indexes: make(map[int]map[string][]int)}
+}
+
+// add inserts tuple unless the relation has it, reporting whether it was new.
+func (r *relation) add(tuple []Term) bool {
+	key, keys := tupleKey(tuple)
+	if r.seen[key] {
+		return false
+	}
+	r.seen[key] = true
+	r.tuples = append(r.tuples, tuple)
+	r.keys = append(r.keys, keys)
+	for pos, index := range r.indexes {
+		index[keys[pos]] = append(index[keys[pos]], len(r.tuples)-1)
+	}
+	return true
+}
+
+// remove deletes the tuples with the given keys.
+func (r *relation) remove(keys map[string]bool) {
+	tuples := r.tuples
+	*r = *newRelation()
+	for _, tuple := range tuples {
+		if key, _ := tupleKey(tuple); !keys[key] {
+			r.add(tuple)
+		}
+	}
+}
+
+// lookup returns the tuples whose argument pos is value.
+func (r *relation) lookup(pos int, value string) []int {
+	index, ok := r.indexes[pos]
+	if !ok {
+		index = make(map[string][]int)
+		for i, keys := range r.keys {
+			index[keys[pos]] = append(index[keys[pos]], i)
+		}
+		r.indexes[pos] = index
+	}
+	return index[value]
+}
+
+// datalogProgram is the part of a session's program a query reaches.
+type datalogProgram struct {
+	p         *queryPlanner
+	rules     map[string][]datalogRule
+	relations map[string]*relation
+	calls     map[string][]string // predicate -> predicates its rules call
+	negated   map[string]map[string]bool
+	order     []string
+	stats     DatalogStats
+
+	// Set for materialized views: the stored facts of each predicate, and
+	// the predicates with clauses from other sessions
+	stored  map[string]map[string]int
+	foreign map[string]bool
+}
+
+func newDatalogProgram(e *Engine, sessionID string) *datalogProgram {
+	return &datalogProgram{p: newQueryPlanner(e, sessionID), rules: make(map[string][]datalogRule),
+		relations: make(map[string]*relation), calls: make(map[string][]string),
+		negated: make(map[string]map[string]bool)}
+}
+
+// DatalogQuery answers query bottom-up from the model of the session's
+// program.
+func (e *Engine) DatalogQuery(query Query, sessionID string) QueryResult {
+	d := newDatalogProgram(e, sessionID)
+	body, err := d.body(query.Goals, userModule, "the query")
+	if err == nil {
+		_, err = d.strata()
+	}
+	if err == nil {
+		body = d.magicSets(body)
+		err = d.evaluate()
+	}
+	if err != nil {
+		return QueryResult{Solutions: []Solution{{Success: false}}, Error: err.Error()}
+	}
+
+	result := QueryResult{Datalog: &d.stats}
+	seen := make(map[string]bool)
+	d.join(body, -1, nil, make(Substitution), func(binding Substitution) {
+		bindings := e.extractQueryBindings(query.Goals, binding)
+		if key := bindingKey(bindings); !seen[key] {
+			seen[key] = true
+			result.Solutions = append(result.Solutions, Solution{Bindings: bindings, Success: true})
+		}
+	})
+	if len(result.Solutions) == 0 {
+		result.Solutions = []Solution{{Success: false}}
+	}
+	return result
+}
+
+// bindingKey identifies an answer by its bindings.
+func bindingKey(bindings Substitution) string {
+	vars := make([]string, 0, len(bindings))
+	for v := range bindings {
+		vars = append(vars, v)
+	}
+	sort.Strings(vars)
+	var key strings.Builder
+	for _, v := range vars {
+		fmt.Fprintf(&key, "%s=%s\x00", v, formatTerm(bindings[v], true))
+	}
+	return key.String()
+}
+
+// evaluation returns how query runs in a session: top_down, bottom_up or
+// sql.
+func (e *Engine) evaluation(query Query, sessionID string) (string, error) {
+	switch query.Evaluation {
+	case "":
+		if e.libraryEnabled(sessionID, datalogLibrary) {
+			return "bottom_up", nil
+		}
+		return "top_down", nil
+	case "top_down", "bottom_up", "sql":
+		return query.Evaluation, nil
+	}
+	return "", fmt.Errorf("unknown evaluation %q, expected top_down, bottom_up or sql", query.Evaluation)
+}
+
+// load reads the clauses of the predicate goal calls in module and of the
+// predicates they call, checking that they are Datalog.
+func (d *datalogProgram) load(goal Term, module string) (string, error) {
+	key := d.p.key(goal, module)
+	if _, ok := d.relations[key]; ok {
+		return key, nil
+	}
+	rel := newRelation()
+	d.relations[key] = rel
+	d.order = append(d.order, key)
+
+	facts, rules := d.p.e.visibleClauses(goal, module, d.p.sessionID)
+	for _, fact := range facts {
+		for _, arg := range fact.Predicate.Args {
+			if !datalogConstant(arg) {
+				return "", fmt.Errorf("not Datalog: fact %s has an argument that is not a constant", formatTerm(fact.Predicate, true))
+			}
+		}
+		if rel.add(fact.Predicate.Args) {
+			d.stats.Facts++
+		}
+		d.trackClause(key, fact.SessionID, fact.Predicate.Args, true)
+	}
+
+	for _, rule := range rules {
+		if termArity(rule.Head) != termArity(goal) {
+			continue
+		}
+		clause := formatTerm(Compound(":-", []Term{rule.Head, conjunction(rule.Body)}), true)
+		for _, arg := range rule.Head.Args {
+			if arg.Type != "variable" && !datalogConstant(arg) {
+				return "", fmt.Errorf("not Datalog: the head of %s has a compound argument", clause)
+			}
+		}
+		body, err := d.body(rule.Body, module, clause)
+		if err != nil {
+			return "", err
+		}
+		if err := checkSafety(rule.Head, body, clause); err != nil {
+			return "", err
+		}
+		d.addRule(datalogRule{head: rule.Head, key: key, body: body})
+		d.trackClause(key, rule.SessionID, nil, false)
+	}
+	return key, nil
+}
+
+// trackClause records a clause of key from sessionID for materialized
+// views, with the tuple of a fact.
+func (d *datalogProgram) trackClause(key, sessionID string, tuple []Term, fact bool) {
+	if d.stored == nil {
+		return
+	}
+	if sessionID != d.p.sessionID {
+		d.foreign[key] = true
+	}
+	if fact {
+		if d.stored[key] == nil {
+			d.stored[key] = make(map[string]int)
+		}
+		tupleKey, _ := tupleKey(tuple)
+		d.stored[key][tupleKey]++
+	}
+}
+
+// addRule adds rule to the program and records the predicates it calls.
+func (d *datalogProgram) addRule(rule datalogRule) {
+	for _, lit := range rule.body {
+		if lit.kind == positiveLiteral || lit.kind == negatedLiteral {
+			d.calls[rule.key] = append(d.calls[rule.key], lit.key)
+		}
+		if lit.kind == negatedLiteral {
+			if d.negated[rule.key] == nil {
+				d.negated[rule.key] = make(map[string]bool)
+			}
+			d.negated[rule.key][lit.key] = true
+		}
+	}
+	d.rules[rule.key] = append(d.rules[rule.key], rule)
+}
+
+// body converts the goals of a clause body run in module to literals,
+// loading the predicates they call, and orders them for evaluation.
+func (d *datalogProgram) body(goals []Term, module, clause string) ([]datalogLiteral, error) {
+	var literals []datalogLiteral
+	for _, goal := range goals {
+		for _, goal := range flattenConjunction(goal) {
+			lit, ok, err := d.literal(goal, module, clause)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				literals = append(literals, lit)
+			}
+		}
+	}
+	return orderLiterals(literals, clause)
+}
+
+// literal converts one body goal, reporting false for true/0.
+func (d *datalogProgram) literal(goal Term, module, clause string) (datalogLiteral, bool, error) {
+	if qualified, plain := splitModule(goal); qualified != userModule {
+		module, goal = qualified, plain
+	}
+	if goal.Type != "atom" && goal.Type != "compound" {
+		return datalogLiteral{}, false, fmt.Errorf("not Datalog: %s is not a goal in %s", formatTerm(goal, true), clause)
+	}
+
+	lit := datalogLiteral{kind: positiveLiteral, goal: goal, args: goal.Args}
+	switch key := indicatorKey(goal.Value.(string), len(goal.Args)); {
+	case key == "true/0":
+		return lit, false, nil
+	case key == "=/2":
+		lit.kind = unifyLiteral
+	case key == "dif/2":
+		lit.kind = difLiteral
+	case key == "\\+/1":
+		negated, ok, err := d.literal(goal.Args[0], module, clause)
+		if err == nil && (!ok || negated.kind != positiveLiteral) {
+			err = fmt.Errorf("not Datalog: %s negates something other than a predicate in %s", formatTerm(goal, true), clause)
+		}
+		negated.kind, negated.goal = negatedLiteral, goal
+		return negated, true, err
+	case goal.Value == ":" || d.p.builtin(goal) || goalPositions[key] != nil:
+		return lit, false, fmt.Errorf("not Datalog: %s is not a Datalog goal in %s", formatTerm(goal, true), clause)
+	}
+	for _, arg := range goal.Args {
+		if arg.Type != "variable" && !datalogConstant(arg) {
+			return lit, false, fmt.Errorf("not Datalog: %s has a compound argument in %s", formatTerm(goal, true), clause)
+		}
+	}
+
+	var err error
+	if lit.kind == positiveLiteral {
+		lit.key, err = d.load(goal, d.p.e.resolveModule(d.p.sessionID, module, goal))
+	}
+	return lit, true, err
+}
+
+// datalogConstant reports whether t is a constant argument.
+func datalogConstant(t Term) bool {
+	return t.Type == "atom" || t.Type == "number" || t.Type == "date"
+}
+
+// orderLiterals keeps the positive literals in order and moves each other
+// literal to the first place its variables are bound, as far as the
+// positive literals bind them.
+func orderLiterals(literals []datalogLiteral, clause string) ([]datalogLiteral, error) {
+	bindable := make(map[string]bool)
+	for _, lit := range literals {
+		if lit.kind == positiveLiteral {
+			collectTermVars(lit.args, bindable)
+		}
+	}
+	for changed := true; changed; {
+		changed = false
+		for _, lit := range literals {
+			if lit.kind == unifyLiteral && ground(lit.args[0], bindable) != ground(lit.args[1], bindable) {
+				collectTermVars(lit.args, bindable)
+				changed = true
+			}
+		}
+	}
+
+	ordered := make([]datalogLiteral, 0, len(literals))
+	remaining := append([]datalogLiteral{}, literals...)
+	bound := make(map[string]bool)
+	for len(remaining) > 0 {
+		next := -1
+		for i, lit := range remaining {
+			if lit.kind != positiveLiteral && literalReady(lit, bound, bindable) {
+				next = i
+				break
+			}
+		}
+		if next < 0 {
+			for i, lit := range remaining {
+				if lit.kind == positiveLiteral {
+					next = i
+					break
+				}
+			}
+		}
+		if next < 0 {
+			return nil, fmt.Errorf("not Datalog: %s is unsafe in %s, no positive goal binds its variables", formatTerm(remaining[0].goal, true), clause)
+		}
+		ordered = append(ordered, remaining[next])
+		if lit := remaining[next]; lit.kind == positiveLiteral || lit.kind == unifyLiteral {
+			collectTermVars(lit.args, bound)
+		}
+		remaining = append(remaining[:next], remaining[next+1:]...)
+	}
+	return ordered, nil
+}
+
+// literalReady reports whether a filter literal can run with the variables
+// in bound bound. A negated literal tests its variables that no positive
+// literal binds as existential ones.
+func literalReady(lit datalogLiteral, bound, bindable map[string]bool) bool {
+	switch lit.kind {
+	case unifyLiteral:
+		return ground(lit.args[0], bound) || ground(lit.args[1], bound)
+	case negatedLiteral:
+		vars := make(map[string]bool)
+		collectTermVars(lit.args, vars)
+		for v := range vars {
+			if bindable[v] && !bound[v] {
+				return false
+			}
+		}
+		return true
+	}
+	return ground(lit.args[0], bound) && ground(lit.args[1], bound)
+}
+
+// checkSafety reports an error unless the body binds every variable of the
+// head.
+func checkSafety(head Term, body []datalogLiteral, clause string) error {
+	bound := make(map[string]bool)
+	for _, lit := range body {
+		if lit.kind == positiveLiteral || lit.kind == unifyLiteral {
+			collectTermVars(lit.args, bound)
+		}
+	}
+	for _, arg := range head.Args {
+		if arg.Type == "variable" && !bound[arg.Value.(string)] {
+			return fmt.Errorf("not Datalog: %s is unsafe, no positive goal binds %s", clause, arg.Value)
+		}
+	}
+	return nil
+}
+
+func collectTermVars(terms []Term, vars map[string]bool) {
+	for _, t := range terms {
+		if t.Type == "variable" {
+			vars[t.Value.(string)] = true
+		}
+	}
+}
+
+// strata returns the strongly connected components of the predicates with
+// rules, each after the components it calls, and reports an error when a
+// predicate depends negatively on its own component.
+func (d *datalogProgram) strata() ([][]string, error) {
+	index := make(map[string]int)
+	low := make(map[string]int)
+	onStack := make(map[string]bool)
+	var stack []string
+	var components [][]string
+
+	var visit func(key string)
+	visit = func(key string) {
+		index[key], low[key] = len(index), len(index)
+		stack = append(stack, key)
+		onStack[key] = true
+		for _, callee := range d.calls[key] {
+			if _, seen := index[callee]; !seen {
+				visit(callee)
+				low[key] = min(low[key], low[callee])
+			} else if onStack[callee] {
+				low[key] = min(low[key], index[callee])
+			}
+		}
+		if low[key] != index[key] {
+			return
+		}
+		var component []string
+		for {
+			top := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			onStack[top] = false
+			component = append([]string{top}, component...)
+			if top == key {
+				break
+			}
+		}
+		components = append(components, component)
+	}
+	for _, key := range d.order {
+		if _, seen := index[key]; !seen {
+			visit(key)
+		}
+	}
+
+	var strata [][]string
+	for _, component := range components {
+		members := make(map[string]bool)
+		for _, key := range component {
+			members[key] = true
+		}
+		for _, key := range component {
+			for callee := range d.negated[key] {
+				if members[callee] {
+					return nil, fmt.Errorf("not stratified: %s depends on the negation of %s through recursion", key, callee)
+				}
+			}
+		}
+		if len(d.rules[component[0]]) > 0 {
+			strata = append(strata, component)
+		}
+	}
+	return strata, nil
+}
+
+// evaluate computes the relations of the loaded predicates stratum by
+// stratum.
+func (d *datalogProgram) evaluate() error {
+	strata, err := d.strata()
+	if err != nil {
+		return err
+	}
+	d.stats.Strata = strata
+	for _, stratum := range strata {
+		d.fixpoint(stratum, nil)
+	}
+	return nil
+}
+
+// fixpoint evaluates the rules of a stratum semi-naively: after a first pass
+// over the complete lower strata, each pass only joins a recursive literal
+// with the facts the previous pass derived. When changed is set the first
+// pass only joins the literals of the relations in it with the tuples it
+// holds, which the relations already have. fixpoint returns the tuples it
+// derived.
+func (d *datalogProgram) fixpoint(stratum []string, changed map[string]*relation) map[string]*relation {
+	members := make(map[string]bool)
+	for _, key := range stratum {
+		members[key] = true
+	}
+
+	delta, derived := make(map[string]*relation), make(map[string]*relation)
+	derive := func(rule datalogRule, deltaAt int, prev map[string]*relation) {
+		d.join(rule.body, deltaAt, prev, make(Substitution), func(binding Substitution) {
+			tuple := make([]Term, len(rule.head.Args))
+			for i, arg := range rule.head.Args {
+				tuple[i] = d.p.e.instantiate(arg, binding)
+			}
+			if key, _ := tupleKey(tuple); d.relations[rule.key].seen[key] {
+				return
+			}
+			if delta[rule.key] == nil {
+				delta[rule.key] = newRelation()
+			}
+			delta[rule.key].add(tuple)
+		})
+	}
+	merge := func() map[string]*relation {
+		for key, rel := range delta {
+			for _, tuple := range rel.tuples {
+				if d.relations[key].add(tuple) {
+					d.stats.Derived++
+					if derived[key] == nil {
+						derived[key] = newRelation()
+					}
+					derived[key].add(tuple)
+				}
+			}
+		}
+		prev := delta
+		delta = make(map[string]*relation)
+		return prev
+	}
+
+	d.stats.Iterations++
+	for _, key := range stratum {
+		for _, rule := range d.rules[key] {
+			if changed == nil {
+				derive(rule, -1, nil)
+				continue
+			}
+			for i, lit := range rule.body {
+				if lit.kind == positiveLiteral && changed[lit.key] != nil {
+					derive(rule, i, changed)
+				}
+			}
+		}
+	}
+	for prev := merge(); len(prev) > 0; prev = merge() {
+		d.stats.Iterations++
+		for _, key := range stratum {
+			for _, rule := range d.rules[key] {
+				for i, lit := range rule.body {
+					if lit.kind == positiveLiteral && members[lit.key] && prev[lit.key] != nil {
+						derive(rule, i, prev)
+					}
+				}
+			}
+		}
+	}
+	return derived
+}
+
+// tupleKey returns the key of tuple in a relation and of each of its
+// arguments.
+func tupleKey(tuple []Term) (string, []string) {
+	keys := make([]string, len(tuple))
+	for i, t := range tuple {
+		keys[i] = formatTerm(t, true)
+	}
+	return strings.Join(keys, "\x00"), keys
+}
+
+// join calls emit with each binding satisfying the literals from binding.
+// The positive literal at deltaAt reads the facts in delta instead of its
+// whole relation.
+func (d *datalogProgram) join(body []datalogLiteral, deltaAt int, delta map[string]*relation, binding Substitution, emit func(Substitution)) {
+	var step func(i int)
+	step = func(i int) {
+		if i == len(body) {
+			emit(binding)
+			return
+		}
+		lit := body[i]
+		switch lit.kind {
+		case positiveLiteral:
+			rel := d.relations[lit.key]
+			if i == deltaAt {
+				rel = delta[lit.key]
+			}
+			d.match(rel, lit.args, binding, func() { step(i + 1) })
+		case negatedLiteral:
+			found := false
+			d.match(d.relations[lit.key], lit.args, binding, func() { found = true })
+			if !found {
+				step(i + 1)
+			}
+		case unifyLiteral:
+			left, right := d.p.e.instantiate(lit.args[0], binding), d.p.e.instantiate(lit.args[1], binding)
+			switch {
+			case left.Type == "variable" && right.Type == "variable":
+				if left.Value == right.Value {
+					step(i + 1)
+				}
+			case left.Type == "variable":
+				binding[left.Value.(string)] = right
+				step(i + 1)
+				delete(binding, left.Value.(string))
+			case right.Type == "variable":
+				binding[right.Value.(string)] = left
+				step(i + 1)
+				delete(binding, right.Value.(string))
+			case formatTerm(left, true) == formatTerm(right, true):
+				step(i + 1)
+			}
+		case difLiteral:
+			if formatTerm(d.p.e.instantiate(lit.args[0], binding), true) != formatTerm(d.p.e.instantiate(lit.args[1], binding), true) {
+				step(i + 1)
+			}
+		}
+	}
+	step(0)
+}
+
+// match calls next once for each tuple of rel matching args, with the
+// variables of args bound to it.
+func (d *datalogProgram) match(rel *relation, args []Term, binding Substitution, next func()) {
+	if rel == nil {
+		return
+	}
+	values := make([]string, len(args))
+	fixed := make([]bool, len(args))
+	candidates := []int(nil)
+	indexed := false
+	for i, arg := range args {
+		arg = d.p.e.instantiate(arg, binding)
+		if arg.Type == "variable" {
+			continue
+		}
+		values[i], fixed[i] = formatTerm(arg, true), true
+		if !indexed {
+			candidates, indexed = rel.lookup(i, values[i]), true
+		}
+	}
+	if !indexed {
+		candidates = make([]int, len(rel.tuples))
+		for i := range candidates {
+			candidates[i] = i
+		}
+	}
+
+	for _, c := range candidates {
+		var bound []string
+		matched := true
+		for i, arg := range args {
+			switch {
+			case fixed[i]:
+				matched = rel.keys[c][i] == values[i]
+			case binding[arg.Value.(string)].Type != "":
+				matched = formatTerm(binding[arg.Value.(string)], true) == rel.keys[c][i]
+			default:
+				binding[arg.Value.(string)] = rel.tuples[c][i]
+				bound = append(bound, arg.Value.(string))
+			}
+			if !matched {
+				break
+			}
+		}
+		if matched {
+			next()
+		}
+		for _, v := range bound {
+			delete(binding, v)
+		}
+	}
+}
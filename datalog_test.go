@@ -0,0 +1,131 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+const graphSource = `
+edge(a, b). edge(b, c). edge(c, a). edge(c, d). edge(e, f).
+node(a). node(b). node(c). node(d). node(e). node(f).
+path(X, Y) :- path(X, Z), edge(Z, Y).
+path(X, Y) :- edge(X, Y).
+unreachable(X, Y) :- node(X), node(Y), \+ path(X, Y).
+sink(X) :- node(X), \+ edge(X, _).
+`
+
+func solutionValues(result QueryResult, variable string) []string {
+	values := []string{}
+	for _, solution := range result.Solutions {
+		if solution.Success {
+			values = append(values, formatTerm(solution.Bindings[variable], true))
+		}
+	}
+	sort.Strings(values)
+	return values
+}
+
+func TestDatalogQuery(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+	if _, err := engine.Consult(sessionID, graphSource); err != nil {
+		t.Fatalf("Consult failed: %v", err)
+	}
+
+	// path/2 is left-recursive, so only bottom-up evaluation terminates
+	goals, _ := engine.ParseQuery(sessionID, "path(a, Y)")
+	result := engine.Query(Query{Goals: goals, Evaluation: "bottom_up"}, sessionID)
+	if values := solutionValues(result, "Y"); !reflect.DeepEqual(values, []string{"a", "b", "c", "d"}) {
+		t.Fatalf("Expected a to reach a, b, c and d, got %v (%s)", values, result.Error)
+	}
+	goals, _ = engine.ParseQuery(sessionID, "path(X, Y)")
+	result = engine.Query(Query{Goals: goals, Evaluation: "bottom_up"}, sessionID)
+	stats := result.Datalog
+	if len(result.Solutions) != 13 || stats == nil || stats.Facts != 5 || stats.Derived != 13 || !reflect.DeepEqual(stats.Strata, [][]string{{"path/2"}}) {
+		t.Errorf("Expected path/2 derived from the 5 edges, got %+v", stats)
+	}
+
+	// Negation reads the finished path/2 relation in a lower stratum
+	goals, _ = engine.ParseQuery(sessionID, "unreachable(d, Y)")
+	result = engine.Query(Query{Goals: goals, Evaluation: "bottom_up"}, sessionID)
+	if values := solutionValues(result, "Y"); !reflect.DeepEqual(values, []string{"a", "b", "c", "d", "e", "f"}) {
+		t.Errorf("Expected d to reach nothing, got %v (%s)", values, result.Error)
+	}
+	goals, _ = engine.ParseQuery(sessionID, "unreachable(X, Y)")
+	result = engine.Query(Query{Goals: goals, Evaluation: "bottom_up"}, sessionID)
+	if strata := result.Datalog.Strata; !reflect.DeepEqual(strata, [][]string{{"path/2"}, {"unreachable/2"}}) {
+		t.Errorf("Expected path/2 below unreachable/2, got %v", strata)
+	}
+	goals, _ = engine.ParseQuery(sessionID, "sink(X), \\+ unreachable(a, X)")
+	result = engine.Query(Query{Goals: goals, Evaluation: "bottom_up"}, sessionID)
+	if values := solutionValues(result, "X"); !reflect.DeepEqual(values, []string{"d"}) {
+		t.Errorf("Expected the reachable sink d, got %v (%s)", values, result.Error)
+	}
+
+	goals, _ = engine.ParseQuery(sessionID, "path(d, Y)")
+	result = engine.Query(Query{Goals: goals, Evaluation: "bottom_up"}, sessionID)
+	if len(result.Solutions) != 1 || result.Solutions[0].Success || result.Error != "" {
+		t.Errorf("Expected no solutions, got %+v", result)
+	}
+	goals, _ = engine.ParseQuery(sessionID, "edge(a, b)")
+	if result = engine.Query(Query{Goals: goals, Evaluation: "sideways"}, sessionID); result.Error == "" {
+		t.Errorf("Expected an unknown evaluation to be reported")
+	}
+}
+
+func TestDatalogErrors(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+	engine.Consult(sessionID, graphSource+`
+wins(X) :- node(X), \+ wins(X).
+tag(X, name(X)) :- node(X).
+shout(X) :- node(X), write(X).
+loose(X, Y) :- node(X).
+holds(l(1, 2)).
+`)
+
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{"wins(a)", "not stratified: wins/1 depends on the negation of wins/1"},
+		{"tag(a, L)", "not Datalog: the head of tag(X,name(X)):-node(X) has a compound argument"},
+		{"shout(a)", "not Datalog: write(X) is not a Datalog goal in shout(X):-node(X),write(X)"},
+		{"loose(a, b)", "not Datalog: loose(X,Y):-node(X) is unsafe, no positive goal binds Y"},
+		{"holds(H)", "not Datalog: fact holds(l(1,2)) has an argument that is not a constant"},
+		{"node(X), dif(X, Y)", "not Datalog: dif(X,Y) is unsafe in the query"},
+	}
+	for _, test := range tests {
+		goals, _ := engine.ParseQuery(sessionID, test.query)
+		result := engine.Query(Query{Goals: goals, Evaluation: "bottom_up"}, sessionID)
+		if !strings.HasPrefix(result.Error, test.expected) || result.Solutions[0].Success {
+			t.Errorf("Expected %s to fail with %q, got %q", test.query, test.expected, result.Error)
+		}
+	}
+}
+
+func TestDatalogLibrary(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+	engine.Consult(sessionID, graphSource)
+
+	if err := engine.EnableLibrary(sessionID, "datalog"); err != nil {
+		t.Fatalf("EnableLibrary failed: %v", err)
+	}
+	goals, _ := engine.ParseQuery(sessionID, "path(e, Y)")
+	result := engine.Query(Query{Goals: goals}, sessionID)
+	if values := solutionValues(result, "Y"); !reflect.DeepEqual(values, []string{"f"}) || result.Datalog == nil {
+		t.Errorf("Expected the session to evaluate bottom-up, got %+v", result)
+	}
+
+	goals, _ = engine.ParseQuery(sessionID, "edge(e, Y), write(Y)")
+	result = engine.Query(Query{Goals: goals, Evaluation: "top_down"}, sessionID)
+	if len(result.Solutions) != 1 || result.Solutions[0].Output != "f" || result.Datalog != nil {
+		t.Errorf("Expected a top-down query to override the session, got %+v", result)
+	}
+}
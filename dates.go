@@ -0,0 +1,433 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+	_ "time/tzdata"
+)
+
+// dateLayouts are the layouts parse_date/2 tries, in order, when no explicit
+// format is given.
+var dateLayouts = []string{
+	time.RFC3339Nano,
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+	"2006/01/02",
+	"20060102",
+	time.RFC1123Z,
+	time.RFC1123,
+	time.RFC850,
+	time.RFC822Z,
+	time.RFC822,
+	time.ANSIC,
+	"Jan 2, 2006",
+	"January 2, 2006",
+	"2 Jan 2006",
+	"2 January 2006",
+	"Mon, 2 Jan 2006",
+}
+
+// namedDateFormats maps the format atoms accepted by parse_date/3 and
+// format_date/3 to Go layouts.
+var namedDateFormats = map[string]string{
+	"rfc3339":  time.RFC3339,
+	"iso8601":  time.RFC3339,
+	"rfc1123":  time.RFC1123,
+	"rfc822":   time.RFC822,
+	"date":     "2006-01-02",
+	"datetime": "2006-01-02 15:04:05",
+	"time":     "15:04:05",
+	"kitchen":  time.Kitchen,
+}
+
+// strftimeDirectives maps strftime-style directives to Go layout fragments.
+var strftimeDirectives = map[byte]string{
+	'Y': "2006",
+	'y': "06",
+	'm': "01",
+	'd': "02",
+	'e': "_2",
+	'H': "15",
+	'I': "03",
+	'M': "04",
+	'S': "05",
+	'p': "PM",
+	'b': "Jan",
+	'B': "January",
+	'a': "Mon",
+	'A': "Monday",
+	'j': "002",
+	'z': "-0700",
+	'Z': "MST",
+	'%': "%",
+}
+
+// dateLayout converts a format atom into a Go layout. Named formats and
+// strftime directives are translated; anything else is used verbatim.
+func dateLayout(format string) string {
+	if layout, ok := namedDateFormats[format]; ok {
+		return layout
+	}
+	if !strings.Contains(format, "%") {
+		return format
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] == '%' && i+1 < len(format) {
+			if frag, ok := strftimeDirectives[format[i+1]]; ok {
+				b.WriteString(frag)
+				i++
+				continue
+			}
+		}
+		b.WriteByte(format[i])
+	}
+	return b.String()
+}
+
+// dateValue dereferences term and returns its time if it is a date term.
+func (e *Engine) dateValue(term Term, subst Substitution) (time.Time, bool) {
+	term = e.deref(term, subst)
+	if term.Type != "date" {
+		return time.Time{}, false
+	}
+	s, ok := term.Value.(string)
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	return t, err == nil
+}
+
+// numberValue dereferences term and returns its value if it is a number.
+func (e *Engine) numberValue(term Term, subst Substitution) (float64, bool) {
+	term = e.deref(term, subst)
+	if term.Type != "number" {
+		return 0, false
+	}
+	n, ok := term.Value.(float64)
+	return n, ok
+}
+
+// intValue is like numberValue but only accepts integral numbers.
+func (e *Engine) intValue(term Term, subst Substitution) (int, bool) {
+	n, ok := e.numberValue(term, subst)
+	if !ok || n != math.Trunc(n) {
+		return 0, false
+	}
+	return int(n), true
+}
+
+// textValue dereferences term and returns its text if it is an atom or number.
+func (e *Engine) textValue(term Term, subst Substitution) (string, bool) {
+	term = e.deref(term, subst)
+	switch term.Type {
+	case "atom":
+		s, ok := term.Value.(string)
+		return s, ok
+	case "number":
+		return formatNumber(term.Value.(float64)), true
+	}
+	return "", false
+}
+
+func formatNumber(n float64) string {
+	if n == math.Trunc(n) && math.Abs(n) < 1e15 {
+		return fmt.Sprintf("%d", int64(n))
+	}
+	return fmt.Sprintf("%g", n)
+}
+
+func parseDateText(text string) (time.Time, bool) {
+	for _, layout := range dateLayouts {
+		if t, err := time.Parse(layout, text); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// handleParseDate implements parse_date(+Text, -Date) and
+// parse_date(+Text, +Format, -Date). Numbers are read as Unix seconds.
+func (e *Engine) handleParseDate(goal Term, subst Substitution) ([]Substitution, bool) {
+	if len(goal.Args) != 2 && len(goal.Args) != 3 {
+		return []Substitution{}, true
+	}
+
+	if t, ok := e.dateValue(goal.Args[0], subst); ok {
+		return e.unifyResult(goal.Args[len(goal.Args)-1], Date(t), subst)
+	}
+	if secs, ok := e.numberValue(goal.Args[0], subst); ok && len(goal.Args) == 2 {
+		whole, frac := math.Modf(secs)
+		t := time.Unix(int64(whole), int64(frac*1e9)).UTC()
+		return e.unifyResult(goal.Args[1], Date(t), subst)
+	}
+
+	text, ok := e.textValue(goal.Args[0], subst)
+	if !ok {
+		return []Substitution{}, true
+	}
+
+	var t time.Time
+	if len(goal.Args) == 3 {
+		format, ok := e.textValue(goal.Args[1], subst)
+		if !ok {
+			return []Substitution{}, true
+		}
+		parsed, err := time.Parse(dateLayout(format), text)
+		if err != nil {
+			return []Substitution{}, true
+		}
+		t = parsed
+	} else if t, ok = parseDateText(text); !ok {
+		return []Substitution{}, true
+	}
+
+	return e.unifyResult(goal.Args[len(goal.Args)-1], Date(t), subst)
+}
+
+// handleFormatDate implements format_date(+Date, +Format, -Atom).
+func (e *Engine) handleFormatDate(goal Term, subst Substitution) ([]Substitution, bool) {
+	if len(goal.Args) != 3 {
+		return []Substitution{}, true
+	}
+
+	t, ok := e.dateValue(goal.Args[0], subst)
+	if !ok {
+		return []Substitution{}, true
+	}
+	format, ok := e.textValue(goal.Args[1], subst)
+	if !ok {
+		return []Substitution{}, true
+	}
+
+	return e.unifyResult(goal.Args[2], Atom(t.Format(dateLayout(format))), subst)
+}
+
+// handleMakeDate implements make_date(Y, M, D, Date) and
+// make_date(Y, M, D, H, Min, S, Date). When Date is bound it is decomposed
+// into its components instead. Components out of range, such as 30
+// February, fail rather than roll over.
+func (e *Engine) handleMakeDate(goal Term, subst Substitution) ([]Substitution, bool) {
+	if len(goal.Args) != 4 && len(goal.Args) != 7 {
+		return []Substitution{}, true
+	}
+
+	dateArg := goal.Args[len(goal.Args)-1]
+	parts := goal.Args[:len(goal.Args)-1]
+
+	if t, ok := e.dateValue(dateArg, subst); ok {
+		values := []int{t.Year(), int(t.Month()), t.Day(), t.Hour(), t.Minute(), t.Second()}
+		current := subst
+		for i, part := range parts {
+			var ok bool
+			if current, ok = e.unify(part, Number(float64(values[i])), current); !ok {
+				return []Substitution{}, true
+			}
+		}
+		return []Substitution{current}, true
+	}
+
+	values := make([]int, 6)
+	for i, part := range parts {
+		n, ok := e.intValue(part, subst)
+		if !ok {
+			return []Substitution{}, true
+		}
+		values[i] = n
+	}
+
+	t := time.Date(values[0], time.Month(values[1]), values[2], values[3], values[4], values[5], 0, time.UTC)
+	if t.Year() != values[0] || int(t.Month()) != values[1] || t.Day() != values[2] ||
+		t.Hour() != values[3] || t.Minute() != values[4] || t.Second() != values[5] {
+		return []Substitution{}, true
+	}
+	return e.unifyResult(dateArg, Date(t), subst)
+}
+
+// handleDatePart implements date_year/2, date_month/2, date_day/2,
+// date_weekday/2, date_hour/2, date_minute/2 and date_second/2.
+// Weekdays are returned as lowercase atoms (monday ... sunday).
+func (e *Engine) handleDatePart(goal Term, subst Substitution) ([]Substitution, bool) {
+	if len(goal.Args) != 2 {
+		return []Substitution{}, true
+	}
+
+	t, ok := e.dateValue(goal.Args[0], subst)
+	if !ok {
+		return []Substitution{}, true
+	}
+
+	var part Term
+	switch goal.Value {
+	case "date_year":
+		part = Number(float64(t.Year()))
+	case "date_month":
+		part = Number(float64(t.Month()))
+	case "date_day":
+		part = Number(float64(t.Day()))
+	case "date_weekday":
+		part = Atom(strings.ToLower(t.Weekday().String()))
+	case "date_hour":
+		part = Number(float64(t.Hour()))
+	case "date_minute":
+		part = Number(float64(t.Minute()))
+	case "date_second":
+		part = Number(float64(t.Second()))
+	}
+
+	return e.unifyResult(goal.Args[1], part, subst)
+}
+
+// handleDateAdd implements date_add(+Date, +Duration, -Result) and, with a
+// negative sign, date_subtract/3. Durations are written as days(N),
+// weeks(N), months(N), years(N), hours(N), minutes(N), seconds(N) or
+// business_days(N). Calendar units, from days up, take whole numbers only.
+func (e *Engine) handleDateAdd(goal Term, subst Substitution, sign int) ([]Substitution, bool) {
+	if len(goal.Args) != 3 {
+		return []Substitution{}, true
+	}
+
+	t, ok := e.dateValue(goal.Args[0], subst)
+	if !ok {
+		return []Substitution{}, true
+	}
+
+	duration := e.deref(goal.Args[1], subst)
+	if duration.Type != "compound" || len(duration.Args) != 1 {
+		return []Substitution{}, true
+	}
+	amount, ok := e.numberValue(duration.Args[0], subst)
+	if !ok {
+		return []Substitution{}, true
+	}
+	amount *= float64(sign)
+
+	var result time.Time
+	switch duration.Value {
+	case "days", "weeks", "months", "years", "business_days":
+		if amount != math.Trunc(amount) {
+			return []Substitution{}, true
+		}
+	}
+	switch duration.Value {
+	case "seconds":
+		result = t.Add(time.Duration(amount * float64(time.Second)))
+	case "minutes":
+		result = t.Add(time.Duration(amount * float64(time.Minute)))
+	case "hours":
+		result = t.Add(time.Duration(amount * float64(time.Hour)))
+	case "days":
+		result = t.AddDate(0, 0, int(amount))
+	case "weeks":
+		result = t.AddDate(0, 0, 7*int(amount))
+	case "months":
+		result = addMonths(t, int(amount))
+	case "years":
+		result = addMonths(t, 12*int(amount))
+	case "business_days":
+		result = addBusinessDays(t, int(amount))
+	default:
+		return []Substitution{}, true
+	}
+
+	return e.unifyResult(goal.Args[2], Date(result), subst)
+}
+
+// addMonths adds n calendar months, clamping the day to the end of the
+// target month (Jan 31 + 1 month = Feb 28/29).
+func addMonths(t time.Time, n int) time.Time {
+	first := time.Date(t.Year(), t.Month()+time.Month(n), 1, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+	lastDay := first.AddDate(0, 1, -1).Day()
+	day := t.Day()
+	if day > lastDay {
+		day = lastDay
+	}
+	return first.AddDate(0, 0, day-1)
+}
+
+// addBusinessDays moves n weekdays forward (or backward when n < 0),
+// skipping Saturdays and Sundays.
+func addBusinessDays(t time.Time, n int) time.Time {
+	step := 1
+	if n < 0 {
+		step, n = -1, -n
+	}
+	for n > 0 {
+		t = t.AddDate(0, 0, step)
+		if wd := t.Weekday(); wd != time.Saturday && wd != time.Sunday {
+			n--
+		}
+	}
+	return t
+}
+
+// handleDateConvertTZ implements date_convert_tz(+Date, +Zone, -Result),
+// where Zone is an IANA name such as 'Europe/Berlin' or 'UTC'. Result only
+// keeps the zone's offset at Date: later date arithmetic on it stays at that
+// offset and does not follow daylight saving changes.
+func (e *Engine) handleDateConvertTZ(goal Term, subst Substitution) ([]Substitution, bool) {
+	if len(goal.Args) != 3 {
+		return []Substitution{}, true
+	}
+
+	t, ok := e.dateValue(goal.Args[0], subst)
+	if !ok {
+		return []Substitution{}, true
+	}
+	zone, ok := e.textValue(goal.Args[1], subst)
+	if !ok {
+		return []Substitution{}, true
+	}
+	loc, err := time.LoadLocation(zone)
+	if err != nil {
+		return []Substitution{}, true
+	}
+
+	return e.unifyResult(goal.Args[2], Date(t.In(loc)), subst)
+}
+
+// handleDateTruncate implements date_truncate(+Date, +Unit, -Result) for the
+// units hour, day, week (ISO, starting Monday), month and year.
+func (e *Engine) handleDateTruncate(goal Term, subst Substitution) ([]Substitution, bool) {
+	if len(goal.Args) != 3 {
+		return []Substitution{}, true
+	}
+
+	t, ok := e.dateValue(goal.Args[0], subst)
+	if !ok {
+		return []Substitution{}, true
+	}
+	unit, ok := e.textValue(goal.Args[1], subst)
+	if !ok {
+		return []Substitution{}, true
+	}
+
+	y, m, d := t.Date()
+	loc := t.Location()
+	var result time.Time
+	switch unit {
+	case "hour":
+		result = time.Date(y, m, d, t.Hour(), 0, 0, 0, loc)
+	case "day":
+		result = time.Date(y, m, d, 0, 0, 0, 0, loc)
+	case "week":
+		offset := (int(t.Weekday()) + 6) % 7
+		result = time.Date(y, m, d-offset, 0, 0, 0, 0, loc)
+	case "month":
+		result = time.Date(y, m, 1, 0, 0, 0, 0, loc)
+	case "year":
+		result = time.Date(y, time.January, 1, 0, 0, 0, 0, loc)
+	default:
+		return []Substitution{}, true
+	}
+
+	return e.unifyResult(goal.Args[2], Date(result), subst)
+}
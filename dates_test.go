@@ -0,0 +1,265 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBuiltinParseDate(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+
+	subst := make(Substitution)
+
+	inputs := map[string]string{
+		"2024-03-15":                "2024-03-15T00:00:00Z",
+		"2024-03-15 09:30":          "2024-03-15T09:30:00Z",
+		"2024-03-15T09:30:00+02:00": "2024-03-15T09:30:00+02:00",
+		"March 15, 2024":            "2024-03-15T00:00:00Z",
+	}
+
+	for input, expected := range inputs {
+		goal := Compound("parse_date", []Term{Atom(input), Variable("D")})
+		solutions, handled := engine.evalBuiltin(goal, subst, sessionID)
+
+		if !handled {
+			t.Fatal("Expected parse_date predicate to be handled")
+		}
+		if len(solutions) != 1 {
+			t.Errorf("Expected 1 solution for parse_date(%s), got %d", input, len(solutions))
+			continue
+		}
+		if solutions[0]["D"].Type != "date" || solutions[0]["D"].Value != expected {
+			t.Errorf("Expected %s for '%s', got %v", expected, input, solutions[0]["D"])
+		}
+	}
+
+	// Explicit strftime-style format
+	goal := Compound("parse_date", []Term{Atom("15/03/2024"), Atom("%d/%m/%Y"), Variable("D")})
+	solutions, _ := engine.evalBuiltin(goal, subst, sessionID)
+	if len(solutions) != 1 || solutions[0]["D"].Value != "2024-03-15T00:00:00Z" {
+		t.Errorf("Expected parse with explicit format to succeed, got %v", solutions)
+	}
+
+	// Unparseable text fails
+	goal = Compound("parse_date", []Term{Atom("not a date"), Variable("D")})
+	solutions, _ = engine.evalBuiltin(goal, subst, sessionID)
+	if len(solutions) != 0 {
+		t.Errorf("Expected 0 solutions for invalid date, got %d", len(solutions))
+	}
+}
+
+func TestBuiltinFormatDate(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+
+	subst := make(Substitution)
+	date := Date(time.Date(2024, 3, 5, 14, 7, 0, 0, time.UTC))
+
+	formats := map[string]string{
+		"%Y-%m-%d":   "2024-03-05",
+		"%d %B %Y":   "05 March 2024",
+		"%A %H:%M":   "Tuesday 14:07",
+		"date":       "2024-03-05",
+		"2006/01/02": "2024/03/05",
+	}
+
+	for format, expected := range formats {
+		goal := Compound("format_date", []Term{date, Atom(format), Variable("S")})
+		solutions, handled := engine.evalBuiltin(goal, subst, sessionID)
+
+		if !handled {
+			t.Fatal("Expected format_date predicate to be handled")
+		}
+		if len(solutions) != 1 || solutions[0]["S"].Value != expected {
+			t.Errorf("Expected '%s' for format '%s', got %v", expected, format, solutions)
+		}
+	}
+}
+
+func TestBuiltinMakeDateAndParts(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+
+	subst := make(Substitution)
+
+	// Build from components
+	goal := Compound("make_date", []Term{Number(2024), Number(2), Number(29), Variable("D")})
+	solutions, handled := engine.evalBuiltin(goal, subst, sessionID)
+	if !handled {
+		t.Fatal("Expected make_date predicate to be handled")
+	}
+	if len(solutions) != 1 || solutions[0]["D"].Value != "2024-02-29T00:00:00Z" {
+		t.Fatalf("Expected 2024-02-29, got %v", solutions)
+	}
+	date := solutions[0]["D"]
+
+	// Out-of-range components do not roll over into the next month or day
+	for _, args := range [][]Term{
+		{Number(2024), Number(2), Number(30), Variable("D")},
+		{Number(2023), Number(2), Number(29), Variable("D")},
+		{Number(2024), Number(13), Number(1), Variable("D")},
+		{Number(2024), Number(1), Number(1), Number(24), Number(0), Number(0), Variable("D")},
+	} {
+		if solutions, _ = engine.evalBuiltin(Compound("make_date", args), subst, sessionID); len(solutions) != 0 {
+			t.Errorf("Expected make_date%v to fail, got %v", args, solutions)
+		}
+	}
+
+	// Decompose a bound date
+	goal = Compound("make_date", []Term{Variable("Y"), Variable("M"), Variable("Day"), date})
+	solutions, _ = engine.evalBuiltin(goal, subst, sessionID)
+	if len(solutions) != 1 {
+		t.Fatalf("Expected 1 solution decomposing date, got %d", len(solutions))
+	}
+	if solutions[0]["Y"].Value != 2024.0 || solutions[0]["M"].Value != 2.0 || solutions[0]["Day"].Value != 29.0 {
+		t.Errorf("Unexpected components: %v", solutions[0])
+	}
+
+	parts := map[string]Term{
+		"date_year":    Number(2024),
+		"date_month":   Number(2),
+		"date_day":     Number(29),
+		"date_weekday": Atom("thursday"),
+		"date_hour":    Number(0),
+	}
+	for name, expected := range parts {
+		goal = Compound(name, []Term{date, Variable("P")})
+		solutions, handled = engine.evalBuiltin(goal, subst, sessionID)
+		if !handled {
+			t.Fatalf("Expected %s predicate to be handled", name)
+		}
+		if len(solutions) != 1 || solutions[0]["P"].Value != expected.Value {
+			t.Errorf("Expected %s to give %v, got %v", name, expected.Value, solutions)
+		}
+	}
+}
+
+func TestBuiltinDateAdd(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+
+	subst := make(Substitution)
+	// Friday 31 January 2025
+	date := Date(time.Date(2025, 1, 31, 9, 0, 0, 0, time.UTC))
+
+	cases := []struct {
+		duration Term
+		expected string
+	}{
+		{Compound("days", []Term{Number(2)}), "2025-02-02T09:00:00Z"},
+		{Compound("weeks", []Term{Number(1)}), "2025-02-07T09:00:00Z"},
+		{Compound("months", []Term{Number(1)}), "2025-02-28T09:00:00Z"},
+		{Compound("years", []Term{Number(1)}), "2026-01-31T09:00:00Z"},
+		{Compound("hours", []Term{Number(36)}), "2025-02-01T21:00:00Z"},
+		{Compound("business_days", []Term{Number(1)}), "2025-02-03T09:00:00Z"},
+		{Compound("business_days", []Term{Number(-5)}), "2025-01-24T09:00:00Z"},
+	}
+
+	for _, c := range cases {
+		goal := Compound("date_add", []Term{date, c.duration, Variable("R")})
+		solutions, handled := engine.evalBuiltin(goal, subst, sessionID)
+		if !handled {
+			t.Fatal("Expected date_add predicate to be handled")
+		}
+		if len(solutions) != 1 || solutions[0]["R"].Value != c.expected {
+			t.Errorf("date_add(%v): expected %s, got %v", c.duration, c.expected, solutions)
+		}
+	}
+
+	// date_subtract is the inverse of date_add
+	goal := Compound("date_subtract", []Term{date, Compound("days", []Term{Number(31)}), Variable("R")})
+	solutions, _ := engine.evalBuiltin(goal, subst, sessionID)
+	if len(solutions) != 1 || solutions[0]["R"].Value != "2024-12-31T09:00:00Z" {
+		t.Errorf("Expected 2024-12-31T09:00:00Z, got %v", solutions)
+	}
+
+	// Calendar units are not split into fractions
+	for _, unit := range []string{"days", "weeks", "months", "years", "business_days"} {
+		goal = Compound("date_add", []Term{date, Compound(unit, []Term{Number(1.5)}), Variable("R")})
+		if solutions, _ = engine.evalBuiltin(goal, subst, sessionID); len(solutions) != 0 {
+			t.Errorf("Expected date_add with %s(1.5) to fail, got %v", unit, solutions)
+		}
+	}
+
+	// Unknown duration unit fails
+	goal = Compound("date_add", []Term{date, Compound("fortnights", []Term{Number(1)}), Variable("R")})
+	solutions, _ = engine.evalBuiltin(goal, subst, sessionID)
+	if len(solutions) != 0 {
+		t.Errorf("Expected 0 solutions for unknown duration unit, got %d", len(solutions))
+	}
+}
+
+func TestBuiltinDateConvertTZ(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+
+	subst := make(Substitution)
+	date := Date(time.Date(2024, 7, 1, 12, 0, 0, 0, time.UTC))
+
+	goal := Compound("date_convert_tz", []Term{date, Atom("Europe/Berlin"), Variable("R")})
+	solutions, handled := engine.evalBuiltin(goal, subst, sessionID)
+	if !handled {
+		t.Fatal("Expected date_convert_tz predicate to be handled")
+	}
+	if len(solutions) != 1 || solutions[0]["R"].Value != "2024-07-01T14:00:00+02:00" {
+		t.Errorf("Expected 2024-07-01T14:00:00+02:00, got %v", solutions)
+	}
+
+	// The converted date still compares equal in time to the original
+	goal = Compound("days_between", []Term{date, solutions[0]["R"], Variable("N")})
+	solutions, _ = engine.evalBuiltin(goal, subst, sessionID)
+	if len(solutions) != 1 || solutions[0]["N"].Value != 0.0 {
+		t.Errorf("Expected converted date to be the same instant, got %v", solutions)
+	}
+
+	// Only the offset is kept, so arithmetic across a daylight saving change
+	// stays at summer time
+	goal = Compound("date_convert_tz", []Term{date, Atom("Europe/Berlin"), Variable("R")})
+	solutions, _ = engine.evalBuiltin(goal, subst, sessionID)
+	goal = Compound("date_add", []Term{solutions[0]["R"], Compound("months", []Term{Number(6)}), Variable("W")})
+	solutions, _ = engine.evalBuiltin(goal, subst, sessionID)
+	if len(solutions) != 1 || solutions[0]["W"].Value != "2025-01-01T14:00:00+02:00" {
+		t.Errorf("Expected 2025-01-01T14:00:00+02:00, got %v", solutions)
+	}
+
+	goal = Compound("date_convert_tz", []Term{date, Atom("Not/AZone"), Variable("R")})
+	solutions, _ = engine.evalBuiltin(goal, subst, sessionID)
+	if len(solutions) != 0 {
+		t.Errorf("Expected 0 solutions for unknown zone, got %d", len(solutions))
+	}
+}
+
+func TestBuiltinDateTruncate(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+
+	subst := make(Substitution)
+	// Thursday 14 March 2024
+	date := Date(time.Date(2024, 3, 14, 16, 45, 10, 0, time.UTC))
+
+	units := map[string]string{
+		"hour":  "2024-03-14T16:00:00Z",
+		"day":   "2024-03-14T00:00:00Z",
+		"week":  "2024-03-11T00:00:00Z",
+		"month": "2024-03-01T00:00:00Z",
+		"year":  "2024-01-01T00:00:00Z",
+	}
+
+	for unit, expected := range units {
+		goal := Compound("date_truncate", []Term{date, Atom(unit), Variable("R")})
+		solutions, handled := engine.evalBuiltin(goal, subst, sessionID)
+		if !handled {
+			t.Fatal("Expected date_truncate predicate to be handled")
+		}
+		if len(solutions) != 1 || solutions[0]["R"].Value != expected {
+			t.Errorf("Expected %s truncating to %s, got %v", expected, unit, solutions)
+		}
+	}
+}
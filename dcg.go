@@ -0,0 +1,179 @@
+package main
+
+import "fmt"
+
+// dcgTranslator turns grammar rules into ordinary clauses threading the
+// input through a pair of difference-list variables.
+type dcgTranslator struct {
+	e      *Engine
+	prefix string
+	count  int
+}
+
+func (e *Engine) newDCGTranslator() *dcgTranslator {
+	return &dcgTranslator{e: e, prefix: fmt.Sprintf("_S%d_", nextVarID())}
+}
+
+func (t *dcgTranslator) fresh() Term {
+	t.count++
+	return Variable(fmt.Sprintf("%s%d", t.prefix, t.count))
+}
+
+// nonTerminal appends the two list arguments to a non-terminal.
+func (t *dcgTranslator) nonTerminal(nt, s0, s Term) (Term, bool) {
+	return t.e.callGoal(nt, []Term{s0, s}, Substitution{})
+}
+
+// translateRule translates Head --> Body, where Head may carry pushback as
+// NT, Pushback.
+func (t *dcgTranslator) translateRule(head, body Term) (Rule, error) {
+	s0, s := t.fresh(), t.fresh()
+
+	var pushback Term
+	if head.Type == "compound" && head.Value == "," && len(head.Args) == 2 {
+		head, pushback = head.Args[0], head.Args[1]
+		if _, ok := t.e.listElements(pushback, Substitution{}); !ok {
+			return Rule{}, fmt.Errorf("pushback must be a list")
+		}
+	}
+	if head.Type != "atom" && head.Type != "compound" {
+		return Rule{}, fmt.Errorf("invalid grammar rule head")
+	}
+
+	newHead, _ := t.nonTerminal(head, s0, s)
+	if pushback.Type == "" {
+		goal, err := t.body(body, s0, s)
+		if err != nil {
+			return Rule{}, err
+		}
+		return Rule{Head: newHead, Body: flattenConjunction(goal)}, nil
+	}
+
+	// The pushback list is put back in front of the remaining input
+	mid := t.fresh()
+	goal, err := t.body(body, s0, mid)
+	if err != nil {
+		return Rule{}, err
+	}
+	items, _ := t.e.listElements(pushback, Substitution{})
+	pushed := Compound("=", []Term{s, ListWithTail(items, mid)})
+	return Rule{Head: newHead, Body: append(flattenConjunction(goal), pushed)}, nil
+}
+
+// body translates a grammar body consuming the input from s0 to s.
+func (t *dcgTranslator) body(b, s0, s Term) (Term, error) {
+	unify := func() Term { return Compound("=", []Term{s0, s}) }
+
+	switch b.Type {
+	case "variable":
+		return Compound("phrase", []Term{b, s0, s}), nil
+	case "list":
+		items, ok := t.e.listElements(b, Substitution{})
+		if !ok {
+			return Term{}, fmt.Errorf("terminal list must be a proper list")
+		}
+		return Compound("=", []Term{s0, ListWithTail(items, s)}), nil
+	case "atom":
+		switch b.Value {
+		case "[]":
+			return unify(), nil
+		case "!":
+			// The engine has no cut; a cut consumes nothing
+			return unify(), nil
+		}
+	case "compound":
+		switch {
+		case b.Value == "," && len(b.Args) == 2:
+			mid := t.fresh()
+			left, err := t.body(b.Args[0], s0, mid)
+			if err != nil {
+				return Term{}, err
+			}
+			right, err := t.body(b.Args[1], mid, s)
+			if err != nil {
+				return Term{}, err
+			}
+			return Compound(",", []Term{left, right}), nil
+		case (b.Value == ";" || b.Value == "|") && len(b.Args) == 2:
+			left, err := t.body(b.Args[0], s0, s)
+			if err != nil {
+				return Term{}, err
+			}
+			right, err := t.body(b.Args[1], s0, s)
+			if err != nil {
+				return Term{}, err
+			}
+			return Compound(";", []Term{left, right}), nil
+		case b.Value == "->" && len(b.Args) == 2:
+			mid := t.fresh()
+			cond, err := t.body(b.Args[0], s0, mid)
+			if err != nil {
+				return Term{}, err
+			}
+			then, err := t.body(b.Args[1], mid, s)
+			if err != nil {
+				return Term{}, err
+			}
+			return Compound("->", []Term{cond, then}), nil
+		case b.Value == "\\+" && len(b.Args) == 1:
+			inner, err := t.body(b.Args[0], s0, t.fresh())
+			if err != nil {
+				return Term{}, err
+			}
+			return Compound(",", []Term{Compound("\\+", []Term{inner}), unify()}), nil
+		case b.Value == "{}" && len(b.Args) == 1:
+			return Compound(",", []Term{b.Args[0], unify()}), nil
+		case b.Value == ":" && len(b.Args) == 2:
+			inner, err := t.body(b.Args[1], s0, s)
+			if err != nil {
+				return Term{}, err
+			}
+			return Compound(":", []Term{b.Args[0], inner}), nil
+		case b.Value == "call" && len(b.Args) >= 1:
+			return Compound("call", append(append([]Term{}, b.Args...), s0, s)), nil
+		}
+	}
+
+	goal, ok := t.nonTerminal(b, s0, s)
+	if !ok {
+		return Term{}, fmt.Errorf("invalid grammar body %s", formatTerm(b, true))
+	}
+	return goal, nil
+}
+
+// flattenConjunction splits a ','/2 term into its goals.
+func flattenConjunction(goal Term) []Term {
+	if goal.Type == "compound" && goal.Value == "," && len(goal.Args) == 2 {
+		return append(flattenConjunction(goal.Args[0]), flattenConjunction(goal.Args[1])...)
+	}
+	return []Term{goal}
+}
+
+// isGrammarRule reports whether a rule was submitted as Head --> Body,
+// possibly module-qualified.
+func isGrammarRule(rule Rule) bool {
+	_, head := splitModule(rule.Head)
+	return head.Type == "compound" && head.Value == "-->" && len(head.Args) == 2 && len(rule.Body) == 0
+}
+
+// handlePhrase implements phrase/2 and phrase/3.
+func (e *Engine) handlePhrase(goal Term, subst Substitution, sessionID string) ([]Substitution, bool) {
+	args := goal.Args
+	if len(args) != 2 && len(args) != 3 {
+		return []Substitution{}, true
+	}
+	rest := Term(List(nil))
+	if len(args) == 3 {
+		rest = args[2]
+	}
+	// An unbound body would translate back into this very call
+	grammar := e.instantiate(args[0], subst)
+	if grammar.Type == "variable" {
+		return []Substitution{}, true
+	}
+	body, err := e.newDCGTranslator().body(grammar, args[1], rest)
+	if err != nil {
+		return []Substitution{}, true
+	}
+	return e.solve([]Term{body}, subst, sessionID), true
+}
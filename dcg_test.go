@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func atoms(names ...string) Term {
+	items := make([]Term, len(names))
+	for i, n := range names {
+		items[i] = Atom(n)
+	}
+	return List(items)
+}
+
+const commandGrammar = `
+% A tiny command language: "move north 3", "stop"
+command(move(D, N)) --> [move], direction(D), steps(N).
+command(stop) --> [stop].
+
+direction(D) --> [D], { dir(D) }.
+
+steps(N) --> [N], { number(N) }.
+steps(1) --> [].
+
+dir(north).
+dir(south).
+
+% Pushback: peek at the next token without consuming it
+peek(T), [T] --> [T].
+
+greeting --> ([hello] ; [hi]), \+ [bye].
+`
+
+func TestConsultGrammar(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+
+	result, err := engine.Consult(sessionID, commandGrammar)
+	if err != nil {
+		t.Fatalf("Consult failed: %v", err)
+	}
+	if result.Clauses != 9 {
+		t.Errorf("Expected 9 clauses, got %d", result.Clauses)
+	}
+
+	tokens := List([]Term{Atom("move"), Atom("north"), Number(3)})
+	solutions := queryAll(engine, sessionID, Compound("phrase", []Term{Compound("command", []Term{Variable("C")}), tokens}))
+	if len(solutions) != 1 || formatTerm(solutions[0].Bindings["C"], true) != "move(north,3)" {
+		t.Errorf("Expected C = move(north,3), got %v", solutions)
+	}
+
+	// The optional step count defaults to 1
+	solutions = queryAll(engine, sessionID, Compound("phrase", []Term{Compound("command", []Term{Variable("C")}), atoms("move", "south")}))
+	if len(solutions) != 1 || formatTerm(solutions[0].Bindings["C"], true) != "move(south,1)" {
+		t.Errorf("Expected C = move(south,1), got %v", solutions)
+	}
+
+	if len(queryAll(engine, sessionID, Compound("phrase", []Term{Compound("command", []Term{Variable("C")}), atoms("move", "west")}))) != 0 {
+		t.Error("Expected an unknown direction not to parse")
+	}
+
+	// phrase/3 returns the unconsumed rest
+	solutions = queryAll(engine, sessionID, Compound("phrase", []Term{Compound("command", []Term{Variable("C")}), atoms("stop", "now"), Variable("Rest")}))
+	if len(solutions) != 1 || formatTerm(solutions[0].Bindings["Rest"], true) != "[now]" {
+		t.Errorf("Expected Rest = [now], got %v", solutions)
+	}
+
+	// Pushback leaves the peeked token in the input
+	solutions = queryAll(engine, sessionID, Compound("phrase", []Term{Compound("peek", []Term{Variable("T")}), atoms("a", "b"), Variable("Rest")}))
+	if len(solutions) != 1 || solutions[0].Bindings["T"].Value != "a" || formatTerm(solutions[0].Bindings["Rest"], true) != "[a,b]" {
+		t.Errorf("Expected T = a with the input untouched, got %v", solutions)
+	}
+
+	// Disjunction and negation in bodies
+	if len(queryAll(engine, sessionID, Compound("phrase", []Term{Atom("greeting"), atoms("hi")}))) != 1 {
+		t.Error("Expected [hi] to be a greeting")
+	}
+
+	// Bodies can be passed to phrase/2 directly
+	if len(queryAll(engine, sessionID, Compound("phrase", []Term{Compound(",", []Term{atoms("stop"), List(nil)}), atoms("stop")}))) != 1 {
+		t.Error("Expected phrase/2 to accept a grammar body")
+	}
+
+	// An unbound grammar body fails instead of recursing forever
+	if len(queryAll(engine, sessionID, Compound("phrase", []Term{Variable("G"), atoms("a")}))) != 0 {
+		t.Error("Expected phrase/2 with an unbound body to fail")
+	}
+	if len(queryAll(engine, sessionID, Compound("phrase", []Term{Compound(",", []Term{Variable("G"), atoms("a")}), atoms("a")}))) != 0 {
+		t.Error("Expected an unbound body inside a conjunction to fail")
+	}
+}
+
+func TestConsultGrammarStrings(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+
+	source := "greeting --> \"hi\", name.\nname --> [bob].\nabc --> \"abc\".\nquiet --> \"\", { X = \"hi\", atom(X) }.\n"
+	if _, err := engine.Consult(sessionID, source); err != nil {
+		t.Fatalf("Consult failed: %v", err)
+	}
+
+	// Double-quoted text in a body is a list of terminals
+	if len(queryAll(engine, sessionID, Compound("phrase", []Term{Atom("greeting"), atoms("h", "i", "bob")}))) != 1 {
+		t.Error("Expected [h,i,bob] to be a greeting")
+	}
+	solutions := queryAll(engine, sessionID, Compound("phrase", []Term{Atom("abc"), Variable("L")}))
+	if len(solutions) != 1 || formatTerm(solutions[0].Bindings["L"], true) != "[a,b,c]" {
+		t.Errorf("Expected L = [a,b,c], got %v", solutions)
+	}
+
+	// Inside {}/1 it stays an atom
+	if len(queryAll(engine, sessionID, Compound("phrase", []Term{Atom("quiet"), List(nil)}))) != 1 {
+		t.Error("Expected the empty string to consume nothing and {} goals to see an atom")
+	}
+}
+
+func TestGrammarRuleThroughRulesAPI(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+
+	// digits --> [D], { number(D) }, digits.  digits --> [].
+	rules := []Rule{
+		{Head: Compound("-->", []Term{Atom("digits"), Compound(",", []Term{
+			List([]Term{Variable("D")}),
+			Compound(",", []Term{Compound("{}", []Term{Compound("number", []Term{Variable("D")})}), Atom("digits")}),
+		})})},
+		{Head: Compound("-->", []Term{Atom("digits"), List(nil)})},
+	}
+	for _, r := range rules {
+		r.SessionID = sessionID
+		r.Body = []Term{}
+		if err := engine.AddRule(r); err != nil {
+			t.Fatalf("Failed to add grammar rule: %v", err)
+		}
+	}
+
+	if len(queryAll(engine, sessionID, Compound("phrase", []Term{Atom("digits"), nums(1, 2, 3)}))) != 1 {
+		t.Error("Expected [1,2,3] to parse as digits")
+	}
+	if len(queryAll(engine, sessionID, Compound("phrase", []Term{Atom("digits"), List([]Term{Number(1), Atom("x")})}))) != 0 {
+		t.Error("Expected [1,x] not to parse as digits")
+	}
+
+	// The stored clause is the translated one
+	solutions := queryAll(engine, sessionID, Compound("current_predicate", []Term{Compound("/", []Term{Atom("digits"), Variable("A")})}))
+	if len(solutions) != 1 || solutions[0].Bindings["A"].Value != 2.0 {
+		t.Errorf("Expected digits/2, got %v", solutions)
+	}
+}
+
+func TestConsultHandler(t *testing.T) {
+	router, engine := setupTestRouter(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+
+	body, _ := json.Marshal(ConsultRequest{Text: "likes(ann, tea).\nlikes(bob, X) :- likes(ann, X).\n:- writeln(loaded).\n"})
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/sessions/"+sessionID+"/consult", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var result ConsultResult
+	json.Unmarshal(w.Body.Bytes(), &result)
+	if result.Clauses != 2 || result.Directives != 1 {
+		t.Errorf("Expected 2 clauses and 1 directive, got %+v", result)
+	}
+
+	solutions := queryAll(engine, sessionID, Compound("likes", []Term{Atom("bob"), Variable("X")}))
+	if len(solutions) != 1 || solutions[0].Bindings["X"].Value != "tea" {
+		t.Errorf("Expected bob to like tea, got %v", solutions)
+	}
+
+	body, _ = json.Marshal(ConsultRequest{Text: "broken(."})
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/api/v1/sessions/"+sessionID+"/consult", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for a syntax error, got %d", http.StatusBadRequest, w.Code)
+	}
+}
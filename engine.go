@@ -5,7 +5,11 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"os"
 	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/oklog/ulid/v2"
@@ -13,8 +17,23 @@ import (
 )
 
 type Engine struct {
-	db    *sql.DB
-	cache map[TableKey]TableEntry
+	db     *sql.DB
+	apiKey string // server-wide API key, opening every session
+
+	mu           sync.Mutex
+	generations  map[string]int // bumped whenever a session's derived state is dropped
+	cache        map[TableKey]TableEntry
+	libraries    map[string]map[string]bool
+	parents      map[string][]string
+	operators    map[string]*opTable
+	modules      map[string]*moduleIndex
+	eventIndexes map[string]*eventIndex
+	spypoints    map[string]map[string]bool
+	profiles     map[string]*Profile // the last profiled query of each session
+	materialized map[string]map[string]Term
+	views        map[string]*materializedView
+	viewLocks    map[string]*sync.Mutex
+	expansions   map[string]expansionHooks
 }
 
 func NewEngine(dbPath string) (*Engine, error) {
@@ -28,6 +47,7 @@ func NewEngine(dbPath string) (*Engine, error) {
 		id TEXT PRIMARY KEY,
 		name TEXT NOT NULL UNIQUE,
 		description TEXT,
+		api_key_hash TEXT NOT NULL DEFAULT '',
 		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
 		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
 	);
@@ -37,6 +57,7 @@ func NewEngine(dbPath string) (*Engine, error) {
 		session_id TEXT NOT NULL,
 		predicate TEXT NOT NULL,
 		data TEXT NOT NULL,
+		module TEXT NOT NULL DEFAULT 'user',
 		FOREIGN KEY (session_id) REFERENCES sessions (id) ON DELETE CASCADE
 	);
 	
@@ -46,6 +67,79 @@ func NewEngine(dbPath string) (*Engine, error) {
 		head_predicate TEXT NOT NULL,
 		head_data TEXT NOT NULL,
 		body_data TEXT NOT NULL,
+		module TEXT NOT NULL DEFAULT 'user',
+		FOREIGN KEY (session_id) REFERENCES sessions (id) ON DELETE CASCADE
+	);
+	
+	CREATE TABLE IF NOT EXISTS session_libraries (
+		session_id TEXT NOT NULL,
+		library TEXT NOT NULL,
+		PRIMARY KEY (session_id, library),
+		FOREIGN KEY (session_id) REFERENCES sessions (id) ON DELETE CASCADE
+	);
+	
+	CREATE TABLE IF NOT EXISTS session_modules (
+		session_id TEXT NOT NULL,
+		module TEXT NOT NULL,
+		exports TEXT NOT NULL,
+		PRIMARY KEY (session_id, module),
+		FOREIGN KEY (session_id) REFERENCES sessions (id) ON DELETE CASCADE
+	);
+	
+	CREATE TABLE IF NOT EXISTS session_imports (
+		session_id TEXT NOT NULL,
+		importer TEXT NOT NULL,
+		module TEXT NOT NULL,
+		predicates TEXT NOT NULL,
+		PRIMARY KEY (session_id, importer, module),
+		FOREIGN KEY (session_id) REFERENCES sessions (id) ON DELETE CASCADE
+	);
+	
+	CREATE TABLE IF NOT EXISTS session_parents (
+		session_id TEXT NOT NULL,
+		parent_id TEXT NOT NULL,
+		PRIMARY KEY (session_id, parent_id),
+		FOREIGN KEY (session_id) REFERENCES sessions (id) ON DELETE CASCADE,
+		FOREIGN KEY (parent_id) REFERENCES sessions (id) ON DELETE CASCADE
+	);
+	
+	CREATE TABLE IF NOT EXISTS session_multifile (
+		session_id TEXT NOT NULL,
+		predicate TEXT NOT NULL,
+		PRIMARY KEY (session_id, predicate),
+		FOREIGN KEY (session_id) REFERENCES sessions (id) ON DELETE CASCADE
+	);
+	
+	CREATE TABLE IF NOT EXISTS session_spypoints (
+		session_id TEXT NOT NULL,
+		predicate TEXT NOT NULL,
+		PRIMARY KEY (session_id, predicate),
+		FOREIGN KEY (session_id) REFERENCES sessions (id) ON DELETE CASCADE
+	);
+	
+	CREATE TABLE IF NOT EXISTS session_materialized (
+		session_id TEXT NOT NULL,
+		module TEXT NOT NULL,
+		predicate TEXT NOT NULL,
+		PRIMARY KEY (session_id, module, predicate),
+		FOREIGN KEY (session_id) REFERENCES sessions (id) ON DELETE CASCADE
+	);
+	
+	CREATE TABLE IF NOT EXISTS materialized_facts (
+		session_id TEXT NOT NULL,
+		predicate TEXT NOT NULL,
+		data TEXT NOT NULL,
+		PRIMARY KEY (session_id, predicate, data),
+		FOREIGN KEY (session_id) REFERENCES sessions (id) ON DELETE CASCADE
+	);
+	
+	CREATE TABLE IF NOT EXISTS session_operators (
+		session_id TEXT NOT NULL,
+		name TEXT NOT NULL,
+		class TEXT NOT NULL,
+		type TEXT NOT NULL,
+		priority INTEGER NOT NULL,
+		PRIMARY KEY (session_id, name, class),
 		FOREIGN KEY (session_id) REFERENCES sessions (id) ON DELETE CASCADE
 	);
 	
@@ -58,13 +152,56 @@ func NewEngine(dbPath string) (*Engine, error) {
 	if _, err = db.Exec(createSchema); err != nil {
 		return nil, err
 	}
+	if err = migrateModules(db); err != nil {
+		return nil, err
+	}
+	if err = ensureColumn(db, "sessions", "api_key_hash", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return nil, err
+	}
 
 	return &Engine{
-		db:    db,
-		cache: make(map[TableKey]TableEntry),
+		db:           db,
+		apiKey:       os.Getenv("API_KEY"),
+		generations:  make(map[string]int),
+		cache:        make(map[TableKey]TableEntry),
+		libraries:    make(map[string]map[string]bool),
+		parents:      make(map[string][]string),
+		operators:    make(map[string]*opTable),
+		modules:      make(map[string]*moduleIndex),
+		eventIndexes: make(map[string]*eventIndex),
+		spypoints:    make(map[string]map[string]bool),
+		profiles:     make(map[string]*Profile),
+		materialized: make(map[string]map[string]Term),
+		views:        make(map[string]*materializedView),
+		viewLocks:    make(map[string]*sync.Mutex),
+		expansions:   make(map[string]expansionHooks),
 	}, nil
 }
 
+// ensureColumn adds a column to a table created by an earlier version of
+// the schema.
+func ensureColumn(db *sql.DB, table, column, definition string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	found := false
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, kind string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &kind, &notNull, &dflt, &pk); err == nil && strings.EqualFold(name, column) {
+			found = true
+		}
+	}
+	rows.Close()
+	if found {
+		return nil
+	}
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
 func (e *Engine) unify(t1, t2 Term, subst Substitution) (Substitution, bool) {
 	t1 = e.deref(t1, subst)
 	t2 = e.deref(t2, subst)
@@ -80,7 +217,12 @@ func (e *Engine) unify(t1, t2 Term, subst Substitution) (Substitution, bool) {
 		return e.bind(t2.Value.(string), t1, subst)
 	}
 
-	if t1.Type == "compound" && t2.Type == "compound" {
+	if t1.Type == "list" || t2.Type == "list" {
+		return e.unifyLists(t1, t2, subst)
+	}
+
+	// Interval terms unify as the interval/2 compounds they stand for
+	if t1, t2 = asCompound(t1), asCompound(t2); t1.Type == "compound" && t2.Type == "compound" {
 		if t1.Value != t2.Value || len(t1.Args) != len(t2.Args) {
 			return subst, false
 		}
@@ -115,6 +257,7 @@ func (e *Engine) bind(varName string, term Term, subst Substitution) (Substituti
 		newSubst[k] = v
 	}
 	newSubst[varName] = term
+	e.queueWakeups(varName, newSubst)
 	return newSubst, true
 }
 
@@ -125,7 +268,7 @@ func (e *Engine) occursCheck(varName string, term Term, subst Substitution) bool
 		return true
 	}
 
-	if term.Type == "compound" {
+	if len(term.Args) > 0 {
 		for _, arg := range term.Args {
 			if e.occursCheck(varName, arg, subst) {
 				return true
@@ -137,11 +280,70 @@ func (e *Engine) occursCheck(varName string, term Term, subst Substitution) bool
 }
 
 func (e *Engine) evalBuiltin(goal Term, subst Substitution, sessionID string) ([]Substitution, bool) {
+	if e.userDefined(goal, sessionID) {
+		return nil, false
+	}
+	if contextOf(subst).readOnly && changesSession(goal) {
+		return []Substitution{}, true
+	}
+	if goal.Type == "atom" {
+		switch goal.Value {
+		case "true":
+			return []Substitution{subst}, true
+		case "fail", "false":
+			return []Substitution{}, true
+		case "listing":
+			return e.handleReflection(goal, subst, sessionID)
+		case "nl":
+			return e.handleOutput(goal, subst, sessionID)
+		case "trace", "notrace":
+			return e.handleTracing(goal, subst, sessionID)
+		}
+		return nil, false
+	}
 	if goal.Type != "compound" {
 		return nil, false
 	}
 
 	switch goal.Value {
+	case ",", ";", "->", "\\+", "call", "once", "ignore", "forall", "findall":
+		return e.handleControl(goal, subst, sessionID)
+
+	case "append", "member", "memberchk", "length", "nth0", "nth1", "reverse", "last",
+		"sum_list", "max_list", "min_list", "list_to_set":
+		return e.handleList(goal, subst)
+	case "include", "exclude", "maplist", "foldl":
+		return e.handleListMeta(goal, subst, sessionID)
+
+	case "freeze", "dif", "when", whenCheck:
+		return e.handleCoroutining(goal, subst, sessionID)
+	case "in", "ins", "#=", "#\\=", "#<", "#=<", "#>", "#>=", "all_different", "all_distinct",
+		"label", "labeling", "fd_dom", "fd_inf", "fd_sup", "fd_size":
+		return e.handleFD(goal, subst, sessionID)
+	case attrUnify:
+		return e.handleAttrUnify(goal, subst, sessionID)
+
+	case "phrase":
+		return e.handlePhrase(goal, subst, sessionID)
+
+	case "clause", "current_predicate", "predicate_property", "listing":
+		return e.handleReflection(goal, subst, sessionID)
+
+	case "write", "writeln", "print", "writeq", "write_canonical", "format", "term_to_atom":
+		return e.handleOutput(goal, subst, sessionID)
+	case "op", "current_op":
+		return e.handleOperators(goal, subst, sessionID)
+	case ":", "module", "use_module", "current_module":
+		return e.handleModule(goal, userModule, subst, sessionID)
+	case "multifile":
+		return e.handleMultifile(goal, userModule, subst, sessionID)
+	case "spy", "nospy":
+		return e.handleTracing(goal, subst, sessionID)
+	case "materialize":
+		return e.handleMaterialize(goal, userModule, subst, sessionID)
+	case "retract":
+		return e.handleRetract(goal, subst, sessionID)
+
 	case "=":
 		if len(goal.Args) == 2 {
 			if newSubst, ok := e.unify(goal.Args[0], goal.Args[1], subst); ok {
@@ -178,11 +380,21 @@ func (e *Engine) evalBuiltin(goal Term, subst Substitution, sessionID string) ([
 	case "count":
 		return e.handleCount(goal, subst, sessionID)
 	case "sum":
+		// sum(Vars, #=, Value) is the finite-domain constraint
+		if len(goal.Args) == 3 {
+			if op := e.deref(goal.Args[1], subst); op.Type == "atom" && fdRelations[op.Value.(string)] {
+				return e.handleFD(goal, subst, sessionID)
+			}
+		}
 		return e.handleSum(goal, subst, sessionID)
 	case "max":
 		return e.handleMax(goal, subst, sessionID)
 	case "min":
 		return e.handleMin(goal, subst, sessionID)
+	case "aggregate_all":
+		return e.handleAggregateAll(goal, subst, sessionID)
+	case "aggregate":
+		return e.handleAggregate(goal, subst, sessionID)
 
 	case "now":
 		if len(goal.Args) == 1 {
@@ -198,6 +410,42 @@ func (e *Engine) evalBuiltin(goal Term, subst Substitution, sessionID string) ([
 		return e.handleDateAfter(goal, subst)
 	case "days_between":
 		return e.handleDaysBetween(goal, subst)
+	case "parse_date":
+		return e.handleParseDate(goal, subst)
+	case "format_date":
+		return e.handleFormatDate(goal, subst)
+	case "make_date":
+		return e.handleMakeDate(goal, subst)
+	case "date_year", "date_month", "date_day", "date_weekday", "date_hour", "date_minute", "date_second":
+		return e.handleDatePart(goal, subst)
+	case "date_add":
+		return e.handleDateAdd(goal, subst, 1)
+	case "date_subtract":
+		return e.handleDateAdd(goal, subst, -1)
+	case "date_convert_tz":
+		return e.handleDateConvertTZ(goal, subst)
+	case "date_truncate":
+		return e.handleDateTruncate(goal, subst)
+	case "make_interval":
+		return e.handleMakeInterval(goal, subst)
+	case "allen_relation":
+		return e.handleAllenRelation(goal, subst)
+	case "interval_before", "interval_after", "interval_meets", "interval_met_by",
+		"interval_overlaps", "interval_overlapped_by", "interval_starts", "interval_started_by",
+		"interval_during", "interval_contains", "interval_finishes", "interval_finished_by",
+		"interval_equals":
+		return e.handleIntervalRelation(goal, subst)
+	case "interval_intersection":
+		return e.handleIntervalIntersection(goal, subst)
+	case "interval_union":
+		return e.handleIntervalUnion(goal, subst)
+	case "interval_duration":
+		return e.handleIntervalDuration(goal, subst)
+	case "holds_at", "clipped", "declipped":
+		if e.libraryEnabled(sessionID, "event_calculus") {
+			return e.handleEventCalculus(goal, subst, sessionID)
+		}
+		return nil, false
 	case "help":
 		// Help predicate always succeeds (used by UI for command detection)
 		return []Substitution{subst}, true
@@ -206,6 +454,14 @@ func (e *Engine) evalBuiltin(goal Term, subst Substitution, sessionID string) ([
 	return nil, false
 }
 
+// unifyResult unifies a and b and wraps the outcome in the builtin result shape.
+func (e *Engine) unifyResult(a, b Term, subst Substitution) ([]Substitution, bool) {
+	if newSubst, ok := e.unify(a, b, subst); ok {
+		return []Substitution{newSubst}, true
+	}
+	return []Substitution{}, true
+}
+
 func (e *Engine) handleCount(goal Term, subst Substitution, sessionID string) ([]Substitution, bool) {
 	if len(goal.Args) != 3 {
 		return []Substitution{}, true
@@ -336,16 +592,11 @@ func (e *Engine) handleDateBefore(goal Term, subst Substitution) ([]Substitution
 		return []Substitution{}, true
 	}
 
-	date1 := e.deref(goal.Args[0], subst)
-	date2 := e.deref(goal.Args[1], subst)
+	t1, ok1 := e.dateValue(goal.Args[0], subst)
+	t2, ok2 := e.dateValue(goal.Args[1], subst)
 
-	if date1.Type == "date" && date2.Type == "date" {
-		t1, err1 := time.Parse(time.RFC3339, date1.Value.(string))
-		t2, err2 := time.Parse(time.RFC3339, date2.Value.(string))
-
-		if err1 == nil && err2 == nil && t1.Before(t2) {
-			return []Substitution{subst}, true
-		}
+	if ok1 && ok2 && t1.Before(t2) {
+		return []Substitution{subst}, true
 	}
 
 	return []Substitution{}, true
@@ -356,16 +607,11 @@ func (e *Engine) handleDateAfter(goal Term, subst Substitution) ([]Substitution,
 		return []Substitution{}, true
 	}
 
-	date1 := e.deref(goal.Args[0], subst)
-	date2 := e.deref(goal.Args[1], subst)
-
-	if date1.Type == "date" && date2.Type == "date" {
-		t1, err1 := time.Parse(time.RFC3339, date1.Value.(string))
-		t2, err2 := time.Parse(time.RFC3339, date2.Value.(string))
+	t1, ok1 := e.dateValue(goal.Args[0], subst)
+	t2, ok2 := e.dateValue(goal.Args[1], subst)
 
-		if err1 == nil && err2 == nil && t1.After(t2) {
-			return []Substitution{subst}, true
-		}
+	if ok1 && ok2 && t1.After(t2) {
+		return []Substitution{subst}, true
 	}
 
 	return []Substitution{}, true
@@ -397,11 +643,14 @@ func (e *Engine) handleDaysBetween(goal Term, subst Substitution) ([]Substitutio
 func (e *Engine) instantiate(term Term, subst Substitution) Term {
 	term = e.deref(term, subst)
 
-	if term.Type == "compound" {
+	if len(term.Args) > 0 {
 		newArgs := make([]Term, len(term.Args))
 		for i, arg := range term.Args {
 			newArgs[i] = e.instantiate(arg, subst)
 		}
+		if term.Type == "list" && term.Value == listTailMarker {
+			return ListWithTail(newArgs[:len(newArgs)-1], newArgs[len(newArgs)-1])
+		}
 		return Term{Type: term.Type, Value: term.Value, Args: newArgs}
 	}
 
@@ -409,16 +658,44 @@ func (e *Engine) instantiate(term Term, subst Substitution) Term {
 }
 
 func (e *Engine) solve(goals []Term, subst Substitution, sessionID string) []Substitution {
+	// Goals woken by binding attributed variables run first
+	if wakeups, rest := takeWakeups(subst); wakeups != nil {
+		goals, subst = append(append([]Term{}, wakeups...), goals...), rest
+	}
+
 	if len(goals) == 0 {
 		return []Substitution{subst}
 	}
 
-	goal := goals[0]
+	goal := e.deref(goals[0], subst)
 	remaining := goals[1:]
+	if tracing(subst) {
+		e.traceStep(subst)
+	}
+
+	if goal.Type == "atom" && goal.Value == proofExit {
+		return e.solve(remaining, e.recordProof(subst, Atom("exit")), sessionID)
+	}
 
-	if solutions, handled := e.evalBuiltin(goal, subst, sessionID); handled {
+	if goal.Type == "compound" && goal.Value == traceExit {
+		inv, clauseID := int(goal.Args[0].Value.(float64)), int(goal.Args[1].Value.(float64))
+		return e.solve(remaining, e.traceExitPort(subst, inv, "rule", clauseID), sessionID)
+	}
+
+	builtinSubst := subst
+	if proving(subst) {
+		builtinSubst = e.recordProof(subst, Compound("builtin", []Term{goal}))
+	}
+	if tracing(subst) && !traceTransparent(goal) {
+		if results, handled := e.solveTracedBuiltin(goal, remaining, builtinSubst, sessionID); handled {
+			return results
+		}
+	} else if solutions, handled := e.evalBuiltin(goal, builtinSubst, sessionID); handled {
 		var allResults []Substitution
 		for _, sol := range solutions {
+			if proving(sol) {
+				sol = e.recordProof(sol, Atom("exit"))
+			}
 			results := e.solve(remaining, sol, sessionID)
 			allResults = append(allResults, results...)
 		}
@@ -429,52 +706,136 @@ func (e *Engine) solve(goals []Term, subst Substitution, sessionID string) []Sub
 }
 
 func (e *Engine) solveUserDefined(goal Term, remaining []Term, subst Substitution, sessionID string) []Substitution {
-	key := e.makeCacheKey(goal, sessionID)
-	if entry, exists := e.cache[key]; exists && entry.Complete {
+	return e.solvePredicate(goal, userModule, remaining, subst, sessionID)
+}
+
+// solvePredicate resolves a user-defined goal called from module against
+// the clauses of the module that defines it.
+func (e *Engine) solvePredicate(goal Term, module string, remaining []Term, subst Substitution, sessionID string) []Substitution {
+	// Key the cache on the goal as seen in this context, so the same goal
+	// reached with different bindings does not share answers.
+	goal = e.instantiate(goal, subst)
+	module = e.resolveModule(sessionID, module, goal)
+	// Materialized and compiled predicates are answered in SQLite, unless
+	// their derivations are needed
+	if !proving(subst) && !e.reporting(subst) {
+		answers, ok := e.solveMaterialized(goal, module, sessionID)
+		if !ok && compilingSQL(subst) {
+			answers, ok = e.solveSQL(goal, module, sessionID)
+		}
+		if ok {
+			var results []Substitution
+			for _, answer := range answers {
+				if newSubst, ok := e.unify(goal, answer, subst); ok {
+					results = append(results, e.solve(remaining, newSubst, sessionID)...)
+				}
+			}
+			return results
+		}
+	}
+	key := e.makeCacheKey(goal, module, sessionID)
+	// Cached answers have no derivation to show, so proofs and traces
+	// always resolve
+	e.mu.Lock()
+	entry, exists := e.cache[key]
+	e.mu.Unlock()
+	if exists && entry.Complete && !proving(subst) && !e.reporting(subst) {
+		inv, callSubst := e.traceCall(subst, qualify(module, goal), false)
+		e.traceCached(callSubst, inv)
 		var results []Substitution
 		for _, cachedSubst := range entry.Solutions {
-			merged := e.mergeSubstitutions(subst, cachedSubst)
-			results = append(results, e.solve(remaining, merged, sessionID)...)
+			// Replay the answer through unification so attributed
+			// variables see the bindings
+			merged, ok := callSubst, true
+			for v, value := range cachedSubst {
+				if merged, ok = e.unify(Variable(v), value, merged); !ok {
+					break
+				}
+			}
+			if ok {
+				results = append(results, e.solve(remaining, e.traceExitPort(merged, inv, "", 0), sessionID)...)
+			}
 		}
+		e.traceFail(callSubst, inv)
 		return results
 	}
 
 	var factSolutions []Substitution
+	var factIDs []int
 	var allResults []Substitution
 
+	inv, callSubst := e.traceCall(subst, qualify(module, goal), false)
+	generation := e.generation(sessionID)
+	facts, rules, factRows, ruleRows := e.loadVisibleClauses(goal, module, sessionID)
+	e.traceLoaded(callSubst, inv, factRows, ruleRows)
+
 	// Handle facts
-	for _, fact := range e.loadFacts(goal, sessionID) {
-		if newSubst, ok := e.unify(goal, fact.Predicate, subst); ok {
+	for _, fact := range facts {
+		if newSubst, ok := e.unify(goal, fact.Predicate, callSubst); ok {
+			if proving(newSubst) {
+				newSubst = e.recordProof(e.proveClause(newSubst, goal, "fact", fact.ID, fact.SessionID, nil), Atom("exit"))
+			}
 			factSolutions = append(factSolutions, newSubst)
+			factIDs = append(factIDs, fact.ID)
 		}
 	}
 
 	// Handle rules (includes remaining goals in the rule processing)
-	for _, rule := range e.loadRules(goal, sessionID) {
-		renamedRule := e.renameVars(rule)
-		if newSubst, ok := e.unify(goal, renamedRule.Head, subst); ok {
-			newGoals := append(renamedRule.Body, remaining...)
-			results := e.solve(newGoals, newSubst, sessionID)
+	for _, rule := range rules {
+		renamedRule, renames := e.renameClause(rule)
+		if newSubst, ok := e.unify(goal, renamedRule.Head, callSubst); ok {
+			body := qualifyGoals(module, renamedRule.Body)
+			if proving(newSubst) {
+				newSubst = e.proveClause(newSubst, goal, "rule", rule.ID, rule.SessionID, renames)
+				body = append(body, Atom(proofExit))
+			}
+			if tracing(newSubst) {
+				newSubst = e.traceClause(newSubst, inv, rule.ID)
+				body = append(body, Compound(traceExit, []Term{Number(float64(inv)), Number(float64(rule.ID))}))
+			}
+			results := e.solve(append(body, remaining...), newSubst, sessionID)
 			allResults = append(allResults, results...)
 		}
 	}
 
 	// Only apply remaining goals to fact solutions
-	for _, sol := range factSolutions {
-		results := e.solve(remaining, sol, sessionID)
+	for i, sol := range factSolutions {
+		results := e.solve(remaining, e.traceExitPort(sol, inv, "fact", factIDs[i]), sessionID)
 		allResults = append(allResults, results...)
 	}
+	e.traceFail(callSubst, inv)
 
-	// Cache only the solutions for this specific goal (not including remaining)
-	e.cache[key] = TableEntry{Solutions: factSolutions, Complete: true}
+	// Cache only the solutions for this specific goal (not including remaining),
+	// restricted to the goal's own variables. Answers derived by rules are
+	// not collected here, so only predicates made of facts are cached.
+	if len(rules) > 0 {
+		return allResults
+	}
+	goalVars := make(map[string]bool)
+	e.collectVars(goal, goalVars)
+	answers := make([]Substitution, 0, len(factSolutions))
+	for _, sol := range factSolutions {
+		answer := make(Substitution)
+		for v := range goalVars {
+			if value := e.instantiate(Variable(v), sol); !(value.Type == "variable" && value.Value == v) {
+				answer[v] = value
+			}
+		}
+		answers = append(answers, answer)
+	}
+	e.mu.Lock()
+	if e.generations[sessionID] == generation {
+		e.cache[key] = TableEntry{Solutions: answers, Complete: true}
+	}
+	e.mu.Unlock()
 
 	return allResults
 }
 
-func (e *Engine) makeCacheKey(goal Term, sessionID string) TableKey {
+func (e *Engine) makeCacheKey(goal Term, module string, sessionID string) TableKey {
 	argsJSON, _ := json.Marshal(goal.Args)
 	return TableKey{
-		Predicate: fmt.Sprintf("%v_%s", goal.Value, sessionID),
+		Predicate: fmt.Sprintf("%s:%v_%s", module, goal.Value, sessionID),
 		Args:      string(argsJSON),
 	}
 }
@@ -490,13 +851,30 @@ func (e *Engine) mergeSubstitutions(s1, s2 Substitution) Substitution {
 	return merged
 }
 
-var globalVarCounter int = 0
+var globalVarCounter int64
+
+// nextVarID returns a number not returned before, for naming variables
+// apart. Queries run concurrently, so the counter is updated atomically.
+func nextVarID() int64 {
+	return atomic.AddInt64(&globalVarCounter, 1)
+}
+
+// freshVar returns a variable that does not occur anywhere else.
+func (e *Engine) freshVar() Term {
+	return Variable(fmt.Sprintf("_G%d", nextVarID()))
+}
 
 func (e *Engine) renameVars(rule Rule) Rule {
+	renamed, _ := e.renameClause(rule)
+	return renamed
+}
+
+// renameClause renames the variables of a rule apart, also returning the
+// new name of each variable.
+func (e *Engine) renameClause(rule Rule) (Rule, map[string]string) {
 	// Create a mapping for variable renaming
 	varMap := make(map[string]string)
-	globalVarCounter++
-	suffix := fmt.Sprintf("_%d", globalVarCounter)
+	suffix := fmt.Sprintf("_%d", nextVarID())
 	
 	// Rename variables in the head
 	renamedHead := e.renameTermVars(rule.Head, varMap, suffix)
@@ -512,7 +890,7 @@ func (e *Engine) renameVars(rule Rule) Rule {
 		SessionID: rule.SessionID,
 		Head:      renamedHead,
 		Body:      renamedBody,
-	}
+	}, varMap
 }
 
 func (e *Engine) renameTermVars(term Term, varMap map[string]string, suffix string) Term {
@@ -525,25 +903,36 @@ func (e *Engine) renameTermVars(term Term, varMap map[string]string, suffix stri
 		newName := varName + suffix
 		varMap[varName] = newName
 		return Variable(newName)
-	case "compound":
+	case "compound", "interval", "list":
 		newArgs := make([]Term, len(term.Args))
 		for i, arg := range term.Args {
 			newArgs[i] = e.renameTermVars(arg, varMap, suffix)
 		}
-		return Compound(term.Value.(string), newArgs)
+		return Term{Type: term.Type, Value: term.Value, Args: newArgs}
 	default:
 		// Atoms and numbers don't need renaming
 		return term
 	}
 }
 
+// factsQuery and rulesQuery load the clauses of a predicate name stored in
+// a session's module.
+const (
+	factsQuery = "SELECT id, session_id, data FROM facts WHERE predicate = ? AND session_id = ? AND module = ?"
+	rulesQuery = "SELECT id, session_id, head_data, body_data FROM rules WHERE head_predicate = ? AND session_id = ? AND module = ?"
+)
+
 func (e *Engine) loadFacts(goal Term, sessionID string) []Fact {
+	return e.loadModuleFacts(goal, userModule, sessionID)
+}
+
+func (e *Engine) loadModuleFacts(goal Term, module string, sessionID string) []Fact {
 	predicate := e.extractPredicate(goal)
 	if predicate == "" {
 		return nil
 	}
 
-	rows, err := e.db.Query("SELECT id, session_id, data FROM facts WHERE predicate = ? AND session_id = ?", predicate, sessionID)
+	rows, err := e.db.Query(factsQuery, predicate, sessionID, module)
 	if err != nil {
 		return nil
 	}
@@ -561,12 +950,16 @@ func (e *Engine) loadFacts(goal Term, sessionID string) []Fact {
 }
 
 func (e *Engine) loadRules(goal Term, sessionID string) []Rule {
+	return e.loadModuleRules(goal, userModule, sessionID)
+}
+
+func (e *Engine) loadModuleRules(goal Term, module string, sessionID string) []Rule {
 	predicate := e.extractPredicate(goal)
 	if predicate == "" {
 		return nil
 	}
 
-	rows, err := e.db.Query("SELECT id, session_id, head_data, body_data FROM rules WHERE head_predicate = ? AND session_id = ?", predicate, sessionID)
+	rows, err := e.db.Query(rulesQuery, predicate, sessionID, module)
 	if err != nil {
 		return nil
 	}
@@ -594,20 +987,94 @@ func (e *Engine) extractPredicate(goal Term) string {
 }
 
 func (e *Engine) AddFact(fact Fact) error {
-	predicate := e.extractPredicate(fact.Predicate)
-	data, err := json.Marshal(fact.Predicate)
+	if e.expandsClauses(fact.SessionID) && !isExpansionHook(fact.Predicate) {
+		return e.addExpanded(fact.SessionID, fact.Predicate)
+	}
+	return e.insertFact(fact)
+}
+
+func (e *Engine) insertFact(fact Fact) error {
+	module, head := splitModule(fact.Predicate)
+	predicate := e.extractPredicate(head)
+	data, err := json.Marshal(head)
 	if err != nil {
 		return err
 	}
 
-	_, err = e.db.Exec("INSERT INTO facts (session_id, predicate, data) VALUES (?, ?, ?)", 
-		fact.SessionID, predicate, string(data))
-	return err
+	defer e.lockViews(fact.SessionID)()
+	_, err = e.db.Exec("INSERT INTO facts (session_id, predicate, data, module) VALUES (?, ?, ?, ?)", 
+		fact.SessionID, predicate, string(data), module)
+	if err != nil {
+		return err
+	}
+	e.updateViews(fact.SessionID, func(v *materializedView) bool { return v.addFact(module, head) })
+	if isExpansionHook(head) {
+		e.forgetExpansions(fact.SessionID)
+	}
+	return nil
+}
+
+// RetractFact removes the first fact of a session matching pattern,
+// returning it.
+func (e *Engine) RetractFact(sessionID string, pattern Term) (Fact, bool, error) {
+	module, head := splitModule(pattern)
+	defer e.lockViews(sessionID)()
+	for _, fact := range e.loadModuleFacts(head, module, sessionID) {
+		if termArity(fact.Predicate) != termArity(head) {
+			continue
+		}
+		if _, ok := e.unify(head, fact.Predicate, make(Substitution)); !ok {
+			continue
+		}
+		if _, err := e.db.Exec("DELETE FROM facts WHERE id = ?", fact.ID); err != nil {
+			return Fact{}, false, err
+		}
+		e.updateViews(sessionID, func(v *materializedView) bool { return v.removeFact(module, fact.Predicate) })
+		if isExpansionHook(head) {
+			e.forgetExpansions(sessionID)
+		}
+		fact.Predicate = qualify(module, fact.Predicate)
+		return fact, true, nil
+	}
+	return Fact{}, false, nil
+}
+
+// handleRetract implements retract/1 for facts.
+func (e *Engine) handleRetract(goal Term, subst Substitution, sessionID string) ([]Substitution, bool) {
+	if len(goal.Args) != 1 {
+		return []Substitution{}, true
+	}
+	pattern := e.instantiate(goal.Args[0], subst)
+	fact, found, err := e.RetractFact(sessionID, pattern)
+	if err != nil || !found {
+		return []Substitution{}, true
+	}
+	if newSubst, ok := e.unify(pattern, fact.Predicate, subst); ok {
+		return []Substitution{newSubst}, true
+	}
+	return []Substitution{}, true
 }
 
 func (e *Engine) AddRule(rule Rule) error {
-	predicate := e.extractPredicate(rule.Head)
-	headData, err := json.Marshal(rule.Head)
+	if e.expandsClauses(rule.SessionID) && !isExpansionHook(rule.Head) {
+		return e.addExpanded(rule.SessionID, ruleTerm(rule))
+	}
+	if isGrammarRule(rule) {
+		module, grammar := splitModule(rule.Head)
+		translated, err := e.newDCGTranslator().translateRule(grammar.Args[0], grammar.Args[1])
+		if err != nil {
+			return err
+		}
+		translated.SessionID, translated.Head = rule.SessionID, qualify(module, translated.Head)
+		rule = translated
+	}
+	return e.insertRule(rule)
+}
+
+func (e *Engine) insertRule(rule Rule) error {
+	module, head := splitModule(rule.Head)
+	predicate := e.extractPredicate(head)
+	headData, err := json.Marshal(head)
 	if err != nil {
 		return err
 	}
@@ -616,25 +1083,91 @@ func (e *Engine) AddRule(rule Rule) error {
 		return err
 	}
 
-	_, err = e.db.Exec("INSERT INTO rules (session_id, head_predicate, head_data, body_data) VALUES (?, ?, ?, ?)",
-		rule.SessionID, predicate, string(headData), string(bodyData))
-	return err
+	defer e.lockViews(rule.SessionID)()
+	_, err = e.db.Exec("INSERT INTO rules (session_id, head_predicate, head_data, body_data, module) VALUES (?, ?, ?, ?, ?)",
+		rule.SessionID, predicate, string(headData), string(bodyData), module)
+	if err != nil {
+		return err
+	}
+	e.updateViews(rule.SessionID, func(v *materializedView) bool { return v.addRule(rule) })
+	if isExpansionHook(head) {
+		e.forgetExpansions(rule.SessionID)
+	}
+	return nil
 }
 
 func (e *Engine) Query(query Query, sessionID string) QueryResult {
-	solutions := e.solve(query.Goals, make(Substitution), sessionID)
+	return e.runQuery(query, sessionID, make(Substitution), nil)
+}
+
+// runQuery solves a query from subst. stream, when set, receives the trace
+// events as they happen.
+func (e *Engine) runQuery(query Query, sessionID string, subst Substitution, stream func(TraceEvent)) (result QueryResult) {
+	ctx := contextOf(subst)
+	switch evaluation, err := e.evaluation(query, sessionID); {
+	case err != nil:
+		return QueryResult{Solutions: []Solution{{Success: false}}, Error: err.Error()}
+	case evaluation == "bottom_up":
+		return e.DatalogQuery(query, sessionID)
+	case evaluation == "sql":
+		ctx.sql = true
+	}
+	if query.Proof {
+		ctx.proof, ctx.steps = true, Atom("[]")
+	}
+	setContext(subst, ctx)
+	if t := e.newTracer(query, sessionID, stream); t != nil {
+		startTrace(t, subst)
+		defer func() {
+			result.Trace = t.events
+			if t.profile != nil {
+				result.Profile = t.summarize()
+				e.mu.Lock()
+				e.profiles[sessionID] = result.Profile
+				e.mu.Unlock()
+			}
+			if r := recover(); r != nil {
+				abort, ok := r.(traceAbort)
+				if !ok {
+					panic(r)
+				}
+				result.Solutions = []Solution{{Success: false}}
+				result.Error = abort.message
+			}
+		}()
+	}
+	goals := query.Goals
+	if query.Optimize {
+		goals = e.reorderGoals(goals, sessionID)
+		if !reflect.DeepEqual(goals, query.Goals) {
+			result.Reordered = goals
+		}
+	}
+	solutions := e.solve(goals, subst, sessionID)
 
-	var result QueryResult
 	if len(solutions) == 0 {
 		result.Solutions = []Solution{{Success: false}}
+		if query.WhyNot {
+			// The analysis replays goals, so it must not change the store
+			ctx.proof, ctx.tracer, ctx.readOnly = false, nil, true
+			setContext(subst, ctx)
+			result.WhyNot = e.whyNot(query.Goals, subst, sessionID)
+		}
 	} else {
 		for _, subst := range solutions {
 			// Only include bindings for variables that appeared in the original query
 			cleanedBindings := e.extractQueryBindings(query.Goals, subst)
-			result.Solutions = append(result.Solutions, Solution{
-				Bindings: cleanedBindings,
-				Success:  true,
-			})
+			solution := Solution{
+				Bindings:  cleanedBindings,
+				Success:   true,
+				Output:    solutionOutput(subst),
+				Residuals: e.residualGoals(query.Goals, subst),
+			}
+			if query.Proof {
+				solution.Proof = e.proofTree(subst, sessionID)
+				solution.Explanation = explainProof(solution.Proof, e.sessionOps(sessionID))
+			}
+			result.Solutions = append(result.Solutions, solution)
 		}
 	}
 
@@ -648,11 +1181,14 @@ func (e *Engine) extractQueryBindings(goals []Term, subst Substitution) Substitu
 		e.collectVars(goal, queryVars)
 	}
 	
-	// Create a new substitution with only query variables, fully dereferenced
+	// Create a new substitution with only query variables, fully instantiated
 	cleaned := make(Substitution)
 	for varName := range queryVars {
+		if isAnonymous(varName) {
+			continue
+		}
 		if val, exists := subst[varName]; exists {
-			cleaned[varName] = e.deref(val, subst)
+			cleaned[varName] = e.instantiate(val, subst)
 		}
 	}
 	return cleaned
@@ -662,7 +1198,7 @@ func (e *Engine) collectVars(term Term, vars map[string]bool) {
 	switch term.Type {
 	case "variable":
 		vars[term.Value.(string)] = true
-	case "compound":
+	case "compound", "interval", "list":
 		for _, arg := range term.Args {
 			e.collectVars(arg, vars)
 		}
@@ -670,7 +1206,38 @@ func (e *Engine) collectVars(term Term, vars map[string]bool) {
 }
 
 func (e *Engine) ClearCache() {
+	e.mu.Lock()
 	e.cache = make(map[TableKey]TableEntry)
+	e.eventIndexes = make(map[string]*eventIndex)
+	e.mu.Unlock()
+}
+
+// invalidateSession drops everything derived from a session's clauses after
+// they change, in the session and in the sessions inheriting from it.
+func (e *Engine) invalidateSession(sessionID string) {
+	for _, id := range append([]string{sessionID}, e.sessionDescendants(sessionID)...) {
+		suffix := "_" + id
+		e.mu.Lock()
+		for key := range e.cache {
+			if strings.HasSuffix(key.Predicate, suffix) {
+				delete(e.cache, key)
+			}
+		}
+		delete(e.eventIndexes, id)
+		delete(e.modules, id)
+		delete(e.views, id)
+		e.generations[id]++
+		e.mu.Unlock()
+	}
+}
+
+// generation returns the number of times a session's derived state has been
+// dropped. State derived from its clauses is only kept if the generation
+// is the same after deriving it as before reading them.
+func (e *Engine) generation(sessionID string) int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.generations[sessionID]
 }
 
 func (e *Engine) CreateSession(req CreateSessionRequest) (*Session, error) {
@@ -680,8 +1247,12 @@ func (e *Engine) CreateSession(req CreateSessionRequest) (*Session, error) {
 	entropy := ulid.Monotonic(rand.Reader, 0)
 	id := ulid.MustNew(ulid.Timestamp(now), entropy).String()
 	
-	_, err := e.db.Exec("INSERT INTO sessions (id, name, description, created_at, updated_at) VALUES (?, ?, ?, ?, ?)",
-		id, req.Name, req.Description, now, now)
+	keyHash := ""
+	if req.APIKey != "" {
+		keyHash = hashKey(req.APIKey)
+	}
+	_, err := e.db.Exec("INSERT INTO sessions (id, name, description, api_key_hash, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)",
+		id, req.Name, req.Description, keyHash, now, now)
 	if err != nil {
 		return nil, err
 	}
@@ -736,7 +1307,31 @@ func (e *Engine) ListSessions() ([]Session, error) {
 
 func (e *Engine) DeleteSession(id string) error {
 	_, err := e.db.Exec("DELETE FROM sessions WHERE id = ?", id)
-	return err
+	if err != nil {
+		return err
+	}
+	e.invalidateSession(id)
+
+	// Children stop inheriting from a deleted session
+	children := e.sessionDescendants(id)
+	if _, err := e.db.Exec("DELETE FROM session_parents WHERE session_id = ? OR parent_id = ?", id, id); err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	delete(e.libraries, id)
+	delete(e.operators, id)
+	delete(e.spypoints, id)
+	delete(e.profiles, id)
+	delete(e.materialized, id)
+	delete(e.parents, id)
+	delete(e.expansions, id)
+	for _, child := range children {
+		delete(e.parents, child)
+		delete(e.expansions, child)
+	}
+	e.mu.Unlock()
+	return nil
 }
 
 func (e *Engine) UpdateSessionTimestamp(sessionID string) error {
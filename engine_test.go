@@ -66,7 +66,7 @@ func TestSessionCRUD(t *testing.T) {
 		t.Fatalf("Failed to create session: %v", err)
 	}
 
-	if session.ID == 0 {
+	if session.ID == "" {
 		t.Error("Expected session ID to be set")
 	}
 	if session.Name != req.Name {
@@ -82,7 +82,7 @@ func TestSessionCRUD(t *testing.T) {
 		t.Fatalf("Failed to get session: %v", err)
 	}
 	if retrieved.ID != session.ID {
-		t.Errorf("Expected session ID %d, got %d", session.ID, retrieved.ID)
+		t.Errorf("Expected session ID %s, got %s", session.ID, retrieved.ID)
 	}
 	if retrieved.Name != session.Name {
 		t.Errorf("Expected session name '%s', got '%s'", session.Name, retrieved.Name)
@@ -94,7 +94,7 @@ func TestSessionCRUD(t *testing.T) {
 		t.Fatalf("Failed to get session by name: %v", err)
 	}
 	if retrievedByName.ID != session.ID {
-		t.Errorf("Expected session ID %d, got %d", session.ID, retrievedByName.ID)
+		t.Errorf("Expected session ID %s, got %s", session.ID, retrievedByName.ID)
 	}
 
 	// Test List Sessions
@@ -169,4 +169,31 @@ func TestSessionUniqueName(t *testing.T) {
 	if err == nil {
 		t.Error("Expected error when creating session with duplicate name")
 	}
-}
\ No newline at end of file
+}
+
+func TestAnswerCacheKeyedOnInstantiatedGoal(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+	for _, edge := range [][2]string{{"a", "b"}, {"a", "c"}, {"b", "d"}, {"c", "e"}} {
+		if err := engine.AddFact(Fact{SessionID: sessionID, Predicate: Compound("edge", []Term{Atom(edge[0]), Atom(edge[1])})}); err != nil {
+			t.Fatalf("Failed to add fact: %v", err)
+		}
+	}
+
+	// edge(X, Y) is reached once with X = b and once with X = c, and each
+	// gets its own answers
+	result := engine.Query(Query{Goals: []Term{
+		Compound("edge", []Term{Atom("a"), Variable("X")}),
+		Compound("edge", []Term{Variable("X"), Variable("Y")}),
+	}}, sessionID)
+	var pairs []string
+	for _, sol := range result.Solutions {
+		if sol.Success {
+			pairs = append(pairs, sol.Bindings["X"].Value.(string)+sol.Bindings["Y"].Value.(string))
+		}
+	}
+	if len(pairs) != 2 || pairs[0] != "bd" || pairs[1] != "ce" {
+		t.Errorf("Expected X-Y pairs bd and ce, got %v", pairs)
+	}
+}
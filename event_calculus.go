@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+)
+
+// eventIndex is a time-ordered view of a session's narrative. For every
+// ground fluent it records the points at which an event initiated or
+// terminated it, so holds_at/2 and clipped/3 are answered by binary search
+// instead of recursing over happens/2.
+type eventIndex struct {
+	sessionID string
+	fluents   map[string]Term
+	changes   map[string][]fluentChange
+	initially map[string]bool
+}
+
+type fluentChange struct {
+	time      float64
+	initiates bool
+}
+
+// timePoint dereferences term and returns it as a comparable instant.
+// Numbers are used as-is and dates as Unix seconds.
+func (e *Engine) timePoint(term Term, subst Substitution) (float64, bool) {
+	if n, ok := e.numberValue(term, subst); ok {
+		return n, true
+	}
+	if t, ok := e.dateValue(term, subst); ok {
+		return float64(t.UnixNano()) / 1e9, true
+	}
+	return 0, false
+}
+
+func fluentKey(fluent Term) string {
+	data, _ := json.Marshal(fluent)
+	return string(data)
+}
+
+func (e *Engine) isGround(term Term, subst Substitution) bool {
+	vars := make(map[string]bool)
+	e.collectVars(e.instantiate(term, subst), vars)
+	return len(vars) == 0
+}
+
+// eventIndexFor returns the session's event index, building it on first use.
+// An index is published only once it is complete, and only if the session
+// was not invalidated while it was built and the caller was not read-only;
+// it is not changed afterwards. While it is built, it is carried in the
+// solve context of the queries building it, so initiates/3 and terminates/3
+// rules that test holds_at/2 at their own time point see the changes
+// already recorded for earlier time points.
+func (e *Engine) eventIndexFor(subst Substitution, sessionID string) *eventIndex {
+	ctx := contextOf(subst)
+	for _, idx := range ctx.events {
+		if idx.sessionID == sessionID {
+			return idx
+		}
+	}
+
+	e.mu.Lock()
+	idx, exists := e.eventIndexes[sessionID]
+	e.mu.Unlock()
+	if exists {
+		return idx
+	}
+
+	generation := e.generation(sessionID)
+	idx = &eventIndex{
+		sessionID: sessionID,
+		fluents:   make(map[string]Term),
+		changes:   make(map[string][]fluentChange),
+		initially: make(map[string]bool),
+	}
+	// The index is built under the caller's restrictions, but without its
+	// proof, trace, output and attributes, which belong to the caller's goal
+	inner := ctx
+	inner.proof, inner.steps, inner.tracer, inner.frame = false, Term{}, nil, 0
+	inner.output, inner.attrs, inner.wake = "", nil, nil
+	inner.events = append(ctx.events[:len(ctx.events):len(ctx.events)], idx)
+	e.buildEventIndex(idx, inner)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if published, exists := e.eventIndexes[sessionID]; exists {
+		return published
+	}
+	if !ctx.readOnly && e.generations[sessionID] == generation {
+		e.eventIndexes[sessionID] = idx
+	}
+	return idx
+}
+
+func (e *Engine) buildEventIndex(idx *eventIndex, ctx solveContext) {
+	sessionID := idx.sessionID
+	subst := make(Substitution)
+	setContext(subst, ctx)
+
+	for _, sol := range e.solve([]Term{Compound("initially", []Term{Variable("Fluent")})}, subst, sessionID) {
+		fluent := e.instantiate(Variable("Fluent"), sol)
+		if e.isGround(fluent, sol) {
+			key := fluentKey(fluent)
+			idx.fluents[key] = fluent
+			idx.initially[key] = true
+		}
+	}
+
+	type occurrence struct {
+		event Term
+		at    Term
+		time  float64
+	}
+	var occurrences []occurrence
+	happens := Compound("happens", []Term{Variable("Event"), Variable("Time")})
+	for _, sol := range e.solve([]Term{happens}, subst, sessionID) {
+		at := e.instantiate(Variable("Time"), sol)
+		if t, ok := e.timePoint(at, sol); ok {
+			occurrences = append(occurrences, occurrence{e.instantiate(Variable("Event"), sol), at, t})
+		}
+	}
+	sort.SliceStable(occurrences, func(i, j int) bool { return occurrences[i].time < occurrences[j].time })
+
+	for _, occ := range occurrences {
+		for _, effect := range []string{"initiates", "terminates"} {
+			goal := Compound(effect, []Term{occ.event, Variable("Fluent"), occ.at})
+			for _, sol := range e.solve([]Term{goal}, subst, sessionID) {
+				fluent := e.instantiate(Variable("Fluent"), sol)
+				if !e.isGround(fluent, sol) {
+					continue
+				}
+				key := fluentKey(fluent)
+				idx.fluents[key] = fluent
+				idx.changes[key] = append(idx.changes[key], fluentChange{time: occ.time, initiates: effect == "initiates"})
+			}
+		}
+	}
+}
+
+// holds reports whether the fluent is true at t: it was initiated strictly
+// before t (or holds initially) and not terminated since. An initiation and
+// a termination at the same instant leave the fluent holding.
+func (idx *eventIndex) holds(key string, t float64) bool {
+	changes := idx.changes[key]
+	i := sort.Search(len(changes), func(i int) bool { return changes[i].time >= t })
+	if i == 0 {
+		return idx.initially[key]
+	}
+
+	last := changes[i-1].time
+	for j := i - 1; j >= 0 && changes[j].time == last; j-- {
+		if changes[j].initiates {
+			return true
+		}
+	}
+	return false
+}
+
+// changedBetween reports whether the fluent was initiated (or terminated)
+// strictly between t1 and t2.
+func (idx *eventIndex) changedBetween(key string, t1, t2 float64, initiates bool) bool {
+	changes := idx.changes[key]
+	i := sort.Search(len(changes), func(i int) bool { return changes[i].time > t1 })
+	for ; i < len(changes) && changes[i].time < t2; i++ {
+		if changes[i].initiates == initiates {
+			return true
+		}
+	}
+	return false
+}
+
+// handleEventCalculus implements holds_at(?Fluent, ?T), clipped(+T1, ?Fluent, +T2)
+// and declipped(+T1, ?Fluent, +T2). Time points are numbers or dates; an
+// unbound T in holds_at/2 is bound to the current time, as now/1 would.
+func (e *Engine) handleEventCalculus(goal Term, subst Substitution, sessionID string) ([]Substitution, bool) {
+	var fluentArg Term
+	var test func(idx *eventIndex, key string) bool
+
+	switch {
+	case goal.Value == "holds_at" && len(goal.Args) == 2:
+		fluentArg = goal.Args[0]
+		if e.deref(goal.Args[1], subst).Type == "variable" {
+			var ok bool
+			if subst, ok = e.unify(goal.Args[1], Date(time.Now()), subst); !ok {
+				return []Substitution{}, true
+			}
+		}
+		t, ok := e.timePoint(goal.Args[1], subst)
+		if !ok {
+			return []Substitution{}, true
+		}
+		test = func(idx *eventIndex, key string) bool { return idx.holds(key, t) }
+
+	case (goal.Value == "clipped" || goal.Value == "declipped") && len(goal.Args) == 3:
+		fluentArg = goal.Args[1]
+		t1, ok1 := e.timePoint(goal.Args[0], subst)
+		t2, ok2 := e.timePoint(goal.Args[2], subst)
+		if !ok1 || !ok2 {
+			return []Substitution{}, true
+		}
+		initiates := goal.Value == "declipped"
+		test = func(idx *eventIndex, key string) bool { return idx.changedBetween(key, t1, t2, initiates) }
+
+	default:
+		return []Substitution{}, true
+	}
+
+	idx := e.eventIndexFor(subst, sessionID)
+
+	if e.isGround(fluentArg, subst) {
+		if test(idx, fluentKey(e.instantiate(fluentArg, subst))) {
+			return []Substitution{subst}, true
+		}
+		return []Substitution{}, true
+	}
+
+	keys := make([]string, 0, len(idx.fluents))
+	for key := range idx.fluents {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var results []Substitution
+	for _, key := range keys {
+		if !test(idx, key) {
+			continue
+		}
+		if newSubst, ok := e.unify(fluentArg, idx.fluents[key], subst); ok {
+			results = append(results, newSubst)
+		}
+	}
+	if results == nil {
+		results = []Substitution{}
+	}
+	return results, true
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func setupDoorNarrative(t *testing.T, engine *Engine, sessionID string) {
+	facts := []Term{
+		Compound("happens", []Term{Atom("open"), Number(5)}),
+		Compound("happens", []Term{Atom("close"), Number(10)}),
+		Compound("happens", []Term{Atom("open"), Number(15)}),
+		Compound("happens", []Term{Atom("lock"), Number(20)}),
+		Compound("happens", []Term{Atom("open"), Number(25)}),
+		Compound("initially", []Term{Atom("light_on")}),
+	}
+	for _, f := range facts {
+		if err := engine.AddFact(Fact{SessionID: sessionID, Predicate: f}); err != nil {
+			t.Fatalf("Failed to add fact: %v", err)
+		}
+	}
+
+	rules := []Rule{
+		// initiates(open, door_open, T) :- unlocked_at(T).
+		{
+			Head: Compound("initiates", []Term{Atom("open"), Atom("door_open"), Variable("T")}),
+			Body: []Term{Compound("unlocked_at", []Term{Variable("T")})},
+		},
+		{
+			Head: Compound("terminates", []Term{Atom("close"), Atom("door_open"), Variable("T")}),
+			Body: []Term{},
+		},
+		{
+			Head: Compound("terminates", []Term{Atom("lock"), Atom("door_open"), Variable("T")}),
+			Body: []Term{},
+		},
+		{
+			Head: Compound("initiates", []Term{Atom("lock"), Atom("locked"), Variable("T")}),
+			Body: []Term{},
+		},
+		// unlocked_at(T) :- count(_, holds_at(locked, T), 0).
+		// Consults the narrative while it is being indexed.
+		{
+			Head: Compound("unlocked_at", []Term{Variable("T")}),
+			Body: []Term{Compound("count", []Term{
+				Variable("_"),
+				Compound("holds_at", []Term{Atom("locked"), Variable("T")}),
+				Number(0),
+			})},
+		},
+	}
+	for _, r := range rules {
+		r.SessionID = sessionID
+		if err := engine.AddRule(r); err != nil {
+			t.Fatalf("Failed to add rule: %v", err)
+		}
+	}
+}
+
+func TestEventCalculusRequiresLibrary(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+
+	goal := Compound("holds_at", []Term{Atom("door_open"), Number(7)})
+	if _, handled := engine.evalBuiltin(goal, make(Substitution), sessionID); handled {
+		t.Error("Expected holds_at to be left to user rules when event_calculus is not enabled")
+	}
+
+	if err := engine.EnableLibrary(sessionID, "no_such_library"); err == nil {
+		t.Error("Expected error enabling an unknown library")
+	}
+
+	if err := engine.EnableLibrary(sessionID, "event_calculus"); err != nil {
+		t.Fatalf("Failed to enable event_calculus: %v", err)
+	}
+	if _, handled := engine.evalBuiltin(goal, make(Substitution), sessionID); !handled {
+		t.Error("Expected holds_at to be handled once event_calculus is enabled")
+	}
+
+	libraries, err := engine.SessionLibraries(sessionID)
+	if err != nil || len(libraries) != 1 || libraries[0] != "event_calculus" {
+		t.Errorf("Expected [event_calculus], got %v (%v)", libraries, err)
+	}
+}
+
+func TestEventCalculusHoldsAt(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+	if err := engine.EnableLibrary(sessionID, "event_calculus"); err != nil {
+		t.Fatalf("Failed to enable event_calculus: %v", err)
+	}
+	setupDoorNarrative(t, engine, sessionID)
+
+	cases := []struct {
+		time  float64
+		holds bool
+	}{
+		{3, false},  // before anything happened
+		{5, false},  // initiated at 5, holds only after
+		{7, true},   // opened at 5
+		{12, false}, // closed at 10
+		{17, true},  // opened again at 15
+		{22, false}, // locked at 20
+		{30, false}, // opening at 25 fails while locked
+	}
+
+	for _, c := range cases {
+		goal := Compound("holds_at", []Term{Atom("door_open"), Number(c.time)})
+		solutions, handled := engine.evalBuiltin(goal, make(Substitution), sessionID)
+		if !handled {
+			t.Fatal("Expected holds_at to be handled")
+		}
+		if (len(solutions) == 1) != c.holds {
+			t.Errorf("holds_at(door_open, %v): expected %v, got %d solutions", c.time, c.holds, len(solutions))
+		}
+	}
+
+	// Enumerate the fluents that hold at a time point
+	result := engine.Query(Query{Goals: []Term{Compound("holds_at", []Term{Variable("F"), Number(22)})}}, sessionID)
+	held := map[interface{}]bool{}
+	for _, sol := range result.Solutions {
+		if sol.Success {
+			held[sol.Bindings["F"].Value] = true
+		}
+	}
+	if len(held) != 2 || !held["locked"] || !held["light_on"] {
+		t.Errorf("Expected locked and light_on to hold at 22, got %v", held)
+	}
+}
+
+func TestEventCalculusConcurrentIndex(t *testing.T) {
+	// Every connection to :memory: opens a database of its own, and the
+	// queries below run on several connections at once
+	engine, err := NewEngine(filepath.Join(t.TempDir(), "events.db"))
+	if err != nil {
+		t.Fatalf("Failed to create engine: %v", err)
+	}
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+	if err := engine.EnableLibrary(sessionID, "event_calculus"); err != nil {
+		t.Fatalf("Failed to enable event_calculus: %v", err)
+	}
+	setupDoorNarrative(t, engine, sessionID)
+
+	// Queries racing to build the index never see it half built
+	var wg sync.WaitGroup
+	counts := make([]int, 8)
+	for i := range counts {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			goal := Compound("holds_at", []Term{Atom("door_open"), Number(17)})
+			solutions, _ := engine.evalBuiltin(goal, make(Substitution), sessionID)
+			counts[i] = len(solutions)
+		}(i)
+	}
+	wg.Wait()
+	for i, count := range counts {
+		if count != 1 {
+			t.Errorf("Query %d: expected door_open to hold at 17, got %d solutions", i, count)
+		}
+	}
+}
+
+func TestEventCalculusReadOnlyIndex(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+	events, _ := engine.CreateSession(CreateSessionRequest{Name: "alarms"})
+	if err := engine.EnableLibrary(events.ID, "event_calculus"); err != nil {
+		t.Fatalf("Failed to enable event_calculus: %v", err)
+	}
+	// Pending alarms are consumed as they are indexed
+	_, err := engine.Consult(events.ID, `
+pending(ring, 5).
+happens(E, T) :- retract(pending(E, T)).
+initiates(ring, ringing, _).
+`)
+	if err != nil {
+		t.Fatalf("Consult failed: %v", err)
+	}
+
+	// Indexing through session(S):Goal runs read-only, like the goal
+	goals, _ := engine.ParseQuery(sessionID, "session(alarms):holds_at(ringing, 7)")
+	if result := engine.Query(Query{Goals: goals}, sessionID); result.Solutions[0].Success {
+		t.Error("Expected no events to be indexed read-only")
+	}
+	if len(queryAll(engine, events.ID, Compound("pending", []Term{Atom("ring"), Number(5)}))) != 1 {
+		t.Error("Expected a read-only caller not to change the session it indexes")
+	}
+
+	// and that index is not the one the session's own queries use
+	if len(queryAll(engine, events.ID, Compound("holds_at", []Term{Atom("ringing"), Number(7)}))) != 1 {
+		t.Error("Expected the session's own index to see the event")
+	}
+}
+
+func TestEventCalculusClipped(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+	if err := engine.EnableLibrary(sessionID, "event_calculus"); err != nil {
+		t.Fatalf("Failed to enable event_calculus: %v", err)
+	}
+	setupDoorNarrative(t, engine, sessionID)
+
+	goal := Compound("clipped", []Term{Number(5), Atom("door_open"), Number(12)})
+	solutions, _ := engine.evalBuiltin(goal, make(Substitution), sessionID)
+	if len(solutions) != 1 {
+		t.Errorf("Expected door_open to be clipped between 5 and 12, got %d solutions", len(solutions))
+	}
+
+	goal = Compound("clipped", []Term{Number(11), Atom("door_open"), Number(19)})
+	solutions, _ = engine.evalBuiltin(goal, make(Substitution), sessionID)
+	if len(solutions) != 0 {
+		t.Errorf("Expected door_open not to be clipped between 11 and 19, got %d solutions", len(solutions))
+	}
+
+	goal = Compound("declipped", []Term{Number(11), Variable("F"), Number(21)})
+	solutions, _ = engine.evalBuiltin(goal, make(Substitution), sessionID)
+	if len(solutions) != 2 {
+		t.Errorf("Expected door_open and locked to be declipped between 11 and 21, got %d solutions", len(solutions))
+	}
+}
+
+func TestEventCalculusWithDates(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+	if err := engine.EnableLibrary(sessionID, "event_calculus"); err != nil {
+		t.Fatalf("Failed to enable event_calculus: %v", err)
+	}
+
+	hired := time.Now().AddDate(0, -6, 0)
+	engine.AddFact(Fact{SessionID: sessionID, Predicate: Compound("happens", []Term{Compound("hire", []Term{Atom("ann")}), Date(hired)})})
+	engine.AddRule(Rule{
+		SessionID: sessionID,
+		Head:      Compound("initiates", []Term{Compound("hire", []Term{Variable("P")}), Compound("employed", []Term{Variable("P")}), Variable("T")}),
+		Body:      []Term{},
+	})
+
+	// holds_at with an unbound time asks about now
+	result := engine.Query(Query{Goals: []Term{Compound("holds_at", []Term{Compound("employed", []Term{Variable("Who")}), Variable("T")})}}, sessionID)
+	if len(result.Solutions) != 1 || !result.Solutions[0].Success {
+		t.Fatalf("Expected ann to be employed now, got %v", result.Solutions)
+	}
+	if result.Solutions[0].Bindings["Who"].Value != "ann" || result.Solutions[0].Bindings["T"].Type != "date" {
+		t.Errorf("Unexpected bindings %v", result.Solutions[0].Bindings)
+	}
+
+	// Before the hire date the fluent does not hold
+	before := Date(hired.AddDate(0, 0, -1))
+	result = engine.Query(Query{Goals: []Term{Compound("holds_at", []Term{Compound("employed", []Term{Atom("ann")}), before})}}, sessionID)
+	if result.Solutions[0].Success {
+		t.Error("Expected employed(ann) not to hold before the hire date")
+	}
+
+	// New events are picked up once added
+	fired := time.Now().AddDate(0, -1, 0)
+	engine.AddFact(Fact{SessionID: sessionID, Predicate: Compound("happens", []Term{Compound("fire", []Term{Atom("ann")}), Date(fired)})})
+	engine.AddRule(Rule{
+		SessionID: sessionID,
+		Head:      Compound("terminates", []Term{Compound("fire", []Term{Variable("P")}), Compound("employed", []Term{Variable("P")}), Variable("T")}),
+		Body:      []Term{},
+	})
+	result = engine.Query(Query{Goals: []Term{Compound("holds_at", []Term{Compound("employed", []Term{Atom("ann")}), Variable("T")})}}, sessionID)
+	if result.Solutions[0].Success {
+		t.Error("Expected employed(ann) to be terminated after firing")
+	}
+}
+
+func TestEnableLibraryHandler(t *testing.T) {
+	router, engine := setupTestRouter(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+
+	body, _ := json.Marshal(EnableLibraryRequest{Library: "event_calculus"})
+	w := httptest.NewRecorder()
+	httpReq, _ := http.NewRequest("POST", "/api/v1/sessions/"+sessionID+"/libraries", bytes.NewBuffer(body))
+	httpReq.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, httpReq)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	httpReq, _ = http.NewRequest("GET", "/api/v1/sessions/"+sessionID+"/libraries", nil)
+	router.ServeHTTP(w, httpReq)
+
+	var response map[string][]string
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	if len(response["libraries"]) != 1 || response["libraries"][0] != "event_calculus" {
+		t.Errorf("Expected [event_calculus], got %v", response["libraries"])
+	}
+
+	body, _ = json.Marshal(EnableLibraryRequest{Library: "unknown"})
+	w = httptest.NewRecorder()
+	httpReq, _ = http.NewRequest("POST", "/api/v1/sessions/"+sessionID+"/libraries", bytes.NewBuffer(body))
+	httpReq.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, httpReq)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for unknown library, got %d", http.StatusBadRequest, w.Code)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Load-time expansion. When a session defines term_expansion/2 or
+// goal_expansion/2, every clause added through AddFact, AddRule or Consult
+// is passed through them before it is stored:
+//
+//	term_expansion(Clause, Expanded)  rewrites a whole clause; Expanded may
+//	                                  be a list of clauses (or [] to drop it)
+//	goal_expansion(Goal, Expanded)    rewrites body goals, repeatedly, inside
+//	                                  control constructs too
+//
+// Clauses of the hooks themselves are stored unexpanded.
+
+// maxGoalExpansions bounds how often one goal is rewritten, so a
+// goal_expansion/2 that never reaches a fixpoint cannot hang a load.
+const maxGoalExpansions = 100
+
+// goalPositions lists the arguments of control constructs that are goals.
+var goalPositions = map[string][]int{
+	",/2": {0, 1}, ";/2": {0, 1}, "->/2": {0, 1}, "\\+/1": {0},
+	"call/1": {0}, "once/1": {0}, "ignore/1": {0}, "forall/2": {0, 1},
+	"findall/3": {1}, "aggregate_all/3": {1},
+}
+
+// expansionHooks records which expansion hooks a session's lineage defines.
+type expansionHooks struct {
+	term, goal bool
+}
+
+// definesPredicate reports whether the user module of a session or of a
+// session it inherits from has any clause for name.
+func (e *Engine) definesPredicate(sessionID, name string) bool {
+	for _, id := range e.sessionLineage(sessionID) {
+		var exists bool
+		err := e.db.QueryRow(`SELECT EXISTS(SELECT 1 FROM facts WHERE session_id = ? AND predicate = ? AND module = 'user')
+			OR EXISTS(SELECT 1 FROM rules WHERE session_id = ? AND head_predicate = ? AND module = 'user')`,
+			id, name, id, name).Scan(&exists)
+		if err == nil && exists {
+			return true
+		}
+	}
+	return false
+}
+
+// sessionExpansions returns the expansion hooks a session sees, looking
+// them up once until a hook clause or the session's parents change.
+func (e *Engine) sessionExpansions(sessionID string) expansionHooks {
+	e.mu.Lock()
+	hooks, ok := e.expansions[sessionID]
+	generation := e.generations[sessionID]
+	e.mu.Unlock()
+	if ok {
+		return hooks
+	}
+
+	hooks = expansionHooks{
+		term: e.definesPredicate(sessionID, "term_expansion"),
+		goal: e.definesPredicate(sessionID, "goal_expansion"),
+	}
+	e.mu.Lock()
+	if e.generations[sessionID] == generation {
+		e.expansions[sessionID] = hooks
+	}
+	e.mu.Unlock()
+	return hooks
+}
+
+// forgetExpansions drops the cached expansion hooks of a session and of the
+// sessions inheriting from it.
+func (e *Engine) forgetExpansions(sessionID string) {
+	ids := append([]string{sessionID}, e.sessionDescendants(sessionID)...)
+	e.mu.Lock()
+	for _, id := range ids {
+		delete(e.expansions, id)
+	}
+	e.mu.Unlock()
+}
+
+// expandsClauses reports whether clauses added to a session go through
+// load-time expansion.
+func (e *Engine) expandsClauses(sessionID string) bool {
+	hooks := e.sessionExpansions(sessionID)
+	return hooks.term || hooks.goal
+}
+
+func isExpansionHook(head Term) bool {
+	name := head.Value
+	return head.Type == "compound" && (name == "term_expansion" || name == "goal_expansion")
+}
+
+// ruleTerm returns a rule as the clause term seen by term_expansion/2.
+func ruleTerm(rule Rule) Term {
+	if isGrammarRule(rule) {
+		return rule.Head
+	}
+	return Compound(":-", []Term{rule.Head, conjunction(rule.Body)})
+}
+
+// directiveFailures is the error of adding a clause that expanded to
+// directives which failed. The clauses it expanded to are still stored.
+type directiveFailures []string
+
+func (f directiveFailures) Error() string {
+	return strings.Join(f, "; ")
+}
+
+// addExpanded stores the clauses term expands to and runs the directives
+// among them, reporting those that fail as directiveFailures.
+func (e *Engine) addExpanded(sessionID string, term Term) error {
+	var failed directiveFailures
+	for _, clause := range e.expandTerm(sessionID, term) {
+		module, clause := splitModule(clause)
+		switch {
+		case clause.Type == "compound" && clause.Value == ":-" && len(clause.Args) == 2:
+			body := flattenConjunction(clause.Args[1])
+			if len(body) == 1 && body[0].Type == "atom" && body[0].Value == "true" {
+				body = []Term{}
+			}
+			if !isExpansionHook(clause.Args[0]) {
+				body = e.expandGoals(sessionID, body)
+			}
+			if err := e.insertRule(Rule{SessionID: sessionID, Head: qualify(module, clause.Args[0]), Body: body}); err != nil {
+				return err
+			}
+
+		case clause.Type == "compound" && clause.Value == "-->" && len(clause.Args) == 2:
+			rule, err := e.newDCGTranslator().translateRule(clause.Args[0], clause.Args[1])
+			if err != nil {
+				return err
+			}
+			rule.SessionID, rule.Head, rule.Body = sessionID, qualify(module, rule.Head), e.expandGoals(sessionID, rule.Body)
+			if err := e.insertRule(rule); err != nil {
+				return err
+			}
+
+		case clause.Type == "compound" && clause.Value == ":-" && len(clause.Args) == 1:
+			goals := qualifyGoals(module, e.expandGoals(sessionID, flattenConjunction(clause.Args[0])))
+			if !e.Query(Query{Goals: goals}, sessionID).Solutions[0].Success {
+				failed = append(failed, fmt.Sprintf("directive failed: %s", e.sessionOps(sessionID).format(clause.Args[0], true)))
+			}
+
+		case clause.Type == "atom" || clause.Type == "compound":
+			if err := e.insertFact(Fact{SessionID: sessionID, Predicate: qualify(module, clause)}); err != nil {
+				return err
+			}
+
+		default:
+			return fmt.Errorf("cannot add %s as a clause", formatTerm(clause, true))
+		}
+	}
+	if len(failed) > 0 {
+		return failed
+	}
+	return nil
+}
+
+// expandTerm applies term_expansion/2 to a clause, returning the clauses
+// to store.
+func (e *Engine) expandTerm(sessionID string, term Term) []Term {
+	if !e.sessionExpansions(sessionID).term {
+		return []Term{term}
+	}
+	result := e.freshVar()
+	solutions := e.solve([]Term{Compound("term_expansion", []Term{term, result})}, make(Substitution), sessionID)
+	if len(solutions) == 0 {
+		return []Term{term}
+	}
+	expanded := e.instantiate(result, solutions[0])
+	if expanded.Type == "list" && expanded.Value != listTailMarker {
+		return expanded.Args
+	}
+	if expanded.Type == "atom" && expanded.Value == "[]" {
+		return nil
+	}
+	return []Term{expanded}
+}
+
+// expandGoals applies goal_expansion/2 to the goals of a clause body.
+func (e *Engine) expandGoals(sessionID string, goals []Term) []Term {
+	if !e.sessionExpansions(sessionID).goal {
+		return goals
+	}
+	expanded := make([]Term, 0, len(goals))
+	for _, goal := range goals {
+		expanded = append(expanded, flattenConjunction(e.expandGoal(sessionID, goal))...)
+	}
+	return expanded
+}
+
+// expandGoal rewrites goal until goal_expansion/2 no longer applies, then
+// expands the goals nested in control constructs.
+func (e *Engine) expandGoal(sessionID string, goal Term) Term {
+	for i := 0; i < maxGoalExpansions; i++ {
+		if goal.Type != "atom" && goal.Type != "compound" {
+			return goal
+		}
+		result := e.freshVar()
+		solutions := e.solve([]Term{Compound("goal_expansion", []Term{goal, result})}, make(Substitution), sessionID)
+		if len(solutions) == 0 {
+			break
+		}
+		expanded, ok := e.expansionResult(goal, result, solutions[0])
+		if !ok || compareTerms(expanded, goal) == 0 {
+			break
+		}
+		goal = expanded
+	}
+
+	if goal.Type != "compound" {
+		return goal
+	}
+	positions, ok := goalPositions[fmt.Sprintf("%s/%d", goal.Value, len(goal.Args))]
+	if !ok {
+		return goal
+	}
+	args := append([]Term{}, goal.Args...)
+	for _, i := range positions {
+		args[i] = e.expandGoal(sessionID, args[i])
+	}
+	return Compound(goal.Value.(string), args)
+}
+
+// expansionResult instantiates the result of goal_expansion/2 so that the
+// variables of the expanded goal keep their names and stay shared with the
+// rest of the clause. It fails when the hook bound one of them, since the
+// binding could not reach the other goals.
+func (e *Engine) expansionResult(goal, result Term, subst Substitution) (Term, bool) {
+	vars := make(map[string]bool)
+	e.collectVars(goal, vars)
+	renames := make(Substitution)
+	for v := range vars {
+		bound := e.deref(Variable(v), subst)
+		if bound.Type != "variable" {
+			return Term{}, false
+		}
+		if name := bound.Value.(string); name != v {
+			if _, aliased := renames[name]; aliased {
+				return Term{}, false
+			}
+			renames[name] = Variable(v)
+		}
+	}
+	return e.instantiate(e.instantiate(result, subst), renames), true
+}
@@ -0,0 +1,170 @@
+package main
+
+import "testing"
+
+func TestTermExpansion(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+
+	_, err := engine.Consult(sessionID, `
+% Tag imported records with their source
+term_expansion(employee(N, D), employee(N, D, hr_import)).
+% One clause can expand to several, or to none
+term_expansion(pair(A, B), [left(A), right(B)]).
+term_expansion(obsolete(_), []).
+
+employee(ann, sales).
+pair(x, y).
+obsolete(z).
+`)
+	if err != nil {
+		t.Fatalf("Consult failed: %v", err)
+	}
+
+	solutions := queryAll(engine, sessionID, Compound("employee", []Term{Atom("ann"), Variable("D"), Variable("Src")}))
+	if len(solutions) != 1 || solutions[0].Bindings["Src"].Value != "hr_import" {
+		t.Errorf("Expected the fact to carry its source, got %v", solutions)
+	}
+	if len(queryAll(engine, sessionID, Compound("employee", []Term{Atom("ann"), Variable("D")}))) != 0 {
+		t.Error("Expected the unexpanded fact not to be stored")
+	}
+
+	if len(queryAll(engine, sessionID, Compound("left", []Term{Atom("x")}), Compound("right", []Term{Atom("y")}))) != 1 {
+		t.Error("Expected pair(x, y) to expand to two facts")
+	}
+	if len(queryAll(engine, sessionID, Compound("current_predicate", []Term{Compound("/", []Term{Atom("obsolete"), Variable("A")})}))) != 0 {
+		t.Error("Expected obsolete/1 to be dropped")
+	}
+
+	// Facts and rules added through the API are expanded too
+	engine.AddFact(Fact{SessionID: sessionID, Predicate: Compound("employee", []Term{Atom("bob"), Atom("it")})})
+	engine.AddRule(Rule{SessionID: sessionID,
+		Head: Compound("employee", []Term{Variable("N"), Atom("it")}),
+		Body: []Term{Compound("contractor", []Term{Variable("N")})},
+	})
+	solutions = queryAll(engine, sessionID, Compound("employee", []Term{Atom("bob"), Atom("it"), Variable("Src")}))
+	if len(solutions) != 1 || solutions[0].Bindings["Src"].Value != "hr_import" {
+		t.Errorf("Expected the API fact to be expanded, got %v", solutions)
+	}
+	// A rule does not match the employee/2 pattern and is stored as given
+	solutions = queryAll(engine, sessionID, Compound("clause", []Term{Compound("employee", []Term{Variable("N"), Atom("it")}), Variable("B")}))
+	if len(solutions) != 1 || solutions[0].Bindings["B"].Value != "contractor" {
+		t.Errorf("Expected the API rule to be stored unchanged, got %v", solutions)
+	}
+}
+
+func TestGoalExpansion(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+
+	_, err := engine.Consult(sessionID, `
+% Inline constants and expand a domain macro
+goal_expansion(retirement_age(X), X = 65).
+goal_expansion(adult(P), (age(P, A), A #>= 18)).
+
+age(ann, 70).
+age(bob, 30).
+age(cal, 12).
+
+retired(P) :- age(P, A), retirement_age(R), A #>= R.
+minor(P) :- age(P, _), \+ adult(P).
+`)
+	if err != nil {
+		t.Fatalf("Consult failed: %v", err)
+	}
+
+	solutions := queryAll(engine, sessionID, Compound("clause", []Term{Compound("retired", []Term{Variable("P")}), Variable("Body")}))
+	if len(solutions) != 1 {
+		t.Fatalf("Expected one clause for retired/1, got %v", solutions)
+	}
+	if body := solutions[0].Bindings["Body"]; containsGoal(body, "retirement_age") || !containsGoal(body, "=") {
+		t.Errorf("Expected retirement_age/1 to be inlined, got %s", formatTerm(body, true))
+	}
+
+	solutions = queryAll(engine, sessionID, Compound("retired", []Term{Variable("P")}))
+	if len(solutions) != 1 || solutions[0].Bindings["P"].Value != "ann" {
+		t.Errorf("Expected ann to be retired, got %v", solutions)
+	}
+
+	// Goals inside control constructs are expanded
+	solutions = queryAll(engine, sessionID, Compound("minor", []Term{Variable("P")}))
+	if len(solutions) != 1 || solutions[0].Bindings["P"].Value != "cal" {
+		t.Errorf("Expected cal to be the only minor, got %v", solutions)
+	}
+}
+
+func TestExpandedDirectives(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+
+	result, err := engine.Consult(sessionID, `
+term_expansion(setting(K, V), [setting(K, V), (:- number(V))]).
+
+setting(retries, 3).
+setting(mode, fast).
+`)
+	if err != nil {
+		t.Fatalf("Consult failed: %v", err)
+	}
+	if len(result.Warnings) != 1 || result.Warnings[0] != "directive failed: number(fast)" {
+		t.Errorf("Expected the failed expanded directive as a warning, got %v", result.Warnings)
+	}
+	if len(queryAll(engine, sessionID, Compound("setting", []Term{Variable("K"), Variable("V")}))) != 2 {
+		t.Error("Expected both settings to be stored")
+	}
+
+	// Through the API the failure is the error of the call
+	err = engine.AddFact(Fact{SessionID: sessionID, Predicate: Compound("setting", []Term{Atom("level"), Atom("high")})})
+	if _, ok := err.(directiveFailures); !ok {
+		t.Errorf("Expected a failed directive error, got %v", err)
+	}
+}
+
+func TestExpansionFromParents(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+
+	library, _ := engine.CreateSession(CreateSessionRequest{Name: "conventions"})
+	sessionID := createTestSession(t, engine)
+	engine.AddFact(Fact{SessionID: sessionID, Predicate: Compound("employee", []Term{Atom("ann"), Atom("sales")})})
+	if err := engine.AddParent(sessionID, library.ID); err != nil {
+		t.Fatalf("Failed to add parent: %v", err)
+	}
+
+	// A hook added to a parent applies to clauses added afterwards
+	if _, err := engine.Consult(library.ID, "term_expansion(employee(N, D), employee(N, D, imported))."); err != nil {
+		t.Fatalf("Consult failed: %v", err)
+	}
+	engine.AddFact(Fact{SessionID: sessionID, Predicate: Compound("employee", []Term{Atom("bob"), Atom("it")})})
+	if len(queryAll(engine, sessionID, Compound("employee", []Term{Atom("bob"), Atom("it"), Atom("imported")}))) != 1 {
+		t.Error("Expected the parent's term_expansion/2 to apply")
+	}
+	if len(queryAll(engine, sessionID, Compound("employee", []Term{Atom("ann"), Atom("sales")}))) != 1 {
+		t.Error("Expected clauses added before the hook to stay as they were")
+	}
+
+	// and stops applying once the session no longer inherits it
+	engine.RemoveParent(sessionID, library.ID)
+	engine.AddFact(Fact{SessionID: sessionID, Predicate: Compound("employee", []Term{Atom("cy"), Atom("it")})})
+	if len(queryAll(engine, sessionID, Compound("employee", []Term{Atom("cy"), Atom("it")}))) != 1 {
+		t.Error("Expected the hook to stop applying after the parent is removed")
+	}
+}
+
+// containsGoal reports whether a clause body calls name.
+func containsGoal(body Term, name string) bool {
+	for _, goal := range flattenConjunction(body) {
+		if goal.Value == name {
+			return true
+		}
+		for _, arg := range goal.Args {
+			if containsGoal(arg, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
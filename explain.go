@@ -0,0 +1,518 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Explain plans. ExplainQuery analyses a query without running it. Starting
+// from the query's goals it follows rule bodies to every predicate the query
+// can reach, classifies each one, asks SQLite how it finds their clauses and
+// marks recursion. Costs are estimated the way the solver works: every call
+// of a user predicate loads and unifies all its clauses, a goal runs once
+// for each solution of the goals before it, and the solutions of a fact
+// predicate shrink by the number of distinct values of each bound argument.
+// Recursive calls are counted for one level.
+
+// maxExplainDepth bounds how far rule bodies are followed when estimating.
+const maxExplainDepth = 8
+
+// builtinNames are the goals evalBuiltin handles, by name; the event
+// calculus predicates only when the library is enabled.
+var builtinNames = map[string]bool{
+	"true": true, "fail": true, "false": true, "listing": true, "nl": true, "trace": true, "notrace": true,
+	",": true, ";": true, "->": true, "\\+": true, "call": true, "once": true, "ignore": true, "forall": true, "findall": true,
+	"append": true, "member": true, "memberchk": true, "length": true, "nth0": true, "nth1": true, "reverse": true,
+	"last": true, "sum_list": true, "max_list": true, "min_list": true, "list_to_set": true,
+	"include": true, "exclude": true, "maplist": true, "foldl": true,
+	"freeze": true, "dif": true, "when": true,
+	"in": true, "ins": true, "#=": true, "#\\=": true, "#<": true, "#=<": true, "#>": true, "#>=": true,
+	"all_different": true, "all_distinct": true, "label": true, "labeling": true,
+	"fd_dom": true, "fd_inf": true, "fd_sup": true, "fd_size": true,
+	"phrase": true, "clause": true, "current_predicate": true, "predicate_property": true,
+	"write": true, "writeln": true, "print": true, "writeq": true, "write_canonical": true, "format": true, "term_to_atom": true,
+	"op": true, "current_op": true, ":": true, "module": true, "use_module": true, "current_module": true,
+	"multifile": true, "spy": true, "nospy": true, "materialize": true, "retract": true,
+	"=": true, "atom": true, "var": true, "number": true,
+	"count": true, "sum": true, "max": true, "min": true, "aggregate_all": true, "aggregate": true,
+	"now": true, "date_before": true, "date_after": true, "days_between": true, "parse_date": true, "format_date": true,
+	"make_date": true, "date_year": true, "date_month": true, "date_day": true, "date_weekday": true,
+	"date_hour": true, "date_minute": true, "date_second": true, "date_add": true, "date_subtract": true,
+	"date_convert_tz": true, "date_truncate": true, "make_interval": true, "allen_relation": true,
+	"interval_before": true, "interval_after": true, "interval_meets": true, "interval_met_by": true,
+	"interval_overlaps": true, "interval_overlapped_by": true, "interval_starts": true, "interval_started_by": true,
+	"interval_during": true, "interval_contains": true, "interval_finishes": true, "interval_finished_by": true,
+	"interval_equals": true, "interval_intersection": true, "interval_union": true, "interval_duration": true,
+	"help": true,
+}
+
+// eventCalculusNames are the goals of the event_calculus library.
+var eventCalculusNames = map[string]bool{"holds_at": true, "clipped": true, "declipped": true}
+
+// QueryPlan is what the engine would do to answer a query.
+type QueryPlan struct {
+	Goals       []GoalPlan      `json:"goals"`
+	Predicates  []PredicatePlan `json:"predicates"` // the predicates the query can reach, in the order reached
+	Cost        float64         `json:"estimated_cost"`
+	Explanation string          `json:"explanation"`
+}
+
+// GoalPlan is the estimate for one goal of the query.
+type GoalPlan struct {
+	Goal      Term    `json:"goal"`
+	Predicate string  `json:"predicate"`
+	Kind      string  `json:"kind"`            // "builtin", "control", "facts", "rules", "mixed" or "undefined"
+	Bound     []int   `json:"bound,omitempty"` // arguments bound when the goal is called, from 1
+	Calls     float64 `json:"estimated_calls"`
+	Solutions float64 `json:"estimated_solutions"` // per call
+	Cost      float64 `json:"estimated_cost"`      // all calls together
+}
+
+// PredicatePlan describes a predicate the query can reach.
+type PredicatePlan struct {
+	Predicate     string   `json:"predicate"` // Name/Arity, qualified outside the user module
+	Kind          string   `json:"kind"`
+	Facts         int      `json:"facts"`
+	Rules         int      `json:"rules"`
+	Distinct      []int    `json:"distinct,omitempty"` // distinct values of each argument among the facts
+	Index         []string `json:"index,omitempty"`    // how SQLite finds the clauses
+	Calls         []string `json:"calls,omitempty"`    // the predicates its rules call
+	Recursive     bool     `json:"recursive,omitempty"`
+	LeftRecursive bool     `json:"left_recursive,omitempty"` // a rule can call it again before anything else
+	SQL           string   `json:"sql,omitempty"`            // the query its rules compile to, if they do
+}
+
+// predicateStats are the stored clauses of a predicate as the solver sees
+// them from a session.
+type predicateStats struct {
+	facts    []Fact
+	rules    []Rule
+	distinct []int
+}
+
+type queryPlanner struct {
+	e          *Engine
+	sessionID  string
+	stats      map[string]*predicateStats
+	plans      map[string]*PredicatePlan
+	order      []string
+	leftCalls  map[string]map[string]bool
+	bodyCalls  map[string]map[string]bool
+	estimating map[string]bool // predicates whose estimate is in progress
+}
+
+// ExplainQuery returns the plan of a query without running it.
+func (e *Engine) ExplainQuery(query Query, sessionID string) *QueryPlan {
+	p := newQueryPlanner(e, sessionID)
+	plan := &QueryPlan{Goals: []GoalPlan{}}
+	bound := make(map[string]bool)
+	calls := 1.0
+	goals := query.Goals
+	if query.Optimize {
+		goals = e.reorderGoals(goals, sessionID)
+	}
+	for _, goal := range goals {
+		p.reach(goal, userModule)
+		module, plain := splitModule(goal)
+		solutions, cost := p.estimate(goal, userModule, bound, 0)
+		goalPlan := GoalPlan{Goal: goal, Predicate: p.key(plain, p.e.resolveModule(sessionID, module, plain)),
+			Kind: p.kind(plain, module), Bound: boundArgs(plain, bound),
+			Calls: calls, Solutions: solutions, Cost: calls * cost}
+		plan.Goals = append(plan.Goals, goalPlan)
+		plan.Cost += goalPlan.Cost
+		calls *= solutions
+		e.collectVars(goal, bound)
+	}
+
+	p.markRecursion()
+	plan.Predicates = make([]PredicatePlan, 0, len(p.order))
+	for _, key := range p.order {
+		plan.Predicates = append(plan.Predicates, *p.plans[key])
+	}
+	plan.Explanation = p.explain(plan)
+	return plan
+}
+
+func newQueryPlanner(e *Engine, sessionID string) *queryPlanner {
+	return &queryPlanner{e: e, sessionID: sessionID, stats: make(map[string]*predicateStats),
+		plans: make(map[string]*PredicatePlan), leftCalls: make(map[string]map[string]bool),
+		bodyCalls: make(map[string]map[string]bool), estimating: make(map[string]bool)}
+}
+
+// key names the predicate of goal as defined in module.
+func (p *queryPlanner) key(goal Term, module string) string {
+	if goal.Type != "atom" && goal.Type != "compound" {
+		return ""
+	}
+	key := indicatorKey(goal.Value.(string), len(goal.Args))
+	if module != userModule {
+		key = module + ":" + key
+	}
+	return key
+}
+
+func (p *queryPlanner) builtin(goal Term) bool {
+	return p.e.isBuiltin(goal, p.sessionID)
+}
+
+// kind classifies goal called from module.
+func (p *queryPlanner) kind(goal Term, module string) string {
+	switch {
+	case goal.Type == "compound" && goalPositions[indicatorKey(goal.Value.(string), len(goal.Args))] != nil:
+		return "control"
+	case p.builtin(goal):
+		return "builtin"
+	case goal.Type != "atom" && goal.Type != "compound":
+		return "undefined"
+	}
+	stats := p.predicate(goal, p.e.resolveModule(p.sessionID, module, goal))
+	switch {
+	case len(stats.facts) > 0 && len(stats.rules) > 0:
+		return "mixed"
+	case len(stats.rules) > 0:
+		return "rules"
+	case len(stats.facts) > 0:
+		return "facts"
+	}
+	return "undefined"
+}
+
+// predicate loads the clauses of goal's predicate in module.
+func (p *queryPlanner) predicate(goal Term, module string) *predicateStats {
+	key := p.key(goal, module)
+	if stats, ok := p.stats[key]; ok {
+		return stats
+	}
+	stats := p.e.predicateStats(goal, module, p.sessionID)
+	p.stats[key] = stats
+	return stats
+}
+
+// predicateStats loads the clauses a session sees for goal's predicate and
+// counts the distinct values of each argument among the facts.
+func (e *Engine) predicateStats(goal Term, module, sessionID string) *predicateStats {
+	facts, rules := e.visibleClauses(goal, module, sessionID)
+	stats := &predicateStats{facts: facts, rules: rules, distinct: make([]int, termArity(goal))}
+	for i := range stats.distinct {
+		values := make(map[string]bool)
+		for _, fact := range facts {
+			values[formatTerm(fact.Predicate.Args[i], true)] = true
+		}
+		stats.distinct[i] = len(values)
+	}
+	return stats
+}
+
+// reach records the predicates goal can call from module, following rule
+// bodies.
+func (p *queryPlanner) reach(goal Term, module string) {
+	if qualified, plain := splitModule(goal); qualified != userModule {
+		module, goal = qualified, plain
+	}
+	if goal.Type != "atom" && goal.Type != "compound" {
+		return
+	}
+	if positions, ok := goalPositions[indicatorKey(goal.Value.(string), len(goal.Args))]; ok {
+		for _, i := range positions {
+			p.reach(goal.Args[i], module)
+		}
+		return
+	}
+	if goal.Type == "compound" && goal.Value == ":" {
+		return // session(S):Goal runs against another session
+	}
+
+	resolved := p.e.resolveModule(p.sessionID, module, goal)
+	key := p.key(goal, resolved)
+	if _, seen := p.plans[key]; seen {
+		return
+	}
+	plan := &PredicatePlan{Predicate: key, Kind: p.kind(goal, module)}
+	p.plans[key] = plan
+	p.order = append(p.order, key)
+	if plan.Kind == "builtin" {
+		return
+	}
+
+	stats := p.predicate(goal, resolved)
+	plan.Facts, plan.Rules = len(stats.facts), len(stats.rules)
+	if plan.Facts > 0 {
+		plan.Distinct = stats.distinct
+	}
+	plan.Index = p.e.clauseIndexes(goal, resolved, p.sessionID)
+	if len(stats.rules) > 0 {
+		args := make([]Term, len(goal.Args))
+		for i := range args {
+			args[i] = Variable(fmt.Sprintf("A%d", i+1))
+		}
+		if query, ok := p.e.compileSQL(Term{Type: goal.Type, Value: goal.Value, Args: args}, resolved, p.sessionID); ok {
+			plan.SQL = query.text.String()
+		}
+	}
+
+	p.leftCalls[key] = make(map[string]bool)
+	p.bodyCalls[key] = make(map[string]bool)
+	for _, rule := range stats.rules {
+		for i, bodyGoal := range rule.Body {
+			for _, called := range p.calledPredicates(bodyGoal, resolved) {
+				p.bodyCalls[key][called] = true
+				if i == 0 {
+					p.leftCalls[key][called] = true
+				}
+			}
+			p.reach(bodyGoal, resolved)
+		}
+	}
+	for called := range p.bodyCalls[key] {
+		plan.Calls = append(plan.Calls, called)
+	}
+	sort.Strings(plan.Calls)
+}
+
+// calledPredicates returns the user predicates goal calls first: itself, or
+// the first goals of a control construct.
+func (p *queryPlanner) calledPredicates(goal Term, module string) []string {
+	if qualified, plain := splitModule(goal); qualified != userModule {
+		module, goal = qualified, plain
+	}
+	if goal.Type != "atom" && goal.Type != "compound" {
+		return nil
+	}
+	if goal.Type == "compound" && (goal.Value == "," || goal.Value == "->") && len(goal.Args) == 2 {
+		return p.calledPredicates(goal.Args[0], module)
+	}
+	if positions, ok := goalPositions[indicatorKey(goal.Value.(string), len(goal.Args))]; ok {
+		var called []string
+		for _, i := range positions {
+			called = append(called, p.calledPredicates(goal.Args[i], module)...)
+		}
+		return called
+	}
+	if p.builtin(goal) {
+		return nil
+	}
+	return []string{p.key(goal, p.e.resolveModule(p.sessionID, module, goal))}
+}
+
+// markRecursion flags the predicates that can call themselves, and those
+// that can do so before any other goal of their rules.
+func (p *queryPlanner) markRecursion() {
+	reaches := func(edges map[string]map[string]bool, from string) bool {
+		seen := make(map[string]bool)
+		stack := []string{}
+		for next := range edges[from] {
+			stack = append(stack, next)
+		}
+		for len(stack) > 0 {
+			key := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if key == from {
+				return true
+			}
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			for next := range edges[key] {
+				stack = append(stack, next)
+			}
+		}
+		return false
+	}
+	for key, plan := range p.plans {
+		plan.Recursive = reaches(p.bodyCalls, key)
+		plan.LeftRecursive = reaches(p.leftCalls, key)
+	}
+}
+
+// estimate returns the solutions per call of goal called from module with
+// the variables in bound bound, and the cost of one call.
+func (p *queryPlanner) estimate(goal Term, module string, bound map[string]bool, depth int) (solutions, cost float64) {
+	if qualified, plain := splitModule(goal); qualified != userModule {
+		module, goal = qualified, plain
+	}
+	if goal.Type != "atom" && goal.Type != "compound" {
+		return 0, 1
+	}
+
+	switch indicatorKey(goal.Value.(string), len(goal.Args)) {
+	case ",/2":
+		return p.conjunction(flattenConjunction(goal), module, copyBound(bound), depth)
+	case ";/2":
+		s1, c1 := p.estimate(goal.Args[0], module, bound, depth)
+		s2, c2 := p.estimate(goal.Args[1], module, bound, depth)
+		return s1 + s2, 1 + c1 + c2
+	case "->/2":
+		return p.conjunction([]Term{goal.Args[0], goal.Args[1]}, module, copyBound(bound), depth)
+	case "call/1", "once/1", "ignore/1", "\\+/1", "findall/3", "forall/2", "aggregate_all/3":
+		cost = 1
+		for _, i := range goalPositions[indicatorKey(goal.Value.(string), len(goal.Args))] {
+			s, c := p.estimate(goal.Args[i], module, bound, depth)
+			solutions, cost = s, cost+c
+		}
+		if goal.Value == "call" {
+			return solutions, cost
+		}
+		return 1, cost
+	}
+	if goal.Value == ":" || p.builtin(goal) {
+		return 1, 1
+	}
+
+	resolved := p.e.resolveModule(p.sessionID, module, goal)
+	key := p.key(goal, resolved)
+	stats := p.predicate(goal, resolved)
+	solutions = float64(len(stats.facts))
+	for i, arg := range goal.Args {
+		if ground(arg, bound) && stats.distinct[i] > 0 {
+			solutions /= float64(stats.distinct[i])
+		}
+	}
+	cost = 1 + float64(len(stats.facts)+len(stats.rules))
+	if len(stats.rules) == 0 {
+		return solutions, cost
+	}
+
+	// Recursive calls and deep bodies are counted as one more call
+	pattern := key + ":" + bindingPattern(goal, bound)
+	if p.estimating[pattern] || depth >= maxExplainDepth {
+		return solutions + 1, cost
+	}
+	p.estimating[pattern] = true
+	defer delete(p.estimating, pattern)
+	for _, rule := range stats.rules {
+		head := rule.Head
+		if termArity(head) != len(goal.Args) {
+			continue
+		}
+		ruleBound := make(map[string]bool)
+		for i, arg := range goal.Args {
+			if ground(arg, bound) {
+				p.e.collectVars(head.Args[i], ruleBound)
+			}
+		}
+		s, c := p.conjunction(rule.Body, resolved, ruleBound, depth+1)
+		solutions += s
+		cost += c
+	}
+	return solutions, cost
+}
+
+// conjunction estimates goals run one after the other, binding their
+// variables in bound.
+func (p *queryPlanner) conjunction(goals []Term, module string, bound map[string]bool, depth int) (solutions, cost float64) {
+	solutions = 1
+	for _, goal := range goals {
+		s, c := p.estimate(goal, module, bound, depth)
+		cost += solutions * c
+		solutions *= s
+		p.e.collectVars(goal, bound)
+	}
+	return solutions, cost
+}
+
+func copyBound(bound map[string]bool) map[string]bool {
+	copied := make(map[string]bool, len(bound))
+	for v := range bound {
+		copied[v] = true
+	}
+	return copied
+}
+
+// ground reports whether t has no variables outside bound.
+func ground(t Term, bound map[string]bool) bool {
+	switch t.Type {
+	case "variable":
+		return bound[t.Value.(string)]
+	case "compound", "interval", "list":
+		for _, arg := range t.Args {
+			if !ground(arg, bound) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// boundArgs lists the arguments of goal that are bound, from 1.
+func boundArgs(goal Term, bound map[string]bool) []int {
+	var positions []int
+	if goal.Type == "compound" {
+		for i, arg := range goal.Args {
+			if ground(arg, bound) {
+				positions = append(positions, i+1)
+			}
+		}
+	}
+	return positions
+}
+
+// bindingPattern writes b for each bound argument of goal and f for the
+// others.
+func bindingPattern(goal Term, bound map[string]bool) string {
+	var sb strings.Builder
+	for _, arg := range goal.Args {
+		if ground(arg, bound) {
+			sb.WriteByte('b')
+		} else {
+			sb.WriteByte('f')
+		}
+	}
+	return sb.String()
+}
+
+// clauseIndexes asks SQLite how it finds the clauses of goal's predicate.
+func (e *Engine) clauseIndexes(goal Term, module, sessionID string) []string {
+	var details []string
+	for _, query := range []string{factsQuery, rulesQuery} {
+		rows, err := e.db.Query("EXPLAIN QUERY PLAN "+query, e.extractPredicate(goal), sessionID, module)
+		if err != nil {
+			continue
+		}
+		for rows.Next() {
+			var id, parent, unused int
+			var detail string
+			if rows.Scan(&id, &parent, &unused, &detail) == nil {
+				details = append(details, detail)
+			}
+		}
+		rows.Close()
+	}
+	return details
+}
+
+// explain renders a plan as text.
+func (p *queryPlanner) explain(plan *QueryPlan) string {
+	ops := p.e.sessionOps(p.sessionID)
+	var sb strings.Builder
+	for i, goal := range plan.Goals {
+		fmt.Fprintf(&sb, "%d. %s  %s", i+1, ops.format(goal.Goal, true), goal.Kind)
+		if len(goal.Bound) > 0 {
+			fmt.Fprintf(&sb, ", bound arguments %v", goal.Bound)
+		}
+		fmt.Fprintf(&sb, ": %s calls, %s solutions per call, cost %s\n",
+			formatEstimate(goal.Calls), formatEstimate(goal.Solutions), formatEstimate(goal.Cost))
+	}
+	fmt.Fprintf(&sb, "Estimated cost: %s\n", formatEstimate(plan.Cost))
+	for _, pred := range plan.Predicates {
+		fmt.Fprintf(&sb, "%s  %s", pred.Predicate, pred.Kind)
+		if pred.Kind != "builtin" {
+			fmt.Fprintf(&sb, ", %d facts, %d rules", pred.Facts, pred.Rules)
+		}
+		if pred.LeftRecursive {
+			sb.WriteString(", left-recursive")
+		} else if pred.Recursive {
+			sb.WriteString(", recursive")
+		}
+		sb.WriteString("\n")
+		for _, index := range pred.Index {
+			sb.WriteString("  " + index + "\n")
+		}
+	}
+	return sb.String()
+}
+
+func formatEstimate(f float64) string {
+	return formatNumber(float64(int64(f*10+0.5)) / 10)
+}
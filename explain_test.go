@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func findPredicatePlan(plan *QueryPlan, predicate string) *PredicatePlan {
+	for i := range plan.Predicates {
+		if plan.Predicates[i].Predicate == predicate {
+			return &plan.Predicates[i]
+		}
+	}
+	return nil
+}
+
+func TestExplainQuery(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+
+	if _, err := engine.Consult(sessionID, familySource+`
+ancestor(X, Y) :- parent(X, Y).
+ancestor(X, Z) :- parent(X, Y), ancestor(Y, Z).
+reaches(X, Y) :- reaches(X, Z), parent(Z, Y).
+reaches(X, Y) :- parent(X, Y).
+`); err != nil {
+		t.Fatalf("Consult failed: %v", err)
+	}
+
+	goals, _ := engine.ParseQuery(sessionID, "parent(X, Y), parent(Y, cal)")
+	plan := engine.ExplainQuery(Query{Goals: goals}, sessionID)
+	if len(plan.Goals) != 2 || plan.Goals[0].Kind != "facts" || plan.Goals[0].Bound != nil {
+		t.Fatalf("Expected two fact goals with nothing bound first, got %+v", plan.Goals)
+	}
+	// Three parents are found first, then each checks its bound child
+	// against 2 distinct parents and 3 distinct children
+	second := plan.Goals[1]
+	if len(second.Bound) != 2 || second.Calls != 3 || second.Solutions != 0.5 || second.Cost != 12 {
+		t.Errorf("Expected 3 calls of 4 with half a solution each, got %+v", second)
+	}
+	parent := findPredicatePlan(plan, "parent/2")
+	if parent == nil || parent.Facts != 3 || parent.Rules != 0 || len(parent.Index) != 2 || parent.Recursive {
+		t.Fatalf("Expected parent/2 as three facts with index details, got %+v", parent)
+	}
+	if !strings.Contains(parent.Index[0], "facts") || parent.Distinct[0] != 2 || parent.Distinct[1] != 3 {
+		t.Errorf("Expected the fact index and distinct values, got %+v", parent)
+	}
+
+	goals, _ = engine.ParseQuery(sessionID, "ancestor(ann, W), reaches(W, V), \\+ missing(V), dif(W, V)")
+	plan = engine.ExplainQuery(Query{Goals: goals}, sessionID)
+	kinds := []string{}
+	for _, goal := range plan.Goals {
+		kinds = append(kinds, goal.Kind)
+	}
+	if strings.Join(kinds, " ") != "rules rules control builtin" {
+		t.Errorf("Expected rules, rules, control and builtin goals, got %v", kinds)
+	}
+	if ancestor := findPredicatePlan(plan, "ancestor/2"); ancestor == nil || !ancestor.Recursive || ancestor.LeftRecursive ||
+		strings.Join(ancestor.Calls, " ") != "ancestor/2 parent/2" {
+		t.Errorf("Expected ancestor/2 to be right-recursive, got %+v", ancestor)
+	}
+	if reaches := findPredicatePlan(plan, "reaches/2"); reaches == nil || !reaches.LeftRecursive {
+		t.Errorf("Expected reaches/2 to be left-recursive, got %+v", reaches)
+	}
+	if missing := findPredicatePlan(plan, "missing/1"); missing == nil || missing.Kind != "undefined" {
+		t.Errorf("Expected missing/1 to be undefined, got %+v", missing)
+	}
+	if dif := findPredicatePlan(plan, "dif/2"); dif == nil || dif.Kind != "builtin" || dif.Index != nil {
+		t.Errorf("Expected dif/2 as a builtin, got %+v", dif)
+	}
+	if !strings.Contains(plan.Explanation, "reaches/2  rules, 0 facts, 2 rules, left-recursive\n") {
+		t.Errorf("Expected left recursion in the explanation, got:\n%s", plan.Explanation)
+	}
+
+	// Nothing runs: the goals have no side effects
+	goals, _ = engine.ParseQuery(sessionID, "write(hello), spy(parent/2)")
+	if plan = engine.ExplainQuery(Query{Goals: goals}, sessionID); plan.Cost != 2 {
+		t.Errorf("Expected two builtin calls, got %v", plan.Cost)
+	}
+	if spies, _ := engine.SessionSpyPoints(sessionID); len(spies) != 0 {
+		t.Errorf("Expected explain not to run spy/1, got %v", spies)
+	}
+}
+
+func TestExplainHandler(t *testing.T) {
+	router, engine := setupTestRouter(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+	engine.Consult(sessionID, familySource)
+
+	body, _ := json.Marshal(Query{Text: "grandparent(ann, W)"})
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/sessions/"+sessionID+"/explain", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+
+	var plan QueryPlan
+	json.Unmarshal(w.Body.Bytes(), &plan)
+	if w.Code != http.StatusOK || len(plan.Goals) != 1 || plan.Goals[0].Predicate != "grandparent/2" || plan.Cost <= 0 {
+		t.Fatalf("Expected a plan for grandparent/2, got %d %s", w.Code, w.Body.String())
+	}
+	if !strings.HasPrefix(plan.Explanation, "1. grandparent(ann,W)  rules, bound arguments [1]") {
+		t.Errorf("Expected the goal in the explanation, got %q", plan.Explanation)
+	}
+}
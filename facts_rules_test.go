@@ -29,7 +29,7 @@ func TestAddAndLoadFacts(t *testing.T) {
 	}
 
 	if facts[0].SessionID != sessionID {
-		t.Errorf("Expected fact session ID %d, got %d", sessionID, facts[0].SessionID)
+		t.Errorf("Expected fact session ID %s, got %s", sessionID, facts[0].SessionID)
 	}
 
 	// Verify the loaded fact matches what we stored
@@ -77,7 +77,7 @@ func TestAddAndLoadRules(t *testing.T) {
 	}
 
 	if rules[0].SessionID != sessionID {
-		t.Errorf("Expected rule session ID %d, got %d", sessionID, rules[0].SessionID)
+		t.Errorf("Expected rule session ID %s, got %s", sessionID, rules[0].SessionID)
 	}
 
 	// Verify the loaded rule
@@ -269,4 +269,27 @@ func TestQueryExecution(t *testing.T) {
 	if result.Solutions[0].Success {
 		t.Error("Expected unsuccessful solution for non-matching query")
 	}
-}
\ No newline at end of file
+}
+
+func TestRepeatedQueryWithRules(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+
+	// p(1). p(X) :- q(X). q(2).
+	engine.AddFact(Fact{SessionID: sessionID, Predicate: Compound("p", []Term{Number(1)})})
+	engine.AddFact(Fact{SessionID: sessionID, Predicate: Compound("q", []Term{Number(2)})})
+	engine.AddRule(Rule{
+		SessionID: sessionID,
+		Head:      Compound("p", []Term{Variable("X")}),
+		Body:      []Term{Compound("q", []Term{Variable("X")})},
+	})
+
+	query := Query{Goals: []Term{Compound("p", []Term{Variable("X")})}}
+	for i := 0; i < 2; i++ {
+		result := engine.Query(query, sessionID)
+		if len(result.Solutions) != 2 || !result.Solutions[1].Success {
+			t.Errorf("Query %d: expected X = 1 and X = 2, got %v", i+1, result.Solutions)
+		}
+	}
+}
@@ -2,12 +2,14 @@ package main
 
 import (
 	"crypto/subtle"
+	"encoding/json"
 	"html/template"
 	"net/http"
 	"os"
 	"strings"
 
 	"github.com/gin-gonic/gin"
+	"github.com/oklog/ulid/v2"
 )
 
 func (e *Engine) apiKeyMiddleware(expectedKey string) gin.HandlerFunc {
@@ -23,7 +25,9 @@ func (e *Engine) apiKeyMiddleware(expectedKey string) gin.HandlerFunc {
 		token := strings.TrimPrefix(auth, "Bearer ")
 		token = strings.TrimSpace(token)
 
-		if token != expectedKey {
+		// Session keys are accepted too; they only open their own sessions
+		// and cannot use the routes that are not scoped to a session
+		if token != expectedKey && !e.isSessionKey(token) {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid API key"})
 			c.Abort()
 			return
@@ -64,6 +68,12 @@ func (e *Engine) uiPasswordMiddleware(expectedPassword string) gin.HandlerFunc {
 	}
 }
 
+// validSessionID reports whether id is a well-formed session ULID.
+func validSessionID(id string) bool {
+	_, err := ulid.ParseStrict(id)
+	return err == nil
+}
+
 func (e *Engine) setupRoutes() *gin.Engine {
 	// Set Gin mode based on environment
 	if os.Getenv("GIN_MODE") == "" {
@@ -100,14 +110,14 @@ func (e *Engine) setupRoutes() *gin.Engine {
 	api := r.Group("/api/v1")
 	
 	// Apply API key middleware if API_KEY is set
-	apiKey := os.Getenv("API_KEY")
-	if apiKey != "" {
-		api.Use(e.apiKeyMiddleware(apiKey))
+	if e.apiKey != "" {
+		api.Use(e.apiKeyMiddleware(e.apiKey))
 	}
+	api.Use(e.sessionAccessMiddleware())
 	
 	{
 		// Session management
-		api.POST("/sessions", e.createSessionHandler)
+		api.POST("/sessions", e.serverKeyMiddleware(), e.createSessionHandler)
 		api.GET("/sessions", e.listSessionsHandler)
 		api.GET("/sessions/:id", e.getSessionHandler)
 		api.DELETE("/sessions/:id", e.deleteSessionHandler)
@@ -116,9 +126,22 @@ func (e *Engine) setupRoutes() *gin.Engine {
 		api.POST("/sessions/:sessionId/facts", e.addFactHandler)
 		api.POST("/sessions/:sessionId/rules", e.addRuleHandler)
 		api.POST("/sessions/:sessionId/query", e.queryHandler)
+		api.POST("/sessions/:sessionId/trace", e.traceHandler)
+		api.GET("/sessions/:id/profile", e.profileHandler)
+		api.POST("/sessions/:sessionId/explain", e.explainHandler)
+		api.POST("/sessions/:sessionId/consult", e.consultHandler)
+		
+		// Optional built-in libraries
+		api.GET("/sessions/:id/libraries", e.listLibrariesHandler)
+		api.POST("/sessions/:sessionId/libraries", e.enableLibraryHandler)
+		
+		// Parent sessions whose clauses a session inherits
+		api.GET("/sessions/:id/parents", e.listParentsHandler)
+		api.POST("/sessions/:sessionId/parents", e.addParentHandler)
+		api.DELETE("/sessions/:id/parents/:parentId", e.removeParentHandler)
 		
 		// Cache management
-		api.POST("/cache/clear", e.clearCacheHandler)
+		api.POST("/cache/clear", e.serverKeyMiddleware(), e.clearCacheHandler)
 	}
 
 	// UI routes (if enabled)
@@ -167,7 +190,16 @@ func (e *Engine) listSessionsHandler(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"sessions": sessions})
+	// Only list the sessions the caller's key opens
+	key := requestKey(c)
+	visible := sessions[:0]
+	for _, session := range sessions {
+		if allowed, _ := e.authorize(session.ID, key); allowed {
+			visible = append(visible, session)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"sessions": visible})
 }
 
 func (e *Engine) getSessionHandler(c *gin.Context) {
@@ -195,6 +227,10 @@ func (e *Engine) deleteSessionHandler(c *gin.Context) {
 
 func (e *Engine) addFactHandler(c *gin.Context) {
 	sessionId := c.Param("sessionId")
+	if !validSessionID(sessionId) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid session ID"})
+		return
+	}
 
 	var fact Fact
 	if err := c.ShouldBindJSON(&fact); err != nil {
@@ -221,6 +257,10 @@ func (e *Engine) addFactHandler(c *gin.Context) {
 
 func (e *Engine) addRuleHandler(c *gin.Context) {
 	sessionId := c.Param("sessionId")
+	if !validSessionID(sessionId) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid session ID"})
+		return
+	}
 
 	var rule Rule
 	if err := c.ShouldBindJSON(&rule); err != nil {
@@ -239,18 +279,223 @@ func (e *Engine) addRuleHandler(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"status": "rule added"})
 }
 
+func (e *Engine) consultHandler(c *gin.Context) {
+	sessionId := c.Param("sessionId")
+	if !validSessionID(sessionId) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid session ID"})
+		return
+	}
+
+	var req ConsultRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	result, err := e.Consult(sessionId, req.Text)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "result": result})
+		return
+	}
+
+	e.UpdateSessionTimestamp(sessionId)
+	c.JSON(http.StatusOK, result)
+}
+
 func (e *Engine) queryHandler(c *gin.Context) {
 	sessionId := c.Param("sessionId")
+	if !validSessionID(sessionId) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid session ID"})
+		return
+	}
+
+	query, ok := e.bindQuery(c, sessionId)
+	if !ok {
+		return
+	}
+
+	result := e.QueryAs(query, sessionId, requestKey(c))
+	e.UpdateSessionTimestamp(sessionId)
+	c.JSON(http.StatusOK, result)
+}
+
+// traceHandler runs a traced query and streams its events as they happen,
+// as newline-delimited JSON: one {"event": ...} line per event, then a
+// {"result": ...} line with the query result.
+func (e *Engine) traceHandler(c *gin.Context) {
+	sessionId := c.Param("sessionId")
+	if !validSessionID(sessionId) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid session ID"})
+		return
+	}
+
+	query, ok := e.bindQuery(c, sessionId)
+	if !ok {
+		return
+	}
+
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Status(http.StatusOK)
+	encoder := json.NewEncoder(c.Writer)
+	result := e.StreamQuery(query, sessionId, requestKey(c), func(event TraceEvent) {
+		encoder.Encode(gin.H{"event": event})
+		c.Writer.Flush()
+	})
+	result.Trace = nil
+	encoder.Encode(gin.H{"result": result})
+	e.UpdateSessionTimestamp(sessionId)
+}
+
+// profileHandler serves the profile of the session's last profiled query in
+// the pprof format, so `go tool pprof` can fetch it directly.
+func (e *Engine) profileHandler(c *gin.Context) {
+	id := c.Param("id")
+
+	profile := e.LastProfile(id)
+	if profile == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No profiled query in this session"})
+		return
+	}
+
+	c.Header("Content-Type", "application/octet-stream")
+	c.Header("Content-Disposition", `attachment; filename="profile.pb.gz"`)
+	c.Status(http.StatusOK)
+	profile.WritePprof(c.Writer)
+}
+
+// explainHandler returns the plan of a query without running it.
+func (e *Engine) explainHandler(c *gin.Context) {
+	sessionId := c.Param("sessionId")
+	if !validSessionID(sessionId) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid session ID"})
+		return
+	}
 
+	query, ok := e.bindQuery(c, sessionId)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, e.ExplainQuery(query, sessionId))
+}
+
+// bindQuery reads the query of a request, parsing its text if given.
+func (e *Engine) bindQuery(c *gin.Context, sessionID string) (Query, bool) {
 	var query Query
 	if err := c.ShouldBindJSON(&query); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return query, false
+	}
+	if query.Text != "" {
+		goals, err := e.ParseQuery(sessionID, query.Text)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return query, false
+		}
+		query.Goals = goals
+	}
+	return query, true
+}
+
+func (e *Engine) listLibrariesHandler(c *gin.Context) {
+	id := c.Param("id")
+
+	libraries, err := e.SessionLibraries(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"libraries": libraries})
+}
+
+func (e *Engine) enableLibraryHandler(c *gin.Context) {
+	sessionId := c.Param("sessionId")
+	if !validSessionID(sessionId) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid session ID"})
+		return
+	}
+
+	var req EnableLibraryRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if _, err := e.GetSession(sessionId); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+
+	if err := e.EnableLibrary(sessionId, req.Library); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	result := e.Query(query, sessionId)
 	e.UpdateSessionTimestamp(sessionId)
-	c.JSON(http.StatusOK, result)
+	c.JSON(http.StatusOK, gin.H{"status": "library enabled"})
+}
+
+func (e *Engine) listParentsHandler(c *gin.Context) {
+	id := c.Param("id")
+
+	parents, err := e.SessionParents(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"parents": parents})
+}
+
+func (e *Engine) addParentHandler(c *gin.Context) {
+	sessionId := c.Param("sessionId")
+	if !validSessionID(sessionId) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid session ID"})
+		return
+	}
+
+	var req AddParentRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if _, err := e.GetSession(sessionId); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+
+	// Inheriting a session exposes its clauses, so the caller must be able to
+	// open it
+	if allowed, exists := e.authorize(req.Parent, requestKey(c)); exists && !allowed {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access to parent session denied"})
+		return
+	}
+
+	if err := e.AddParent(sessionId, req.Parent); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	e.UpdateSessionTimestamp(sessionId)
+	c.JSON(http.StatusOK, gin.H{"status": "parent added"})
+}
+
+func (e *Engine) removeParentHandler(c *gin.Context) {
+	id := c.Param("id")
+	if !validSessionID(id) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid session ID"})
+		return
+	}
+
+	if err := e.RemoveParent(id, c.Param("parentId")); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	e.UpdateSessionTimestamp(id)
+	c.JSON(http.StatusOK, gin.H{"status": "parent removed"})
 }
 
 func (e *Engine) clearCacheHandler(c *gin.Context) {
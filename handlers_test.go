@@ -5,7 +5,6 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
-	"strconv"
 	"testing"
 
 	"github.com/gin-gonic/gin"
@@ -91,7 +90,7 @@ func TestGetSessionHandler(t *testing.T) {
 	sessionID := createTestSession(t, engine)
 
 	w := httptest.NewRecorder()
-	httpReq, _ := http.NewRequest("GET", "/api/v1/sessions/"+strconv.Itoa(sessionID), nil)
+	httpReq, _ := http.NewRequest("GET", "/api/v1/sessions/"+sessionID, nil)
 
 	router.ServeHTTP(w, httpReq)
 
@@ -106,7 +105,7 @@ func TestGetSessionHandler(t *testing.T) {
 	}
 
 	if session.ID != sessionID {
-		t.Errorf("Expected session ID %d, got %d", sessionID, session.ID)
+		t.Errorf("Expected session ID %s, got %s", sessionID, session.ID)
 	}
 }
 
@@ -131,7 +130,7 @@ func TestDeleteSessionHandler(t *testing.T) {
 	sessionID := createTestSession(t, engine)
 
 	w := httptest.NewRecorder()
-	httpReq, _ := http.NewRequest("DELETE", "/api/v1/sessions/"+strconv.Itoa(sessionID), nil)
+	httpReq, _ := http.NewRequest("DELETE", "/api/v1/sessions/"+sessionID, nil)
 
 	router.ServeHTTP(w, httpReq)
 
@@ -158,7 +157,7 @@ func TestAddFactHandler(t *testing.T) {
 
 	jsonData, _ := json.Marshal(fact)
 	w := httptest.NewRecorder()
-	httpReq, _ := http.NewRequest("POST", "/api/v1/sessions/"+strconv.Itoa(sessionID)+"/facts", bytes.NewBuffer(jsonData))
+	httpReq, _ := http.NewRequest("POST", "/api/v1/sessions/"+sessionID+"/facts", bytes.NewBuffer(jsonData))
 	httpReq.Header.Set("Content-Type", "application/json")
 
 	router.ServeHTTP(w, httpReq)
@@ -191,7 +190,7 @@ func TestAddRuleHandler(t *testing.T) {
 
 	jsonData, _ := json.Marshal(rule)
 	w := httptest.NewRecorder()
-	httpReq, _ := http.NewRequest("POST", "/api/v1/sessions/"+strconv.Itoa(sessionID)+"/rules", bytes.NewBuffer(jsonData))
+	httpReq, _ := http.NewRequest("POST", "/api/v1/sessions/"+sessionID+"/rules", bytes.NewBuffer(jsonData))
 	httpReq.Header.Set("Content-Type", "application/json")
 
 	router.ServeHTTP(w, httpReq)
@@ -232,7 +231,7 @@ func TestQueryHandler(t *testing.T) {
 
 	jsonData, _ := json.Marshal(query)
 	w := httptest.NewRecorder()
-	httpReq, _ := http.NewRequest("POST", "/api/v1/sessions/"+strconv.Itoa(sessionID)+"/query", bytes.NewBuffer(jsonData))
+	httpReq, _ := http.NewRequest("POST", "/api/v1/sessions/"+sessionID+"/query", bytes.NewBuffer(jsonData))
 	httpReq.Header.Set("Content-Type", "application/json")
 
 	router.ServeHTTP(w, httpReq)
@@ -313,7 +312,7 @@ func TestMalformedJSON(t *testing.T) {
 
 	// Send malformed JSON
 	w := httptest.NewRecorder()
-	httpReq, _ := http.NewRequest("POST", "/api/v1/sessions/"+strconv.Itoa(sessionID)+"/facts", bytes.NewBuffer([]byte("{invalid json")))
+	httpReq, _ := http.NewRequest("POST", "/api/v1/sessions/"+sessionID+"/facts", bytes.NewBuffer([]byte("{invalid json")))
 	httpReq.Header.Set("Content-Type", "application/json")
 
 	router.ServeHTTP(w, httpReq)
@@ -0,0 +1,201 @@
+package main
+
+import "time"
+
+// Intervals have a start strictly before their end. A zero-length interval
+// would both meet and start an interval beginning at the same time, so
+// exactly one of the thirteen Allen relations holds between any two
+// intervals. An interval term is the compound interval(Start, End): the two
+// unify with each other and sort alike.
+
+// asCompound returns an interval term as the compound interval/2, leaving
+// other terms unchanged.
+func asCompound(t Term) Term {
+	if t.Type == "interval" {
+		return Compound("interval", t.Args)
+	}
+	return t
+}
+
+// intervalValue dereferences term and returns its bounds. Both interval
+// terms and interval(Start, End) compounds over dates are accepted.
+func (e *Engine) intervalValue(term Term, subst Substitution) (time.Time, time.Time, bool) {
+	term = e.deref(term, subst)
+	if len(term.Args) != 2 {
+		return time.Time{}, time.Time{}, false
+	}
+	if term.Type != "interval" && !(term.Type == "compound" && term.Value == "interval") {
+		return time.Time{}, time.Time{}, false
+	}
+
+	start, ok1 := e.dateValue(term.Args[0], subst)
+	end, ok2 := e.dateValue(term.Args[1], subst)
+	if !ok1 || !ok2 || !end.After(start) {
+		return time.Time{}, time.Time{}, false
+	}
+	return start, end, true
+}
+
+// allenRelation returns the one Allen relation that holds between the
+// intervals [s1, e1] and [s2, e2].
+func allenRelation(s1, e1, s2, e2 time.Time) string {
+	switch {
+	case s1.Equal(s2) && e1.Equal(e2):
+		return "equals"
+	case e1.Before(s2):
+		return "before"
+	case s1.After(e2):
+		return "after"
+	case e1.Equal(s2):
+		return "meets"
+	case s1.Equal(e2):
+		return "met_by"
+	case s1.Equal(s2):
+		if e1.Before(e2) {
+			return "starts"
+		}
+		return "started_by"
+	case e1.Equal(e2):
+		if s1.After(s2) {
+			return "finishes"
+		}
+		return "finished_by"
+	case s1.After(s2) && e1.Before(e2):
+		return "during"
+	case s1.Before(s2) && e1.After(e2):
+		return "contains"
+	case s1.Before(s2):
+		return "overlaps"
+	default:
+		return "overlapped_by"
+	}
+}
+
+// handleMakeInterval implements make_interval(Start, End, Interval). When
+// Interval is bound it is decomposed into its start and end dates.
+func (e *Engine) handleMakeInterval(goal Term, subst Substitution) ([]Substitution, bool) {
+	if len(goal.Args) != 3 {
+		return []Substitution{}, true
+	}
+
+	if start, end, ok := e.intervalValue(goal.Args[2], subst); ok {
+		newSubst, ok := e.unify(goal.Args[0], Date(start), subst)
+		if !ok {
+			return []Substitution{}, true
+		}
+		return e.unifyResult(goal.Args[1], Date(end), newSubst)
+	}
+
+	start, ok1 := e.dateValue(goal.Args[0], subst)
+	end, ok2 := e.dateValue(goal.Args[1], subst)
+	if !ok1 || !ok2 || !end.After(start) {
+		return []Substitution{}, true
+	}
+
+	return e.unifyResult(goal.Args[2], Interval(start, end), subst)
+}
+
+// handleAllenRelation implements allen_relation(+I1, +I2, ?Relation).
+func (e *Engine) handleAllenRelation(goal Term, subst Substitution) ([]Substitution, bool) {
+	if len(goal.Args) != 3 {
+		return []Substitution{}, true
+	}
+
+	s1, e1, ok1 := e.intervalValue(goal.Args[0], subst)
+	s2, e2, ok2 := e.intervalValue(goal.Args[1], subst)
+	if !ok1 || !ok2 {
+		return []Substitution{}, true
+	}
+
+	return e.unifyResult(goal.Args[2], Atom(allenRelation(s1, e1, s2, e2)), subst)
+}
+
+// handleIntervalRelation implements the thirteen interval_<relation>/2
+// tests, e.g. interval_overlaps(I1, I2).
+func (e *Engine) handleIntervalRelation(goal Term, subst Substitution) ([]Substitution, bool) {
+	if len(goal.Args) != 2 {
+		return []Substitution{}, true
+	}
+
+	s1, e1, ok1 := e.intervalValue(goal.Args[0], subst)
+	s2, e2, ok2 := e.intervalValue(goal.Args[1], subst)
+	if !ok1 || !ok2 {
+		return []Substitution{}, true
+	}
+
+	if "interval_"+allenRelation(s1, e1, s2, e2) == goal.Value {
+		return []Substitution{subst}, true
+	}
+	return []Substitution{}, true
+}
+
+// handleIntervalIntersection implements interval_intersection(+I1, +I2, -I).
+// It fails when the intervals share no time, including when they only meet.
+func (e *Engine) handleIntervalIntersection(goal Term, subst Substitution) ([]Substitution, bool) {
+	if len(goal.Args) != 3 {
+		return []Substitution{}, true
+	}
+
+	s1, e1, ok1 := e.intervalValue(goal.Args[0], subst)
+	s2, e2, ok2 := e.intervalValue(goal.Args[1], subst)
+	if !ok1 || !ok2 {
+		return []Substitution{}, true
+	}
+
+	switch allenRelation(s1, e1, s2, e2) {
+	case "before", "after", "meets", "met_by":
+		return []Substitution{}, true
+	}
+
+	start, end := s1, e1
+	if s2.After(start) {
+		start = s2
+	}
+	if e2.Before(end) {
+		end = e2
+	}
+
+	return e.unifyResult(goal.Args[2], Interval(start, end), subst)
+}
+
+// handleIntervalUnion implements interval_union(+I1, +I2, -I). It fails when
+// the intervals neither overlap nor meet, since the union would have a gap.
+func (e *Engine) handleIntervalUnion(goal Term, subst Substitution) ([]Substitution, bool) {
+	if len(goal.Args) != 3 {
+		return []Substitution{}, true
+	}
+
+	s1, e1, ok1 := e.intervalValue(goal.Args[0], subst)
+	s2, e2, ok2 := e.intervalValue(goal.Args[1], subst)
+	if !ok1 || !ok2 {
+		return []Substitution{}, true
+	}
+	if e1.Before(s2) || e2.Before(s1) {
+		return []Substitution{}, true
+	}
+
+	start, end := s1, e1
+	if s2.Before(start) {
+		start = s2
+	}
+	if e2.After(end) {
+		end = e2
+	}
+
+	return e.unifyResult(goal.Args[2], Interval(start, end), subst)
+}
+
+// handleIntervalDuration implements interval_duration(+I, -Days), measured
+// in (possibly fractional) days like days_between/3.
+func (e *Engine) handleIntervalDuration(goal Term, subst Substitution) ([]Substitution, bool) {
+	if len(goal.Args) != 2 {
+		return []Substitution{}, true
+	}
+
+	start, end, ok := e.intervalValue(goal.Args[0], subst)
+	if !ok {
+		return []Substitution{}, true
+	}
+
+	return e.unifyResult(goal.Args[1], Number(end.Sub(start).Hours()/24), subst)
+}
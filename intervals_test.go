@@ -0,0 +1,221 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func day(d int) time.Time {
+	return time.Date(2024, 1, d, 0, 0, 0, 0, time.UTC)
+}
+
+func TestAllenRelations(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+
+	subst := make(Substitution)
+	base := Interval(day(10), day(20))
+
+	cases := []struct {
+		other    Term
+		relation string
+	}{
+		{Interval(day(1), day(5)), "before"},
+		{Interval(day(22), day(25)), "after"},
+		{Interval(day(5), day(10)), "meets"},
+		{Interval(day(20), day(25)), "met_by"},
+		{Interval(day(5), day(15)), "overlaps"},
+		{Interval(day(15), day(25)), "overlapped_by"},
+		{Interval(day(10), day(15)), "starts"},
+		{Interval(day(10), day(25)), "started_by"},
+		{Interval(day(12), day(18)), "during"},
+		{Interval(day(5), day(25)), "contains"},
+		{Interval(day(15), day(20)), "finishes"},
+		{Interval(day(5), day(20)), "finished_by"},
+		{Interval(day(10), day(20)), "equals"},
+	}
+
+	for _, c := range cases {
+		goal := Compound("allen_relation", []Term{c.other, base, Variable("R")})
+		solutions, handled := engine.evalBuiltin(goal, subst, sessionID)
+		if !handled {
+			t.Fatal("Expected allen_relation predicate to be handled")
+		}
+		if len(solutions) != 1 || solutions[0]["R"].Value != c.relation {
+			t.Errorf("Expected relation %s, got %v", c.relation, solutions)
+		}
+
+		goal = Compound("interval_"+c.relation, []Term{c.other, base})
+		solutions, handled = engine.evalBuiltin(goal, subst, sessionID)
+		if !handled {
+			t.Fatalf("Expected interval_%s predicate to be handled", c.relation)
+		}
+		if len(solutions) != 1 {
+			t.Errorf("Expected interval_%s to hold, got %d solutions", c.relation, len(solutions))
+		}
+	}
+
+	// A relation that does not hold fails
+	goal := Compound("interval_during", []Term{base, Interval(day(1), day(5))})
+	solutions, _ := engine.evalBuiltin(goal, subst, sessionID)
+	if len(solutions) != 0 {
+		t.Errorf("Expected 0 solutions for interval_during, got %d", len(solutions))
+	}
+
+	// A zero-length interval would both meet and start base, so it is not
+	// an interval
+	point := Interval(day(10), day(10))
+	for _, relation := range []string{"meets", "starts"} {
+		goal = Compound("interval_"+relation, []Term{point, base})
+		if solutions, _ = engine.evalBuiltin(goal, subst, sessionID); len(solutions) != 0 {
+			t.Errorf("Expected interval_%s to fail on a zero-length interval, got %v", relation, solutions)
+		}
+	}
+}
+
+func TestMakeInterval(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+
+	subst := make(Substitution)
+
+	goal := Compound("make_interval", []Term{Date(day(1)), Date(day(3)), Variable("I")})
+	solutions, handled := engine.evalBuiltin(goal, subst, sessionID)
+	if !handled {
+		t.Fatal("Expected make_interval predicate to be handled")
+	}
+	if len(solutions) != 1 || solutions[0]["I"].Type != "interval" {
+		t.Fatalf("Expected an interval term, got %v", solutions)
+	}
+
+	// Decompose
+	goal = Compound("make_interval", []Term{Variable("S"), Variable("E"), solutions[0]["I"]})
+	solutions, _ = engine.evalBuiltin(goal, subst, sessionID)
+	if len(solutions) != 1 || solutions[0]["S"].Value != Date(day(1)).Value || solutions[0]["E"].Value != Date(day(3)).Value {
+		t.Errorf("Expected interval to decompose into its dates, got %v", solutions)
+	}
+
+	// End before start is rejected
+	goal = Compound("make_interval", []Term{Date(day(3)), Date(day(1)), Variable("I")})
+	solutions, _ = engine.evalBuiltin(goal, subst, sessionID)
+	if len(solutions) != 0 {
+		t.Errorf("Expected 0 solutions for reversed interval, got %d", len(solutions))
+	}
+	goal = Compound("make_interval", []Term{Date(day(3)), Date(day(3)), Variable("I")})
+	if solutions, _ = engine.evalBuiltin(goal, subst, sessionID); len(solutions) != 0 {
+		t.Errorf("Expected 0 solutions for a zero-length interval, got %d", len(solutions))
+	}
+
+	// interval(Start, End) compounds are accepted wherever intervals are
+	compound := Compound("interval", []Term{Date(day(1)), Date(day(3))})
+	goal = Compound("interval_duration", []Term{compound, Variable("D")})
+	solutions, _ = engine.evalBuiltin(goal, subst, sessionID)
+	if len(solutions) != 1 || solutions[0]["D"].Value != 2.0 {
+		t.Errorf("Expected duration of 2 days, got %v", solutions)
+	}
+
+	// and unify and sort like the interval terms they stand for
+	pattern := Compound("interval", []Term{Variable("S"), Date(day(3))})
+	newSubst, ok := engine.unify(Interval(day(1), day(3)), pattern, subst)
+	if !ok || newSubst["S"].Value != Date(day(1)).Value {
+		t.Errorf("Expected an interval term to unify with interval(S, End), got %v", newSubst)
+	}
+	if compareTerms(Interval(day(1), day(3)), compound) != 0 {
+		t.Error("Expected an interval term to compare equal to its compound")
+	}
+}
+
+func TestIntervalIntersectionAndUnion(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+
+	subst := make(Substitution)
+	a := Interval(day(1), day(10))
+	b := Interval(day(5), day(15))
+
+	goal := Compound("interval_intersection", []Term{a, b, Variable("I")})
+	solutions, handled := engine.evalBuiltin(goal, subst, sessionID)
+	if !handled {
+		t.Fatal("Expected interval_intersection predicate to be handled")
+	}
+	expected := Interval(day(5), day(10))
+	if len(solutions) != 1 {
+		t.Fatalf("Expected 1 solution for intersection, got %d", len(solutions))
+	}
+	if _, ok := engine.unify(solutions[0]["I"], expected, subst); !ok {
+		t.Errorf("Expected intersection %v, got %v", expected, solutions[0]["I"])
+	}
+
+	goal = Compound("interval_union", []Term{a, b, Variable("U")})
+	solutions, _ = engine.evalBuiltin(goal, subst, sessionID)
+	expected = Interval(day(1), day(15))
+	if len(solutions) != 1 {
+		t.Fatalf("Expected 1 solution for union, got %d", len(solutions))
+	}
+	if _, ok := engine.unify(solutions[0]["U"], expected, subst); !ok {
+		t.Errorf("Expected union %v, got %v", expected, solutions[0]["U"])
+	}
+
+	// Meeting intervals have a union but no intersection
+	c := Interval(day(10), day(12))
+	goal = Compound("interval_intersection", []Term{a, c, Variable("I")})
+	solutions, _ = engine.evalBuiltin(goal, subst, sessionID)
+	if len(solutions) != 0 {
+		t.Errorf("Expected 0 solutions for intersection of meeting intervals, got %d", len(solutions))
+	}
+	goal = Compound("interval_union", []Term{a, c, Variable("U")})
+	solutions, _ = engine.evalBuiltin(goal, subst, sessionID)
+	if len(solutions) != 1 {
+		t.Errorf("Expected 1 solution for union of meeting intervals, got %d", len(solutions))
+	}
+
+	// Disjoint intervals have neither
+	d := Interval(day(20), day(25))
+	goal = Compound("interval_union", []Term{a, d, Variable("U")})
+	solutions, _ = engine.evalBuiltin(goal, subst, sessionID)
+	if len(solutions) != 0 {
+		t.Errorf("Expected 0 solutions for union of disjoint intervals, got %d", len(solutions))
+	}
+}
+
+func TestIntervalsInRules(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+
+	bookings := []Fact{
+		{SessionID: sessionID, Predicate: Compound("booking", []Term{Atom("room1"), Interval(day(1), day(5))})},
+		{SessionID: sessionID, Predicate: Compound("booking", []Term{Atom("room2"), Interval(day(4), day(8))})},
+		{SessionID: sessionID, Predicate: Compound("booking", []Term{Atom("room3"), Interval(day(9), day(12))})},
+	}
+	for _, fact := range bookings {
+		if err := engine.AddFact(fact); err != nil {
+			t.Fatalf("Failed to add booking: %v", err)
+		}
+	}
+
+	// clash(A, B) :- booking(A, I1), booking(B, I2), interval_overlaps(I1, I2).
+	rule := Rule{
+		SessionID: sessionID,
+		Head:      Compound("clash", []Term{Variable("A"), Variable("B")}),
+		Body: []Term{
+			Compound("booking", []Term{Variable("A"), Variable("I1")}),
+			Compound("booking", []Term{Variable("B"), Variable("I2")}),
+			Compound("interval_overlaps", []Term{Variable("I1"), Variable("I2")}),
+		},
+	}
+	if err := engine.AddRule(rule); err != nil {
+		t.Fatalf("Failed to add rule: %v", err)
+	}
+
+	result := engine.Query(Query{Goals: []Term{Compound("clash", []Term{Variable("A"), Variable("B")})}}, sessionID)
+	if len(result.Solutions) != 1 || !result.Solutions[0].Success {
+		t.Fatalf("Expected exactly one clash, got %v", result.Solutions)
+	}
+	if result.Solutions[0].Bindings["A"].Value != "room1" || result.Solutions[0].Bindings["B"].Value != "room2" {
+		t.Errorf("Expected room1 to clash with room2, got %v", result.Solutions[0].Bindings)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// optionalLibraries are the built-in libraries a session can enable, with the
+// predicates each one provides.
+var optionalLibraries = map[string]string{
+	"event_calculus": "holds_at/2, clipped/3, declipped/3 over happens/2, initiates/3, terminates/3, initially/1",
+	"datalog":        "bottom-up evaluation of the session's queries",
+}
+
+// EnableLibrary turns on an optional built-in library for a session.
+func (e *Engine) EnableLibrary(sessionID, library string) error {
+	if _, ok := optionalLibraries[library]; !ok {
+		return fmt.Errorf("unknown library %q", library)
+	}
+
+	_, err := e.db.Exec("INSERT OR IGNORE INTO session_libraries (session_id, library) VALUES (?, ?)", sessionID, library)
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	delete(e.libraries, sessionID)
+	e.mu.Unlock()
+	return nil
+}
+
+// SessionLibraries lists the optional libraries enabled for a session.
+func (e *Engine) SessionLibraries(sessionID string) ([]string, error) {
+	rows, err := e.db.Query("SELECT library FROM session_libraries WHERE session_id = ?", sessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	libraries := []string{}
+	for rows.Next() {
+		var library string
+		if err := rows.Scan(&library); err != nil {
+			return nil, err
+		}
+		libraries = append(libraries, library)
+	}
+	sort.Strings(libraries)
+	return libraries, nil
+}
+
+// libraryEnabled reports whether a session has enabled library. Lookups are
+// cached until the session's libraries change.
+func (e *Engine) libraryEnabled(sessionID, library string) bool {
+	e.mu.Lock()
+	enabled, cached := e.libraries[sessionID]
+	e.mu.Unlock()
+
+	if !cached {
+		names, err := e.SessionLibraries(sessionID)
+		if err != nil {
+			return false
+		}
+		enabled = make(map[string]bool)
+		for _, name := range names {
+			enabled[name] = true
+		}
+
+		e.mu.Lock()
+		e.libraries[sessionID] = enabled
+		e.mu.Unlock()
+	}
+
+	return enabled[library]
+}
+
+// libraryPredicates are the builtins of the list, output and finite-domain
+// libraries. Unlike core builtins, they give way to a session's own
+// definition of a predicate with the same name and arity.
+var libraryPredicates = map[string]bool{
+	"append": true, "member": true, "memberchk": true, "length": true, "nth0": true, "nth1": true,
+	"reverse": true, "last": true, "sum_list": true, "max_list": true, "min_list": true, "list_to_set": true,
+	"include": true, "exclude": true, "maplist": true, "foldl": true,
+	"write": true, "writeln": true, "print": true, "writeq": true, "write_canonical": true,
+	"format": true, "term_to_atom": true, "nl": true,
+	"in": true, "ins": true, "all_different": true, "all_distinct": true, "label": true, "labeling": true,
+	"fd_dom": true, "fd_inf": true, "fd_sup": true, "fd_size": true,
+}
+
+// userDefined reports whether goal calls a library predicate the session
+// defines itself, in which case its clauses are used instead.
+func (e *Engine) userDefined(goal Term, sessionID string) bool {
+	if goal.Type != "atom" && goal.Type != "compound" {
+		return false
+	}
+	name := goal.Value.(string)
+	return libraryPredicates[name] && e.sessionModules(sessionID).overrides[indicatorKey(name, termArity(goal))]
+}
+
+// isBuiltin reports whether evalBuiltin handles goal in a session.
+func (e *Engine) isBuiltin(goal Term, sessionID string) bool {
+	if goal.Type != "atom" && goal.Type != "compound" {
+		return false
+	}
+	name := goal.Value.(string)
+	if eventCalculusNames[name] {
+		return e.libraryEnabled(sessionID, "event_calculus")
+	}
+	return builtinNames[name] && !e.userDefined(goal, sessionID)
+}
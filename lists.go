@@ -0,0 +1,266 @@
+package main
+
+// The list library is implemented natively, so it is available in every
+// session without storing any clauses. Predicates that would enumerate
+// infinitely in standard Prolog (for example length(L, N) with both
+// unbound) fail instead, since solutions are computed eagerly.
+
+// listPrefix dereferences term and returns the known elements of a possibly
+// partial list together with its dereferenced tail ([] for proper lists).
+func (e *Engine) listPrefix(term Term, subst Substitution) ([]Term, Term) {
+	var items []Term
+	for {
+		term = emptyListAtom(e.deref(term, subst))
+		if term.Type != "list" {
+			return items, term
+		}
+		if term.Value != listTailMarker {
+			return append(items, term.Args...), List(nil)
+		}
+		items = append(items, term.Args[:len(term.Args)-1]...)
+		term = term.Args[len(term.Args)-1]
+	}
+}
+
+func (e *Engine) freshList(n int) Term {
+	items := make([]Term, n)
+	for i := range items {
+		items[i] = e.freshVar()
+	}
+	return List(items)
+}
+
+// handleList implements the first-order list predicates: append/3,
+// member/2, memberchk/2, length/2, nth0/3, nth1/3, reverse/2, last/2,
+// sum_list/2, max_list/2, min_list/2 and list_to_set/2.
+func (e *Engine) handleList(goal Term, subst Substitution) ([]Substitution, bool) {
+	args := goal.Args
+	results := []Substitution{}
+
+	switch {
+	case goal.Value == "append" && len(args) == 3:
+		if xs, ok := e.listElements(args[0], subst); ok {
+			return e.unifyResult(args[2], ListWithTail(xs, args[1]), subst)
+		}
+		zs, ok := e.listElements(args[2], subst)
+		if !ok {
+			return results, true
+		}
+		for i := 0; i <= len(zs); i++ {
+			if s1, ok := e.unify(args[0], List(zs[:i]), subst); ok {
+				if s2, ok := e.unify(args[1], List(zs[i:]), s1); ok {
+					results = append(results, s2)
+				}
+			}
+		}
+
+	case (goal.Value == "member" || goal.Value == "memberchk") && len(args) == 2:
+		items, _ := e.listPrefix(args[1], subst)
+		for _, item := range items {
+			if newSubst, ok := e.unify(args[0], item, subst); ok {
+				results = append(results, newSubst)
+				if goal.Value == "memberchk" {
+					break
+				}
+			}
+		}
+
+	case goal.Value == "length" && len(args) == 2:
+		items, tail := e.listPrefix(args[0], subst)
+		if tail.Type == "list" {
+			return e.unifyResult(args[1], Number(float64(len(items))), subst)
+		}
+		n, ok := e.intValue(args[1], subst)
+		if tail.Type == "variable" && ok && n >= len(items) {
+			return e.unifyResult(tail, e.freshList(n-len(items)), subst)
+		}
+
+	case (goal.Value == "nth0" || goal.Value == "nth1") && len(args) == 3:
+		xs, ok := e.listElements(args[1], subst)
+		if !ok {
+			return results, true
+		}
+		base := 0
+		if goal.Value == "nth1" {
+			base = 1
+		}
+		if i, ok := e.intValue(args[0], subst); ok {
+			if i-base < 0 || i-base >= len(xs) {
+				return results, true
+			}
+			return e.unifyResult(args[2], xs[i-base], subst)
+		}
+		for i, x := range xs {
+			if s1, ok := e.unify(args[0], Number(float64(i+base)), subst); ok {
+				if s2, ok := e.unify(args[2], x, s1); ok {
+					results = append(results, s2)
+				}
+			}
+		}
+
+	case goal.Value == "reverse" && len(args) == 2:
+		from, to := args[0], args[1]
+		xs, ok := e.listElements(from, subst)
+		if !ok {
+			if xs, ok = e.listElements(to, subst); !ok {
+				return results, true
+			}
+			to = from
+		}
+		reversed := make([]Term, len(xs))
+		for i, x := range xs {
+			reversed[len(xs)-1-i] = x
+		}
+		return e.unifyResult(to, List(reversed), subst)
+
+	case goal.Value == "last" && len(args) == 2:
+		if xs, ok := e.listElements(args[0], subst); ok && len(xs) > 0 {
+			return e.unifyResult(args[1], xs[len(xs)-1], subst)
+		}
+
+	case (goal.Value == "sum_list" || goal.Value == "max_list" || goal.Value == "min_list") && len(args) == 2:
+		xs, ok := e.listElements(args[0], subst)
+		if !ok || (len(xs) == 0 && goal.Value != "sum_list") {
+			return results, true
+		}
+		var acc float64
+		for i, x := range xs {
+			n, ok := e.numberValue(x, subst)
+			if !ok {
+				return results, true
+			}
+			switch {
+			case goal.Value == "sum_list":
+				acc += n
+			case i == 0, goal.Value == "max_list" && n > acc, goal.Value == "min_list" && n < acc:
+				acc = n
+			}
+		}
+		return e.unifyResult(args[1], Number(acc), subst)
+
+	case goal.Value == "list_to_set" && len(args) == 2:
+		xs, ok := e.listElements(args[0], subst)
+		if !ok {
+			return results, true
+		}
+		var set []Term
+		for _, x := range xs {
+			x = e.instantiate(x, subst)
+			seen := false
+			for _, y := range set {
+				if compareTerms(x, y) == 0 {
+					seen = true
+					break
+				}
+			}
+			if !seen {
+				set = append(set, x)
+			}
+		}
+		return e.unifyResult(args[1], List(set), subst)
+	}
+
+	return results, true
+}
+
+// handleListMeta implements the list predicates that call a closure:
+// include/3, exclude/3, maplist/2..5 and foldl/4..6.
+func (e *Engine) handleListMeta(goal Term, subst Substitution, sessionID string) ([]Substitution, bool) {
+	args := goal.Args
+
+	switch {
+	case (goal.Value == "include" || goal.Value == "exclude") && len(args) == 3:
+		xs, ok := e.listElements(args[1], subst)
+		if !ok {
+			return []Substitution{}, true
+		}
+		var kept []Term
+		for _, x := range xs {
+			called, ok := e.callGoal(args[0], []Term{x}, subst)
+			if !ok {
+				return []Substitution{}, true
+			}
+			succeeded := len(e.solve([]Term{called}, subst, sessionID)) > 0
+			if succeeded == (goal.Value == "include") {
+				kept = append(kept, x)
+			}
+		}
+		return e.unifyResult(args[2], List(kept), subst)
+
+	case goal.Value == "maplist" && len(args) >= 2 && len(args) <= 5:
+		columns, newSubst, ok := e.alignLists(args[1:], subst)
+		if !ok {
+			return []Substitution{}, true
+		}
+		var goals []Term
+		for i := range columns[0] {
+			extra := make([]Term, len(columns))
+			for j, column := range columns {
+				extra[j] = column[i]
+			}
+			called, ok := e.callGoal(args[0], extra, newSubst)
+			if !ok {
+				return []Substitution{}, true
+			}
+			goals = append(goals, called)
+		}
+		return e.solve(goals, newSubst, sessionID), true
+
+	case goal.Value == "foldl" && len(args) >= 4 && len(args) <= 6:
+		lists := args[1 : len(args)-2]
+		columns, newSubst, ok := e.alignLists(lists, subst)
+		if !ok {
+			return []Substitution{}, true
+		}
+		acc := args[len(args)-2]
+		var goals []Term
+		for i := range columns[0] {
+			next := args[len(args)-1]
+			if i < len(columns[0])-1 {
+				next = e.freshVar()
+			}
+			extra := make([]Term, 0, len(columns)+2)
+			for _, column := range columns {
+				extra = append(extra, column[i])
+			}
+			called, ok := e.callGoal(args[0], append(extra, acc, next), newSubst)
+			if !ok {
+				return []Substitution{}, true
+			}
+			goals = append(goals, called)
+			acc = next
+		}
+		if len(goals) == 0 {
+			return e.unifyResult(args[len(args)-2], args[len(args)-1], newSubst)
+		}
+		return e.solve(goals, newSubst, sessionID), true
+	}
+
+	return []Substitution{}, true
+}
+
+// alignLists makes every argument a proper list of the same length, binding
+// unbound (or partial) lists to lists of fresh variables. At least one
+// argument must already be a proper list.
+func (e *Engine) alignLists(lists []Term, subst Substitution) ([][]Term, Substitution, bool) {
+	length := -1
+	for _, l := range lists {
+		if xs, ok := e.listElements(l, subst); ok {
+			length = len(xs)
+			break
+		}
+	}
+	if length < 0 {
+		return nil, subst, false
+	}
+
+	columns := make([][]Term, len(lists))
+	for i, l := range lists {
+		var ok bool
+		if subst, ok = e.unify(l, e.freshList(length), subst); !ok {
+			return nil, subst, false
+		}
+		columns[i], _ = e.listElements(l, subst)
+	}
+	return columns, subst, true
+}
@@ -0,0 +1,187 @@
+package main
+
+import "testing"
+
+func nums(values ...float64) Term {
+	items := make([]Term, len(values))
+	for i, v := range values {
+		items[i] = Number(v)
+	}
+	return List(items)
+}
+
+func queryAll(engine *Engine, sessionID string, goals ...Term) []Solution {
+	var solutions []Solution
+	for _, sol := range engine.Query(Query{Goals: goals}, sessionID).Solutions {
+		if sol.Success {
+			solutions = append(solutions, sol)
+		}
+	}
+	return solutions
+}
+
+func TestCallN(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+
+	engine.AddFact(Fact{SessionID: sessionID, Predicate: Compound("parent", []Term{Atom("tom"), Atom("bob")})})
+	engine.AddFact(Fact{SessionID: sessionID, Predicate: Compound("parent", []Term{Atom("tom"), Atom("liz")})})
+
+	// call(parent(tom), X) extends the closure to parent(tom, X)
+	solutions := queryAll(engine, sessionID, Compound("call", []Term{Compound("parent", []Term{Atom("tom")}), Variable("X")}))
+	if len(solutions) != 2 || solutions[0].Bindings["X"].Value != "bob" {
+		t.Errorf("Expected bob and liz, got %v", solutions)
+	}
+
+	// A closure held in a variable
+	solutions = queryAll(engine, sessionID,
+		Compound("=", []Term{Variable("G"), Atom("parent")}),
+		Compound("call", []Term{Variable("G"), Variable("P"), Atom("liz")}),
+	)
+	if len(solutions) != 1 || solutions[0].Bindings["P"].Value != "tom" {
+		t.Errorf("Expected P = tom, got %v", solutions)
+	}
+
+	// \+, once/1 and findall/3
+	if len(queryAll(engine, sessionID, Compound("\\+", []Term{Compound("parent", []Term{Atom("bob"), Variable("_")})}))) != 1 {
+		t.Error("Expected \\+ parent(bob, _) to succeed")
+	}
+	if len(queryAll(engine, sessionID, Compound("once", []Term{Compound("parent", []Term{Atom("tom"), Variable("X")})}))) != 1 {
+		t.Error("Expected once/1 to yield a single solution")
+	}
+	solutions = queryAll(engine, sessionID, Compound("findall", []Term{Variable("C"), Compound("parent", []Term{Atom("tom"), Variable("C")}), Variable("L")}))
+	if len(solutions) != 1 || len(solutions[0].Bindings["L"].Args) != 2 {
+		t.Errorf("Expected findall to collect two children, got %v", solutions)
+	}
+
+	// If-then-else commits to the first solution of the condition
+	ite := Compound(";", []Term{
+		Compound("->", []Term{Compound("parent", []Term{Atom("tom"), Variable("X")}), Compound("=", []Term{Variable("R"), Atom("yes")})}),
+		Compound("=", []Term{Variable("R"), Atom("no")}),
+	})
+	solutions = queryAll(engine, sessionID, ite)
+	if len(solutions) != 1 || solutions[0].Bindings["R"].Value != "yes" || solutions[0].Bindings["X"].Value != "bob" {
+		t.Errorf("Expected R = yes with X = bob, got %v", solutions)
+	}
+}
+
+func TestListLibrary(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+
+	// append/3 splits a list in every way
+	solutions := queryAll(engine, sessionID, Compound("append", []Term{Variable("X"), Variable("Y"), nums(1, 2, 3)}))
+	if len(solutions) != 4 {
+		t.Errorf("Expected 4 splits, got %d", len(solutions))
+	}
+
+	solutions = queryAll(engine, sessionID, Compound("append", []Term{nums(1), nums(2, 3), Variable("Z")}))
+	if len(solutions) != 1 || compareTerms(solutions[0].Bindings["Z"], nums(1, 2, 3)) != 0 {
+		t.Errorf("Expected Z = [1,2,3], got %v", solutions)
+	}
+
+	// length/2 counts or builds a list of fresh variables
+	solutions = queryAll(engine, sessionID, Compound("length", []Term{Variable("L"), Number(3)}))
+	if len(solutions) != 1 || len(solutions[0].Bindings["L"].Args) != 3 {
+		t.Errorf("Expected a list of length 3, got %v", solutions)
+	}
+
+	cases := []struct {
+		goal     Term
+		variable string
+		expected Term
+	}{
+		{Compound("length", []Term{nums(4, 5), Variable("N")}), "N", Number(2)},
+		{Compound("nth0", []Term{Number(1), nums(4, 5, 6), Variable("E")}), "E", Number(5)},
+		{Compound("nth1", []Term{Variable("I"), nums(4, 5, 6), Number(6)}), "I", Number(3)},
+		{Compound("reverse", []Term{nums(1, 2, 3), Variable("R")}), "R", nums(3, 2, 1)},
+		{Compound("last", []Term{nums(1, 2, 3), Variable("X")}), "X", Number(3)},
+		{Compound("sum_list", []Term{nums(1, 2, 3), Variable("S")}), "S", Number(6)},
+		{Compound("max_list", []Term{nums(4, 9, 2), Variable("M")}), "M", Number(9)},
+		{Compound("min_list", []Term{nums(4, 9, 2), Variable("M")}), "M", Number(2)},
+		{Compound("list_to_set", []Term{nums(1, 2, 1, 3, 2), Variable("S")}), "S", nums(1, 2, 3)},
+		{Compound("memberchk", []Term{Variable("X"), nums(7, 8)}), "X", Number(7)},
+	}
+	for _, c := range cases {
+		solutions := queryAll(engine, sessionID, c.goal)
+		if len(solutions) != 1 {
+			t.Errorf("%s: expected 1 solution, got %d", c.goal.Value, len(solutions))
+			continue
+		}
+		if got := solutions[0].Bindings[c.variable]; compareTerms(got, c.expected) != 0 {
+			t.Errorf("%s: expected %s = %v, got %v", c.goal.Value, c.variable, c.expected, got)
+		}
+	}
+
+	if len(queryAll(engine, sessionID, Compound("member", []Term{Variable("X"), nums(1, 2, 3)}))) != 3 {
+		t.Error("Expected member/2 to enumerate three elements")
+	}
+
+	// A session's own definition takes precedence over the library, for
+	// the same name and arity only
+	session, _ := engine.CreateSession(CreateSessionRequest{Name: "own-lists"})
+	own := session.ID
+	if _, err := engine.Consult(own, "member(ann, team).\nlast(a, b, c).\n"); err != nil {
+		t.Fatalf("Consult failed: %v", err)
+	}
+	solutions = queryAll(engine, own, Compound("member", []Term{Variable("X"), Atom("team")}))
+	if len(solutions) != 1 || solutions[0].Bindings["X"].Value != "ann" {
+		t.Errorf("Expected the session's member/2, got %v", solutions)
+	}
+	solutions = queryAll(engine, own, Compound("last", []Term{nums(1, 2), Variable("X")}))
+	if len(solutions) != 1 || solutions[0].Bindings["X"].Value != 2.0 {
+		t.Errorf("Expected the library's last/2, got %v", solutions)
+	}
+
+	// Overrides follow the session's clauses as they change
+	engine.AddRule(Rule{SessionID: own, Head: Compound("last", []Term{Variable("L"), Atom("none")}), Body: []Term{Atom("true")}})
+	solutions = queryAll(engine, own, Compound("last", []Term{nums(1, 2), Variable("X")}))
+	if len(solutions) != 1 || solutions[0].Bindings["X"].Value != "none" {
+		t.Errorf("Expected the session's new last/2, got %v", solutions)
+	}
+}
+
+func TestListMetaPredicates(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+
+	// double(X, Y) :- Y = twice(X).
+	engine.AddRule(Rule{
+		SessionID: sessionID,
+		Head:      Compound("double", []Term{Variable("X"), Variable("Y")}),
+		Body:      []Term{Compound("=", []Term{Variable("Y"), Compound("twice", []Term{Variable("X")})})},
+	})
+	// cons(X, Acc, [X|Acc]).
+	engine.AddRule(Rule{
+		SessionID: sessionID,
+		Head:      Compound("cons", []Term{Variable("X"), Variable("Acc"), ListWithTail([]Term{Variable("X")}, Variable("Acc"))}),
+		Body:      []Term{},
+	})
+	engine.AddFact(Fact{SessionID: sessionID, Predicate: Compound("small", []Term{Number(1)})})
+	engine.AddFact(Fact{SessionID: sessionID, Predicate: Compound("small", []Term{Number(2)})})
+
+	solutions := queryAll(engine, sessionID, Compound("maplist", []Term{Atom("double"), nums(1, 2), Variable("L")}))
+	expected := List([]Term{Compound("twice", []Term{Number(1)}), Compound("twice", []Term{Number(2)})})
+	if len(solutions) != 1 || compareTerms(solutions[0].Bindings["L"], expected) != 0 {
+		t.Errorf("Expected L = [twice(1),twice(2)], got %v", solutions)
+	}
+
+	solutions = queryAll(engine, sessionID, Compound("include", []Term{Atom("small"), nums(1, 2, 3), Variable("L")}))
+	if len(solutions) != 1 || compareTerms(solutions[0].Bindings["L"], nums(1, 2)) != 0 {
+		t.Errorf("Expected include to keep [1,2], got %v", solutions)
+	}
+
+	solutions = queryAll(engine, sessionID, Compound("exclude", []Term{Atom("small"), nums(1, 2, 3), Variable("L")}))
+	if len(solutions) != 1 || compareTerms(solutions[0].Bindings["L"], nums(3)) != 0 {
+		t.Errorf("Expected exclude to keep [3], got %v", solutions)
+	}
+
+	// foldl(cons, [1,2,3], [], R) reverses the list
+	solutions = queryAll(engine, sessionID, Compound("foldl", []Term{Atom("cons"), nums(1, 2, 3), List(nil), Variable("R")}))
+	if len(solutions) != 1 || compareTerms(solutions[0].Bindings["R"], nums(3, 2, 1)) != 0 {
+		t.Errorf("Expected R = [3,2,1], got %v", solutions)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import "strings"
+
+// Magic sets. Before a bottom-up query is evaluated, the rules it reaches
+// are specialised for the arguments its goals bind, so that only the part
+// of each relation the query can use is derived. A predicate called with
+// some arguments bound (adornment "bf" for path(a, Y)) gets a copy of its
+// rules named path/2^bf, guarded by a magic predicate magic(path/2^bf)
+// holding the bound arguments it is called with. Each derived call in a
+// rule body seeds the magic predicate of its callee from the goals before
+// it, passing bindings sideways left to right. Negated calls use the
+// unspecialised rules. Magic predicates can still tie a negated call into
+// the recursion of the goals after it, so a rewrite that leaves the program
+// unstratified is dropped and the query runs on the original rules.
+
+type magicRewrite struct {
+	d     *datalogProgram
+	rules map[string][]datalogRule // the rules before rewriting
+	done  map[string]bool
+	queue []adornedPredicate
+}
+
+type adornedPredicate struct {
+	key, adornment, adorned string
+}
+
+// magicSets replaces the program's rules by their specialisations for the
+// query body and returns the body calling them, or leaves the program and
+// the body as they are when the specialised program is not stratified.
+func (d *datalogProgram) magicSets(query []datalogLiteral) []datalogLiteral {
+	m := &magicRewrite{d: d, rules: d.rules, done: make(map[string]bool)}
+	calls, negated, order := d.calls, d.negated, d.order
+	original := query
+	d.rules = make(map[string][]datalogRule)
+	d.calls = make(map[string][]string)
+	d.negated = make(map[string]map[string]bool)
+
+	query = m.rewriteBody(query, nil, make(map[string]bool))
+	for len(m.queue) > 0 {
+		pred := m.queue[0]
+		m.queue = m.queue[1:]
+		for _, rule := range m.rules[pred.key] {
+			bound := make(map[string]bool)
+			var magic *datalogLiteral
+			if lit, ok := magicLiteral(pred.adorned, pred.adornment, rule.head.Args); ok {
+				magic = &lit
+				collectTermVars(lit.args, bound)
+			}
+			d.addRule(datalogRule{head: rule.head, key: pred.adorned, body: m.rewriteBody(rule.body, magic, bound)})
+		}
+	}
+
+	if _, err := d.strata(); err != nil {
+		for _, key := range d.order[len(order):] {
+			delete(d.relations, key)
+		}
+		d.rules, d.calls, d.negated, d.order = m.rules, calls, negated, order
+		return original
+	}
+	return query
+}
+
+// rewriteBody calls the specialisations of the derived predicates in body,
+// starting it with magic and adding the rules seeding their magic
+// predicates. bound holds the variables bound before body runs.
+func (m *magicRewrite) rewriteBody(body []datalogLiteral, magic *datalogLiteral, bound map[string]bool) []datalogLiteral {
+	var rewritten []datalogLiteral
+	if magic != nil {
+		rewritten = append(rewritten, *magic)
+	}
+	for _, lit := range body {
+		if len(m.rules[lit.key]) > 0 {
+			switch lit.kind {
+			case positiveLiteral:
+				adornment := adorn(lit.args, bound)
+				lit.key = m.adorned(lit.key, adornment)
+				if seed, ok := magicLiteral(lit.key, adornment, lit.args); ok {
+					head := Compound("magic", seed.args)
+					m.d.addRule(datalogRule{head: head, key: seed.key, body: append([]datalogLiteral{}, rewritten...)})
+				}
+			case negatedLiteral:
+				lit.key = m.adorned(lit.key, strings.Repeat("f", len(lit.args)))
+			}
+		}
+		rewritten = append(rewritten, lit)
+		if lit.kind == positiveLiteral || lit.kind == unifyLiteral {
+			collectTermVars(lit.args, bound)
+		}
+	}
+	return rewritten
+}
+
+// adorned returns the predicate specialising key for adornment, queueing
+// its rules for rewriting the first time.
+func (m *magicRewrite) adorned(key, adornment string) string {
+	adorned := key
+	if strings.Contains(adornment, "b") {
+		adorned = key + "^" + adornment
+	}
+	if m.done[adorned] {
+		return adorned
+	}
+	m.done[adorned] = true
+	m.queue = append(m.queue, adornedPredicate{key: key, adornment: adornment, adorned: adorned})
+
+	// The stored facts of the predicate hold whatever it is called with
+	if adorned != key {
+		rel := newRelation()
+		for _, tuple := range m.d.relations[key].tuples {
+			rel.add(tuple)
+		}
+		m.d.relations[adorned] = rel
+		m.d.order = append(m.d.order, adorned)
+		magic := "magic(" + adorned + ")"
+		m.d.relations[magic] = newRelation()
+		m.d.order = append(m.d.order, magic)
+	}
+	return adorned
+}
+
+// adorn marks each argument b when it is bound and f when it is free.
+func adorn(args []Term, bound map[string]bool) string {
+	adornment := make([]byte, len(args))
+	for i, arg := range args {
+		adornment[i] = 'f'
+		if ground(arg, bound) {
+			adornment[i] = 'b'
+		}
+	}
+	return string(adornment)
+}
+
+// magicLiteral returns the call of the magic predicate of adorned with the
+// bound arguments among args, reporting false when none are bound.
+func magicLiteral(adorned, adornment string, args []Term) (datalogLiteral, bool) {
+	var bound []Term
+	for i, arg := range args {
+		if adornment[i] == 'b' {
+			bound = append(bound, arg)
+		}
+	}
+	if len(bound) == 0 {
+		return datalogLiteral{}, false
+	}
+	return datalogLiteral{kind: positiveLiteral, goal: Compound("magic", bound), key: "magic(" + adorned + ")", args: bound}, true
+}
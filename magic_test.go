@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMagicSets(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+
+	// A chain of 100 people, each the parent of the next
+	var source strings.Builder
+	for i := 1; i < 100; i++ {
+		fmt.Fprintf(&source, "parent(p%d, p%d).\n", i, i+1)
+	}
+	source.WriteString(`
+ancestor(X, Y) :- parent(X, Y).
+ancestor(X, Z) :- parent(X, Y), ancestor(Y, Z).
+start(p95).
+`)
+	if _, err := engine.Consult(sessionID, source.String()); err != nil {
+		t.Fatalf("Consult failed: %v", err)
+	}
+
+	// Only the ancestors of p95 are derived, not all 4950 pairs
+	goals, _ := engine.ParseQuery(sessionID, "ancestor(p95, Y)")
+	result := engine.Query(Query{Goals: goals, Evaluation: "bottom_up"}, sessionID)
+	if values := solutionValues(result, "Y"); !reflect.DeepEqual(values, []string{"p100", "p96", "p97", "p98", "p99"}) {
+		t.Fatalf("Expected the five descendants of p95, got %v (%s)", values, result.Error)
+	}
+	expected := [][]string{{"magic(ancestor/2^bf)"}, {"ancestor/2^bf"}}
+	if stats := result.Datalog; stats.Derived != 21 || !reflect.DeepEqual(stats.Strata, expected) {
+		t.Errorf("Expected p95 to p100 as magic facts and 15 ancestors, got %+v", stats)
+	}
+
+	// Bindings pass sideways from earlier goals
+	goals, _ = engine.ParseQuery(sessionID, "start(S), ancestor(S, p97)")
+	result = engine.Query(Query{Goals: goals, Evaluation: "bottom_up"}, sessionID)
+	if values := solutionValues(result, "S"); !reflect.DeepEqual(values, []string{"p95"}) || result.Datalog.Derived != 8 {
+		t.Errorf("Expected p95 from a goal-directed evaluation, got %v and %+v", values, result.Datalog)
+	}
+
+	// The recursive call binds both arguments once parent/2 has run
+	goals, _ = engine.ParseQuery(sessionID, "ancestor(X, p3)")
+	result = engine.Query(Query{Goals: goals, Evaluation: "bottom_up"}, sessionID)
+	expected = [][]string{{"magic(ancestor/2^fb)"}, {"magic(ancestor/2^bb)"}, {"ancestor/2^bb"}, {"ancestor/2^fb"}}
+	if values := solutionValues(result, "X"); !reflect.DeepEqual(values, []string{"p1", "p2"}) || !reflect.DeepEqual(result.Datalog.Strata, expected) {
+		t.Errorf("Expected p1 and p2 from ancestor/2^fb, got %v and %+v", values, result.Datalog)
+	}
+}
+
+func TestMagicSetsNegation(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+	engine.Consult(sessionID, graphSource+"path(f, a).\n")
+
+	// Negated calls use the whole relation, so the program stays stratified
+	goals, _ := engine.ParseQuery(sessionID, "unreachable(a, Y)")
+	result := engine.Query(Query{Goals: goals, Evaluation: "bottom_up"}, sessionID)
+	if values := solutionValues(result, "Y"); !reflect.DeepEqual(values, []string{"e", "f"}) {
+		t.Errorf("Expected e and f to be unreachable from a, got %v (%s)", values, result.Error)
+	}
+	expected := [][]string{{"path/2"}, {"magic(unreachable/2^bf)"}, {"unreachable/2^bf"}}
+	if !reflect.DeepEqual(result.Datalog.Strata, expected) {
+		t.Errorf("Expected %v, got %v", expected, result.Datalog.Strata)
+	}
+
+	// Predicates with facts and rules keep their facts when specialised
+	goals, _ = engine.ParseQuery(sessionID, "path(f, c)")
+	if result = engine.Query(Query{Goals: goals, Evaluation: "bottom_up"}, sessionID); !result.Solutions[0].Success {
+		t.Errorf("Expected f to reach c through the stored path(f, a), got %+v", result)
+	}
+	// A rewrite the negation would make unstratified falls back to the
+	// original rules
+	engine.Consult(sessionID, "t(a).\nq(X) :- t(X), path(X, Y).\nc(X) :- node(X), \\+ q(X), path(X, Y).\n")
+	goals, _ = engine.ParseQuery(sessionID, "c(X)")
+	result = engine.Query(Query{Goals: goals, Evaluation: "bottom_up"}, sessionID)
+	if values := solutionValues(result, "X"); !reflect.DeepEqual(values, []string{"b", "c", "e", "f"}) {
+		t.Errorf("Expected b, c, e and f, got %v (%s)", values, result.Error)
+	}
+}
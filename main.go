@@ -40,6 +40,15 @@ func main() {
 	fmt.Println("  POST /api/v1/sessions/:sessionId/facts - Add a fact")
 	fmt.Println("  POST /api/v1/sessions/:sessionId/rules - Add a rule")  
 	fmt.Println("  POST /api/v1/sessions/:sessionId/query - Execute a query")
+	fmt.Println("  POST /api/v1/sessions/:sessionId/trace - Execute a query, streaming its trace events")
+	fmt.Println("  GET  /api/v1/sessions/:id/profile - Last profiled query in pprof format")
+	fmt.Println("  POST /api/v1/sessions/:sessionId/explain - Plan a query without running it")
+	fmt.Println("  POST /api/v1/sessions/:sessionId/consult - Load Prolog source text")
+	fmt.Println("  GET  /api/v1/sessions/:id/libraries - List enabled libraries")
+	fmt.Println("  POST /api/v1/sessions/:sessionId/libraries - Enable a library (e.g. event_calculus)")
+	fmt.Println("  GET  /api/v1/sessions/:id/parents - List parent sessions")
+	fmt.Println("  POST /api/v1/sessions/:sessionId/parents - Inherit the clauses of another session")
+	fmt.Println("  DEL  /api/v1/sessions/:id/parents/:parentId - Stop inheriting from a session")
 	fmt.Println("\nUtilities:")
 	fmt.Println("  POST /api/v1/cache/clear - Clear cache")
 	
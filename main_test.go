@@ -21,7 +21,7 @@ func teardownTestEngine(engine *Engine) {
 }
 
 // createTestSession creates a test session and returns its ID
-func createTestSession(t *testing.T, engine *Engine) int {
+func createTestSession(t *testing.T, engine *Engine) string {
 	req := CreateSessionRequest{
 		Name:        "test-session",
 		Description: "Test session for unit tests",
@@ -0,0 +1,542 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Materialized predicates. materialize(Name/Arity) marks a Datalog
+// predicate of a session as materialized: its extension is stored in the
+// materialized_facts table, and calls of it look their answers up there
+// instead of resolving its rules. The extension comes from a bottom-up
+// model of the predicates it depends on, built on first use and then kept
+// up to date as the session's clauses change. An added fact or rule only
+// derives its new consequences, semi-naively; a retracted fact is handled
+// with DRed, deleting everything derived from it and rederiving what has
+// another derivation. Changes the model cannot follow incrementally — those
+// under negation, new rules reaching new derived predicates, clauses of
+// other sessions, module and parent changes — drop the model, and the next
+// call rebuilds it.
+
+type materializedView struct {
+	d          *datalogProgram
+	predicates map[string]Term // the materialized predicates, by key
+	strata     [][]string
+}
+
+// Materialize marks the predicate Name/Arity of module as materialized in
+// a session.
+func (e *Engine) Materialize(sessionID, module, name string, arity int) error {
+	defer e.lockViews(sessionID)()
+	_, err := e.db.Exec("INSERT OR IGNORE INTO session_materialized (session_id, module, predicate) VALUES (?, ?, ?)",
+		sessionID, module, indicatorKey(name, arity))
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	delete(e.materialized, sessionID)
+	delete(e.views, sessionID)
+	e.mu.Unlock()
+	return nil
+}
+
+// MaterializedPredicates lists the materialized predicates of a session,
+// qualified outside the user module.
+func (e *Engine) MaterializedPredicates(sessionID string) ([]string, error) {
+	rows, err := e.db.Query("SELECT module, predicate FROM session_materialized WHERE session_id = ?", sessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []string{}
+	for rows.Next() {
+		var module, predicate string
+		if err := rows.Scan(&module, &predicate); err != nil {
+			return nil, err
+		}
+		if module != userModule {
+			predicate = module + ":" + predicate
+		}
+		keys = append(keys, predicate)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// materializedGoals returns the most general goal of each materialized
+// predicate of a session, qualified with its module, cached until they
+// change.
+func (e *Engine) materializedGoals(sessionID string) map[string]Term {
+	e.mu.Lock()
+	goals, cached := e.materialized[sessionID]
+	e.mu.Unlock()
+	if cached {
+		return goals
+	}
+
+	keys, err := e.MaterializedPredicates(sessionID)
+	if err != nil {
+		return nil
+	}
+	goals = make(map[string]Term)
+	for _, key := range keys {
+		module, indicator := userModule, key
+		if i := strings.LastIndex(key, ":"); i >= 0 {
+			module, indicator = key[:i], key[i+1:]
+		}
+		slash := strings.LastIndex(indicator, "/")
+		var arity int
+		fmt.Sscanf(indicator[slash+1:], "%d", &arity)
+		goal := Atom(indicator[:slash])
+		if arity > 0 {
+			args := make([]Term, arity)
+			for i := range args {
+				args[i] = Variable(fmt.Sprintf("A%d", i+1))
+			}
+			goal = Compound(indicator[:slash], args)
+		}
+		goals[key] = qualify(module, goal)
+	}
+	e.mu.Lock()
+	e.materialized[sessionID] = goals
+	e.mu.Unlock()
+	return goals
+}
+
+// handleMaterialize implements materialize/1 for a predicate indicator or a
+// list of them. Unqualified indicators belong to module.
+func (e *Engine) handleMaterialize(goal Term, module string, subst Substitution, sessionID string) ([]Substitution, bool) {
+	if len(goal.Args) != 1 {
+		return []Substitution{}, true
+	}
+	specs := []Term{e.instantiate(goal.Args[0], subst)}
+	if items, ok := e.listElements(specs[0], subst); ok {
+		specs = items
+	}
+	for _, spec := range specs {
+		specModule, spec := splitModule(spec)
+		if specModule == userModule {
+			specModule = module
+		}
+		if spec.Type != "compound" || spec.Value != "/" || len(spec.Args) != 2 ||
+			spec.Args[0].Type != "atom" || spec.Args[1].Type != "number" {
+			return []Substitution{}, true
+		}
+		if err := e.Materialize(sessionID, specModule, spec.Args[0].Value.(string), int(spec.Args[1].Value.(float64))); err != nil {
+			return []Substitution{}, true
+		}
+	}
+	return []Substitution{subst}, true
+}
+
+// solveMaterialized returns the stored answers of goal called in module,
+// reporting false unless its predicate is materialized in the session and
+// its model can be built.
+func (e *Engine) solveMaterialized(goal Term, module, sessionID string) ([]Term, bool) {
+	if goal.Type != "atom" && goal.Type != "compound" {
+		return nil, false
+	}
+	key := newQueryPlanner(e, sessionID).key(goal, module)
+	if _, ok := e.materializedGoals(sessionID)[key]; !ok || e.view(sessionID) == nil {
+		return nil, false
+	}
+
+	query := &sqlQuery{}
+	query.text.WriteString("SELECT data FROM materialized_facts WHERE session_id = ? AND predicate = ?")
+	query.args = append(query.args, sessionID, key)
+	for i, arg := range goal.Args {
+		if datalogConstant(arg) {
+			fmt.Fprintf(&query.text, " AND %s = %s", argColumn("materialized_facts", i), query.param(arg))
+		}
+	}
+	rows, err := e.db.Query(query.text.String(), query.args...)
+	if err != nil {
+		return nil, false
+	}
+	defer rows.Close()
+
+	var answers []Term
+	for rows.Next() {
+		var data string
+		var answer Term
+		if rows.Scan(&data) != nil || json.Unmarshal([]byte(data), &answer) != nil {
+			return nil, false
+		}
+		answers = append(answers, answer)
+	}
+	return answers, rows.Err() == nil
+}
+
+// view returns the materialized view of a session, building it when there
+// is none, or nil when its predicates are not Datalog.
+func (e *Engine) view(sessionID string) *materializedView {
+	e.mu.Lock()
+	v := e.views[sessionID]
+	e.mu.Unlock()
+	if v != nil {
+		return v
+	}
+
+	defer e.lockViews(sessionID)()
+	e.mu.Lock()
+	v = e.views[sessionID]
+	e.mu.Unlock()
+	if v != nil {
+		return v
+	}
+	generation := e.generation(sessionID)
+
+	d := newDatalogProgram(e, sessionID)
+	d.stored, d.foreign = make(map[string]map[string]int), make(map[string]bool)
+	v = &materializedView{d: d, predicates: make(map[string]Term)}
+	for key, goal := range e.materializedGoals(sessionID) {
+		module, goal := splitModule(goal)
+		if _, err := d.load(goal, module); err != nil {
+			return nil
+		}
+		v.predicates[key] = goal
+	}
+	if err := d.evaluate(); err != nil {
+		return nil
+	}
+	v.strata = d.stats.Strata
+
+	// Replace whatever an earlier model stored
+	if _, err := e.db.Exec("DELETE FROM materialized_facts WHERE session_id = ?", sessionID); err != nil {
+		return nil
+	}
+	added := make(map[string][][]Term)
+	for key := range v.predicates {
+		added[key] = d.relations[key].tuples
+	}
+	if v.store(added, nil) != nil {
+		return nil
+	}
+
+	e.mu.Lock()
+	if e.generations[sessionID] == generation {
+		e.views[sessionID] = v
+	}
+	e.mu.Unlock()
+	return v
+}
+
+// store writes the changes of the materialized predicates' extensions.
+func (v *materializedView) store(added, removed map[string][][]Term) error {
+	tx, err := v.d.p.e.db.Begin()
+	if err != nil {
+		return err
+	}
+	write := func(statement string, changes map[string][][]Term) error {
+		for key, tuples := range changes {
+			goal, ok := v.predicates[key]
+			if !ok {
+				continue
+			}
+			for _, tuple := range tuples {
+				answer := Atom(goal.Value.(string))
+				if len(tuple) > 0 {
+					answer = Compound(goal.Value.(string), tuple)
+				}
+				data, _ := json.Marshal(answer)
+				if _, err := tx.Exec(statement, v.d.p.sessionID, key, string(data)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err := write("INSERT OR IGNORE INTO materialized_facts (session_id, predicate, data) VALUES (?, ?, ?)", added); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := write("DELETE FROM materialized_facts WHERE session_id = ? AND predicate = ? AND data = ?", removed); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// lockViews serializes the changes to a session's clauses with the
+// building and maintenance of its materialized view, so each change is
+// applied to the view exactly once. It returns the function releasing the
+// lock.
+func (e *Engine) lockViews(sessionID string) func() {
+	e.mu.Lock()
+	lock, ok := e.viewLocks[sessionID]
+	if !ok {
+		lock = &sync.Mutex{}
+		e.viewLocks[sessionID] = lock
+	}
+	e.mu.Unlock()
+	lock.Lock()
+	return lock.Unlock
+}
+
+// updateViews drops everything derived from a session's clauses after a
+// change to them, keeping its materialized view when update brings it up
+// to date. The caller holds lockViews across the change and the update.
+func (e *Engine) updateViews(sessionID string, update func(v *materializedView) bool) {
+	e.mu.Lock()
+	v := e.views[sessionID]
+	e.mu.Unlock()
+	e.invalidateSession(sessionID)
+	generation := e.generation(sessionID)
+	if v != nil && update(v) {
+		e.mu.Lock()
+		if e.generations[sessionID] == generation {
+			e.views[sessionID] = v
+		}
+		e.mu.Unlock()
+	}
+}
+
+// dependency returns the relation of the predicate of head in module when
+// the view depends on it, reporting false when the view cannot follow a
+// change to it.
+func (v *materializedView) dependency(module string, head Term) (string, *relation, bool) {
+	key := v.d.p.key(head, module)
+	rel := v.d.relations[key]
+	return key, rel, rel == nil || !v.d.foreign[key]
+}
+
+// addFact brings the view up to date with a fact added in module.
+func (v *materializedView) addFact(module string, head Term) bool {
+	key, rel, ok := v.dependency(module, head)
+	if rel == nil || !ok {
+		return ok
+	}
+	for _, arg := range head.Args {
+		if !datalogConstant(arg) {
+			return false
+		}
+	}
+	tuple, _ := tupleKey(head.Args)
+	if v.d.stored[key] == nil {
+		v.d.stored[key] = make(map[string]int)
+	}
+	v.d.stored[key][tuple]++
+	if !rel.add(head.Args) {
+		return true
+	}
+
+	changed := map[string]*relation{key: newRelation()}
+	changed[key].add(head.Args)
+	return v.propagate(changed, map[string][][]Term{key: {head.Args}})
+}
+
+// addRule brings the view up to date with a rule added to a session.
+func (v *materializedView) addRule(rule Rule) bool {
+	d := v.d
+	module, head := splitModule(rule.Head)
+	key, rel, ok := v.dependency(module, head)
+	if rel == nil || !ok {
+		return ok
+	}
+	for _, arg := range head.Args {
+		if arg.Type != "variable" && !datalogConstant(arg) {
+			return false
+		}
+	}
+
+	// The rule may only reach derived predicates the model has
+	loaded := len(d.order)
+	clause := formatTerm(Compound(":-", []Term{head, conjunction(rule.Body)}), true)
+	body, err := d.body(rule.Body, module, clause)
+	if err != nil || checkSafety(head, body, clause) != nil {
+		return false
+	}
+	for _, added := range d.order[loaded:] {
+		if len(d.rules[added]) > 0 {
+			return false
+		}
+	}
+	d.addRule(datalogRule{head: head, key: key, body: body})
+	d.trackClause(key, rule.SessionID, nil, false)
+	if v.strata, err = d.strata(); err != nil {
+		return false
+	}
+
+	changed, added := map[string]*relation{key: newRelation()}, make(map[string][][]Term)
+	d.join(body, -1, nil, make(Substitution), func(binding Substitution) {
+		tuple := make([]Term, len(head.Args))
+		for i, arg := range head.Args {
+			tuple[i] = d.p.e.instantiate(arg, binding)
+		}
+		if rel.add(tuple) {
+			changed[key].add(tuple)
+			added[key] = append(added[key], tuple)
+		}
+	})
+	return v.propagate(changed, added)
+}
+
+// propagate derives the consequences of the tuples in changed, which the
+// model already has, collecting the new tuples in added and storing them.
+func (v *materializedView) propagate(changed map[string]*relation, added map[string][][]Term) bool {
+	for _, stratum := range v.strata {
+		if v.negates(stratum, changed) {
+			return false
+		}
+		for key, rel := range v.d.fixpoint(stratum, changed) {
+			if changed[key] == nil {
+				changed[key] = newRelation()
+			}
+			for _, tuple := range rel.tuples {
+				changed[key].add(tuple)
+			}
+			added[key] = append(added[key], rel.tuples...)
+		}
+	}
+	return v.store(added, nil) == nil
+}
+
+// negates reports whether a rule of stratum negates a relation in changed.
+func (v *materializedView) negates(stratum []string, changed map[string]*relation) bool {
+	for _, key := range stratum {
+		for negated := range v.d.negated[key] {
+			if changed[negated] != nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// removeFact brings the view up to date with a fact retracted in module:
+// every tuple with a derivation using it is deleted, then those with
+// another derivation are derived again.
+func (v *materializedView) removeFact(module string, head Term) bool {
+	d := v.d
+	key, rel, ok := v.dependency(module, head)
+	if rel == nil || !ok {
+		return ok
+	}
+	tuple, _ := tupleKey(head.Args)
+	if d.stored[key] != nil {
+		d.stored[key][tuple]--
+	}
+	if d.stored[key][tuple] > 0 || !rel.seen[tuple] {
+		return true
+	}
+
+	deleted := map[string]*relation{key: newRelation()}
+	deleted[key].add(head.Args)
+	for _, stratum := range v.strata {
+		if v.negates(stratum, deleted) {
+			return false
+		}
+		v.overdelete(stratum, deleted)
+	}
+	for key, rel := range deleted {
+		d.relations[key].remove(rel.seen)
+	}
+
+	for _, stratum := range v.strata {
+		rederived := make(map[string]*relation)
+		for _, key := range stratum {
+			if deleted[key] == nil {
+				continue
+			}
+			for _, tuple := range deleted[key].tuples {
+				if v.derivable(key, tuple) {
+					if rederived[key] == nil {
+						rederived[key] = newRelation()
+					}
+					rederived[key].add(tuple)
+					d.relations[key].add(tuple)
+				}
+			}
+		}
+		if len(rederived) > 0 {
+			d.fixpoint(stratum, rederived)
+		}
+	}
+
+	removed := make(map[string][][]Term)
+	for key, rel := range deleted {
+		for _, tuple := range rel.tuples {
+			if tupleKey, _ := tupleKey(tuple); !d.relations[key].seen[tupleKey] {
+				removed[key] = append(removed[key], tuple)
+			}
+		}
+	}
+	return v.store(nil, removed) == nil
+}
+
+// overdelete adds to deleted the tuples of stratum with a derivation using
+// a tuple in deleted, joining against the model before the deletion.
+func (v *materializedView) overdelete(stratum []string, deleted map[string]*relation) {
+	d := v.d
+	for delta := deleted; len(delta) > 0; {
+		next := make(map[string]*relation)
+		for _, key := range stratum {
+			for _, rule := range d.rules[key] {
+				for i, lit := range rule.body {
+					if lit.kind != positiveLiteral || delta[lit.key] == nil {
+						continue
+					}
+					d.join(rule.body, i, delta, make(Substitution), func(binding Substitution) {
+						tuple := make([]Term, len(rule.head.Args))
+						for i, arg := range rule.head.Args {
+							tuple[i] = d.p.e.instantiate(arg, binding)
+						}
+						tupleKey, _ := tupleKey(tuple)
+						if !d.relations[key].seen[tupleKey] || deleted[key] != nil && deleted[key].seen[tupleKey] {
+							return
+						}
+						if next[key] == nil {
+							next[key] = newRelation()
+						}
+						next[key].add(tuple)
+					})
+				}
+			}
+		}
+		for key, rel := range next {
+			if deleted[key] == nil {
+				deleted[key] = newRelation()
+			}
+			for _, tuple := range rel.tuples {
+				deleted[key].add(tuple)
+			}
+		}
+		delta = next
+	}
+}
+
+// derivable reports whether tuple of key is a stored fact or follows from
+// one of its rules in the current model.
+func (v *materializedView) derivable(key string, tuple []Term) bool {
+	d := v.d
+	if tupleKey, _ := tupleKey(tuple); d.stored[key][tupleKey] > 0 {
+		return true
+	}
+	for _, rule := range d.rules[key] {
+		binding := make(Substitution)
+		matched := true
+		for i, arg := range rule.head.Args {
+			if arg.Type == "variable" {
+				arg = d.p.e.instantiate(arg, binding)
+			}
+			if arg.Type == "variable" {
+				binding[arg.Value.(string)] = tuple[i]
+			} else if formatTerm(arg, true) != formatTerm(tuple[i], true) {
+				matched = false
+				break
+			}
+		}
+		found := false
+		if matched {
+			d.join(rule.body, -1, nil, binding, func(Substitution) { found = true })
+		}
+		if found {
+			return true
+		}
+	}
+	return false
+}
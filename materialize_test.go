@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestMaterialize(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+	if _, err := engine.Consult(sessionID, graphSource); err != nil {
+		t.Fatalf("Consult failed: %v", err)
+	}
+
+	query := func(text, variable string) []string {
+		t.Helper()
+		goals, err := engine.ParseQuery(sessionID, text)
+		if err != nil {
+			t.Fatalf("ParseQuery(%s) failed: %v", text, err)
+		}
+		result := engine.Query(Query{Goals: goals}, sessionID)
+		if result.Error != "" {
+			t.Fatalf("%s failed: %s", text, result.Error)
+		}
+		return solutionValues(result, variable)
+	}
+	stored := func() int {
+		t.Helper()
+		var count int
+		if err := engine.db.QueryRow("SELECT COUNT(*) FROM materialized_facts WHERE session_id = ? AND predicate = 'path/2'", sessionID).Scan(&count); err != nil {
+			t.Fatalf("Counting materialized facts failed: %v", err)
+		}
+		return count
+	}
+
+	// path/2 is left-recursive, so top-down calls only terminate when they
+	// read the stored extension
+	if values := query("materialize(path/2)", "X"); len(values) != 1 {
+		t.Fatalf("Expected materialize/1 to succeed, got %v", values)
+	}
+	if values := query("path(a, Y)", "Y"); !reflect.DeepEqual(values, []string{"a", "b", "c", "d"}) {
+		t.Fatalf("Expected a to reach a, b, c and d, got %v", values)
+	}
+	if count := stored(); count != 13 {
+		t.Errorf("Expected 13 stored paths, got %d", count)
+	}
+	if keys, _ := engine.MaterializedPredicates(sessionID); !reflect.DeepEqual(keys, []string{"path/2"}) {
+		t.Errorf("Expected path/2 to be materialized, got %v", keys)
+	}
+	view := engine.views[sessionID]
+
+	// Added facts and rules only derive their consequences
+	if _, err := engine.Consult(sessionID, "edge(d, e). edge(b, d). link(f, a)."); err != nil {
+		t.Fatalf("Consult failed: %v", err)
+	}
+	if values := query("path(a, Y)", "Y"); !reflect.DeepEqual(values, []string{"a", "b", "c", "d", "e", "f"}) {
+		t.Errorf("Expected a to reach e and f through d, got %v", values)
+	}
+	if _, err := engine.Consult(sessionID, "path(X, Y) :- link(X, Y)."); err != nil {
+		t.Fatalf("Consult failed: %v", err)
+	}
+	if values := query("path(f, Y)", "Y"); !reflect.DeepEqual(values, []string{"a", "b", "c", "d", "e", "f"}) {
+		t.Errorf("Expected f to reach everything through link/2, got %v", values)
+	}
+	if engine.views[sessionID] != view {
+		t.Error("Expected added clauses to update the view in place")
+	}
+
+	// A retracted edge keeps the paths with another derivation
+	if values := query("retract(edge(c, d))", "X"); len(values) != 1 {
+		t.Fatalf("Expected retract/1 to succeed, got %v", values)
+	}
+	if values := query("path(c, Y)", "Y"); !reflect.DeepEqual(values, []string{"a", "b", "c", "d", "e", "f"}) {
+		t.Errorf("Expected c to reach d through b, got %v", values)
+	}
+	if values := query("retract(edge(b, d))", "X"); len(values) != 1 {
+		t.Fatalf("Expected retract/1 to succeed, got %v", values)
+	}
+	if values := query("path(a, Y)", "Y"); !reflect.DeepEqual(values, []string{"a", "b", "c"}) {
+		t.Errorf("Expected a to reach only a, b and c, got %v", values)
+	}
+	if values := query("path(d, Y)", "Y"); !reflect.DeepEqual(values, []string{"e", "f"}) {
+		t.Errorf("Expected d to keep its paths through e, got %v", values)
+	}
+	if engine.views[sessionID] != view {
+		t.Error("Expected retracted facts to update the view in place")
+	}
+
+	// The stored extension matches a fresh evaluation
+	count := stored()
+	goals, _ := engine.ParseQuery(sessionID, "path(X, Y)")
+	if result := engine.Query(Query{Goals: goals, Evaluation: "bottom_up"}, sessionID); len(result.Solutions) != count {
+		t.Errorf("Expected %d stored paths, got %d", len(result.Solutions), count)
+	}
+	if values := query("retract(edge(x, y))", "X"); len(values) != 0 {
+		t.Errorf("Expected retracting a missing fact to fail, got %v", values)
+	}
+}
+
+func TestMaterializeFallback(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+	source := `
+num(1). num(2).
+pair(p(X, Y)) :- num(X), num(Y).
+`
+	if _, err := engine.Consult(sessionID, source); err != nil {
+		t.Fatalf("Consult failed: %v", err)
+	}
+
+	// pair/1 builds compound terms, so its calls are resolved as before
+	goals, _ := engine.ParseQuery(sessionID, "materialize(pair/1), pair(p(2, Y))")
+	result := engine.Query(Query{Goals: goals}, sessionID)
+	if values := solutionValues(result, "Y"); !reflect.DeepEqual(values, []string{"1", "2"}) {
+		t.Errorf("Expected pair/1 to be resolved, got %v (%s)", values, result.Error)
+	}
+	if engine.views[sessionID] != nil {
+		t.Error("Expected no view for a predicate that is not Datalog")
+	}
+}
+
+func TestMaterializeInModule(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+
+	// A qualified call materializes the predicate of its module
+	goals, _ := engine.ParseQuery(sessionID, "graph:materialize(path/2)")
+	if len(queryAll(engine, sessionID, goals...)) != 1 {
+		t.Fatal("Expected graph:materialize(path/2) to succeed")
+	}
+	if keys, _ := engine.MaterializedPredicates(sessionID); !reflect.DeepEqual(keys, []string{"graph:path/2"}) {
+		t.Errorf("Expected graph:path/2 to be materialized, got %v", keys)
+	}
+}
+
+func TestMaterializeOnlyOwnSession(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+	graph, _ := engine.CreateSession(CreateSessionRequest{Name: "graph"})
+	if _, err := engine.Consult(graph.ID, graphSource); err != nil {
+		t.Fatalf("Consult failed: %v", err)
+	}
+	sessionID := createTestSession(t, engine)
+
+	// Another session's facts and views are not changed through session(S):
+	for _, text := range []string{"session(graph):materialize(path/2)", "session(graph):retract(edge(a, b))"} {
+		goals, _ := engine.ParseQuery(sessionID, text)
+		if result := engine.Query(Query{Goals: goals}, sessionID); len(solutionValues(result, "X")) != 0 {
+			t.Errorf("Expected %s to fail", text)
+		}
+	}
+	if keys, _ := engine.MaterializedPredicates(graph.ID); len(keys) != 0 {
+		t.Errorf("Expected nothing materialized in the graph session, got %v", keys)
+	}
+	if len(queryAll(engine, graph.ID, Compound("edge", []Term{Atom("a"), Atom("b")}))) != 1 {
+		t.Error("Expected edge(a, b) to be kept")
+	}
+}
+
+func TestMaterializeConcurrentChanges(t *testing.T) {
+	// Every connection to :memory: opens a database of its own, and the
+	// changes below run on several connections at once
+	engine, err := NewEngine(filepath.Join(t.TempDir(), "views.db"))
+	if err != nil {
+		t.Fatalf("Failed to create engine: %v", err)
+	}
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+	if _, err := engine.Consult(sessionID, graphSource+"edge(a, n1).\n"); err != nil {
+		t.Fatalf("Consult failed: %v", err)
+	}
+	reached := func() int {
+		goals, _ := engine.ParseQuery(sessionID, "path(a, Y)")
+		return len(queryAll(engine, sessionID, goals...))
+	}
+	goals, _ := engine.ParseQuery(sessionID, "materialize(path/2)")
+	queryAll(engine, sessionID, goals...)
+
+	// Each added fact reaches the view once, however the changes interleave
+	// with each other and with queries
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				node := Atom(fmt.Sprintf("m%d_%d", g, i))
+				if err := engine.AddFact(Fact{SessionID: sessionID, Predicate: Compound("edge", []Term{Atom("n1"), node})}); err != nil {
+					t.Errorf("Failed to add fact: %v", err)
+				}
+				reached()
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	if count := reached(); count != 85 {
+		t.Errorf("Expected a to reach 85 nodes, got %d", count)
+	}
+	engine.invalidateSession(sessionID)
+	if count := reached(); count != 85 {
+		t.Errorf("Expected a rebuilt view to reach 85 nodes, got %d", count)
+	}
+}
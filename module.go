@@ -0,0 +1,393 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// Modules. Every clause belongs to a module of its session; clauses added
+// without a qualification go to the user module. A module declared with
+// :- module(Name, Exports) exports Name/Arity indicators, and a module sees
+// its own predicates, the exports of the modules it imports with
+// use_module/1,2 and, failing those, the predicates of user. Clause bodies
+// run in the module that defines the clause, and M:Goal runs Goal in M.
+
+const userModule = "user"
+
+// metaPositions lists the arguments of builtins that are goals or closures
+// and therefore run in the caller's module.
+var metaPositions = map[string][]int{
+	"call/2": {0}, "call/3": {0}, "call/4": {0}, "call/5": {0}, "call/6": {0}, "call/7": {0}, "call/8": {0},
+	"maplist/2": {0}, "maplist/3": {0}, "maplist/4": {0}, "maplist/5": {0},
+	"foldl/4": {0}, "foldl/5": {0}, "foldl/6": {0},
+	"include/3": {0}, "exclude/3": {0}, "phrase/2": {0}, "phrase/3": {0},
+	"freeze/2": {1}, "when/2": {1}, "count/3": {1}, "aggregate/3": {1},
+}
+
+// splitModule removes module qualifications from t, returning the
+// innermost module and the plain term.
+func splitModule(t Term) (string, Term) {
+	module := userModule
+	for t.Type == "compound" && t.Value == ":" && len(t.Args) == 2 && t.Args[0].Type == "atom" {
+		module, t = t.Args[0].Value.(string), t.Args[1]
+	}
+	return module, t
+}
+
+// qualify returns module:t, leaving terms for the user module unqualified.
+func qualify(module string, t Term) Term {
+	if module == userModule {
+		return t
+	}
+	return Compound(":", []Term{Atom(module), t})
+}
+
+// moduleImport is one use_module/1,2 import; only is nil when all exports
+// are imported.
+type moduleImport struct {
+	module string
+	only   map[string]bool
+}
+
+// moduleIndex caches the module structure a session sees, including the
+// modules of the sessions it inherits from, for resolution.
+type moduleIndex struct {
+	defined   map[string]map[string]bool // module -> predicate names with clauses
+	exports   map[string]map[string]bool // module -> exported Name/Arity
+	imports   map[string][]moduleImport  // importing module -> imports in order
+	multifile map[string]bool            // Module:Name/Arity declared multifile
+	overrides map[string]bool            // library Name/Arity with clauses in user
+}
+
+func indicatorKey(name string, arity int) string {
+	return fmt.Sprintf("%s/%d", name, arity)
+}
+
+// sessionModules returns the module index of a session, cached until its
+// clauses or modules, or those of its parents, change.
+func (e *Engine) sessionModules(sessionID string) *moduleIndex {
+	e.mu.Lock()
+	idx, cached := e.modules[sessionID]
+	e.mu.Unlock()
+	if cached {
+		return idx
+	}
+
+	idx = &moduleIndex{
+		defined:   make(map[string]map[string]bool),
+		exports:   make(map[string]map[string]bool),
+		imports:   make(map[string][]moduleImport),
+		multifile: make(map[string]bool),
+		overrides: make(map[string]bool),
+	}
+	lineage := e.sessionLineage(sessionID)
+	scan := func(id, query string, each func(a, b string), args ...interface{}) {
+		rows, err := e.db.Query(query, append([]interface{}{id}, args...)...)
+		if err != nil {
+			return
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var a, b string
+			if rows.Scan(&a, &b) == nil {
+				each(a, b)
+			}
+		}
+	}
+	define := func(module, name string) {
+		if idx.defined[module] == nil {
+			idx.defined[module] = make(map[string]bool)
+		}
+		idx.defined[module][name] = true
+	}
+	for _, id := range lineage {
+		scan(id, "SELECT DISTINCT module, predicate FROM facts WHERE session_id = ?", define)
+		scan(id, "SELECT DISTINCT module, head_predicate FROM rules WHERE session_id = ?", define)
+		scan(id, "SELECT predicate, '' FROM session_multifile WHERE session_id = ?", func(key, _ string) {
+			idx.multifile[key] = true
+		})
+		// A session's own module declarations take precedence over inherited ones
+		scan(id, "SELECT module, exports FROM session_modules WHERE session_id = ?", func(module, exports string) {
+			if _, declared := idx.exports[module]; declared {
+				return
+			}
+			var list []string
+			json.Unmarshal([]byte(exports), &list)
+			idx.exports[module] = make(map[string]bool)
+			for _, pi := range list {
+				idx.exports[module][pi] = true
+			}
+		})
+		e.scanImports(idx, id)
+	}
+	// Library predicates the session defines itself, whose builtins give way
+	// to its clauses
+	for name := range idx.defined[userModule] {
+		if !libraryPredicates[name] {
+			continue
+		}
+		override := func(_, data string) {
+			var head Term
+			if json.Unmarshal([]byte(data), &head) == nil {
+				idx.overrides[indicatorKey(name, termArity(head))] = true
+			}
+		}
+		for _, id := range lineage {
+			scan(id, "SELECT '', data FROM facts WHERE session_id = ? AND module = ? AND predicate = ?", override, userModule, name)
+			scan(id, "SELECT '', head_data FROM rules WHERE session_id = ? AND module = ? AND head_predicate = ?", override, userModule, name)
+		}
+	}
+
+	e.mu.Lock()
+	e.modules[sessionID] = idx
+	e.mu.Unlock()
+	return idx
+}
+
+// scanImports adds the use_module/1,2 imports of one session to idx.
+func (e *Engine) scanImports(idx *moduleIndex, sessionID string) {
+	rows, err := e.db.Query("SELECT importer, module, predicates FROM session_imports WHERE session_id = ? ORDER BY rowid", sessionID)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var importer, module, predicates string
+		if rows.Scan(&importer, &module, &predicates) != nil {
+			continue
+		}
+		imp := moduleImport{module: module}
+		if predicates != "" {
+			var list []string
+			json.Unmarshal([]byte(predicates), &list)
+			imp.only = make(map[string]bool)
+			for _, pi := range list {
+				imp.only[pi] = true
+			}
+		}
+		idx.imports[importer] = append(idx.imports[importer], imp)
+	}
+}
+
+// resolveModule returns the module whose clauses answer goal when it is
+// called from module.
+func (e *Engine) resolveModule(sessionID, module string, goal Term) string {
+	idx := e.sessionModules(sessionID)
+	name := e.extractPredicate(goal)
+	for {
+		if idx.defined[module][name] {
+			return module
+		}
+		key := indicatorKey(name, termArity(goal))
+		for _, imp := range idx.imports[module] {
+			if idx.exports[imp.module][key] && (imp.only == nil || imp.only[key]) {
+				return imp.module
+			}
+		}
+		if module == userModule {
+			return module
+		}
+		module = userModule
+	}
+}
+
+// qualifyGoals runs each goal of a clause body in module.
+func qualifyGoals(module string, goals []Term) []Term {
+	if module == userModule {
+		return goals
+	}
+	qualified := make([]Term, len(goals))
+	for i, goal := range goals {
+		qualified[i] = qualify(module, goal)
+	}
+	return qualified
+}
+
+// DeclareModule records a module and its exported Name/Arity indicators,
+// and imports it into user as loading a module file does.
+func (e *Engine) DeclareModule(sessionID, module string, exports []string) error {
+	if module == userModule {
+		return fmt.Errorf("cannot redeclare the user module")
+	}
+	data, err := json.Marshal(exports)
+	if err != nil {
+		return err
+	}
+	_, err = e.db.Exec("INSERT OR REPLACE INTO session_modules (session_id, module, exports) VALUES (?, ?, ?)", sessionID, module, string(data))
+	if err != nil {
+		return err
+	}
+	return e.ImportModule(sessionID, userModule, module, nil)
+}
+
+// ImportModule makes the exports of module visible in importer; only limits
+// the import to some Name/Arity indicators.
+func (e *Engine) ImportModule(sessionID, importer, module string, only []string) error {
+	if importer == module {
+		return fmt.Errorf("module %s cannot import itself", module)
+	}
+	predicates := ""
+	if only != nil {
+		data, err := json.Marshal(only)
+		if err != nil {
+			return err
+		}
+		predicates = string(data)
+	}
+	_, err := e.db.Exec("INSERT OR REPLACE INTO session_imports (session_id, importer, module, predicates) VALUES (?, ?, ?, ?)",
+		sessionID, importer, module, predicates)
+	if err != nil {
+		return err
+	}
+	e.invalidateSession(sessionID)
+	return nil
+}
+
+// indicators converts a list of Name/Arity terms to their string form.
+func (e *Engine) indicators(list Term, subst Substitution) ([]string, bool) {
+	items, ok := e.listElements(list, subst)
+	if !ok {
+		return nil, false
+	}
+	keys := make([]string, 0, len(items))
+	for _, item := range items {
+		item = e.instantiate(item, subst)
+		if item.Type != "compound" || item.Value != "/" || len(item.Args) != 2 ||
+			item.Args[0].Type != "atom" || item.Args[1].Type != "number" {
+			return nil, false
+		}
+		keys = append(keys, indicatorKey(item.Args[0].Value.(string), int(item.Args[1].Value.(float64))))
+	}
+	return keys, true
+}
+
+// handleModule implements Module:Goal, session(S):Goal, module/2,
+// use_module/1,2 and current_module/1. context is the module the goal is
+// called from.
+func (e *Engine) handleModule(goal Term, context string, subst Substitution, sessionID string) ([]Substitution, bool) {
+	args := goal.Args
+
+	switch {
+	case goal.Value == ":" && len(args) == 2:
+		module := e.deref(args[0], subst)
+		inner := e.deref(args[1], subst)
+		if module.Type == "compound" && module.Value == "session" && len(module.Args) == 1 {
+			return e.solveInSession(module.Args[0], inner, subst), true
+		}
+		if module.Type != "atom" {
+			return []Substitution{}, true
+		}
+		return e.callInModule(inner, module.Value.(string), subst, sessionID), true
+
+	case goal.Value == "module" && len(args) == 2:
+		module := e.deref(args[0], subst)
+		exports, ok := e.indicators(args[1], subst)
+		if module.Type != "atom" || !ok {
+			return []Substitution{}, true
+		}
+		if err := e.DeclareModule(sessionID, module.Value.(string), exports); err != nil {
+			return []Substitution{}, true
+		}
+		return []Substitution{subst}, true
+
+	case goal.Value == "use_module" && (len(args) == 1 || len(args) == 2):
+		module := e.deref(args[0], subst)
+		if module.Type != "atom" {
+			return []Substitution{}, true
+		}
+		var only []string
+		if len(args) == 2 {
+			keys, ok := e.indicators(args[1], subst)
+			if !ok {
+				return []Substitution{}, true
+			}
+			only = keys
+		}
+		if err := e.ImportModule(sessionID, context, module.Value.(string), only); err != nil {
+			return []Substitution{}, true
+		}
+		return []Substitution{subst}, true
+
+	case goal.Value == "current_module" && len(args) == 1:
+		idx := e.sessionModules(sessionID)
+		names := map[string]bool{userModule: true}
+		for module := range idx.defined {
+			names[module] = true
+		}
+		for module := range idx.exports {
+			names[module] = true
+		}
+		sorted := make([]string, 0, len(names))
+		for name := range names {
+			sorted = append(sorted, name)
+		}
+		sort.Strings(sorted)
+		var results []Substitution
+		for _, name := range sorted {
+			if s, ok := e.unify(args[0], Atom(name), subst); ok {
+				results = append(results, s)
+			}
+		}
+		return results, true
+	}
+
+	return []Substitution{}, true
+}
+
+// callInModule solves goal as called from module: meta-arguments of control
+// constructs and meta-predicates are qualified, other builtins run as usual
+// and user predicates are resolved from module.
+func (e *Engine) callInModule(goal Term, module string, subst Substitution, sessionID string) []Substitution {
+	switch goal.Type {
+	case "atom":
+	case "compound":
+		key := indicatorKey(goal.Value.(string), len(goal.Args))
+		positions, isControl := goalPositions[key]
+		if !isControl {
+			positions = metaPositions[key]
+		}
+		if len(positions) > 0 {
+			args := append([]Term{}, goal.Args...)
+			for _, i := range positions {
+				args[i] = qualify(module, args[i])
+			}
+			goal = Compound(goal.Value.(string), args)
+		}
+		// The builtins taking the calling module are dispatched here, so
+		// they need the read-only check evalBuiltin makes for the others
+		if contextOf(subst).readOnly && changesSession(goal) {
+			return []Substitution{}
+		}
+		switch key {
+		case "use_module/1", "use_module/2":
+			results, _ := e.handleModule(goal, module, subst, sessionID)
+			return results
+		case "multifile/1":
+			results, _ := e.handleMultifile(goal, module, subst, sessionID)
+			return results
+		case "materialize/1":
+			results, _ := e.handleMaterialize(goal, module, subst, sessionID)
+			return results
+		}
+	default:
+		return []Substitution{}
+	}
+
+	if results, handled := e.evalBuiltin(goal, subst, sessionID); handled {
+		return results
+	}
+	return e.solvePredicate(goal, module, nil, subst, sessionID)
+}
+
+// migrateModules adds the module column to fact and rule tables created
+// before modules existed.
+func migrateModules(db *sql.DB) error {
+	for _, table := range []string{"facts", "rules"} {
+		if err := ensureColumn(db, table, "module", "TEXT NOT NULL DEFAULT 'user'"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
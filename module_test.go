@@ -0,0 +1,116 @@
+package main
+
+import "testing"
+
+const geometrySource = `
+:- module(geometry, [area/2]).
+
+% helper/2 is private to each module
+helper(R, A) :- A = R.
+area(square(S), A) :- helper(S, A).
+`
+
+const pricingSource = `
+:- module(pricing, [price/2]).
+
+helper(X, discounted(X)).
+price(Item, P) :- base(Item, B), helper(B, P).
+`
+
+func TestModules(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+
+	for _, source := range []string{geometrySource, pricingSource, "base(book, 10).\n"} {
+		if _, err := engine.Consult(sessionID, source); err != nil {
+			t.Fatalf("Consult failed: %v", err)
+		}
+	}
+
+	// Exports are visible from user, and each module uses its own helper/2
+	solutions := queryAll(engine, sessionID, Compound("area", []Term{Compound("square", []Term{Number(3)}), Variable("A")}))
+	if len(solutions) != 1 || solutions[0].Bindings["A"].Value != 3.0 {
+		t.Errorf("Expected area 3, got %v", solutions)
+	}
+	solutions = queryAll(engine, sessionID, Compound("price", []Term{Atom("book"), Variable("P")}))
+	if len(solutions) != 1 || formatTerm(solutions[0].Bindings["P"], true) != "discounted(10)" {
+		t.Errorf("Expected the pricing helper to see user's base/2, got %v", solutions)
+	}
+
+	// Private predicates need a qualification
+	if len(queryAll(engine, sessionID, Compound("helper", []Term{Atom("x"), Variable("Y")}))) != 0 {
+		t.Error("Expected helper/2 not to be visible from user")
+	}
+	solutions = queryAll(engine, sessionID, Compound(":", []Term{Atom("pricing"), Compound("helper", []Term{Atom("x"), Variable("Y")})}))
+	if len(solutions) != 1 || formatTerm(solutions[0].Bindings["Y"], true) != "discounted(x)" {
+		t.Errorf("Expected pricing:helper/2 to answer, got %v", solutions)
+	}
+
+	// Closures keep their module
+	goals, _ := engine.ParseQuery(sessionID, "maplist(geometry:helper, [1, 2], L)")
+	solutions = queryAll(engine, sessionID, goals...)
+	if len(solutions) != 1 || formatTerm(solutions[0].Bindings["L"], true) != "[1,2]" {
+		t.Errorf("Expected maplist over geometry:helper, got %v", solutions)
+	}
+
+	solutions = queryAll(engine, sessionID, Compound("current_module", []Term{Variable("M")}))
+	if len(solutions) != 3 {
+		t.Errorf("Expected geometry, pricing and user, got %v", solutions)
+	}
+	goals, _ = engine.ParseQuery(sessionID, "current_predicate(pricing:helper/2)")
+	if len(queryAll(engine, sessionID, goals...)) != 1 {
+		t.Error("Expected current_predicate to report pricing:helper/2")
+	}
+}
+
+func TestUseModule(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+
+	_, err := engine.Consult(sessionID, `
+:- module(lists_extra, [last_of/2, first_of/2]).
+last_of([X], X).
+last_of([_|T], X) :- last_of(T, X).
+first_of([X|_], X).
+`)
+	if err != nil {
+		t.Fatalf("Consult failed: %v", err)
+	}
+	_, err = engine.Consult(sessionID, `
+:- module(report, [summary/2]).
+:- use_module(lists_extra, [last_of/2]).
+summary(L, S) :- last_of(L, S).
+uses_first(L, F) :- first_of(L, F).
+`)
+	if err != nil {
+		t.Fatalf("Consult failed: %v", err)
+	}
+
+	goals, _ := engine.ParseQuery(sessionID, "summary([a, b, c], S)")
+	solutions := queryAll(engine, sessionID, goals...)
+	if len(solutions) != 1 || solutions[0].Bindings["S"].Value != "c" {
+		t.Errorf("Expected summary to use the imported last_of/2, got %v", solutions)
+	}
+
+	// first_of/2 was not imported into report, but report falls back to user,
+	// which imports every export of lists_extra
+	goals, _ = engine.ParseQuery(sessionID, "report:uses_first([a, b], F)")
+	solutions = queryAll(engine, sessionID, goals...)
+	if len(solutions) != 1 || solutions[0].Bindings["F"].Value != "a" {
+		t.Errorf("Expected first_of/2 through user, got %v", solutions)
+	}
+
+	// Redefining a predicate in user does not touch the module's version
+	engine.AddFact(Fact{SessionID: sessionID, Predicate: Compound("last_of", []Term{Variable("_"), Atom("shadowed")})})
+	goals, _ = engine.ParseQuery(sessionID, "summary([a, b], S)")
+	solutions = queryAll(engine, sessionID, goals...)
+	if len(solutions) != 1 || solutions[0].Bindings["S"].Value != "b" {
+		t.Errorf("Expected report to keep using lists_extra:last_of/2, got %v", solutions)
+	}
+
+	if len(queryAll(engine, sessionID, Compound("module", []Term{Atom("user"), List(nil)}))) != 0 {
+		t.Error("Expected redeclaring user to fail")
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+type opDef struct {
+	priority int
+	kind     string // xfx, xfy, yfx, fy, fx, xf or yf
+}
+
+// opTable holds the operators terms are read and written with. Every
+// session starts from defaultOps and can change it with op/3.
+type opTable struct {
+	infix   map[string]opDef
+	prefix  map[string]opDef
+	postfix map[string]opDef
+}
+
+// defaultOps is the ISO operator table, plus the clpfd operators.
+var defaultOps = &opTable{
+	infix: map[string]opDef{
+		":-": {1200, "xfx"}, "-->": {1200, "xfx"},
+		";": {1100, "xfy"}, "|": {1100, "xfy"}, "->": {1050, "xfy"}, "*->": {1050, "xfy"}, ",": {1000, "xfy"},
+		"=": {700, "xfx"}, "\\=": {700, "xfx"}, "==": {700, "xfx"}, "\\==": {700, "xfx"},
+		"@<": {700, "xfx"}, "@>": {700, "xfx"}, "@=<": {700, "xfx"}, "@>=": {700, "xfx"},
+		"=..": {700, "xfx"}, "is": {700, "xfx"}, "=:=": {700, "xfx"}, "=\\=": {700, "xfx"},
+		"<": {700, "xfx"}, ">": {700, "xfx"}, "=<": {700, "xfx"}, ">=": {700, "xfx"},
+		"=@=": {700, "xfx"}, "\\=@=": {700, "xfx"},
+		":":  {200, "xfy"},
+		"#=": {700, "xfx"}, "#\\=": {700, "xfx"}, "#<": {700, "xfx"}, "#>": {700, "xfx"},
+		"#=<": {700, "xfx"}, "#>=": {700, "xfx"}, "in": {700, "xfx"}, "ins": {700, "xfx"},
+		"..": {450, "xfx"},
+		"+":  {500, "yfx"}, "-": {500, "yfx"}, "/\\": {500, "yfx"}, "\\/": {500, "yfx"}, "xor": {500, "yfx"},
+		"*": {400, "yfx"}, "/": {400, "yfx"}, "//": {400, "yfx"}, "mod": {400, "yfx"}, "rem": {400, "yfx"},
+		"div": {400, "yfx"}, "<<": {400, "yfx"}, ">>": {400, "yfx"},
+		"**": {200, "xfx"}, "^": {200, "xfy"},
+	},
+	prefix: map[string]opDef{
+		":-": {1200, "fx"}, "?-": {1200, "fx"},
+		"dynamic": {1150, "fx"}, "discontiguous": {1150, "fx"}, "initialization": {1150, "fx"},
+		"multifile": {1150, "fx"}, "table": {1150, "fx"},
+		"\\+": {900, "fy"}, "-": {200, "fy"}, "+": {200, "fy"}, "\\": {200, "fy"},
+	},
+	postfix: map[string]opDef{},
+}
+
+// opClass returns the map of t holding operators of the given type.
+func (t *opTable) opClass(kind string) (map[string]opDef, bool) {
+	switch kind {
+	case "xfx", "xfy", "yfx":
+		return t.infix, true
+	case "fy", "fx":
+		return t.prefix, true
+	case "xf", "yf":
+		return t.postfix, true
+	}
+	return nil, false
+}
+
+func (t *opTable) clone() *opTable {
+	c := &opTable{infix: map[string]opDef{}, prefix: map[string]opDef{}, postfix: map[string]opDef{}}
+	for name, op := range t.infix {
+		c.infix[name] = op
+	}
+	for name, op := range t.prefix {
+		c.prefix[name] = op
+	}
+	for name, op := range t.postfix {
+		c.postfix[name] = op
+	}
+	return c
+}
+
+// set declares name as an operator; priority 0 removes it.
+func (t *opTable) set(priority int, kind, name string) {
+	class, _ := t.opClass(kind)
+	if priority == 0 {
+		delete(class, name)
+		return
+	}
+	class[name] = opDef{priority, kind}
+}
+
+// checkOp validates an op/3 declaration against t.
+func (t *opTable) checkOp(priority int, kind, name string) error {
+	if priority < 0 || priority > 1200 {
+		return fmt.Errorf("operator priority must be between 0 and 1200")
+	}
+	if _, ok := t.opClass(kind); !ok {
+		return fmt.Errorf("invalid operator type %q", kind)
+	}
+	switch name {
+	case ",", "[]", "{}":
+		return fmt.Errorf("cannot modify operator %q", name)
+	case "|":
+		if priority != 0 && (priority < 1001 || kind[1] != 'f' || len(kind) != 3) {
+			return fmt.Errorf("'|' can only be an infix operator with priority above 1000")
+		}
+	}
+	if _, postfix := t.postfix[name]; postfix && len(kind) == 3 && priority > 0 {
+		return fmt.Errorf("%s is already a postfix operator", name)
+	}
+	if _, infix := t.infix[name]; infix && len(kind) == 2 && kind[1] == 'f' && priority > 0 {
+		return fmt.Errorf("%s is already an infix operator", name)
+	}
+	return nil
+}
+
+// sessionOps returns the operator table of a session. Tables are cached
+// until the session's operators change.
+func (e *Engine) sessionOps(sessionID string) *opTable {
+	e.mu.Lock()
+	ops, cached := e.operators[sessionID]
+	e.mu.Unlock()
+	if cached {
+		return ops
+	}
+
+	rows, err := e.db.Query("SELECT name, type, priority FROM session_operators WHERE session_id = ? ORDER BY rowid", sessionID)
+	if err != nil {
+		return defaultOps
+	}
+	defer rows.Close()
+
+	ops = defaultOps.clone()
+	for rows.Next() {
+		var name, kind string
+		var priority int
+		if err := rows.Scan(&name, &kind, &priority); err != nil {
+			return defaultOps
+		}
+		ops.set(priority, kind, name)
+	}
+
+	e.mu.Lock()
+	e.operators[sessionID] = ops
+	e.mu.Unlock()
+	return ops
+}
+
+// AddOperator declares an operator for a session, as op/3 does.
+func (e *Engine) AddOperator(sessionID string, priority int, kind, name string) error {
+	if err := e.sessionOps(sessionID).checkOp(priority, kind, name); err != nil {
+		return err
+	}
+
+	var class string
+	switch len(kind) {
+	case 3:
+		class = "infix"
+	case 2:
+		class = "prefix"
+		if kind[1] == 'f' {
+			class = "postfix"
+		}
+	}
+	_, err := e.db.Exec("INSERT OR REPLACE INTO session_operators (session_id, name, class, type, priority) VALUES (?, ?, ?, ?, ?)",
+		sessionID, name, class, kind, priority)
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	delete(e.operators, sessionID)
+	e.mu.Unlock()
+	return nil
+}
+
+// handleOperators implements op/3 and current_op/3.
+func (e *Engine) handleOperators(goal Term, subst Substitution, sessionID string) ([]Substitution, bool) {
+	if len(goal.Args) != 3 {
+		return []Substitution{}, true
+	}
+
+	if goal.Value == "op" {
+		priority := e.deref(goal.Args[0], subst)
+		kind := e.deref(goal.Args[1], subst)
+		if priority.Type != "number" || kind.Type != "atom" {
+			return []Substitution{}, true
+		}
+		names := []Term{e.deref(goal.Args[2], subst)}
+		if items, ok := e.listElements(names[0], subst); ok {
+			names = items
+		}
+		for _, name := range names {
+			if name = e.deref(name, subst); name.Type != "atom" {
+				return []Substitution{}, true
+			}
+		}
+		for _, name := range names {
+			if err := e.AddOperator(sessionID, int(priority.Value.(float64)), kind.Value.(string), e.deref(name, subst).Value.(string)); err != nil {
+				return []Substitution{}, true
+			}
+		}
+		return []Substitution{subst}, true
+	}
+
+	ops := e.sessionOps(sessionID)
+	var results []Substitution
+	for _, class := range []map[string]opDef{ops.prefix, ops.infix, ops.postfix} {
+		names := make([]string, 0, len(class))
+		for name := range class {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			op := class[name]
+			if s, ok := e.unify(Compound("op", []Term{Number(float64(op.priority)), Atom(op.kind), Atom(name)}), Compound("op", goal.Args), subst); ok {
+				results = append(results, s)
+			}
+		}
+	}
+	return results, true
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const relationsSource = `
+:- op(700, xfx, likes).
+:- op(700, xfx, isa).
+
+alice likes bob.
+bob likes carol.
+rex isa dog.
+X isa mammal :- X isa dog.
+`
+
+func TestUserDefinedOperators(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+
+	result, err := engine.Consult(sessionID, relationsSource)
+	if err != nil {
+		t.Fatalf("Consult failed: %v", err)
+	}
+	if result.Clauses != 4 || result.Directives != 2 {
+		t.Errorf("Expected 4 clauses and 2 directives, got %+v", result)
+	}
+
+	goals, err := engine.ParseQuery(sessionID, "Who likes bob, rex isa What")
+	if err != nil {
+		t.Fatalf("Failed to parse query: %v", err)
+	}
+	solutions := queryAll(engine, sessionID, goals...)
+	if len(solutions) != 2 || solutions[0].Bindings["Who"].Value != "alice" {
+		t.Errorf("Expected alice likes bob with two classes for rex, got %v", solutions)
+	}
+
+	// Written back in operator form
+	goals, _ = engine.ParseQuery(sessionID, "X likes carol, format(atom(A), '~q', [likes(X, likes(a, b))])")
+	solutions = queryAll(engine, sessionID, goals...)
+	if len(solutions) != 1 || solutions[0].Bindings["A"].Value != "bob likes (a likes b)" {
+		t.Errorf("Expected bob likes (a likes b), got %v", solutions)
+	}
+
+	// Other sessions keep the default table
+	other, _ := engine.CreateSession(CreateSessionRequest{Name: "plain"})
+	if _, err := engine.ParseQuery(other.ID, "alice likes bob"); err == nil {
+		t.Error("Expected likes not to be an operator in another session")
+	}
+
+	// Declarations persist beyond the cache
+	engine.mu.Lock()
+	delete(engine.operators, sessionID)
+	engine.mu.Unlock()
+	if _, err := engine.ParseQuery(sessionID, "alice likes bob"); err != nil {
+		t.Errorf("Expected likes to stay an operator, got %v", err)
+	}
+
+	// Priority 0 removes an operator
+	queryAll(engine, sessionID, Compound("op", []Term{Number(0), Atom("xfx"), Atom("likes")}))
+	if _, err := engine.ParseQuery(sessionID, "alice likes bob"); err == nil {
+		t.Error("Expected likes to be removed")
+	}
+}
+
+func TestOperatorPriorityAndAssociativity(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+
+	_, err := engine.Consult(sessionID, `
+:- op(400, yfx, then).
+:- op(400, xfy, and).
+:- op(900, fy, not).
+:- op(100, xf, percent).
+`)
+	if err != nil {
+		t.Fatalf("Consult failed: %v", err)
+	}
+	ops := engine.sessionOps(sessionID)
+
+	cases := []struct {
+		text     string
+		expected string
+	}{
+		{"a then b then c", "then(then(a,b),c)"},
+		{"a and b and c", "and(a,and(b,c))"},
+		{"not not a", "not(not(a))"},
+		{"not a=b", "not(=(a,b))"},
+		{"50 percent+1", "+(percent(50),1)"},
+		{"1+2*3", "+(1,*(2,3))"},
+	}
+	for _, c := range cases {
+		term, err := parseTerm(c.text, ops)
+		if err != nil {
+			t.Errorf("Failed to parse %q: %v", c.text, err)
+			continue
+		}
+		w := &termWriter{ops: ops, quoted: true, ignoreOps: true}
+		w.write(term, 1200)
+		if got := w.sb.String(); got != c.expected {
+			t.Errorf("%q: expected %s, got %s", c.text, c.expected, got)
+		}
+		if round := ops.format(term, true); round != c.text {
+			t.Errorf("Expected %q to be written back unchanged, got %q", c.text, round)
+		}
+	}
+
+	if got := ops.format(Compound("then", []Term{Atom("a"), Compound("then", []Term{Atom("b"), Atom("c")})}), true); got != "a then (b then c)" {
+		t.Errorf("Expected a then (b then c), got %s", got)
+	}
+}
+
+func TestOpAndCurrentOp(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+
+	solutions := queryAll(engine, sessionID, Compound("current_op", []Term{Variable("P"), Variable("T"), Atom("^")}))
+	if len(solutions) != 1 || solutions[0].Bindings["P"].Value != 200.0 || solutions[0].Bindings["T"].Value != "xfy" {
+		t.Errorf("Expected ^ to be 200 xfy, got %v", solutions)
+	}
+	if len(queryAll(engine, sessionID, Compound("current_op", []Term{Variable("P"), Variable("T"), Atom("-")}))) != 2 {
+		t.Error("Expected - to be both prefix and infix")
+	}
+
+	// op/3 accepts a list of names
+	queryAll(engine, sessionID, Compound("op", []Term{Number(700), Atom("xfx"), List([]Term{Atom("===>"), Atom("<===")})}))
+	solutions = queryAll(engine, sessionID, Compound("current_op", []Term{Number(700), Atom("xfx"), Variable("Op")}))
+	found := 0
+	for _, sol := range solutions {
+		if name := sol.Bindings["Op"].Value; name == "===>" || name == "<===" {
+			found++
+		}
+	}
+	if found != 2 {
+		t.Errorf("Expected both new operators to be listed, got %v", solutions)
+	}
+
+	invalid := []Term{
+		Compound("op", []Term{Number(1201), Atom("xfx"), Atom("foo")}),
+		Compound("op", []Term{Number(700), Atom("xxx"), Atom("foo")}),
+		Compound("op", []Term{Number(700), Atom("xfx"), Atom(",")}),
+		Compound("op", []Term{Number(700), Atom("xf"), Atom("===>")}),
+		Compound("op", []Term{Variable("P"), Atom("xfx"), Atom("foo")}),
+	}
+	for _, goal := range invalid {
+		if len(queryAll(engine, sessionID, goal)) != 0 {
+			t.Errorf("Expected %s to fail", formatTerm(goal, true))
+		}
+	}
+}
+
+func TestQueryHandlerText(t *testing.T) {
+	router, engine := setupTestRouter(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+
+	if _, err := engine.Consult(sessionID, ":- op(700, xfx, likes).\nalice likes bob.\n"); err != nil {
+		t.Fatalf("Consult failed: %v", err)
+	}
+
+	body, _ := json.Marshal(Query{Text: "?- X likes bob"})
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/sessions/"+sessionID+"/query", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var result QueryResult
+	json.Unmarshal(w.Body.Bytes(), &result)
+	if len(result.Solutions) != 1 || result.Solutions[0].Bindings["X"].Value != "alice" {
+		t.Errorf("Expected X = alice, got %v", result.Solutions)
+	}
+
+	body, _ = json.Marshal(Query{Text: "X likes"})
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/api/v1/sessions/"+sessionID+"/query", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for a syntax error, got %d", http.StatusBadRequest, w.Code)
+	}
+}
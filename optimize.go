@@ -0,0 +1,151 @@
+package main
+
+// Goal reordering. A query run with Optimize has each run of consecutive
+// pure user-defined goals put in the order the planner estimates cheapest,
+// given the variables bound by the goals before the run. A goal is pure
+// when it cannot reach recursion and every goal its rules can reach is a
+// pure user-defined goal or one of pureBuiltins; anything else, builtins
+// and recursive predicates in the query included, keeps its place and
+// splits the conjunction around it. A recursive predicate may only
+// terminate when some of its arguments are bound, so it is called with the
+// same bindings it would get in the order written. Reordering thus keeps
+// the set of solutions, side effects and termination, but may change the
+// order solutions are found in.
+
+// maxExhaustiveReorder is the longest run of goals whose orders are all
+// compared; longer runs are ordered greedily.
+const maxExhaustiveReorder = 6
+
+// pureBuiltins are the builtins whose outcome does not depend on the order
+// goals bind variables in.
+var pureBuiltins = map[string]bool{"=/2": true, "dif/2": true, "true/0": true, ",/2": true}
+
+// reorderGoals returns goals with their pure user-defined runs reordered.
+func (e *Engine) reorderGoals(goals []Term, sessionID string) []Term {
+	p := newQueryPlanner(e, sessionID)
+	pure := make(map[string]bool)
+
+	reordered := make([]Term, 0, len(goals))
+	bound := make(map[string]bool)
+	for start := 0; start < len(goals); {
+		end := start
+		for end < len(goals) && p.userGoal(goals[end]) && p.pure(goals[end], userModule, pure) {
+			end++
+		}
+		if end == start {
+			reordered = append(reordered, goals[start])
+			e.collectVars(goals[start], bound)
+			start++
+			continue
+		}
+
+		run := p.orderRun(goals[start:end], bound)
+		reordered = append(reordered, run...)
+		for _, goal := range run {
+			e.collectVars(goal, bound)
+		}
+		start = end
+	}
+	return reordered
+}
+
+// userGoal reports whether goal calls a user-defined predicate.
+func (p *queryPlanner) userGoal(goal Term) bool {
+	if module, plain := splitModule(goal); module != userModule {
+		goal = plain
+	}
+	return (goal.Type == "atom" || goal.Type == "compound") && goal.Value != ":" && !p.builtin(goal)
+}
+
+// pure reports whether goal, called from module, can only reach pure
+// goals and no recursion. pure caches the answer per predicate; predicates
+// being checked count as impure, so any predicate on a cycle is.
+func (p *queryPlanner) pure(goal Term, module string, pure map[string]bool) bool {
+	if qualified, plain := splitModule(goal); qualified != userModule {
+		module, goal = qualified, plain
+	}
+	switch {
+	case goal.Type == "variable":
+		return false
+	case goal.Type != "atom" && goal.Type != "compound":
+		return true
+	case goal.Value == ":":
+		return false // session(S):Goal
+	case goal.Value == "," && len(goal.Args) == 2:
+		return p.pure(goal.Args[0], module, pure) && p.pure(goal.Args[1], module, pure)
+	case p.builtin(goal):
+		return pureBuiltins[indicatorKey(goal.Value.(string), len(goal.Args))]
+	}
+
+	resolved := p.e.resolveModule(p.sessionID, module, goal)
+	key := p.key(goal, resolved)
+	if known, ok := pure[key]; ok {
+		return known
+	}
+	pure[key] = false
+	for _, rule := range p.predicate(goal, resolved).rules {
+		for _, bodyGoal := range rule.Body {
+			if !p.pure(bodyGoal, resolved, pure) {
+				return false
+			}
+		}
+	}
+	pure[key] = true
+	return true
+}
+
+// orderRun returns the cheapest order of goals found, keeping the given
+// order unless another one is estimated to cost less.
+func (p *queryPlanner) orderRun(goals []Term, bound map[string]bool) []Term {
+	if len(goals) < 2 {
+		return goals
+	}
+	if len(goals) > maxExhaustiveReorder {
+		return p.greedyOrder(goals, bound)
+	}
+
+	best := goals
+	_, bestCost := p.conjunction(goals, userModule, copyBound(bound), 0)
+	order := make([]Term, len(goals))
+	used := make([]bool, len(goals))
+	var permute func(n int)
+	permute = func(n int) {
+		if n == len(goals) {
+			if _, cost := p.conjunction(order, userModule, copyBound(bound), 0); cost < bestCost {
+				best, bestCost = append([]Term{}, order...), cost
+			}
+			return
+		}
+		for i, goal := range goals {
+			if !used[i] {
+				used[i] = true
+				order[n] = goal
+				permute(n + 1)
+				used[i] = false
+			}
+		}
+	}
+	permute(0)
+	return best
+}
+
+// greedyOrder picks the goal with the fewest estimated solutions next, the
+// cheaper one among equals, and the earlier one among those.
+func (p *queryPlanner) greedyOrder(goals []Term, bound map[string]bool) []Term {
+	bound = copyBound(bound)
+	remaining := append([]Term{}, goals...)
+	ordered := make([]Term, 0, len(goals))
+	for len(remaining) > 0 {
+		best, bestSolutions, bestCost := 0, 0.0, 0.0
+		for i, goal := range remaining {
+			solutions, cost := p.estimate(goal, userModule, bound, 0)
+			if i == 0 || solutions < bestSolutions || solutions == bestSolutions && cost < bestCost {
+				best, bestSolutions, bestCost = i, solutions, cost
+			}
+		}
+		ordered = append(ordered, remaining[best])
+		p.e.collectVars(remaining[best], bound)
+		remaining = append(remaining[:best], remaining[best+1:]...)
+	}
+	return ordered
+}
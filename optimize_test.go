@@ -0,0 +1,112 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const registrySource = `
+person(p1). person(p2). person(p3). person(p4). person(p5). person(p6).
+name(p1, ann). name(p2, bob). name(p3, cal). name(p4, dee). name(p5, eve). name(p6, fay).
+named(X, N) :- name(X, N).
+shown(X) :- name(X, N), write(N).
+`
+
+func formatGoals(goals []Term) string {
+	texts := []string{}
+	for _, goal := range goals {
+		texts = append(texts, formatTerm(goal, true))
+	}
+	return strings.Join(texts, ", ")
+}
+
+func TestReorderGoals(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+	if _, err := engine.Consult(sessionID, registrySource); err != nil {
+		t.Fatalf("Consult failed: %v", err)
+	}
+
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{"person(X), name(X, ann)", "name(X,ann), person(X)"},
+		{"person(X), named(X, ann)", "named(X,ann), person(X)"},
+		{"name(X, ann), person(X)", "name(X,ann), person(X)"},
+		// Builtins and goals reaching them keep their place
+		{"person(X), write(X), name(X, ann)", "person(X), write(X), name(X,ann)"},
+		{"person(X), shown(X), name(X, ann)", "person(X), shown(X), name(X,ann)"},
+		{"person(X), \\+ name(X, bob), person(Y), name(Y, cal)", "person(X), \\+name(X,bob), name(Y,cal), person(Y)"},
+	}
+	for _, test := range tests {
+		goals, _ := engine.ParseQuery(sessionID, test.query)
+		if reordered := formatGoals(engine.reorderGoals(goals, sessionID)); reordered != test.expected {
+			t.Errorf("Expected %s to run as %s, got %s", test.query, test.expected, reordered)
+		}
+	}
+}
+
+func TestReorderKeepsRecursionInPlace(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+	// len/2 only terminates once its second argument is bound, but looks
+	// cheaper than the six size/1 facts
+	_, err := engine.Consult(sessionID, `
+size(z). size(s(z)). size(s(s(z))). size(s(s(s(z)))). size(s(s(s(s(z))))). size(s(s(s(s(s(z)))))).
+len([], z).
+len([_|T], s(N)) :- len(T, N).
+counted(L) :- size(N), len(L, N).
+`)
+	if err != nil {
+		t.Fatalf("Consult failed: %v", err)
+	}
+
+	for _, query := range []string{"size(N), len(L, N)", "size(N), counted(L), len(L, N)"} {
+		goals, _ := engine.ParseQuery(sessionID, query)
+		if reordered := formatGoals(engine.reorderGoals(goals, sessionID)); reordered != formatGoals(goals) {
+			t.Errorf("Expected %s to keep its order, got %s", query, reordered)
+		}
+	}
+
+	goals, _ := engine.ParseQuery(sessionID, "size(N), len(L, N)")
+	if result := engine.Query(Query{Goals: goals, Optimize: true}, sessionID); len(result.Solutions) != 6 {
+		t.Errorf("Expected six lists, got %v", result.Solutions)
+	}
+}
+
+func TestOptimizedQuery(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+	engine.Consult(sessionID, registrySource)
+
+	goals, _ := engine.ParseQuery(sessionID, "person(X), name(X, N), name(X, dee)")
+	plain := engine.Query(Query{Goals: goals, Profile: true}, sessionID)
+	optimized := engine.Query(Query{Goals: goals, Profile: true, Optimize: true}, sessionID)
+	if !reflect.DeepEqual(plain.Solutions, optimized.Solutions) || len(optimized.Solutions) != 1 {
+		t.Fatalf("Expected the same solution, got %+v and %+v", plain.Solutions, optimized.Solutions)
+	}
+	if formatGoals(optimized.Reordered) != "name(X,dee), person(X), name(X,N)" || plain.Reordered != nil {
+		t.Errorf("Expected the reordered goals to be reported, got %v", formatGoals(optimized.Reordered))
+	}
+	if optimized.Profile.Inferences >= plain.Profile.Inferences {
+		t.Errorf("Expected fewer inferences, got %d and %d", plain.Profile.Inferences, optimized.Profile.Inferences)
+	}
+
+	// Goals already in their best order are not reported
+	goals, _ = engine.ParseQuery(sessionID, "name(X, dee), person(X)")
+	if result := engine.Query(Query{Goals: goals, Optimize: true}, sessionID); result.Reordered != nil {
+		t.Errorf("Expected no reordering, got %v", formatGoals(result.Reordered))
+	}
+
+	goals, _ = engine.ParseQuery(sessionID, "person(X), name(X, dee)")
+	plan := engine.ExplainQuery(Query{Goals: goals}, sessionID)
+	optimizedPlan := engine.ExplainQuery(Query{Goals: goals, Optimize: true}, sessionID)
+	if optimizedPlan.Cost >= plan.Cost || optimizedPlan.Goals[0].Predicate != "name/2" {
+		t.Errorf("Expected the explained plan to be reordered, got %+v", optimizedPlan.Goals)
+	}
+}
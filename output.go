@@ -0,0 +1,577 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// emit appends text to the output of the branch described by subst. The
+// output is kept in the solve context, so every solution carries exactly
+// the output produced while deriving it.
+func (e *Engine) emit(subst Substitution, text string) Substitution {
+	ctx := contextOf(subst)
+	ctx.output += text
+	return withContext(subst, ctx)
+}
+
+// withOutput is emit that leaves subst untouched when there is no text.
+func (e *Engine) withOutput(subst Substitution, text string) Substitution {
+	if text == "" {
+		return subst
+	}
+	return e.emit(subst, text)
+}
+
+// solutionOutput returns the text written while deriving a solution.
+func solutionOutput(subst Substitution) string {
+	return contextOf(subst).output
+}
+
+// termWriter renders terms as Prolog text.
+type termWriter struct {
+	ops       *opTable
+	quoted    bool // quote atoms where needed so the text reads back
+	spacing   bool // listing style: a space after argument separators
+	ignoreOps bool // write operators in functional notation
+	sb        strings.Builder
+}
+
+// formatTerm renders an instantiated term as write/1 (quoted=false) or
+// writeq/1 (quoted=true) would with the default operators.
+func formatTerm(t Term, quoted bool) string {
+	return defaultOps.format(t, quoted)
+}
+
+// format renders an instantiated term using the operators in ops.
+func (ops *opTable) format(t Term, quoted bool) string {
+	w := &termWriter{ops: ops, quoted: quoted}
+	w.write(t, 1200)
+	return w.sb.String()
+}
+
+// portrayClause renders a clause in the layout used by listing/1.
+func (ops *opTable) portrayClause(head Term, body []Term) string {
+	w := &termWriter{ops: ops, quoted: true, spacing: true}
+	w.write(head, 1199)
+	if len(body) == 0 {
+		w.sb.WriteString(".\n")
+		return w.sb.String()
+	}
+	w.sb.WriteString(" :-")
+	for i, goal := range body {
+		if i > 0 {
+			w.sb.WriteString(",")
+		}
+		w.sb.WriteString("\n    ")
+		w.write(goal, 999)
+	}
+	w.sb.WriteString(".\n")
+	return w.sb.String()
+}
+
+func (w *termWriter) write(t Term, max int) {
+	switch t.Type {
+	case "variable":
+		w.sb.WriteString(t.Value.(string))
+	case "number":
+		w.sb.WriteString(formatNumber(t.Value.(float64)))
+	case "atom":
+		w.atom(t.Value.(string))
+	case "date":
+		w.atom(t.Value.(string))
+	case "list":
+		w.list(t)
+	case "interval":
+		w.compound(Compound("interval", t.Args), max)
+	case "compound":
+		w.compound(t, max)
+	}
+}
+
+func (w *termWriter) atom(name string) {
+	if w.quoted && atomNeedsQuotes(name) {
+		w.sb.WriteString(quoteAtom(name))
+		return
+	}
+	w.sb.WriteString(name)
+}
+
+func (w *termWriter) separator() {
+	if w.spacing {
+		w.sb.WriteString(", ")
+	} else {
+		w.sb.WriteString(",")
+	}
+}
+
+func (w *termWriter) list(t Term) {
+	items, tail := t.Args, Term{}
+	if t.Value == listTailMarker {
+		items, tail = t.Args[:len(t.Args)-1], t.Args[len(t.Args)-1]
+	}
+	w.sb.WriteString("[")
+	for i, item := range items {
+		if i > 0 {
+			w.separator()
+		}
+		w.write(item, 999)
+	}
+	if t.Value == listTailMarker {
+		w.sb.WriteString("|")
+		w.write(tail, 999)
+	}
+	w.sb.WriteString("]")
+}
+
+func (w *termWriter) compound(t Term, max int) {
+	name := t.Value.(string)
+
+	if name == "{}" && len(t.Args) == 1 {
+		w.sb.WriteString("{")
+		w.write(t.Args[0], 1200)
+		w.sb.WriteString("}")
+		return
+	}
+
+	if op, ok := w.ops.infix[name]; ok && len(t.Args) == 2 && !w.ignoreOps {
+		left, right := op.priority-1, op.priority-1
+		switch op.kind {
+		case "xfy":
+			right = op.priority
+		case "yfx":
+			left = op.priority
+		}
+		if op.priority > max {
+			w.sb.WriteString("(")
+		}
+		w.write(t.Args[0], left)
+		switch {
+		case name == ",":
+			w.sb.WriteString(",")
+		case isAlphaAtom(name):
+			w.sb.WriteString(" " + name + " ")
+		default:
+			w.sb.WriteString(name)
+			if w.startsWithSymbol(t.Args[1]) {
+				w.sb.WriteString(" ")
+			}
+		}
+		w.write(t.Args[1], right)
+		if op.priority > max {
+			w.sb.WriteString(")")
+		}
+		return
+	}
+
+	if op, ok := w.ops.prefix[name]; ok && len(t.Args) == 1 && !w.ignoreOps {
+		arg := op.priority - 1
+		if op.kind == "fy" {
+			arg = op.priority
+		}
+		if op.priority > max {
+			w.sb.WriteString("(")
+		}
+		w.atom(name)
+		if isAlphaAtom(name) || w.startsWithSymbol(t.Args[0]) || t.Args[0].Type == "number" || w.startsWithParen(t.Args[0], arg) {
+			w.sb.WriteString(" ")
+		}
+		w.write(t.Args[0], arg)
+		if op.priority > max {
+			w.sb.WriteString(")")
+		}
+		return
+	}
+
+	if op, ok := w.ops.postfix[name]; ok && len(t.Args) == 1 && !w.ignoreOps {
+		arg := op.priority - 1
+		if op.kind == "yf" {
+			arg = op.priority
+		}
+		if op.priority > max {
+			w.sb.WriteString("(")
+		}
+		w.write(t.Args[0], arg)
+		if isAlphaAtom(name) {
+			w.sb.WriteString(" ")
+		}
+		w.atom(name)
+		if op.priority > max {
+			w.sb.WriteString(")")
+		}
+		return
+	}
+
+	w.atom(name)
+	w.sb.WriteString("(")
+	for i, arg := range t.Args {
+		if i > 0 {
+			w.separator()
+		}
+		w.write(arg, 999)
+	}
+	w.sb.WriteString(")")
+}
+
+const symbolChars = "+-*/\\^<>=~:.?@#&$"
+
+func isAlphaAtom(name string) bool {
+	for i, r := range name {
+		if !(unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_') || (i == 0 && !unicode.IsLower(r)) {
+			return false
+		}
+	}
+	return name != ""
+}
+
+func isSymbolAtom(name string) bool {
+	for _, r := range name {
+		if !strings.ContainsRune(symbolChars, r) {
+			return false
+		}
+	}
+	return name != ""
+}
+
+// startsWithSymbol reports whether writing t begins with a symbol character
+// or a minus sign, which would run into a preceding symbolic operator.
+func (w *termWriter) startsWithSymbol(t Term) bool {
+	switch t.Type {
+	case "number":
+		return t.Value.(float64) < 0
+	case "atom":
+		return isSymbolAtom(t.Value.(string))
+	case "compound":
+		name := t.Value.(string)
+		if _, infix := w.ops.infix[name]; infix && len(t.Args) == 2 && !w.ignoreOps {
+			return w.startsWithSymbol(t.Args[0])
+		}
+		if _, postfix := w.ops.postfix[name]; postfix && len(t.Args) == 1 && !w.ignoreOps {
+			return w.startsWithSymbol(t.Args[0])
+		}
+		return isSymbolAtom(name)
+	}
+	return false
+}
+
+// startsWithParen reports whether writing t with priority max begins with an
+// opening bracket, which would turn a preceding prefix operator into a
+// functor: \+ (a,b) must not be written \+(a,b).
+func (w *termWriter) startsWithParen(t Term, max int) bool {
+	if t.Type != "compound" || w.ignoreOps {
+		return false
+	}
+	name := t.Value.(string)
+	if op, infix := w.ops.infix[name]; infix && len(t.Args) == 2 {
+		left := op.priority - 1
+		if op.kind == "yfx" {
+			left = op.priority
+		}
+		return op.priority > max || w.startsWithParen(t.Args[0], left)
+	}
+	if op, prefix := w.ops.prefix[name]; prefix && len(t.Args) == 1 {
+		return op.priority > max
+	}
+	if op, postfix := w.ops.postfix[name]; postfix && len(t.Args) == 1 {
+		arg := op.priority - 1
+		if op.kind == "yf" {
+			arg = op.priority
+		}
+		return op.priority > max || w.startsWithParen(t.Args[0], arg)
+	}
+	return false
+}
+
+func atomNeedsQuotes(name string) bool {
+	switch name {
+	case "[]", "!", ";", "{}":
+		return false
+	}
+	return !isAlphaAtom(name) && !isSymbolAtom(name)
+}
+
+func quoteAtom(name string) string {
+	replacer := strings.NewReplacer("\\", "\\\\", "'", "\\'", "\n", "\\n", "\t", "\\t")
+	return "'" + replacer.Replace(name) + "'"
+}
+
+// handleOutput implements write/1, print/1, writeln/1, writeq/1,
+// write_canonical/1, nl/0, format/1,2,3 and term_to_atom/2. Output is
+// appended to the solution's output rather than printed.
+func (e *Engine) handleOutput(goal Term, subst Substitution, sessionID string) ([]Substitution, bool) {
+	args := goal.Args
+	ops := e.sessionOps(sessionID)
+
+	switch {
+	case goal.Type == "atom" && goal.Value == "nl":
+		return []Substitution{e.emit(subst, "\n")}, true
+
+	case len(args) == 1 && goal.Value != "format":
+		t := e.instantiate(args[0], subst)
+		var text string
+		switch goal.Value {
+		case "write":
+			text = ops.format(t, false)
+		case "writeln":
+			text = ops.format(t, false) + "\n"
+		case "print", "writeq":
+			text = ops.format(t, true)
+		case "write_canonical":
+			w := &termWriter{ops: ops, quoted: true, ignoreOps: true}
+			w.write(t, 1200)
+			text = w.sb.String()
+		}
+		return []Substitution{e.emit(subst, text)}, true
+
+	case goal.Value == "format" && len(args) >= 1 && len(args) <= 3:
+		if len(args) == 1 {
+			args = []Term{args[0], List(nil)}
+		}
+		sink := Atom("user_output")
+		if len(args) == 3 {
+			sink, args = e.deref(args[0], subst), args[1:]
+		}
+		text, ok := e.formatText(args[0], args[1], subst, ops)
+		if !ok {
+			return []Substitution{}, true
+		}
+		// format(atom(A), Format, Args) builds an atom instead of writing
+		if sink.Type == "compound" && len(sink.Args) == 1 {
+			switch sink.Value {
+			case "atom", "string":
+				return e.unifyResult(sink.Args[0], Atom(text), subst)
+			case "codes":
+				codes := make([]Term, 0, len(text))
+				for _, r := range text {
+					codes = append(codes, Number(float64(r)))
+				}
+				return e.unifyResult(sink.Args[0], List(codes), subst)
+			}
+			return []Substitution{}, true
+		}
+		return []Substitution{e.emit(subst, text)}, true
+
+	case goal.Value == "term_to_atom" && len(args) == 2:
+		if t := e.deref(args[0], subst); t.Type == "variable" {
+			text, ok := e.textValue(args[1], subst)
+			if !ok {
+				return []Substitution{}, true
+			}
+			parsed, err := parseTerm(text, ops)
+			if err != nil {
+				return []Substitution{}, true
+			}
+			parsed = e.renameTermVars(parsed, make(map[string]string), fmt.Sprintf("_%d", nextVarID()))
+			return e.unifyResult(t, parsed, subst)
+		}
+		return e.unifyResult(args[1], Atom(ops.format(e.instantiate(args[0], subst), true)), subst)
+	}
+
+	return []Substitution{}, true
+}
+
+// formatColumn tracks the pending column segment of format/2 for ~t, ~| and
+// ~+: text written since the last column stop and its fill points.
+type formatColumn struct {
+	out       []rune
+	lineStart int
+	segStart  int
+	fills     []formatFill
+}
+
+type formatFill struct {
+	pos  int
+	char rune
+}
+
+func (c *formatColumn) write(text string) {
+	c.out = append(c.out, []rune(text)...)
+	for i := len(c.out) - 1; i >= c.segStart; i-- {
+		if c.out[i] == '\n' {
+			c.lineStart, c.segStart, c.fills = i+1, i+1, nil
+			break
+		}
+	}
+}
+
+// stop ends the current segment at column target, padding at the fill
+// points (or after the text when there are none).
+func (c *formatColumn) stop(target int) {
+	pad := target - (len(c.out) - c.lineStart)
+	if pad > 0 {
+		fills := c.fills
+		if len(fills) == 0 {
+			fills = []formatFill{{pos: len(c.out), char: ' '}}
+		}
+		var padded []rune
+		prev := c.segStart
+		for i, fill := range fills {
+			n := pad / len(fills)
+			if i == len(fills)-1 {
+				n = pad - n*(len(fills)-1)
+			}
+			padded = append(padded, c.out[prev:fill.pos]...)
+			padded = append(padded, []rune(strings.Repeat(string(fill.char), n))...)
+			prev = fill.pos
+		}
+		padded = append(padded, c.out[prev:]...)
+		c.out = append(c.out[:c.segStart], padded...)
+	}
+	c.segStart, c.fills = len(c.out), nil
+}
+
+// formatText expands a format/2 string. Supported directives are ~w, ~p,
+// ~q, ~a, ~d (with an optional number of decimals), ~f, ~e, ~g, ~s, ~c, ~n,
+// ~i, ~~ and the column directives ~t, ~| and ~+.
+func (e *Engine) formatText(format, arguments Term, subst Substitution, ops *opTable) (string, bool) {
+	f, ok := e.textValue(format, subst)
+	if !ok {
+		return "", false
+	}
+	values, ok := e.listElements(arguments, subst)
+	if !ok {
+		values = []Term{arguments}
+	}
+	next := func() (Term, bool) {
+		if len(values) == 0 {
+			return Term{}, false
+		}
+		v := e.instantiate(values[0], subst)
+		values = values[1:]
+		return v, true
+	}
+
+	col := &formatColumn{}
+	directives := []rune(f)
+	for i := 0; i < len(directives); i++ {
+		if directives[i] != '~' {
+			col.write(string(directives[i]))
+			continue
+		}
+
+		// Optional numeric argument, or `c for a fill character
+		i++
+		numArg, hasNum := 0, false
+		for ; i < len(directives) && directives[i] >= '0' && directives[i] <= '9'; i++ {
+			numArg, hasNum = numArg*10+int(directives[i]-'0'), true
+		}
+		if i+1 < len(directives) && directives[i] == '`' {
+			numArg, hasNum = int(directives[i+1]), true
+			i += 2
+		}
+		if i >= len(directives) {
+			return "", false
+		}
+
+		switch directives[i] {
+		case '~':
+			col.write("~")
+		case 'n':
+			if !hasNum {
+				numArg = 1
+			}
+			col.write(strings.Repeat("\n", numArg))
+		case 't':
+			fill := ' '
+			if hasNum {
+				fill = rune(numArg)
+			}
+			col.fills = append(col.fills, formatFill{pos: len(col.out), char: fill})
+		case '|', '+':
+			target := len(col.out) - col.lineStart
+			if directives[i] == '+' {
+				if !hasNum {
+					numArg = 8
+				}
+				target = col.segStart - col.lineStart + numArg
+			} else if hasNum {
+				target = numArg
+			}
+			col.stop(target)
+		default:
+			v, ok := next()
+			if !ok {
+				return "", false
+			}
+			text, ok := e.formatDirective(directives[i], v, numArg, hasNum, ops)
+			if !ok {
+				return "", false
+			}
+			col.write(text)
+		}
+	}
+	if len(values) > 0 {
+		return "", false
+	}
+	return string(col.out), true
+}
+
+func (e *Engine) formatDirective(directive rune, v Term, numArg int, hasNum bool, ops *opTable) (string, bool) {
+	switch directive {
+	case 'w':
+		return ops.format(v, false), true
+	case 'p', 'q':
+		return ops.format(v, true), true
+	case 'a':
+		if v.Type != "atom" && v.Type != "number" && v.Type != "date" {
+			return "", false
+		}
+		return ops.format(v, false), true
+	case 'i':
+		return "", true
+	case 'd':
+		n, ok := v.Value.(float64)
+		if v.Type != "number" || !ok || n != math.Trunc(n) {
+			return "", false
+		}
+		digits := strconv.FormatInt(int64(math.Abs(n)), 10)
+		if hasNum && numArg > 0 {
+			for len(digits) <= numArg {
+				digits = "0" + digits
+			}
+			digits = digits[:len(digits)-numArg] + "." + digits[len(digits)-numArg:]
+		}
+		if n < 0 {
+			digits = "-" + digits
+		}
+		return digits, true
+	case 'f', 'e', 'g':
+		n, ok := v.Value.(float64)
+		if v.Type != "number" || !ok {
+			return "", false
+		}
+		if !hasNum {
+			numArg = 6
+		}
+		return strconv.FormatFloat(n, byte(directive), numArg, 64), true
+	case 'c':
+		n, ok := v.Value.(float64)
+		if v.Type != "number" || !ok {
+			return "", false
+		}
+		if !hasNum {
+			numArg = 1
+		}
+		return strings.Repeat(string(rune(int(n))), numArg), true
+	case 's':
+		if v.Type == "atom" {
+			return v.Value.(string), true
+		}
+		codes, ok := e.listElements(v, make(Substitution))
+		if !ok {
+			return "", false
+		}
+		var sb strings.Builder
+		for _, c := range codes {
+			n, ok := c.Value.(float64)
+			if c.Type != "number" || !ok {
+				return "", false
+			}
+			sb.WriteRune(rune(int(n)))
+		}
+		return sb.String(), true
+	}
+	return "", false
+}
@@ -0,0 +1,237 @@
+package main
+
+import "testing"
+
+func TestWriteBuiltins(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+
+	term := Compound("f", []Term{Atom("hello world"), Compound("+", []Term{Number(1), Number(2)})})
+	cases := []struct {
+		goal     Term
+		expected string
+	}{
+		{Compound("write", []Term{term}), "f(hello world,1+2)"},
+		{Compound("print", []Term{term}), "f('hello world',1+2)"},
+		{Compound("writeq", []Term{term}), "f('hello world',1+2)"},
+		{Compound("write_canonical", []Term{term}), "f('hello world',+(1,2))"},
+		{Compound("writeln", []Term{Atom("done")}), "done\n"},
+		{Atom("nl"), "\n"},
+	}
+	for _, c := range cases {
+		solutions := queryAll(engine, sessionID, c.goal)
+		if len(solutions) != 1 || solutions[0].Output != c.expected {
+			t.Errorf("%v: expected output %q, got %v", c.goal.Value, c.expected, solutions)
+		}
+	}
+
+	// A session defining print/1 itself gets its own predicate
+	session, _ := engine.CreateSession(CreateSessionRequest{Name: "own-output"})
+	engine.AddFact(Fact{SessionID: session.ID, Predicate: Compound("print", []Term{Atom("summary")})})
+	solutions := queryAll(engine, session.ID, Compound("print", []Term{Variable("X")}))
+	if len(solutions) != 1 || solutions[0].Bindings["X"].Value != "summary" || solutions[0].Output != "" {
+		t.Errorf("Expected the session's print/1, got %v", solutions)
+	}
+}
+
+func TestOutputPerSolution(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+
+	for _, name := range []string{"ann", "bob"} {
+		engine.AddFact(Fact{SessionID: sessionID, Predicate: Compound("person", []Term{Atom(name)})})
+	}
+	// greet(X) :- person(X), format("Hello, ~w!~n", [X]).
+	engine.AddRule(Rule{
+		SessionID: sessionID,
+		Head:      Compound("greet", []Term{Variable("X")}),
+		Body: []Term{
+			Compound("person", []Term{Variable("X")}),
+			Compound("format", []Term{Atom("Hello, ~w!~n"), List([]Term{Variable("X")})}),
+		},
+	})
+
+	solutions := queryAll(engine, sessionID, Compound("greet", []Term{Variable("Who")}))
+	if len(solutions) != 2 {
+		t.Fatalf("Expected 2 solutions, got %d", len(solutions))
+	}
+	if solutions[0].Output != "Hello, ann!\n" || solutions[1].Output != "Hello, bob!\n" {
+		t.Errorf("Expected each solution to carry its own output, got %q and %q", solutions[0].Output, solutions[1].Output)
+	}
+
+	// Output written inside forall/2 is kept
+	solutions = queryAll(engine, sessionID, Compound("forall", []Term{
+		Compound("person", []Term{Variable("P")}),
+		Compound("writeln", []Term{Variable("P")}),
+	}))
+	if len(solutions) != 1 || solutions[0].Output != "ann\nbob\n" {
+		t.Errorf("Expected forall output, got %v", solutions)
+	}
+
+	// Variables cannot reach the output of a solution
+	solutions = queryAll(engine, sessionID,
+		Compound("=", []Term{Variable("$output"), Atom("fake")}),
+		Compound("write", []Term{Atom("real")}))
+	if len(solutions) != 1 || solutions[0].Output != "real" || solutions[0].Bindings["$output"].Value != "fake" {
+		t.Errorf("Expected $output to be an ordinary variable, got %v", solutions)
+	}
+}
+
+func TestFormatDirectives(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+
+	cases := []struct {
+		format   string
+		args     Term
+		expected string
+	}{
+		{"~w and ~q", List([]Term{Atom("a b"), Atom("a b")}), "a b and 'a b'"},
+		{"~a", Atom("single"), "single"},
+		{"~d items", List([]Term{Number(42)}), "42 items"},
+		{"~2d", List([]Term{Number(314)}), "3.14"},
+		{"~2f", List([]Term{Number(2.0 / 3)}), "0.67"},
+		{"~~~n", List(nil), "~\n"},
+		{"~w~t~10|~w", List([]Term{Atom("name"), Atom("x")}), "name      x"},
+		{"~t~w~10|", List([]Term{Atom("right")}), "     right"},
+		{"~t~w~t~9|", List([]Term{Atom("mid")}), "   mid   "},
+		{"~`-t~30|", List(nil), "------------------------------"},
+		{"~p", List([]Term{Compound("-", []Term{Number(1)})}), "- 1"},
+	}
+	for _, c := range cases {
+		goal := Compound("format", []Term{Compound("atom", []Term{Variable("A")}), Atom(c.format), c.args})
+		solutions := queryAll(engine, sessionID, goal)
+		if len(solutions) != 1 || solutions[0].Bindings["A"].Value != c.expected {
+			t.Errorf("format(%q): expected %q, got %v", c.format, c.expected, solutions)
+		}
+	}
+
+	// ~d requires an integer and arguments must be used up
+	for _, args := range []Term{List([]Term{Number(1.5)}), List([]Term{Number(1), Number(2)})} {
+		goal := Compound("format", []Term{Compound("atom", []Term{Variable("A")}), Atom("~d"), args})
+		if len(queryAll(engine, sessionID, goal)) != 0 {
+			t.Errorf("Expected format(\"~d\", %v) to fail", args)
+		}
+	}
+}
+
+func TestTermToAtom(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+
+	solutions := queryAll(engine, sessionID, Compound("term_to_atom", []Term{
+		Compound("foo", []Term{Atom("Bar"), List([]Term{Number(1), Number(2)})}),
+		Variable("A"),
+	}))
+	if len(solutions) != 1 || solutions[0].Bindings["A"].Value != "foo('Bar',[1,2])" {
+		t.Errorf("Expected foo('Bar',[1,2]), got %v", solutions)
+	}
+
+	solutions = queryAll(engine, sessionID,
+		Compound("term_to_atom", []Term{Variable("T"), Atom("point(X, -3, 'a b')")}),
+		Compound("=", []Term{Variable("T"), Compound("point", []Term{Atom("x"), Variable("Y"), Variable("Z")})}),
+	)
+	if len(solutions) != 1 || solutions[0].Bindings["Y"].Value != -3.0 || solutions[0].Bindings["Z"].Value != "a b" {
+		t.Errorf("Expected term_to_atom to parse the atom, got %v", solutions)
+	}
+}
+
+func TestAnonymousVariables(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+
+	if _, err := engine.Consult(sessionID, "pair(a, b).\npair(c, d).\n"); err != nil {
+		t.Fatalf("Failed to consult: %v", err)
+	}
+
+	// Each _ is a fresh variable left out of the answer, and does not clash
+	// with a variable the user names _1
+	goals, err := engine.ParseQuery(sessionID, "pair(_, X), pair(_1, _)")
+	if err != nil {
+		t.Fatalf("Failed to parse query: %v", err)
+	}
+	solutions := queryAll(engine, sessionID, goals...)
+	if len(solutions) != 4 {
+		t.Fatalf("Expected 4 solutions, got %d", len(solutions))
+	}
+	for _, sol := range solutions {
+		if len(sol.Bindings) != 2 || sol.Bindings["X"].Type != "atom" || sol.Bindings["_1"].Type != "atom" {
+			t.Errorf("Expected bindings for X and _1 only, got %v", sol.Bindings)
+		}
+	}
+}
+
+func TestReadTerms(t *testing.T) {
+	cases := []struct {
+		text     string
+		expected Term
+	}{
+		{"foo(X, bar)", Compound("foo", []Term{Variable("X"), Atom("bar")})},
+		{"a :- b, c ; d", Compound(":-", []Term{Atom("a"), Compound(";", []Term{
+			Compound(",", []Term{Atom("b"), Atom("c")}), Atom("d"),
+		})})},
+		{"X is 1 + 2 * 3", Compound("is", []Term{Variable("X"), Compound("+", []Term{
+			Number(1), Compound("*", []Term{Number(2), Number(3)}),
+		})})},
+		{"1 - 2 - 3", Compound("-", []Term{Compound("-", []Term{Number(1), Number(2)}), Number(3)})},
+		{"[a, b | T]", ListWithTail([]Term{Atom("a"), Atom("b")}, Variable("T"))},
+		{"\\+ foo", Compound("\\+", []Term{Atom("foo")})},
+		{"- 1", Compound("-", []Term{Number(1)})},
+		{"-1", Number(-1)},
+		{"{a, b}", Compound("{}", []Term{Compound(",", []Term{Atom("a"), Atom("b")})})},
+		{"'it''s' % comment", Atom("it's")},
+	}
+	for _, c := range cases {
+		got, err := parseTerm(c.text, defaultOps)
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", c.text, err)
+			continue
+		}
+		if compareTerms(got, c.expected) != 0 {
+			t.Errorf("%q: expected %s, got %s", c.text, formatTerm(c.expected, true), formatTerm(got, true))
+		}
+	}
+
+	terms, err := readTerms("parent(tom, bob).\ngrandparent(X, Z) :- parent(X, Y), parent(Y, Z).\n", defaultOps)
+	if err != nil || len(terms) != 2 {
+		t.Fatalf("Expected 2 clauses, got %d (%v)", len(terms), err)
+	}
+
+	for _, bad := range []string{"foo(", "a b", "[1,2"} {
+		if _, err := parseTerm(bad, defaultOps); err == nil {
+			t.Errorf("Expected a syntax error for %q", bad)
+		}
+	}
+}
+
+func TestFormatTerm(t *testing.T) {
+	cases := []struct {
+		term     Term
+		quoted   bool
+		expected string
+	}{
+		{Compound("foo", []Term{Atom("a"), Number(1.5)}), false, "foo(a,1.5)"},
+		{Atom("hello world"), true, "'hello world'"},
+		{Atom("hello world"), false, "hello world"},
+		{Compound("+", []Term{Number(1), Compound("*", []Term{Number(2), Number(3)})}), false, "1+2*3"},
+		{Compound("*", []Term{Compound("+", []Term{Number(1), Number(2)}), Number(3)}), false, "(1+2)*3"},
+		{Compound("-", []Term{Number(1), Number(-2)}), false, "1- -2"},
+		{Compound("is", []Term{Variable("X"), Number(1)}), false, "X is 1"},
+		{Compound("\\+", []Term{Atom("a")}), false, "\\+a"},
+		{Compound("\\+", []Term{Compound(",", []Term{Atom("a"), Atom("b")})}), true, "\\+ (a,b)"},
+		{Compound("-", []Term{Compound("=", []Term{Compound(":-", []Term{Atom("a"), Atom("b")}), Atom("c")})}), false, "- ((a:-b)=c)"},
+		{Compound("\\+", []Term{Compound("=", []Term{Compound(":-", []Term{Atom("a"), Atom("b")}), Atom("c")})}), false, "\\+ (a:-b)=c"},
+		{ListWithTail([]Term{Atom("a"), Atom("b")}, Variable("T")), false, "[a,b|T]"},
+		{Compound(",", []Term{Atom("a"), Compound(";", []Term{Atom("b"), Atom("c")})}), false, "a,(b;c)"},
+	}
+	for _, c := range cases {
+		if got := formatTerm(c.term, c.quoted); got != c.expected {
+			t.Errorf("Expected %q, got %q", c.expected, got)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import "fmt"
+
+// Parent sessions. A session can inherit the clauses of other sessions, such
+// as shared reference data, without copying them. Parents are searched after
+// the session itself, in the order they were added and depth first, and are
+// read-only from the child: its clauses are always stored in the child. A
+// predicate the child defines replaces the inherited one, unless it is
+// declared multifile in the child or a parent, in which case the clauses of
+// every session are used together. Changes to a parent are seen by its
+// children at once.
+
+// SessionParents lists the parents of a session in the order they were
+// added.
+func (e *Engine) SessionParents(sessionID string) ([]string, error) {
+	rows, err := e.db.Query("SELECT parent_id FROM session_parents WHERE session_id = ? ORDER BY rowid", sessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	parents := []string{}
+	for rows.Next() {
+		var parent string
+		if err := rows.Scan(&parent); err != nil {
+			return nil, err
+		}
+		parents = append(parents, parent)
+	}
+	return parents, nil
+}
+
+// sessionParents returns the parents of a session, cached until they
+// change.
+func (e *Engine) sessionParents(sessionID string) []string {
+	e.mu.Lock()
+	parents, cached := e.parents[sessionID]
+	e.mu.Unlock()
+	if cached {
+		return parents
+	}
+
+	parents, err := e.SessionParents(sessionID)
+	if err != nil {
+		return nil
+	}
+	e.mu.Lock()
+	e.parents[sessionID] = parents
+	e.mu.Unlock()
+	return parents
+}
+
+// sessionLineage returns a session followed by the sessions it inherits
+// from, depth first, each listed once.
+func (e *Engine) sessionLineage(sessionID string) []string {
+	lineage := []string{}
+	seen := make(map[string]bool)
+	var visit func(id string)
+	visit = func(id string) {
+		if seen[id] {
+			return
+		}
+		seen[id] = true
+		lineage = append(lineage, id)
+		for _, parent := range e.sessionParents(id) {
+			visit(parent)
+		}
+	}
+	visit(sessionID)
+	return lineage
+}
+
+// sessionDescendants returns the sessions that inherit from a session,
+// directly or through other parents.
+func (e *Engine) sessionDescendants(sessionID string) []string {
+	rows, err := e.db.Query(`WITH RECURSIVE descendants(id) AS (
+			SELECT session_id FROM session_parents WHERE parent_id = ?
+			UNION SELECT p.session_id FROM session_parents p JOIN descendants d ON p.parent_id = d.id
+		) SELECT id FROM descendants`, sessionID)
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+
+	var descendants []string
+	for rows.Next() {
+		var id string
+		if rows.Scan(&id) == nil && id != sessionID {
+			descendants = append(descendants, id)
+		}
+	}
+	return descendants
+}
+
+// AddParent makes a session inherit the clauses of parentID.
+func (e *Engine) AddParent(sessionID, parentID string) error {
+	if sessionID == parentID {
+		return fmt.Errorf("a session cannot inherit from itself")
+	}
+	if _, err := e.GetSession(parentID); err != nil {
+		return fmt.Errorf("parent session %s not found", parentID)
+	}
+	for _, ancestor := range e.sessionLineage(parentID) {
+		if ancestor == sessionID {
+			return fmt.Errorf("session %s already inherits from this session", parentID)
+		}
+	}
+
+	_, err := e.db.Exec("INSERT OR IGNORE INTO session_parents (session_id, parent_id) VALUES (?, ?)", sessionID, parentID)
+	if err != nil {
+		return err
+	}
+	e.invalidateParents(sessionID)
+	return nil
+}
+
+// RemoveParent stops a session inheriting from parentID.
+func (e *Engine) RemoveParent(sessionID, parentID string) error {
+	_, err := e.db.Exec("DELETE FROM session_parents WHERE session_id = ? AND parent_id = ?", sessionID, parentID)
+	if err != nil {
+		return err
+	}
+	e.invalidateParents(sessionID)
+	return nil
+}
+
+// invalidateParents drops the cached parents of a session and everything
+// derived from the clauses it could see.
+func (e *Engine) invalidateParents(sessionID string) {
+	e.mu.Lock()
+	delete(e.parents, sessionID)
+	e.mu.Unlock()
+	e.invalidateSession(sessionID)
+	e.forgetExpansions(sessionID)
+}
+
+// visibleClauses returns the facts and rules for goal in module as seen from
+// a session: those of the first session in its lineage defining the
+// predicate, or of every session when the predicate is multifile.
+func (e *Engine) visibleClauses(goal Term, module, sessionID string) ([]Fact, []Rule) {
+	facts, rules, _, _ := e.loadVisibleClauses(goal, module, sessionID)
+	return facts, rules
+}
+
+// loadVisibleClauses is visibleClauses, also returning the number of fact
+// and rule rows loaded from the store.
+func (e *Engine) loadVisibleClauses(goal Term, module, sessionID string) (facts []Fact, rules []Rule, factRows, ruleRows int) {
+	arity := termArity(goal)
+	multifile := e.sessionModules(sessionID).multifile[module+":"+indicatorKey(e.extractPredicate(goal), arity)]
+
+	for _, id := range e.sessionLineage(sessionID) {
+		defined := false
+		loadedFacts, loadedRules := e.loadModuleFacts(goal, module, id), e.loadModuleRules(goal, module, id)
+		factRows += len(loadedFacts)
+		ruleRows += len(loadedRules)
+		for _, fact := range loadedFacts {
+			if termArity(fact.Predicate) == arity {
+				facts = append(facts, fact)
+				defined = true
+			}
+		}
+		for _, rule := range loadedRules {
+			if termArity(rule.Head) == arity {
+				rules = append(rules, rule)
+				defined = true
+			}
+		}
+		if defined && !multifile {
+			break
+		}
+	}
+	return facts, rules, factRows, ruleRows
+}
+
+// predicateSources returns the sessions whose stored facts for goal in
+// module a session sees, and its visible rules, without loading the facts.
+// ground is false when one of those facts contains a variable.
+func (e *Engine) predicateSources(goal Term, module, sessionID string) (sessions []string, rules []Rule, ground bool) {
+	arity := termArity(goal)
+	multifile := e.sessionModules(sessionID).multifile[module+":"+indicatorKey(e.extractPredicate(goal), arity)]
+
+	ground = true
+	for _, id := range e.sessionLineage(sessionID) {
+		var hasFacts, hasVariables bool
+		e.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM facts f WHERE `+factsFilter+`),
+				EXISTS (SELECT 1 FROM facts f, json_tree(f.data) t WHERE `+factsFilter+` AND t.key = 'type' AND t.value = 'variable')`,
+			e.extractPredicate(goal), id, module, arity, e.extractPredicate(goal), id, module, arity).Scan(&hasFacts, &hasVariables)
+		ground = ground && !hasVariables
+		if hasFacts {
+			sessions = append(sessions, id)
+		}
+		defined := hasFacts
+		for _, rule := range e.loadModuleRules(goal, module, id) {
+			if termArity(rule.Head) == arity {
+				rules = append(rules, rule)
+				defined = true
+			}
+		}
+		if defined && !multifile {
+			break
+		}
+	}
+	return sessions, rules, ground
+}
+
+// factsFilter selects the facts f of a predicate, session, module and arity.
+const factsFilter = "f.predicate = ? AND f.session_id = ? AND f.module = ? AND COALESCE(json_array_length(f.data, '$.args'), 0) = ?"
+
+// handleMultifile implements multifile/1 for a predicate indicator, a
+// conjunction or a list of them. Unqualified indicators belong to module.
+func (e *Engine) handleMultifile(goal Term, module string, subst Substitution, sessionID string) ([]Substitution, bool) {
+	if len(goal.Args) != 1 {
+		return []Substitution{}, true
+	}
+	specs := flattenConjunction(e.instantiate(goal.Args[0], subst))
+	if len(specs) == 1 {
+		if items, ok := e.listElements(specs[0], subst); ok {
+			specs = items
+		}
+	}
+
+	keys := make([]string, 0, len(specs))
+	for _, spec := range specs {
+		if spec.Type != "compound" || spec.Value != "/" || len(spec.Args) != 2 {
+			return []Substitution{}, true
+		}
+		specModule, name := module, spec.Args[0]
+		if name.Type == "compound" && name.Value == ":" {
+			specModule, name = splitModule(name)
+		}
+		if name.Type != "atom" || spec.Args[1].Type != "number" {
+			return []Substitution{}, true
+		}
+		keys = append(keys, specModule+":"+indicatorKey(name.Value.(string), int(spec.Args[1].Value.(float64))))
+	}
+
+	for _, key := range keys {
+		if _, err := e.db.Exec("INSERT OR IGNORE INTO session_multifile (session_id, predicate) VALUES (?, ?)", sessionID, key); err != nil {
+			return []Substitution{}, true
+		}
+	}
+	e.invalidateSession(sessionID)
+	return []Substitution{subst}, true
+}
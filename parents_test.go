@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParentSessions(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+
+	library, _ := engine.CreateSession(CreateSessionRequest{Name: "reference"})
+	_, err := engine.Consult(library.ID, `
+:- multifile(employee/2).
+country(de, germany).
+country(fr, france).
+holiday(jan_1).
+employee(ann, sales).
+`)
+	if err != nil {
+		t.Fatalf("Consult failed: %v", err)
+	}
+
+	sessionID := createTestSession(t, engine)
+	if err := engine.AddParent(sessionID, library.ID); err != nil {
+		t.Fatalf("Failed to add parent: %v", err)
+	}
+	_, err = engine.Consult(sessionID, `
+holiday(dec_25).
+employee(bob, it).
+lives_in(bob, de).
+home(P, C) :- lives_in(P, Code), country(Code, C).
+`)
+	if err != nil {
+		t.Fatalf("Consult failed: %v", err)
+	}
+
+	// Inherited clauses are used in resolution
+	solutions := queryAll(engine, sessionID, Compound("home", []Term{Atom("bob"), Variable("C")}))
+	if len(solutions) != 1 || solutions[0].Bindings["C"].Value != "germany" {
+		t.Errorf("Expected bob to live in germany, got %v", solutions)
+	}
+
+	// A local definition overrides the inherited one, a multifile one extends it
+	solutions = queryAll(engine, sessionID, Compound("holiday", []Term{Variable("D")}))
+	if len(solutions) != 1 || solutions[0].Bindings["D"].Value != "dec_25" {
+		t.Errorf("Expected the local holiday/1 to override, got %v", solutions)
+	}
+	if solutions = queryAll(engine, sessionID, Compound("employee", []Term{Variable("N"), Variable("D")})); len(solutions) != 2 {
+		t.Errorf("Expected the local employee/2 to extend, got %v", solutions)
+	}
+
+	// The parent is not changed by its child
+	if solutions = queryAll(engine, library.ID, Compound("employee", []Term{Variable("N"), Variable("D")})); len(solutions) != 1 {
+		t.Errorf("Expected the library to keep one employee, got %v", solutions)
+	}
+
+	// Changes to the parent are visible at once, even after answers were cached
+	engine.AddFact(Fact{SessionID: library.ID, Predicate: Compound("country", []Term{Atom("it"), Atom("italy")})})
+	if solutions = queryAll(engine, sessionID, Compound("country", []Term{Variable("Code"), Variable("C")})); len(solutions) != 3 {
+		t.Errorf("Expected the new country to be inherited, got %v", solutions)
+	}
+
+	goals, _ := engine.ParseQuery(sessionID, "current_predicate(country/2), clause(employee(ann, D), true)")
+	if len(queryAll(engine, sessionID, goals...)) != 1 {
+		t.Error("Expected reflection to see inherited predicates")
+	}
+
+	// Inheritance is transitive and cannot be circular
+	child, _ := engine.CreateSession(CreateSessionRequest{Name: "conversation"})
+	grandchild := child.ID
+	engine.AddParent(grandchild, sessionID)
+	if len(queryAll(engine, grandchild, Compound("home", []Term{Atom("bob"), Atom("germany")}))) != 1 {
+		t.Error("Expected a grandchild to inherit through its parent")
+	}
+	if err := engine.AddParent(library.ID, grandchild); err == nil {
+		t.Error("Expected a cycle to be rejected")
+	}
+
+	if err := engine.RemoveParent(sessionID, library.ID); err != nil {
+		t.Fatalf("Failed to remove parent: %v", err)
+	}
+	if len(queryAll(engine, grandchild, Compound("home", []Term{Atom("bob"), Variable("C")}))) != 0 {
+		t.Error("Expected inherited clauses to disappear with the parent")
+	}
+}
+
+func TestParentsHandlers(t *testing.T) {
+	router, engine := setupTestRouter(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+	reference, _ := engine.CreateSession(CreateSessionRequest{Name: "reference"})
+	library := reference.ID
+
+	body, _ := json.Marshal(AddParentRequest{Parent: library})
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/sessions/"+sessionID+"/parents", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/sessions/"+sessionID+"/parents", nil)
+	router.ServeHTTP(w, req)
+	var listed struct {
+		Parents []string `json:"parents"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &listed)
+	if len(listed.Parents) != 1 || listed.Parents[0] != library {
+		t.Errorf("Expected the library to be listed, got %s", w.Body.String())
+	}
+
+	// A session cannot inherit from itself
+	body, _ = json.Marshal(AddParentRequest{Parent: sessionID})
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/api/v1/sessions/"+sessionID+"/parents", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("DELETE", "/api/v1/sessions/"+sessionID+"/parents/"+library, nil)
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if parents, _ := engine.SessionParents(sessionID); len(parents) != 0 {
+		t.Errorf("Expected no parents, got %v", parents)
+	}
+}
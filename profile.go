@@ -0,0 +1,390 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// Profiling. A query run with Profile set is traced without reporting any
+// events: its tracer charges the time between solver steps to the
+// invocation being worked on, and the invocations, rule bodies and fact
+// exits it records are summed up per predicate and per clause once the
+// query is done. Inferences are the goals called, user predicates and
+// builtins alike; the total time and inferences of a recursive predicate
+// count its outermost invocations only.
+
+// maxProfileStack is the number of callers kept for each sample of the
+// pprof profile.
+const maxProfileStack = 64
+
+// Profile reports where a query spent its work.
+type Profile struct {
+	Predicates []PredicateProfile `json:"predicates"` // by total time, longest first
+	Inferences int                `json:"inferences"`
+	Time       time.Duration      `json:"time_ns"`
+
+	start   time.Time
+	samples []profileSample
+}
+
+// PredicateProfile is the work done by the invocations of one predicate.
+type PredicateProfile struct {
+	Predicate  string          `json:"predicate"` // Name/Arity, qualified outside the user module
+	Builtin    bool            `json:"builtin,omitempty"`
+	Calls      int             `json:"calls"`
+	Exits      int             `json:"exits"`
+	Fails      int             `json:"fails"` // calls without a solution
+	Inferences int             `json:"inferences"`
+	SelfTime   time.Duration   `json:"self_time_ns"`
+	TotalTime  time.Duration   `json:"total_time_ns"`
+	CacheHits  int             `json:"cache_hits"` // calls answered from the answer table
+	FactRows   int             `json:"fact_rows"`  // rows loaded from the facts table
+	RuleRows   int             `json:"rule_rows"`  // rows loaded from the rules table
+	Clauses    []ClauseProfile `json:"clauses,omitempty"`
+}
+
+// ClauseProfile is the work done through one fact or rule. Calls count the
+// goals whose head unified with it.
+type ClauseProfile struct {
+	Kind       string        `json:"kind"` // "fact" or "rule"
+	ClauseID   int           `json:"clause_id"`
+	Calls      int           `json:"calls"`
+	Exits      int           `json:"exits"`
+	Fails      int           `json:"fails"`
+	Inferences int           `json:"inferences"`
+	SelfTime   time.Duration `json:"self_time_ns"`
+	TotalTime  time.Duration `json:"total_time_ns"`
+}
+
+// profileLocation is a predicate, or one of its rules when line is set.
+type profileLocation struct {
+	predicate string
+	line      int
+}
+
+type profileSample struct {
+	stack []profileLocation // innermost first
+	calls int64
+	time  time.Duration
+}
+
+type profiler struct {
+	start  time.Time
+	last   time.Time
+	active int                    // the frame time is charged to
+	facts  map[string]map[int]int // predicate -> fact ID -> exits
+}
+
+func newProfiler() *profiler {
+	now := time.Now()
+	return &profiler{start: now, last: now, facts: make(map[string]map[int]int)}
+}
+
+// enter charges the time since the last step to the active frame and makes
+// frame the active one.
+func (p *profiler) enter(t *tracer, frame int) {
+	if p == nil {
+		return
+	}
+	now := time.Now()
+	t.frames[p.active].self += now.Sub(p.last)
+	p.active, p.last = frame, now
+}
+
+func (p *profiler) factExit(predicate string, id int) {
+	if p == nil {
+		return
+	}
+	if p.facts[predicate] == nil {
+		p.facts[predicate] = make(map[int]int)
+	}
+	p.facts[predicate][id]++
+}
+
+// summarize sums up the frames of a finished query.
+func (t *tracer) summarize() *Profile {
+	p := t.profile
+	p.enter(t, 0)
+	frames := t.frames
+
+	// Time and calls of each frame with everything below it. Frames are
+	// created after the frame they are called from.
+	subTime := make([]time.Duration, len(frames))
+	subCalls := make([]int, len(frames))
+	children := make([][]int, len(frames))
+	for i := len(frames) - 1; i >= 0; i-- {
+		frame := frames[i]
+		subTime[i] += frame.self
+		if i > 0 && frame.clauseID == 0 {
+			subCalls[i]++
+		}
+		if i > 0 {
+			subTime[frame.parent] += subTime[i]
+			subCalls[frame.parent] += subCalls[i]
+			children[frame.parent] = append(children[frame.parent], i)
+		}
+	}
+
+	predicates := make(map[string]*PredicateProfile)
+	clauses := make(map[string]map[string]*ClauseProfile)
+	predicate := func(frame *traceFrame) *PredicateProfile {
+		stats, ok := predicates[frame.predicate]
+		if !ok {
+			stats = &PredicateProfile{Predicate: frame.predicate, Builtin: frame.builtin}
+			predicates[frame.predicate] = stats
+			clauses[frame.predicate] = make(map[string]*ClauseProfile)
+		}
+		return stats
+	}
+	clause := func(name, kind string, id int) *ClauseProfile {
+		key := fmt.Sprintf("%s#%d", kind, id)
+		stats, ok := clauses[name][key]
+		if !ok {
+			stats = &ClauseProfile{Kind: kind, ClauseID: id}
+			clauses[name][key] = stats
+		}
+		return stats
+	}
+
+	// Walk the frames depth first, keeping count of the predicates and
+	// rules on the path to tell outermost invocations
+	onPath := make(map[string]int)
+	type visit struct {
+		frame int
+		leave bool
+	}
+	stack := []visit{{frame: 0}}
+	for len(stack) > 0 {
+		v := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		frame := frames[v.frame]
+		key := frame.predicate
+		if frame.clauseID != 0 {
+			key = fmt.Sprintf("%s#rule#%d", frame.predicate, frame.clauseID)
+		}
+		if v.leave {
+			onPath[key]--
+			continue
+		}
+		if v.frame != 0 {
+			stack = append(stack, visit{frame: v.frame, leave: true})
+		}
+		for i := len(children[v.frame]) - 1; i >= 0; i-- {
+			stack = append(stack, visit{frame: children[v.frame][i]})
+		}
+		if v.frame == 0 {
+			continue
+		}
+		onPath[key]++
+		outermost := onPath[key] == 1
+
+		stats := predicate(frame)
+		stats.SelfTime += frame.self
+		if frame.clauseID != 0 {
+			rule := clause(frame.predicate, "rule", frame.clauseID)
+			rule.Calls++
+			rule.Exits += frame.exits
+			if frame.exits == 0 {
+				rule.Fails++
+			}
+			rule.SelfTime += frame.self
+			if outermost {
+				rule.TotalTime += subTime[v.frame]
+				rule.Inferences += subCalls[v.frame]
+			}
+			continue
+		}
+		stats.Calls++
+		stats.Exits += frame.exits
+		if frame.exits == 0 {
+			stats.Fails++
+		}
+		if frame.cached {
+			stats.CacheHits++
+		}
+		stats.FactRows += frame.factRows
+		stats.RuleRows += frame.ruleRows
+		if outermost {
+			stats.TotalTime += subTime[v.frame]
+			stats.Inferences += subCalls[v.frame]
+		}
+	}
+	for name, facts := range p.facts {
+		for id, exits := range facts {
+			fact := clause(name, "fact", id)
+			fact.Calls += exits
+			fact.Exits += exits
+		}
+	}
+
+	profile := &Profile{Inferences: subCalls[0], Time: subTime[0], start: p.start,
+		Predicates: make([]PredicateProfile, 0, len(predicates))}
+	for name, stats := range predicates {
+		for _, c := range clauses[name] {
+			stats.Clauses = append(stats.Clauses, *c)
+		}
+		sort.Slice(stats.Clauses, func(i, j int) bool {
+			a, b := stats.Clauses[i], stats.Clauses[j]
+			if a.Kind != b.Kind {
+				return a.Kind < b.Kind
+			}
+			return a.ClauseID < b.ClauseID
+		})
+		profile.Predicates = append(profile.Predicates, *stats)
+	}
+	sort.Slice(profile.Predicates, func(i, j int) bool {
+		a, b := profile.Predicates[i], profile.Predicates[j]
+		if a.TotalTime != b.TotalTime {
+			return a.TotalTime > b.TotalTime
+		}
+		return a.Predicate < b.Predicate
+	})
+	profile.samples = t.samples()
+	return profile
+}
+
+// samples returns the pprof samples of the frames: each frame's calls and
+// own time, under the predicates and rules it was called from.
+func (t *tracer) samples() []profileSample {
+	// callers[i] is the node of a call tree that frames called from frame i
+	// hang below; a rule body frame stands in for the frame of its call
+	type node struct {
+		location profileLocation
+		parent   int
+	}
+	nodes := []node{{}}
+	index := make(map[node]int)
+	nodeFor := func(n node) int {
+		if id, ok := index[n]; ok {
+			return id
+		}
+		nodes = append(nodes, n)
+		index[n] = len(nodes) - 1
+		return len(nodes) - 1
+	}
+
+	callers := make([]int, len(t.frames))
+	bySite := make(map[int]*profileSample)
+	var order []int
+	for i := 1; i < len(t.frames); i++ {
+		frame := t.frames[i]
+		above := callers[frame.parent]
+		if frame.clauseID != 0 {
+			above = callers[t.frames[frame.parent].parent]
+		}
+		site := nodeFor(node{profileLocation{frame.predicate, frame.clauseID}, above})
+		callers[i] = site
+
+		sample, ok := bySite[site]
+		if !ok {
+			sample = &profileSample{}
+			for n := site; n != 0 && len(sample.stack) < maxProfileStack; n = nodes[n].parent {
+				sample.stack = append(sample.stack, nodes[n].location)
+			}
+			bySite[site] = sample
+			order = append(order, site)
+		}
+		if frame.clauseID == 0 {
+			sample.calls++
+		}
+		sample.time += frame.self
+	}
+
+	samples := make([]profileSample, len(order))
+	for i, site := range order {
+		samples[i] = *bySite[site]
+	}
+	return samples
+}
+
+// WritePprof writes the profile in the gzipped protocol buffer format read
+// by pprof, with the calls and time of each predicate and rule under its
+// callers. Rules appear as lines numbered by their clause ID.
+func (p *Profile) WritePprof(w io.Writer) error {
+	strings := []string{""}
+	stringIDs := map[string]int{"": 0}
+	str := func(s string) uint64 {
+		if id, ok := stringIDs[s]; ok {
+			return uint64(id)
+		}
+		strings = append(strings, s)
+		stringIDs[s] = len(strings) - 1
+		return uint64(len(strings) - 1)
+	}
+
+	var out []byte
+	valueType := func(kind, unit string) []byte {
+		return protoVarint(protoVarint(nil, 1, str(kind)), 2, str(unit))
+	}
+	out = protoBytes(out, 1, valueType("calls", "count"))
+	out = protoBytes(out, 1, valueType("time", "nanoseconds"))
+
+	functions := make(map[string]uint64)
+	locations := make(map[profileLocation]uint64)
+	var functionData, locationData []byte
+	for _, sample := range p.samples {
+		var ids []byte
+		for _, location := range sample.stack {
+			id, ok := locations[location]
+			if !ok {
+				function, ok := functions[location.predicate]
+				if !ok {
+					function = uint64(len(functions) + 1)
+					functions[location.predicate] = function
+					fn := protoVarint(nil, 1, function)
+					fn = protoVarint(fn, 2, str(location.predicate))
+					fn = protoVarint(fn, 3, str(location.predicate))
+					functionData = protoBytes(functionData, 5, fn)
+				}
+				id = uint64(len(locations) + 1)
+				locations[location] = id
+				line := protoVarint(protoVarint(nil, 1, function), 2, uint64(location.line))
+				locationData = protoBytes(locationData, 4, protoBytes(protoVarint(nil, 1, id), 4, line))
+			}
+			ids = binary.AppendUvarint(ids, id)
+		}
+		values := binary.AppendUvarint(nil, uint64(sample.calls))
+		values = binary.AppendUvarint(values, uint64(sample.time.Nanoseconds()))
+		out = protoBytes(out, 2, protoBytes(protoBytes(nil, 1, ids), 2, values))
+	}
+	out = append(append(out, locationData...), functionData...)
+
+	periodType := valueType("time", "nanoseconds")
+	for _, s := range strings {
+		out = protoBytes(out, 6, []byte(s))
+	}
+	out = protoVarint(out, 9, uint64(p.start.UnixNano()))
+	out = protoVarint(out, 10, uint64(p.Time.Nanoseconds()))
+	out = protoBytes(out, 11, periodType)
+	out = protoVarint(out, 12, 1)
+
+	gz := gzip.NewWriter(w)
+	if _, err := gz.Write(out); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// protoVarint appends a varint field of a protocol buffer message.
+func protoVarint(b []byte, field int, v uint64) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3)
+	return binary.AppendUvarint(b, v)
+}
+
+// protoBytes appends a length-delimited field of a protocol buffer message.
+func protoBytes(b []byte, field int, data []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+// LastProfile returns the profile of the last profiled query of a session.
+func (e *Engine) LastProfile(sessionID string) *Profile {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.profiles[sessionID]
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func findPredicateProfile(profile *Profile, predicate string) *PredicateProfile {
+	for i := range profile.Predicates {
+		if profile.Predicates[i].Predicate == predicate {
+			return &profile.Predicates[i]
+		}
+	}
+	return nil
+}
+
+func TestProfiler(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+
+	if _, err := engine.Consult(sessionID, familySource+`
+ancestor(X, Y) :- parent(X, Y).
+ancestor(X, Z) :- parent(X, Y), ancestor(Y, Z).
+`); err != nil {
+		t.Fatalf("Consult failed: %v", err)
+	}
+	goals, _ := engine.ParseQuery(sessionID, "ancestor(ann, W)")
+	result := engine.Query(Query{Goals: goals, Profile: true}, sessionID)
+	if len(result.Solutions) != 3 || result.Profile == nil {
+		t.Fatalf("Expected three ancestors and a profile, got %v", result.Solutions)
+	}
+
+	// ancestor/2 is called for ann, bob, cal and dee, and only the last two
+	// have no descendants
+	ancestor := findPredicateProfile(result.Profile, "ancestor/2")
+	if ancestor == nil || ancestor.Calls != 4 || ancestor.Exits != 5 || ancestor.Fails != 2 {
+		t.Fatalf("Expected 4 calls, 5 exits and 2 fails of ancestor/2, got %+v", ancestor)
+	}
+	if ancestor.RuleRows != 8 || ancestor.FactRows != 0 || ancestor.TotalTime < ancestor.SelfTime {
+		t.Errorf("Expected two rule rows per call and a total covering the self time, got %+v", ancestor)
+	}
+	if len(ancestor.Clauses) != 2 || ancestor.Clauses[0].Kind != "rule" || ancestor.Clauses[0].Calls != 4 || ancestor.Clauses[0].Exits != 3 {
+		t.Errorf("Expected the base rule to succeed three times, got %+v", ancestor.Clauses)
+	}
+
+	parent := findPredicateProfile(result.Profile, "parent/2")
+	if parent == nil || parent.Calls != 8 || parent.FactRows != 24 || parent.Inferences != 8 {
+		t.Fatalf("Expected 8 calls of parent/2 loading 3 rows each, got %+v", parent)
+	}
+	if len(parent.Clauses) != 3 || parent.Clauses[0].Kind != "fact" || parent.Clauses[0].Exits != 2 {
+		t.Errorf("Expected parent(ann, bob) to be used by both rules, got %+v", parent.Clauses)
+	}
+	if result.Profile.Inferences != ancestor.Inferences || result.Profile.Inferences != 12 {
+		t.Errorf("Expected 12 inferences, all below ancestor/2, got %d and %d", result.Profile.Inferences, ancestor.Inferences)
+	}
+
+	// The second of two identical calls is answered from the cache
+	goals, _ = engine.ParseQuery(sessionID, "member(X, [1, 2]), parent(ann, bob)")
+	result = engine.Query(Query{Goals: goals, Profile: true}, sessionID)
+	if parent = findPredicateProfile(result.Profile, "parent/2"); parent == nil || parent.Calls != 2 || parent.CacheHits != 1 || parent.FactRows != 3 {
+		t.Errorf("Expected one call to load the facts and one to hit the cache, got %+v", parent)
+	}
+	if member := findPredicateProfile(result.Profile, "member/2"); member == nil || !member.Builtin || member.Exits != 2 {
+		t.Errorf("Expected member/2 as a builtin with two exits, got %+v", member)
+	}
+}
+
+func TestProfileHandler(t *testing.T) {
+	router, engine := setupTestRouter(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+	engine.Consult(sessionID, familySource)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/v1/sessions/"+sessionID+"/profile", nil)
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d before profiling, got %d", http.StatusNotFound, w.Code)
+	}
+
+	body, _ := json.Marshal(Query{Text: "grandparent(ann, W)", Profile: true})
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/api/v1/sessions/"+sessionID+"/query", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+	var result QueryResult
+	json.Unmarshal(w.Body.Bytes(), &result)
+	if result.Profile == nil || findPredicateProfile(result.Profile, "grandparent/2") == nil {
+		t.Fatalf("Expected a profile of grandparent/2, got %s", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/sessions/"+sessionID+"/profile", nil)
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	gz, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatalf("Expected a gzipped profile: %v", err)
+	}
+	data, _ := io.ReadAll(gz)
+	if !bytes.Contains(data, []byte("grandparent/2")) || !bytes.Contains(data, []byte("nanoseconds")) {
+		t.Errorf("Expected the predicates and sample types in the profile")
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Proof trees. A query run with Proof set records, on every branch, the
+// goals it resolves: the fact or rule used for a user predicate, with the
+// clause's variable bindings, and the builtins evaluated. The steps are kept
+// in the solve context, newest first, so each solution carries exactly the
+// derivation that produced it; proofTree turns them back into a tree.
+
+// proofExit is the goal that closes the node of a rule once its body has
+// been proved.
+const proofExit = contextKey + "proof_exit"
+
+// ProofNode is one resolved goal of a derivation.
+type ProofNode struct {
+	Goal      Term         `json:"goal"`
+	Kind      string       `json:"kind"` // "fact", "rule", "builtin" or "control"
+	ClauseID  int          `json:"clause_id,omitempty"`
+	SessionID string       `json:"session_id,omitempty"` // set when the clause belongs to another session
+	Bindings  Substitution `json:"bindings,omitempty"`   // the clause's variables, by their names in the clause
+	Children  []ProofNode  `json:"children,omitempty"`
+}
+
+func proving(subst Substitution) bool {
+	return contextOf(subst).proof
+}
+
+// recordProof adds a step to the proof of the branch described by subst.
+func (e *Engine) recordProof(subst Substitution, step Term) Substitution {
+	ctx := contextOf(subst)
+	ctx.steps = Compound("$step", []Term{step, ctx.steps})
+	return withContext(subst, ctx)
+}
+
+// proveClause records the resolution of goal with a stored clause. renames
+// maps the clause's variable names to the variables they were renamed to.
+func (e *Engine) proveClause(subst Substitution, goal Term, kind string, id int, sessionID string, renames map[string]string) Substitution {
+	names := make([]string, 0, len(renames))
+	for name := range renames {
+		if !strings.HasPrefix(name, "_") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	bindings := make([]Term, len(names))
+	for i, name := range names {
+		bindings[i] = Compound("=", []Term{Atom(name), Variable(renames[name])})
+	}
+	return e.recordProof(subst, Compound("call", []Term{goal, Atom(kind), Number(float64(id)), Atom(sessionID), List(bindings)}))
+}
+
+// proofTree rebuilds the derivation recorded in a solution. Goals and
+// bindings are shown as the solution instantiates them; clauses from
+// sessionID are not marked with their session.
+func (e *Engine) proofTree(subst Substitution, sessionID string) []ProofNode {
+	var steps []Term
+	for step := contextOf(subst).steps; step.Type == "compound" && step.Value == "$step"; step = step.Args[1] {
+		steps = append(steps, step.Args[0])
+	}
+
+	var roots []ProofNode
+	var stack []*ProofNode
+	closeNode := func() {
+		node := *stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if len(stack) == 0 {
+			roots = append(roots, node)
+		} else {
+			parent := stack[len(stack)-1]
+			parent.Children = append(parent.Children, node)
+		}
+	}
+	for i := len(steps) - 1; i >= 0; i-- {
+		step := steps[i]
+		switch {
+		case step.Type == "atom" && step.Value == "exit":
+			if len(stack) > 0 {
+				closeNode()
+			}
+
+		case step.Value == "builtin":
+			goal := step.Args[0]
+			kind := "builtin"
+			if goal.Type == "compound" {
+				if _, control := goalPositions[indicatorKey(goal.Value.(string), len(goal.Args))]; control {
+					kind = "control"
+				}
+			}
+			stack = append(stack, &ProofNode{Goal: e.instantiate(goal, subst), Kind: kind})
+
+		case step.Value == "call":
+			node := &ProofNode{
+				Goal:     e.instantiate(step.Args[0], subst),
+				Kind:     step.Args[1].Value.(string),
+				ClauseID: int(step.Args[2].Value.(float64)),
+			}
+			if from := step.Args[3].Value.(string); from != sessionID {
+				node.SessionID = from
+			}
+			for _, pair := range step.Args[4].Args {
+				if node.Bindings == nil {
+					node.Bindings = make(Substitution)
+				}
+				node.Bindings[pair.Args[0].Value.(string)] = e.instantiate(pair.Args[1], subst)
+			}
+			stack = append(stack, node)
+		}
+	}
+	for len(stack) > 0 {
+		closeNode()
+	}
+	return roots
+}
+
+// explainProof renders a proof tree as indented text, one goal per line
+// with the clause or builtin that resolved it.
+func explainProof(nodes []ProofNode, ops *opTable) string {
+	var sb strings.Builder
+	var explain func(nodes []ProofNode, depth int)
+	explain = func(nodes []ProofNode, depth int) {
+		for _, node := range nodes {
+			sb.WriteString(strings.Repeat("  ", depth))
+			sb.WriteString(ops.format(node.Goal, true))
+			switch node.Kind {
+			case "fact", "rule":
+				fmt.Fprintf(&sb, "  by %s #%d", node.Kind, node.ClauseID)
+				if node.SessionID != "" {
+					fmt.Fprintf(&sb, " of session %s", node.SessionID)
+				}
+			default:
+				fmt.Fprintf(&sb, "  (%s)", node.Kind)
+			}
+			if len(node.Bindings) > 0 {
+				names := make([]string, 0, len(node.Bindings))
+				for name := range node.Bindings {
+					names = append(names, name)
+				}
+				sort.Strings(names)
+				for i, name := range names {
+					if i == 0 {
+						sb.WriteString(" with ")
+					} else {
+						sb.WriteString(", ")
+					}
+					sb.WriteString(name + " = " + ops.format(node.Bindings[name], true))
+				}
+			}
+			sb.WriteString("\n")
+			explain(node.Children, depth+1)
+		}
+	}
+	explain(nodes, 0)
+	return sb.String()
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const familySource = `
+parent(ann, bob).
+parent(bob, cal).
+parent(bob, dee).
+grandparent(X, Z) :- parent(X, Y), parent(Y, Z).
+sibling(A, B) :- parent(P, A), parent(P, B), dif(A, B).
+`
+
+func TestProofTree(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+
+	if _, err := engine.Consult(sessionID, familySource); err != nil {
+		t.Fatalf("Consult failed: %v", err)
+	}
+	goals, _ := engine.ParseQuery(sessionID, "grandparent(ann, W)")
+	result := engine.Query(Query{Goals: goals, Proof: true}, sessionID)
+	if len(result.Solutions) != 2 {
+		t.Fatalf("Expected two grandchildren, got %v", result.Solutions)
+	}
+
+	proof := result.Solutions[0].Proof
+	if len(proof) != 1 {
+		t.Fatalf("Expected one root, got %v", proof)
+	}
+	root := proof[0]
+	if root.Kind != "rule" || root.ClauseID == 0 || formatTerm(root.Goal, true) != "grandparent(ann,cal)" {
+		t.Errorf("Expected grandparent(ann,cal) by a rule, got %+v", root)
+	}
+	if root.Bindings["Y"].Value != "bob" || root.Bindings["Z"].Value != "cal" {
+		t.Errorf("Expected the rule's bindings, got %v", root.Bindings)
+	}
+	if len(root.Children) != 2 || root.Children[0].Kind != "fact" || root.Children[1].ClauseID == root.Children[0].ClauseID {
+		t.Errorf("Expected two distinct facts below the rule, got %+v", root.Children)
+	}
+
+	expected := "grandparent(ann,cal)  by rule #1 with X = ann, Y = bob, Z = cal\n" +
+		"  parent(ann,bob)  by fact #1\n" +
+		"  parent(bob,cal)  by fact #2\n"
+	if result.Solutions[0].Explanation != expected {
+		t.Errorf("Expected explanation:\n%s\ngot:\n%s", expected, result.Solutions[0].Explanation)
+	}
+
+	// Builtins are part of the derivation, and cached answers are derived
+	// again
+	queryAll(engine, sessionID, Compound("parent", []Term{Variable("P"), Variable("C")}))
+	goals, _ = engine.ParseQuery(sessionID, "sibling(cal, S)")
+	result = engine.Query(Query{Goals: goals, Proof: true}, sessionID)
+	if len(result.Solutions) != 1 || !strings.Contains(result.Solutions[0].Explanation, "  dif(cal,dee)  (builtin)\n") {
+		t.Errorf("Expected the dif/2 check in the explanation, got %v", result.Solutions)
+	}
+	if children := result.Solutions[0].Proof[0].Children; len(children) != 3 || children[0].Kind != "fact" {
+		t.Errorf("Expected two facts and a builtin, got %+v", children)
+	}
+
+	// Without the option nothing is recorded
+	solutions := queryAll(engine, sessionID, Compound("grandparent", []Term{Atom("ann"), Atom("dee")}))
+	if len(solutions) != 1 || solutions[0].Proof != nil || solutions[0].Explanation != "" {
+		t.Errorf("Expected no proof, got %v", solutions)
+	}
+
+	// The recorded steps are not reachable through a variable
+	result = engine.Query(Query{Proof: true, Goals: []Term{
+		Compound("=", []Term{Variable("$proof"), Atom("x")}),
+		Compound("parent", []Term{Atom("ann"), Atom("bob")}),
+	}}, sessionID)
+	if len(result.Solutions) != 1 || result.Solutions[0].Bindings["$proof"].Value != "x" || len(result.Solutions[0].Proof) != 2 {
+		t.Errorf("Expected $proof to be an ordinary variable, got %+v", result.Solutions)
+	}
+}
+
+func TestQueryHandlerProof(t *testing.T) {
+	router, engine := setupTestRouter(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+	engine.Consult(sessionID, familySource)
+
+	body, _ := json.Marshal(Query{Text: "grandparent(ann, dee)", Proof: true})
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/sessions/"+sessionID+"/query", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+
+	var result struct {
+		Solutions []struct {
+			Proof []struct {
+				Kind     string `json:"kind"`
+				ClauseID int    `json:"clause_id"`
+				Children []struct {
+					Kind string `json:"kind"`
+				} `json:"children"`
+			} `json:"proof"`
+			Explanation string `json:"explanation"`
+		} `json:"solutions"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &result)
+	if len(result.Solutions) != 1 || len(result.Solutions[0].Proof) != 1 {
+		t.Fatalf("Expected one proof, got %s", w.Body.String())
+	}
+	if root := result.Solutions[0].Proof[0]; root.Kind != "rule" || root.ClauseID != 1 || len(root.Children) != 2 {
+		t.Errorf("Expected the rule with two children, got %s", w.Body.String())
+	}
+	if !strings.HasPrefix(result.Solutions[0].Explanation, "grandparent(ann,dee)  by rule #1") {
+		t.Errorf("Expected an explanation, got %q", result.Solutions[0].Explanation)
+	}
+}
@@ -0,0 +1,547 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// The reader turns Prolog text into terms. It supports the standard syntax
+// used by the engine: atoms (including quoted atoms), variables, numbers,
+// double-quoted text, lists, curly terms, functional notation and the
+// operators of an opTable. Double-quoted text is read as an atom, except in
+// the body of a grammar rule outside {}/1 goals, where it is a terminal
+// list of one-character atoms: "ab" reads as [a, b].
+
+type tokenKind int
+
+const (
+	tokAtom tokenKind = iota
+	tokQuoted
+	tokVar
+	tokNumber
+	tokString
+	tokPunct
+	tokEnd
+	tokEOF
+)
+
+type token struct {
+	kind   tokenKind
+	text   string
+	number float64
+	layout bool // whitespace precedes the token
+}
+
+type lexer struct {
+	src []rune
+	pos int
+}
+
+func (l *lexer) peekRune(offset int) rune {
+	if l.pos+offset < len(l.src) {
+		return l.src[l.pos+offset]
+	}
+	return 0
+}
+
+// skipLayout skips whitespace and comments, reporting whether any was found.
+func (l *lexer) skipLayout() bool {
+	start := l.pos
+	for l.pos < len(l.src) {
+		r := l.src[l.pos]
+		switch {
+		case unicode.IsSpace(r):
+			l.pos++
+		case r == '%':
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+				l.pos++
+			}
+		case r == '/' && l.peekRune(1) == '*':
+			l.pos += 2
+			for l.pos < len(l.src) && !(l.src[l.pos] == '*' && l.peekRune(1) == '/') {
+				l.pos++
+			}
+			l.pos += 2
+		default:
+			return l.pos > start
+		}
+	}
+	return l.pos > start
+}
+
+func (l *lexer) next() (token, error) {
+	layout := l.skipLayout()
+	if l.pos >= len(l.src) {
+		return token{kind: tokEOF, layout: layout}, nil
+	}
+
+	start := l.pos
+	r := l.src[l.pos]
+	switch {
+	case unicode.IsDigit(r):
+		return l.number(layout)
+
+	case unicode.IsLetter(r) || r == '_':
+		for l.pos < len(l.src) && (unicode.IsLetter(l.src[l.pos]) || unicode.IsDigit(l.src[l.pos]) || l.src[l.pos] == '_') {
+			l.pos++
+		}
+		text := string(l.src[start:l.pos])
+		if r == '_' || unicode.IsUpper(r) {
+			return token{kind: tokVar, text: text, layout: layout}, nil
+		}
+		return token{kind: tokAtom, text: text, layout: layout}, nil
+
+	case r == '\'' || r == '"':
+		text, err := l.quoted(r)
+		if err != nil {
+			return token{}, err
+		}
+		if r == '"' {
+			return token{kind: tokString, text: text, layout: layout}, nil
+		}
+		return token{kind: tokQuoted, text: text, layout: layout}, nil
+
+	case strings.ContainsRune("()[]{},|", r):
+		l.pos++
+		return token{kind: tokPunct, text: string(r), layout: layout}, nil
+
+	case r == '!' || r == ';':
+		l.pos++
+		return token{kind: tokAtom, text: string(r), layout: layout}, nil
+
+	case strings.ContainsRune(symbolChars, r):
+		// A lone '.' followed by layout or the end of input ends a clause
+		if r == '.' && (l.pos+1 >= len(l.src) || unicode.IsSpace(l.src[l.pos+1]) || l.src[l.pos+1] == '%') {
+			l.pos++
+			return token{kind: tokEnd, text: ".", layout: layout}, nil
+		}
+		for l.pos < len(l.src) && strings.ContainsRune(symbolChars, l.src[l.pos]) {
+			l.pos++
+		}
+		return token{kind: tokAtom, text: string(l.src[start:l.pos]), layout: layout}, nil
+	}
+
+	return token{}, fmt.Errorf("unexpected character %q", r)
+}
+
+func (l *lexer) number(layout bool) (token, error) {
+	start := l.pos
+	// 0'c character codes
+	if l.src[l.pos] == '0' && l.peekRune(1) == '\'' && l.pos+2 < len(l.src) {
+		l.pos += 3
+		return token{kind: tokNumber, number: float64(l.src[l.pos-1]), layout: layout}, nil
+	}
+	for l.pos < len(l.src) && unicode.IsDigit(l.src[l.pos]) {
+		l.pos++
+	}
+	if l.peekRune(0) == '.' && unicode.IsDigit(l.peekRune(1)) {
+		l.pos++
+		for l.pos < len(l.src) && unicode.IsDigit(l.src[l.pos]) {
+			l.pos++
+		}
+	}
+	if r := l.peekRune(0); r == 'e' || r == 'E' {
+		offset := 1
+		if s := l.peekRune(1); s == '+' || s == '-' {
+			offset = 2
+		}
+		if unicode.IsDigit(l.peekRune(offset)) {
+			l.pos += offset
+			for l.pos < len(l.src) && unicode.IsDigit(l.src[l.pos]) {
+				l.pos++
+			}
+		}
+	}
+	n, err := strconv.ParseFloat(string(l.src[start:l.pos]), 64)
+	if err != nil {
+		return token{}, err
+	}
+	return token{kind: tokNumber, number: n, layout: layout}, nil
+}
+
+func (l *lexer) quoted(quote rune) (string, error) {
+	var sb strings.Builder
+	l.pos++
+	for l.pos < len(l.src) {
+		r := l.src[l.pos]
+		l.pos++
+		switch {
+		case r == quote && l.peekRune(0) == quote:
+			sb.WriteRune(quote)
+			l.pos++
+		case r == quote:
+			return sb.String(), nil
+		case r == '\\' && l.pos < len(l.src):
+			escaped := l.src[l.pos]
+			l.pos++
+			switch escaped {
+			case 'n':
+				sb.WriteRune('\n')
+			case 't':
+				sb.WriteRune('\t')
+			case '\n':
+				// Line continuation
+			default:
+				sb.WriteRune(escaped)
+			}
+		default:
+			sb.WriteRune(r)
+		}
+	}
+	return "", fmt.Errorf("unterminated quoted text")
+}
+
+// termReader is an operator precedence parser over the token stream.
+type termReader struct {
+	ops     *opTable
+	lex     *lexer
+	tok     token
+	peeked  bool
+	anonVar int
+	grammar bool // reading the body of a grammar rule
+}
+
+// anonymousName names the nth anonymous variable of a term. No variable
+// written in Prolog text can start with "_#", so the name cannot collide
+// with one of the user's, and answers leave such variables out.
+func anonymousName(n int) string {
+	return fmt.Sprintf("_#%d", n)
+}
+
+// isAnonymous reports whether a variable, possibly renamed apart, is an
+// anonymous one.
+func isAnonymous(name string) bool {
+	return strings.HasPrefix(name, "_#")
+}
+
+func newTermReader(text string, ops *opTable) *termReader {
+	return &termReader{ops: ops, lex: &lexer{src: []rune(text)}}
+}
+
+func (r *termReader) peek() (token, error) {
+	if !r.peeked {
+		tok, err := r.lex.next()
+		if err != nil {
+			return token{}, err
+		}
+		r.tok, r.peeked = tok, true
+	}
+	return r.tok, nil
+}
+
+func (r *termReader) advance() (token, error) {
+	tok, err := r.peek()
+	r.peeked = false
+	return tok, err
+}
+
+func (r *termReader) expect(text string) error {
+	tok, err := r.advance()
+	if err != nil {
+		return err
+	}
+	if tok.kind != tokPunct || tok.text != text {
+		return fmt.Errorf("expected %q", text)
+	}
+	return nil
+}
+
+// readClause reads the next term terminated by '.'. It returns ok=false at
+// the end of the input.
+func (r *termReader) readClause() (Term, bool, error) {
+	if tok, err := r.peek(); err != nil {
+		return Term{}, false, err
+	} else if tok.kind == tokEOF {
+		return Term{}, false, nil
+	}
+	term, err := r.parse(1200)
+	if err != nil {
+		return Term{}, false, err
+	}
+	tok, err := r.advance()
+	if err != nil {
+		return Term{}, false, err
+	}
+	if tok.kind != tokEnd {
+		return Term{}, false, fmt.Errorf("operator expected")
+	}
+	return term, true, nil
+}
+
+// parseTerm reads a single term from text; the terminating '.' is optional.
+func parseTerm(text string, ops *opTable) (Term, error) {
+	r := newTermReader(text, ops)
+	term, err := r.parse(1200)
+	if err != nil {
+		return Term{}, err
+	}
+	tok, err := r.advance()
+	if err == nil && tok.kind == tokEnd {
+		tok, err = r.advance()
+	}
+	if err != nil {
+		return Term{}, err
+	}
+	if tok.kind != tokEOF {
+		return Term{}, fmt.Errorf("unexpected text after term")
+	}
+	return term, nil
+}
+
+// readTerms reads every clause in text.
+func readTerms(text string, ops *opTable) ([]Term, error) {
+	r := newTermReader(text, ops)
+	var terms []Term
+	for {
+		term, ok, err := r.readClause()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return terms, nil
+		}
+		terms = append(terms, term)
+	}
+}
+
+// infixName returns the operator name of tok when it can act as an infix
+// operator.
+func (r *termReader) infixName(tok token) (string, bool) {
+	switch tok.kind {
+	case tokAtom, tokQuoted:
+		_, ok := r.ops.infix[tok.text]
+		return tok.text, ok
+	case tokPunct:
+		if tok.text == "," || tok.text == "|" {
+			return tok.text, true
+		}
+	}
+	return "", false
+}
+
+// startsTerm reports whether tok can begin an operand.
+func (r *termReader) startsTerm(tok token) bool {
+	switch tok.kind {
+	case tokEOF, tokEnd:
+		return false
+	case tokPunct:
+		return tok.text == "(" || tok.text == "[" || tok.text == "{"
+	case tokAtom:
+		_, infix := r.ops.infix[tok.text]
+		_, postfix := r.ops.postfix[tok.text]
+		_, prefix := r.ops.prefix[tok.text]
+		return !(infix || postfix) || prefix
+	}
+	return true
+}
+
+func (r *termReader) parse(max int) (Term, error) {
+	left, leftPrec, err := r.primary(max)
+	if err != nil {
+		return Term{}, err
+	}
+
+	for {
+		tok, err := r.peek()
+		if err != nil {
+			return Term{}, err
+		}
+		if op, ok := r.ops.postfix[tok.text]; ok && (tok.kind == tokAtom || tok.kind == tokQuoted) {
+			argMax := op.priority - 1
+			if op.kind == "yf" {
+				argMax = op.priority
+			}
+			if op.priority > max || leftPrec > argMax {
+				return left, nil
+			}
+			r.advance()
+			left, leftPrec = Compound(tok.text, []Term{left}), op.priority
+			continue
+		}
+
+		name, ok := r.infixName(tok)
+		if !ok {
+			return left, nil
+		}
+		if name == "|" {
+			name = ";"
+		}
+		op := r.ops.infix[name]
+		leftMax, rightMax := op.priority-1, op.priority-1
+		switch op.kind {
+		case "xfy":
+			rightMax = op.priority
+		case "yfx":
+			leftMax = op.priority
+		}
+		if op.priority > max || leftPrec > leftMax {
+			return left, nil
+		}
+		r.advance()
+		grammar := r.grammar
+		r.grammar = grammar || name == "-->"
+		right, err := r.parse(rightMax)
+		r.grammar = grammar
+		if err != nil {
+			return Term{}, err
+		}
+		left, leftPrec = Compound(name, []Term{left, right}), op.priority
+	}
+}
+
+func (r *termReader) primary(max int) (Term, int, error) {
+	tok, err := r.advance()
+	if err != nil {
+		return Term{}, 0, err
+	}
+
+	switch tok.kind {
+	case tokNumber:
+		return Number(tok.number), 0, nil
+
+	case tokString:
+		if r.grammar {
+			var chars []Term
+			for _, c := range tok.text {
+				chars = append(chars, Atom(string(c)))
+			}
+			return List(chars), 0, nil
+		}
+		return Atom(tok.text), 0, nil
+
+	case tokVar:
+		if tok.text == "_" {
+			r.anonVar++
+			return Variable(anonymousName(r.anonVar)), 0, nil
+		}
+		return Variable(tok.text), 0, nil
+
+	case tokPunct:
+		switch tok.text {
+		case "(":
+			term, err := r.parse(1200)
+			if err != nil {
+				return Term{}, 0, err
+			}
+			return term, 0, r.expect(")")
+		case "[":
+			return r.list()
+		case "{":
+			if next, _ := r.peek(); next.kind == tokPunct && next.text == "}" {
+				r.advance()
+				return r.atomOrCompound("{}", max)
+			}
+			grammar := r.grammar
+			r.grammar = false
+			term, err := r.parse(1200)
+			r.grammar = grammar
+			if err != nil {
+				return Term{}, 0, err
+			}
+			return Compound("{}", []Term{term}), 0, r.expect("}")
+		case ",":
+			return Term{}, 0, fmt.Errorf("unexpected comma")
+		}
+		return Term{}, 0, fmt.Errorf("unexpected %q", tok.text)
+
+	case tokAtom, tokQuoted:
+		if tok.kind == tokAtom && tok.text == "-" {
+			// A minus sign directly followed by a number is a negative number
+			if next, err := r.peek(); err == nil && next.kind == tokNumber && !next.layout {
+				r.advance()
+				return Number(-next.number), 0, nil
+			}
+		}
+		return r.atomOrCompound(tok.text, max)
+	}
+
+	return Term{}, 0, fmt.Errorf("unexpected end of input")
+}
+
+func (r *termReader) atomOrCompound(name string, max int) (Term, int, error) {
+	next, err := r.peek()
+	if err != nil {
+		return Term{}, 0, err
+	}
+
+	// Functional notation: name immediately followed by '('
+	if next.kind == tokPunct && next.text == "(" && !next.layout {
+		r.advance()
+		var args []Term
+		for {
+			arg, err := r.parse(999)
+			if err != nil {
+				return Term{}, 0, err
+			}
+			args = append(args, arg)
+			tok, err := r.advance()
+			if err != nil {
+				return Term{}, 0, err
+			}
+			if tok.kind == tokPunct && tok.text == ")" {
+				return Compound(name, args), 0, nil
+			}
+			if tok.kind != tokPunct || tok.text != "," {
+				return Term{}, 0, fmt.Errorf("expected ',' or ')' in arguments of %s", name)
+			}
+		}
+	}
+
+	if op, ok := r.ops.prefix[name]; ok && r.startsTerm(next) {
+		priority, argMax := op.priority, op.priority-1
+		if op.kind == "fy" {
+			argMax = op.priority
+		}
+		if priority > max {
+			priority, argMax = max, min(argMax, max)
+		}
+		arg, err := r.parse(argMax)
+		if err != nil {
+			return Term{}, 0, err
+		}
+		return Compound(name, []Term{arg}), priority, nil
+	}
+
+	if name == "[]" {
+		return List(nil), 0, nil
+	}
+	return Atom(name), 0, nil
+}
+
+func (r *termReader) list() (Term, int, error) {
+	if next, err := r.peek(); err != nil {
+		return Term{}, 0, err
+	} else if next.kind == tokPunct && next.text == "]" {
+		r.advance()
+		return List(nil), 0, nil
+	}
+
+	var items []Term
+	for {
+		item, err := r.parse(999)
+		if err != nil {
+			return Term{}, 0, err
+		}
+		items = append(items, item)
+
+		tok, err := r.advance()
+		if err != nil {
+			return Term{}, 0, err
+		}
+		switch {
+		case tok.kind == tokPunct && tok.text == ",":
+			continue
+		case tok.kind == tokPunct && tok.text == "|":
+			tail, err := r.parse(999)
+			if err != nil {
+				return Term{}, 0, err
+			}
+			return ListWithTail(items, tail), 0, r.expect("]")
+		case tok.kind == tokPunct && tok.text == "]":
+			return List(items), 0, nil
+		}
+		return Term{}, 0, fmt.Errorf("expected ',', '|' or ']' in list")
+	}
+}
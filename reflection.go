@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// predicateInfo summarises one predicate stored in a session.
+type predicateInfo struct {
+	module    string
+	name      string
+	arity     int
+	facts     int
+	rules     int
+	inherited bool // defined by a parent session
+}
+
+// dynamic reports whether retract/1 can change a predicate: it removes the
+// session's own facts.
+func (p predicateInfo) dynamic() bool {
+	return p.rules == 0 && !p.inherited
+}
+
+func termArity(t Term) int {
+	if t.Type == "compound" {
+		return len(t.Args)
+	}
+	return 0
+}
+
+// indicator returns the Name/Arity term for a predicate, with the name
+// qualified by its module outside user, as M:Name/Arity reads.
+func (p predicateInfo) indicator() Term {
+	return Compound("/", []Term{qualify(p.module, Atom(p.name)), Number(float64(p.arity))})
+}
+
+// sessionPredicates returns the predicates visible in a session, its own or
+// inherited from its parents, user module first, then sorted by module, name
+// and arity.
+func (e *Engine) sessionPredicates(sessionID string) []predicateInfo {
+	index := make(map[string]*predicateInfo)
+	multifile := e.sessionModules(sessionID).multifile
+	var owned map[string]bool // predicates defined by the session being counted
+	count := func(id, query string, isRule bool) {
+		rows, err := e.db.Query(query, id)
+		if err != nil {
+			return
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var module, name string
+			var arity, n int
+			if rows.Scan(&module, &name, &arity, &n) != nil {
+				continue
+			}
+			key := fmt.Sprintf("%s:%s/%d", module, name, arity)
+			info, exists := index[key]
+			if exists && !owned[key] && !multifile[key] {
+				continue // overridden by an earlier session
+			}
+			if !exists {
+				info = &predicateInfo{module: module, name: name, arity: arity, inherited: id != sessionID}
+				index[key] = info
+			}
+			owned[key] = true
+			if isRule {
+				info.rules += n
+			} else {
+				info.facts += n
+			}
+		}
+	}
+	for _, id := range e.sessionLineage(sessionID) {
+		owned = make(map[string]bool)
+		count(id, `SELECT module, predicate, COALESCE(json_array_length(data, '$.args'), 0) AS arity, COUNT(*)
+			FROM facts WHERE session_id = ? GROUP BY module, predicate, arity`, false)
+		count(id, `SELECT module, head_predicate, COALESCE(json_array_length(head_data, '$.args'), 0) AS arity, COUNT(*)
+			FROM rules WHERE session_id = ? GROUP BY module, head_predicate, arity`, true)
+	}
+
+	predicates := make([]predicateInfo, 0, len(index))
+	for _, info := range index {
+		predicates = append(predicates, *info)
+	}
+	sort.Slice(predicates, func(i, j int) bool {
+		if predicates[i].module != predicates[j].module {
+			return predicates[i].module == userModule || (predicates[j].module != userModule && predicates[i].module < predicates[j].module)
+		}
+		if predicates[i].name != predicates[j].name {
+			return predicates[i].name < predicates[j].name
+		}
+		return predicates[i].arity < predicates[j].arity
+	})
+	return predicates
+}
+
+// sessionClauses returns the visible clauses of Name/Arity in module, facts
+// first, with facts represented as rules with an empty body.
+func (e *Engine) sessionClauses(module, name string, arity int, sessionID string) []Rule {
+	goal := Atom(name)
+	if arity > 0 {
+		goal = Compound(name, e.freshList(arity).Args)
+	}
+	facts, rules := e.visibleClauses(goal, module, sessionID)
+	clauses := make([]Rule, 0, len(facts)+len(rules))
+	for _, fact := range facts {
+		clauses = append(clauses, Rule{ID: fact.ID, SessionID: fact.SessionID, Head: fact.Predicate})
+	}
+	return append(clauses, rules...)
+}
+
+// conjunction folds goals into a single ','/2 term, or true when empty.
+func conjunction(goals []Term) Term {
+	switch len(goals) {
+	case 0:
+		return Atom("true")
+	case 1:
+		return goals[0]
+	}
+	return Compound(",", []Term{goals[0], conjunction(goals[1:])})
+}
+
+// matchingPredicates returns the stored predicates matching a listing
+// specification: a Name, or a Name/Arity indicator that may be partially
+// unbound.
+func (e *Engine) matchingPredicates(spec Term, subst Substitution, sessionID string) []predicateInfo {
+	spec = e.deref(spec, subst)
+	var matches []predicateInfo
+	for _, p := range e.sessionPredicates(sessionID) {
+		if spec.Type == "atom" {
+			if spec.Value == p.name {
+				matches = append(matches, p)
+			}
+		} else if _, ok := e.unify(spec, p.indicator(), subst); ok {
+			matches = append(matches, p)
+		}
+	}
+	return matches
+}
+
+// handleReflection implements clause/2, current_predicate/1,
+// predicate_property/2 and listing/0,1 over the session's stored clauses.
+func (e *Engine) handleReflection(goal Term, subst Substitution, sessionID string) ([]Substitution, bool) {
+	args := goal.Args
+	results := []Substitution{}
+
+	switch {
+	case goal.Value == "clause" && len(args) == 2:
+		module, head := splitModule(e.instantiate(args[0], subst))
+		if head.Type != "atom" && head.Type != "compound" {
+			return results, true
+		}
+		for _, clause := range e.sessionClauses(module, e.extractPredicate(head), termArity(head), sessionID) {
+			renamed := e.renameVars(clause)
+			if s1, ok := e.unify(head, renamed.Head, subst); ok {
+				if s2, ok := e.unify(args[1], conjunction(renamed.Body), s1); ok {
+					results = append(results, s2)
+				}
+			}
+		}
+
+	case goal.Value == "current_predicate" && len(args) == 1:
+		for _, p := range e.sessionPredicates(sessionID) {
+			if newSubst, ok := e.unify(args[0], p.indicator(), subst); ok {
+				results = append(results, newSubst)
+			}
+		}
+
+	case goal.Value == "predicate_property" && len(args) == 2:
+		head := e.deref(args[0], subst)
+		module, plain := splitModule(head)
+		materialized := e.materializedGoals(sessionID)
+		for _, p := range e.sessionPredicates(sessionID) {
+			template := Atom(p.name)
+			if p.arity > 0 {
+				template = Compound(p.name, e.freshList(p.arity).Args)
+			}
+			template = qualify(p.module, template)
+			if head.Type != "variable" && (module != p.module || e.extractPredicate(plain) != p.name || termArity(plain) != p.arity) {
+				continue
+			}
+			s1, ok := e.unify(head, template, subst)
+			if !ok {
+				continue
+			}
+			properties := []Term{
+				Atom("defined"),
+				Compound("number_of_clauses", []Term{Number(float64(p.facts + p.rules))}),
+			}
+			if p.dynamic() {
+				properties = append(properties, Atom("dynamic"))
+			}
+			// Materialized predicates answer calls from their stored extension
+			key := indicatorKey(p.name, p.arity)
+			if p.module != userModule {
+				key = p.module + ":" + key
+			}
+			if _, ok := materialized[key]; ok {
+				properties = append(properties, Atom("tabled"))
+			}
+			for _, property := range properties {
+				if s2, ok := e.unify(args[1], property, s1); ok {
+					results = append(results, s2)
+				}
+			}
+		}
+
+	case goal.Value == "listing" && len(args) <= 1:
+		predicates := e.sessionPredicates(sessionID)
+		if len(args) == 1 {
+			predicates = e.matchingPredicates(args[0], subst, sessionID)
+		}
+		ops := e.sessionOps(sessionID)
+		text := ""
+		for _, p := range predicates {
+			if p.dynamic() {
+				text += fmt.Sprintf(":- dynamic %s.\n\n", ops.format(p.indicator(), true))
+			}
+			for _, clause := range e.sessionClauses(p.module, p.name, p.arity, sessionID) {
+				text += ops.portrayClause(qualify(p.module, clause.Head), clause.Body)
+			}
+			text += "\n"
+		}
+		return []Substitution{e.emit(subst, text)}, true
+	}
+
+	return results, true
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func setupFamily(t *testing.T, engine *Engine, sessionID string) {
+	for _, child := range []string{"bob", "liz"} {
+		if err := engine.AddFact(Fact{SessionID: sessionID, Predicate: Compound("parent", []Term{Atom("tom"), Atom(child)})}); err != nil {
+			t.Fatalf("Failed to add fact: %v", err)
+		}
+	}
+	engine.AddFact(Fact{SessionID: sessionID, Predicate: Compound("parent", []Term{Atom("bob"), Atom("ann")})})
+	err := engine.AddRule(Rule{
+		SessionID: sessionID,
+		Head:      Compound("grandparent", []Term{Variable("X"), Variable("Z")}),
+		Body: []Term{
+			Compound("parent", []Term{Variable("X"), Variable("Y")}),
+			Compound("parent", []Term{Variable("Y"), Variable("Z")}),
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to add rule: %v", err)
+	}
+}
+
+func TestClauseAndMetaInterpreter(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+	setupFamily(t, engine, sessionID)
+
+	solutions := queryAll(engine, sessionID, Compound("clause", []Term{Compound("grandparent", []Term{Variable("A"), Variable("B")}), Variable("Body")}))
+	if len(solutions) != 1 || solutions[0].Bindings["Body"].Value != "," {
+		t.Fatalf("Expected one rule body as a conjunction, got %v", solutions)
+	}
+
+	solutions = queryAll(engine, sessionID, Compound("clause", []Term{Compound("parent", []Term{Atom("tom"), Variable("C")}), Variable("Body")}))
+	if len(solutions) != 2 || solutions[0].Bindings["Body"].Value != "true" {
+		t.Errorf("Expected two facts with body true, got %v", solutions)
+	}
+
+	// A vanilla meta-interpreter built on clause/2
+	meta := []Rule{
+		{Head: Compound("prove", []Term{Atom("true")}), Body: []Term{}},
+		{
+			Head: Compound("prove", []Term{Compound(",", []Term{Variable("A"), Variable("B")})}),
+			Body: []Term{Compound("prove", []Term{Variable("A")}), Compound("prove", []Term{Variable("B")})},
+		},
+		{
+			Head: Compound("prove", []Term{Variable("H")}),
+			Body: []Term{Compound("clause", []Term{Variable("H"), Variable("B")}), Compound("prove", []Term{Variable("B")})},
+		},
+	}
+	for _, r := range meta {
+		r.SessionID = sessionID
+		engine.AddRule(r)
+	}
+
+	solutions = queryAll(engine, sessionID, Compound("prove", []Term{Compound("grandparent", []Term{Atom("tom"), Variable("W")})}))
+	if len(solutions) != 1 || solutions[0].Bindings["W"].Value != "ann" {
+		t.Errorf("Expected the meta-interpreter to prove grandparent(tom, ann), got %v", solutions)
+	}
+}
+
+func TestCurrentPredicateAndProperties(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+	setupFamily(t, engine, sessionID)
+
+	solutions := queryAll(engine, sessionID, Compound("current_predicate", []Term{Compound("/", []Term{Variable("N"), Variable("A")})}))
+	if len(solutions) != 2 || solutions[0].Bindings["N"].Value != "grandparent" || solutions[1].Bindings["A"].Value != 2.0 {
+		t.Errorf("Expected grandparent/2 and parent/2, got %v", solutions)
+	}
+
+	solutions = queryAll(engine, sessionID, Compound("predicate_property", []Term{
+		Compound("parent", []Term{Variable("X"), Variable("Y")}),
+		Compound("number_of_clauses", []Term{Variable("N")}),
+	}))
+	if len(solutions) != 1 || solutions[0].Bindings["N"].Value != 3.0 {
+		t.Errorf("Expected parent/2 to have 3 clauses, got %v", solutions)
+	}
+
+	// Only properties that hold are reported: facts can be retracted, rules
+	// cannot, and only materialized predicates are tabled
+	properties := func(name string) []string {
+		var names []string
+		for _, sol := range queryAll(engine, sessionID, Compound("predicate_property", []Term{Compound(name, []Term{Variable("X"), Variable("Y")}), Variable("P")})) {
+			if p := sol.Bindings["P"]; p.Type == "atom" {
+				names = append(names, p.Value.(string))
+			}
+		}
+		return names
+	}
+	if got := properties("parent"); !reflect.DeepEqual(got, []string{"defined", "dynamic"}) {
+		t.Errorf("Expected parent/2 to be defined and dynamic, got %v", got)
+	}
+	if len(queryAll(engine, sessionID, Compound("predicate_property", []Term{
+		Compound("parent", []Term{Variable("X"), Variable("Y")}), Atom("tabled"),
+	}))) != 0 {
+		t.Error("Expected a fact predicate not to be tabled")
+	}
+	if got := properties("grandparent"); !reflect.DeepEqual(got, []string{"defined"}) {
+		t.Errorf("Expected grandparent/2 to be defined only, got %v", got)
+	}
+	queryAll(engine, sessionID, Compound("materialize", []Term{Compound("/", []Term{Atom("grandparent"), Number(2)})}))
+	if got := properties("grandparent"); !reflect.DeepEqual(got, []string{"defined", "tabled"}) {
+		t.Errorf("Expected materialized grandparent/2 to be tabled, got %v", got)
+	}
+
+	if len(queryAll(engine, sessionID, Compound("predicate_property", []Term{Atom("unknown"), Atom("defined")}))) != 0 {
+		t.Error("Expected unknown/0 not to be defined")
+	}
+}
+
+func TestListing(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+	setupFamily(t, engine, sessionID)
+
+	solutions := queryAll(engine, sessionID, Compound("listing", []Term{Atom("grandparent")}))
+	if len(solutions) != 1 {
+		t.Fatalf("Expected listing/1 to succeed once, got %d", len(solutions))
+	}
+	// Only predicates predicate_property/2 reports as dynamic are declared so
+	expected := "grandparent(X, Z) :-\n    parent(X, Y),\n    parent(Y, Z).\n\n"
+	if solutions[0].Output != expected {
+		t.Errorf("Unexpected listing:\n%s", solutions[0].Output)
+	}
+
+	solutions = queryAll(engine, sessionID, Compound("listing", []Term{Compound("/", []Term{Atom("parent"), Number(2)})}))
+	if len(solutions) != 1 || !strings.HasPrefix(solutions[0].Output, ":- dynamic parent/2.\n\nparent(tom, bob).\n") {
+		t.Errorf("Expected parent/2 to be listed as dynamic, got %v", solutions)
+	}
+
+	solutions = queryAll(engine, sessionID, Atom("listing"))
+	if len(solutions) != 1 || !strings.Contains(solutions[0].Output, "parent(tom, bob).\n") {
+		t.Errorf("Expected listing/0 to include parent facts, got %v", solutions)
+	}
+}
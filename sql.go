@@ -0,0 +1,309 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// SQL compilation. A query run with "evaluation": "sql" answers each call
+// of a rule-defined predicate inside SQLite when it can: every rule body
+// must be a conjunction of calls to predicates made of ground facts and
+// dif/2, plus at most one call of the predicate itself, with constants and
+// variables as arguments, and the predicate's own facts must be ground.
+// The rules become one SQL query joining the facts table with itself, and
+// a recursive call makes it a WITH RECURSIVE common table expression. Arguments the call binds are filtered inside the recursion
+// when every recursive rule passes them on unchanged. Answers come back as
+// a set, without the duplicates the resolver returns for several
+// derivations. Anything else is resolved as usual.
+
+// sqlRelation names the common table expression of a compiled predicate.
+const sqlRelation = "answers"
+
+func compilingSQL(subst Substitution) bool {
+	return contextOf(subst).sql
+}
+
+// sqlQuery is SQL text with its parameters.
+type sqlQuery struct {
+	text strings.Builder
+	args []interface{}
+}
+
+func (q *sqlQuery) param(t Term) string {
+	data, _ := json.Marshal(t)
+	q.args = append(q.args, string(data))
+	return "json(?)"
+}
+
+// solveSQL returns the instances of goal called from module that the
+// compiled rules of its predicate derive, reporting false when they do not
+// compile.
+func (e *Engine) solveSQL(goal Term, module, sessionID string) ([]Term, bool) {
+	query, ok := e.compileSQL(goal, module, sessionID)
+	if !ok {
+		return nil, false
+	}
+	rows, err := e.db.Query(query.text.String(), query.args...)
+	if err != nil {
+		return nil, false
+	}
+	defer rows.Close()
+
+	var answers []Term
+	columns := make([]string, len(goal.Args))
+	pointers := make([]interface{}, len(goal.Args))
+	for i := range columns {
+		pointers[i] = &columns[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, false
+		}
+		args := make([]Term, len(columns))
+		for i, column := range columns {
+			if err := json.Unmarshal([]byte(column), &args[i]); err != nil {
+				return nil, false
+			}
+		}
+		answers = append(answers, Compound(goal.Value.(string), args))
+	}
+	return answers, rows.Err() == nil
+}
+
+// compileSQL translates the rules of goal's predicate in module to a query
+// returning its answers for the constants goal passes.
+func (e *Engine) compileSQL(goal Term, module, sessionID string) (*sqlQuery, bool) {
+	if goal.Type != "compound" {
+		return nil, false
+	}
+	for _, arg := range goal.Args {
+		if arg.Type != "variable" && !datalogConstant(arg) {
+			return nil, false
+		}
+	}
+	// Facts are joined as constants, so facts with variables are left to
+	// the resolver
+	sessions, rules, ground := e.predicateSources(goal, module, sessionID)
+	if len(rules) == 0 || !ground {
+		return nil, false
+	}
+
+	// Compile the stored facts and the rules without a recursive call
+	// first, as WITH RECURSIVE requires
+	var base, recursive []*sqlSelect
+	if len(sessions) > 0 {
+		base = append(base, factsSelect(goal, module, sessions))
+	}
+	invariant := make([]bool, len(goal.Args))
+	for i := range invariant {
+		invariant[i] = true
+	}
+	for _, rule := range rules {
+		sel, ok := e.ruleSelect(rule, goal, module, sessionID)
+		if !ok {
+			return nil, false
+		}
+		if sel.recursive == nil {
+			base = append(base, sel)
+			continue
+		}
+		recursive = append(recursive, sel)
+		for i, arg := range rule.Head.Args {
+			passed := sel.recursive.Args[i]
+			invariant[i] = invariant[i] && arg.Type == "variable" && passed.Type == "variable" && passed.Value == arg.Value
+		}
+	}
+	if len(base) == 0 {
+		return nil, false
+	}
+
+	query := &sqlQuery{}
+	columns := make([]string, len(goal.Args))
+	for i := range columns {
+		columns[i] = fmt.Sprintf("c%d", i)
+	}
+	fmt.Fprintf(&query.text, "WITH RECURSIVE %s(%s) AS (", sqlRelation, strings.Join(columns, ", "))
+	for i, sel := range append(base, recursive...) {
+		if i > 0 {
+			query.text.WriteString(" UNION ")
+		}
+		for j, arg := range goal.Args {
+			if arg.Type != "variable" && invariant[j] {
+				column := sel.columns[j]
+				if constant, ok := sel.constants[j]; ok {
+					column = sel.param(constant) // the column's own parameter is already taken
+				}
+				sel.where = append(sel.where, column+" = "+sel.param(arg))
+			}
+		}
+		sel.writeTo(query)
+	}
+	fmt.Fprintf(&query.text, ") SELECT %s FROM %s", strings.Join(columns, ", "), sqlRelation)
+	var filters []string
+	for i, arg := range goal.Args {
+		if arg.Type != "variable" {
+			filters = append(filters, columns[i]+" = "+query.param(arg))
+		}
+	}
+	if len(filters) > 0 {
+		query.text.WriteString(" WHERE " + strings.Join(filters, " AND "))
+	}
+	return query, true
+}
+
+// sqlSelect is one branch of a compiled predicate.
+type sqlSelect struct {
+	sqlQuery            // the conditions and their parameters
+	columns    []string // the expressions of the head arguments
+	columnArgs []interface{}
+	constants  map[int]Term // the constant head arguments, by position
+	from       []string
+	where      []string
+	recursive  *Term // the recursive call, if any
+}
+
+func (s *sqlSelect) writeTo(query *sqlQuery) {
+	fmt.Fprintf(&query.text, "SELECT %s FROM %s", strings.Join(s.columns, ", "), strings.Join(s.from, ", "))
+	if len(s.where) > 0 {
+		query.text.WriteString(" WHERE " + strings.Join(s.where, " AND "))
+	}
+	query.args = append(query.args, s.columnArgs...)
+	query.args = append(query.args, s.args...)
+}
+
+// factsSelect returns the stored facts of goal's predicate.
+func factsSelect(goal Term, module string, sessions []string) *sqlSelect {
+	sel := &sqlSelect{from: []string{"facts AS f"}}
+	sel.where = sel.factConditions("f", goal, module, sessions)
+	for i := range goal.Args {
+		sel.columns = append(sel.columns, argColumn("f", i))
+	}
+	return sel
+}
+
+// factConditions selects the facts of goal's predicate among the rows of
+// the facts table named alias.
+func (s *sqlSelect) factConditions(alias string, goal Term, module string, sessions []string) []string {
+	s.args = append(s.args, goal.Value.(string), module)
+	for _, session := range sessions {
+		s.args = append(s.args, session)
+	}
+	s.args = append(s.args, len(goal.Args))
+	return []string{
+		alias + ".predicate = ?", alias + ".module = ?",
+		alias + ".session_id IN (?" + strings.Repeat(", ?", len(sessions)-1) + ")",
+		"json_array_length(" + alias + ".data, '$.args') = ?",
+	}
+}
+
+func argColumn(alias string, i int) string {
+	return fmt.Sprintf("json_extract(%s.data, '$.args[%d]')", alias, i)
+}
+
+// ruleSelect compiles rule of goal's predicate in module, reporting false
+// when its body is not a join of fact-only predicates.
+func (e *Engine) ruleSelect(rule Rule, goal Term, module, sessionID string) (*sqlSelect, bool) {
+	sel := &sqlSelect{}
+	vars := make(map[string]string)
+	var difs [][]Term
+
+	// bind joins an argument with the expression it is read from
+	bind := func(arg Term, column string) bool {
+		switch {
+		case arg.Type == "variable":
+			if bound, ok := vars[arg.Value.(string)]; ok {
+				sel.where = append(sel.where, column+" = "+bound)
+			} else {
+				vars[arg.Value.(string)] = column
+			}
+		case datalogConstant(arg):
+			sel.where = append(sel.where, column+" = "+sel.param(arg))
+		default:
+			return false
+		}
+		return true
+	}
+
+	for _, bodyGoal := range rule.Body {
+		for _, call := range flattenConjunction(bodyGoal) {
+			callModule, call := splitModule(call)
+			if callModule == userModule {
+				callModule = module
+			}
+			if call.Type != "compound" || call.Value == ":" || goalPositions[indicatorKey(call.Value.(string), len(call.Args))] != nil {
+				return nil, false
+			}
+			if call.Value == "dif" && len(call.Args) == 2 {
+				difs = append(difs, call.Args)
+				continue
+			}
+			if e.isBuiltin(call, sessionID) {
+				return nil, false
+			}
+
+			alias := fmt.Sprintf("t%d", len(sel.from))
+			resolved := e.resolveModule(sessionID, callModule, call)
+			columns := make([]string, len(call.Args))
+			if resolved == module && call.Value == goal.Value && len(call.Args) == len(goal.Args) {
+				if sel.recursive != nil {
+					return nil, false // only linear recursion compiles
+				}
+				recursiveCall := call
+				sel.recursive = &recursiveCall
+				sel.from = append(sel.from, sqlRelation+" AS "+alias)
+				for i := range columns {
+					columns[i] = fmt.Sprintf("%s.c%d", alias, i)
+				}
+			} else {
+				sessions, rules, ground := e.predicateSources(call, resolved, sessionID)
+				if len(rules) > 0 || len(sessions) == 0 || !ground {
+					return nil, false
+				}
+				sel.from = append(sel.from, "facts AS "+alias)
+				sel.where = append(sel.where, sel.factConditions(alias, call, resolved, sessions)...)
+				for i := range columns {
+					columns[i] = argColumn(alias, i)
+				}
+			}
+			for i, arg := range call.Args {
+				if !bind(arg, columns[i]) {
+					return nil, false
+				}
+			}
+		}
+	}
+
+	for _, dif := range difs {
+		sides := make([]string, 2)
+		for i, arg := range dif {
+			switch {
+			case arg.Type == "variable" && vars[arg.Value.(string)] != "":
+				sides[i] = vars[arg.Value.(string)]
+			case datalogConstant(arg):
+				sides[i] = sel.param(arg)
+			default:
+				return nil, false
+			}
+		}
+		sel.where = append(sel.where, sides[0]+" <> "+sides[1])
+	}
+	if len(sel.from) == 0 {
+		return nil, false
+	}
+	sel.constants = make(map[int]Term)
+	for i, arg := range rule.Head.Args {
+		switch {
+		case arg.Type == "variable" && vars[arg.Value.(string)] != "":
+			sel.columns = append(sel.columns, vars[arg.Value.(string)])
+		case datalogConstant(arg):
+			data, _ := json.Marshal(arg)
+			sel.columns = append(sel.columns, "json(?)")
+			sel.columnArgs = append(sel.columnArgs, string(data))
+			sel.constants[i] = arg
+		default:
+			return nil, false
+		}
+	}
+	return sel, true
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSQLEvaluation(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+	if _, err := engine.Consult(sessionID, graphSource+familySource+`
+path(a, e).
+hop(X, Y) :- edge(X, Z), edge(Z, Y), dif(X, Y).
+loud(X) :- node(X), write(X).
+`); err != nil {
+		t.Fatalf("Consult failed: %v", err)
+	}
+
+	// Left recursion over a cycle terminates inside SQLite, and the stored
+	// path(a, e) leads on to f
+	goals, _ := engine.ParseQuery(sessionID, "path(a, Y)")
+	result := engine.Query(Query{Goals: goals, Evaluation: "sql"}, sessionID)
+	if values := solutionValues(result, "Y"); !reflect.DeepEqual(values, []string{"a", "b", "c", "d", "e", "f"}) {
+		t.Errorf("Expected a to reach every node, got %v", values)
+	}
+	goals, _ = engine.ParseQuery(sessionID, "path(a, X), \\+ edge(X, _)")
+	result = engine.Query(Query{Goals: goals, Evaluation: "sql"}, sessionID)
+	if values := solutionValues(result, "X"); !reflect.DeepEqual(values, []string{"d", "f"}) {
+		t.Errorf("Expected the sinks d and f, got %v", values)
+	}
+
+	// Rules that do not compile are resolved
+	goals, _ = engine.ParseQuery(sessionID, "loud(Z)")
+	result = engine.Query(Query{Goals: goals, Evaluation: "sql"}, sessionID)
+	if len(result.Solutions) != 6 || result.Solutions[5].Output != "f" {
+		t.Errorf("Expected the resolver to write each node, got %+v", result.Solutions)
+	}
+
+	// Non-recursive joins give the resolver's answers
+	for _, text := range []string{"grandparent(ann, W)", "hop(X, Y)", "sibling(X, Y)"} {
+		goals, _ = engine.ParseQuery(sessionID, text)
+		resolved := engine.Query(Query{Goals: goals}, sessionID)
+		compiled := engine.Query(Query{Goals: goals, Evaluation: "sql"}, sessionID)
+		if !reflect.DeepEqual(resolved.Solutions, compiled.Solutions) {
+			t.Errorf("Expected %s to give %+v, got %+v", text, resolved.Solutions, compiled.Solutions)
+		}
+	}
+}
+
+func TestSQLEvaluationNonGroundFacts(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+	if _, err := engine.Consult(sessionID, `
+likes(X, X).
+likes(ann, tom).
+self(X) :- likes(X, bob).
+near(X, X).
+near(X, Y) :- likes(X, Y).
+`); err != nil {
+		t.Fatalf("Consult failed: %v", err)
+	}
+
+	// Facts with variables are left to the resolver, whether they are
+	// joined in a rule body or stored for the called predicate
+	for _, text := range []string{"self(X)", "near(bob, Y)"} {
+		goals, _ := engine.ParseQuery(sessionID, text)
+		if _, ok := engine.compileSQL(goals[0], userModule, sessionID); ok {
+			t.Errorf("Expected %s not to compile", text)
+		}
+		resolved := engine.Query(Query{Goals: goals}, sessionID)
+		compiled := engine.Query(Query{Goals: goals, Evaluation: "sql"}, sessionID)
+		if !resolved.Solutions[0].Success || !reflect.DeepEqual(resolved.Solutions, compiled.Solutions) {
+			t.Errorf("Expected %s to give %+v, got %+v", text, resolved.Solutions, compiled.Solutions)
+		}
+	}
+}
+
+func TestCompileSQL(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+	engine.Consult(sessionID, graphSource+"shout(X) :- node(X), write(X).\nreach(X, Y) :- reach(X, Z), reach(Z, Y).\nreach(X, Y) :- edge(X, Y).\n")
+
+	// The bound first argument is filtered inside the recursion too
+	goals, _ := engine.ParseQuery(sessionID, "path(a, Y)")
+	query, ok := engine.compileSQL(goals[0], userModule, sessionID)
+	if !ok || !strings.HasPrefix(query.text.String(), "WITH RECURSIVE answers(c0, c1) AS (") ||
+		strings.Count(query.text.String(), "= json(?)") != 3 || len(query.args) != 11 {
+		t.Fatalf("Expected a recursive query filtering on a three times, got %v", query)
+	}
+
+	for _, text := range []string{"shout(X)", "reach(a, Y)", "edge(a, Y)"} {
+		goals, _ = engine.ParseQuery(sessionID, text)
+		if _, ok := engine.compileSQL(goals[0], userModule, sessionID); ok {
+			t.Errorf("Expected %s not to compile", text)
+		}
+	}
+
+	// Constant head arguments compared with the call's constants keep the
+	// parameters in step with the placeholders
+	engine.Consult(sessionID, "tag(a, X) :- edge(X, _).\ntag(b, X) :- node(X).\n")
+	goals, _ = engine.ParseQuery(sessionID, "tag(a, X)")
+	query, ok = engine.compileSQL(goals[0], userModule, sessionID)
+	if !ok || strings.Count(query.text.String(), "?") != len(query.args) {
+		t.Fatalf("Expected a parameter for each placeholder, got %d for %s", len(query.args), query.text.String())
+	}
+	result := engine.Query(Query{Goals: goals, Evaluation: "sql"}, sessionID)
+	if values := solutionValues(result, "X"); !reflect.DeepEqual(values, []string{"a", "b", "c", "e"}) {
+		t.Errorf("Expected the nodes with edges, got %v (%s)", values, result.Error)
+	}
+
+	goals, _ = engine.ParseQuery(sessionID, "path(X, Y)")
+	plan := engine.ExplainQuery(Query{Goals: goals}, sessionID)
+	if path := findPredicatePlan(plan, "path/2"); path == nil || !strings.Contains(path.SQL, "FROM answers AS t0, facts AS t1") {
+		t.Errorf("Expected the plan to show the compiled query, got %+v", path)
+	}
+}
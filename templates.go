@@ -851,69 +851,30 @@ function executePrologInput(input) {
         const cleanQuery = queryStr.endsWith('.') ? queryStr.slice(0, -1) : queryStr;
         executeQuery(cleanQuery);
     } else if (trimmed.endsWith('.')) {
-        // It's a fact or rule
-        if (trimmed.includes(':-')) {
-            addRule(trimmed);
-        } else {
-            addFact(trimmed);
-        }
+        // Facts, rules and directives are read by the server, which knows
+        // the session's operators
+        consultText(trimmed);
     } else {
         // No period, assume it's a query
         executeQuery(trimmed);
     }
 }
 
-function addFact(factStr) {
-    const fact = parseFact(factStr.slice(0, -1));
-    
-    fetch('/api/v1/sessions/' + currentSession.id + '/facts', {
+function consultText(text) {
+    fetch('/api/v1/sessions/' + currentSession.id + '/consult', {
         method: 'POST',
         headers: getHeaders(),
-        body: JSON.stringify({ predicate: fact })
+        body: JSON.stringify({ text: text })
     })
     .then(response => response.json())
     .then(data => {
         if (data.error) {
             appendToTerminal('<span class="error">Error: ' + data.error + '</span><br>');
+        } else if (data.directives > 0) {
+            (data.warnings || []).forEach(w => appendToTerminal('<span class="warning">Warning: ' + escapeOutput(w) + '</span><br>'));
+            appendToTerminal('<span class="success">Directive executed.</span><br>');
         } else {
-            appendToTerminal('<span class="success">Fact added.</span><br>');
-        }
-        appendToTerminal('<span class="prompt">?- </span>');
-    })
-    .catch(error => {
-        console.error('Fetch error:', error);
-        appendToTerminal('<span class="error">Error: ' + error.message + ' (Check console for details)</span><br>');
-        appendToTerminal('<span class="prompt">?- </span>');
-    });
-}
-
-function addRule(ruleStr) {
-    const parts = ruleStr.slice(0, -1).split(':-');
-    if (parts.length !== 2) {
-        appendToTerminal('<span class="error">Invalid rule format</span><br>');
-        appendToTerminal('<span class="prompt">?- </span>');
-        return;
-    }
-    
-    const head = parseTerm(parts[0].trim());
-    const bodyTerms = parseGoals(parts[1].trim());
-    
-    const rule = {
-        head: head,
-        body: bodyTerms
-    };
-    
-    fetch('/api/v1/sessions/' + currentSession.id + '/rules', {
-        method: 'POST',
-        headers: getHeaders(),
-        body: JSON.stringify(rule)
-    })
-    .then(response => response.json())
-    .then(data => {
-        if (data.error) {
-            appendToTerminal('<span class="error">Error: ' + data.error + '</span><br>');
-        } else {
-            appendToTerminal('<span class="success">Rule added.</span><br>');
+            appendToTerminal('<span class="success">Clause added.</span><br>');
         }
         appendToTerminal('<span class="prompt">?- </span>');
     })
@@ -925,10 +886,7 @@ function addRule(ruleStr) {
 }
 
 function executeQuery(queryStr) {
-    // Parse goals properly, respecting parentheses
-    const goals = parseGoals(queryStr);
-    
-    const query = { goals: goals };
+    const query = { text: queryStr };
     
     fetch('/api/v1/sessions/' + currentSession.id + '/query', {
         method: 'POST',
@@ -961,6 +919,9 @@ function displayQueryResults(solutions) {
     solutions.forEach((solution, index) => {
         if (solution.success) {
             successCount++;
+            if (solution.output) {
+                appendToTerminal('<span class="output">' + escapeOutput(solution.output) + '</span>');
+            }
             if (solution.bindings && Object.keys(solution.bindings).length > 0) {
                 appendToTerminal('<span class="success">Solution ' + successCount + ':</span><br>');
                 for (const variable in solution.bindings) {
@@ -970,6 +931,9 @@ function displayQueryResults(solutions) {
             } else {
                 appendToTerminal('<span class="success">Yes (' + successCount + ')</span><br>');
             }
+            if (solution.residuals) {
+                solution.residuals.forEach(goal => appendToTerminal('  ' + formatTerm(goal) + '<br>'));
+            }
         }
     });
     
@@ -980,92 +944,8 @@ function displayQueryResults(solutions) {
     }
 }
 
-function parseTerm(str) {
-    str = str.trim();
-    
-    if (/^[A-Z_][a-zA-Z0-9_]*$/.test(str)) {
-        return { type: 'variable', value: str };
-    }
-    
-    if (/^-?\d+(\.\d+)?$/.test(str)) {
-        return { type: 'number', value: parseFloat(str) };
-    }
-    
-    // First try to match operators like =, <, >, etc.
-    const operatorMatch = str.match(/^([=<>!@#$%^&*+\-\/\\]+)\((.*)\)$/);
-    if (operatorMatch) {
-        const functor = operatorMatch[1];
-        const argsStr = operatorMatch[2];
-        const args = parseArgs(argsStr);
-        return { type: 'compound', value: functor, args: args };
-    }
-    
-    // Then try regular functors
-    const match = str.match(/^([a-z][a-zA-Z0-9_]*)\((.*)\)$/);
-    if (match) {
-        const functor = match[1];
-        const argsStr = match[2];
-        const args = parseArgs(argsStr);
-        return { type: 'compound', value: functor, args: args };
-    }
-    
-    return { type: 'atom', value: str };
-}
-
-function parseArgs(argsStr) {
-    if (!argsStr.trim()) return [];
-    
-    const args = [];
-    let current = '';
-    let parenLevel = 0;
-    
-    for (let i = 0; i < argsStr.length; i++) {
-        const char = argsStr[i];
-        if (char === ',' && parenLevel === 0) {
-            args.push(parseTerm(current.trim()));
-            current = '';
-        } else {
-            if (char === '(') parenLevel++;
-            if (char === ')') parenLevel--;
-            current += char;
-        }
-    }
-    
-    if (current.trim()) {
-        args.push(parseTerm(current.trim()));
-    }
-    
-    return args;
-}
-
-function parseGoals(goalsStr) {
-    if (!goalsStr.trim()) return [];
-    
-    const goals = [];
-    let current = '';
-    let parenLevel = 0;
-    
-    for (let i = 0; i < goalsStr.length; i++) {
-        const char = goalsStr[i];
-        if (char === ',' && parenLevel === 0) {
-            goals.push(parseTerm(current.trim()));
-            current = '';
-        } else {
-            if (char === '(') parenLevel++;
-            if (char === ')') parenLevel--;
-            current += char;
-        }
-    }
-    
-    if (current.trim()) {
-        goals.push(parseTerm(current.trim()));
-    }
-    
-    return goals;
-}
-
-function parseFact(str) {
-    return parseTerm(str);
+function escapeOutput(text) {
+    return text.replace(/&/g, '&amp;').replace(/</g, '&lt;').replace(/>/g, '&gt;');
 }
 
 function formatTerm(term) {
@@ -1081,6 +961,13 @@ function formatTerm(term) {
         case 'compound':
             const args = term.args ? term.args.map(formatTerm).join(', ') : '';
             return term.value + '(' + args + ')';
+        case 'list':
+            const items = term.args ? term.args.map(formatTerm) : [];
+            if (term.value === '|') {
+                const tail = items.pop();
+                return '[' + items.join(', ') + '|' + tail + ']';
+            }
+            return '[' + items.join(', ') + ']';
         default:
             return JSON.stringify(term);
     }
@@ -1102,7 +989,22 @@ function showHelp() {
         '  ?- count(_, parent(X,Y), N)    - Count parent relationships<br><br>' +
         '<span class="success">Built-ins:</span><br>' +
         '  =(X, value), atom(X), var(X), number(X)<br>' +
-        '  now(X), count(..), sum(..), max(..), min(..)<br><br>');
+        '  now(X), count(..), sum(..), max(..), min(..)<br>' +
+        '  aggregate_all(Spec, Goal, R), aggregate(Spec, Goal, R)<br>' +
+        '  call(G, ...), findall(T, G, L), \\+ G, (C -> T ; E)<br>' +
+        '  append/3, member/2, length/2, maplist/2..5, foldl/4..6<br>' +
+        '  clause(H, B), current_predicate(N/A), predicate_property(H, P), listing(N)<br>' +
+        '  write(T), writeln(T), nl, format(F, Args), term_to_atom(T, A)<br>' +
+        '  dif(X, Y), freeze(X, G), when(Cond, G)<br>' +
+        '  X in 1..9, X #= Y + 1, all_different(Vs), label(Vs)<br>' +
+        '  phrase(Grammar, List), phrase(Grammar, List, Rest)<br>' +
+        '  :- op(700, xfx, likes).  current_op(P, T, Name)<br>' +
+        '  term_expansion(Clause, Expanded), goal_expansion(Goal, Expanded)<br>' +
+        '  :- module(m, [p/1]).  m:Goal, use_module(m), use_module(m, [p/1])<br>' +
+        '  :- multifile(p/1).  (extend p/1 inherited from a parent session)<br>' +
+        '  session(catalog):price(X, P)  (query another session)<br>' +
+        '  trace, notrace, spy(p/1), nospy(p/1)  (trace the next queries)<br>' +
+        '  materialize(p/1), retract(Fact)  (store a Datalog predicate, remove a fact)<br><br>');
     appendToTerminal('<span class="prompt">?- </span>');
 }
 
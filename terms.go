@@ -0,0 +1,158 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// emptyListAtom normalises the atom [] to the empty list term.
+func emptyListAtom(t Term) Term {
+	if t.Type == "atom" && t.Value == "[]" {
+		return List(nil)
+	}
+	return t
+}
+
+// splitList returns the head and tail of a non-empty list term.
+func splitList(t Term) (Term, Term, bool) {
+	if t.Type != "list" || len(t.Args) == 0 {
+		return Term{}, Term{}, false
+	}
+	if t.Value == listTailMarker {
+		items, tail := t.Args[:len(t.Args)-1], t.Args[len(t.Args)-1]
+		return items[0], ListWithTail(items[1:], tail), true
+	}
+	return t.Args[0], List(t.Args[1:]), true
+}
+
+func (e *Engine) unifyLists(t1, t2 Term, subst Substitution) (Substitution, bool) {
+	t1, t2 = emptyListAtom(t1), emptyListAtom(t2)
+	if t1.Type != "list" || t2.Type != "list" {
+		return subst, false
+	}
+
+	h1, tail1, ok1 := splitList(t1)
+	h2, tail2, ok2 := splitList(t2)
+	if !ok1 || !ok2 {
+		// Only two empty lists unify
+		return subst, ok1 == ok2
+	}
+
+	var ok bool
+	if subst, ok = e.unify(h1, h2, subst); !ok {
+		return subst, false
+	}
+	return e.unify(tail1, tail2, subst)
+}
+
+// listElements dereferences term and returns its elements if it is a proper
+// list, following bound tails of partial lists.
+func (e *Engine) listElements(term Term, subst Substitution) ([]Term, bool) {
+	var items []Term
+	for {
+		term = emptyListAtom(e.deref(term, subst))
+		if term.Type != "list" {
+			return nil, false
+		}
+		if term.Value != listTailMarker {
+			return append(items, term.Args...), true
+		}
+		items = append(items, term.Args[:len(term.Args)-1]...)
+		term = term.Args[len(term.Args)-1]
+	}
+}
+
+// termRank orders term types for the standard order of terms:
+// variables < numbers < dates < atoms < lists < compound terms.
+func termRank(t Term) int {
+	switch t.Type {
+	case "variable":
+		return 0
+	case "number":
+		return 1
+	case "date":
+		return 2
+	case "atom":
+		return 3
+	case "list":
+		return 4
+	default:
+		return 5
+	}
+}
+
+// compareTerms compares two instantiated terms in the standard order,
+// returning -1, 0 or 1.
+func compareTerms(a, b Term) int {
+	a, b = asCompound(emptyListAtom(a)), asCompound(emptyListAtom(b))
+	if ra, rb := termRank(a), termRank(b); ra != rb {
+		if ra < rb {
+			return -1
+		}
+		return 1
+	}
+
+	switch a.Type {
+	case "number":
+		x, y := a.Value.(float64), b.Value.(float64)
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	case "date":
+		x, errX := time.Parse(time.RFC3339, a.Value.(string))
+		y, errY := time.Parse(time.RFC3339, b.Value.(string))
+		if errX == nil && errY == nil {
+			return x.Compare(y)
+		}
+		return strings.Compare(a.Value.(string), b.Value.(string))
+	case "variable", "atom":
+		return strings.Compare(a.Value.(string), b.Value.(string))
+	case "list":
+		if a.Value != b.Value {
+			// Proper lists before partial lists
+			if a.Value == listTailMarker {
+				return 1
+			}
+			return -1
+		}
+		for i := 0; i < len(a.Args) && i < len(b.Args); i++ {
+			if c := compareTerms(a.Args[i], b.Args[i]); c != 0 {
+				return c
+			}
+		}
+		return compareInts(len(a.Args), len(b.Args))
+	}
+
+	// Compound terms: arity, then name, then arguments left to right
+	if c := compareInts(len(a.Args), len(b.Args)); c != 0 {
+		return c
+	}
+	if a.Type != b.Type {
+		return strings.Compare(a.Type, b.Type)
+	}
+	nameA, _ := a.Value.(string)
+	nameB, _ := b.Value.(string)
+	if c := strings.Compare(nameA, nameB); c != 0 {
+		return c
+	}
+	for i := range a.Args {
+		if c := compareTerms(a.Args[i], b.Args[i]); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+func compareInts(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
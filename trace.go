@@ -0,0 +1,422 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Tracing. A traced query reports resolution in the Byrd box model: call
+// when a goal is entered, exit for each of its solutions, redo before each
+// further solution, fail when it has none, and exception when evaluating a
+// builtin panics, which aborts the query. The solver finds every solution,
+// so a goal that succeeded is not followed by a final redo and fail.
+//
+// Tracing is turned on per query with the trace option, optionally limited
+// to some predicates, or for every query of a session with trace/0 (all
+// predicates) and spy/1 (the spied predicates only). A profiled query runs
+// with a tracer too, one that only counts and times the ports.
+
+// traceExit is the goal that reports the exit of a rule once its body has
+// been proved.
+const traceExit = contextKey + "trace_exit"
+
+// traceAll is the spy point trace/0 records for a session.
+const traceAll = "*"
+
+// TraceEvent is one port of a traced goal.
+type TraceEvent struct {
+	Port     string `json:"port"` // call, exit, redo, fail or exception
+	Depth    int    `json:"depth"`
+	Goal     Term   `json:"goal"`
+	ClauseID int    `json:"clause_id,omitempty"` // the fact or rule behind an exit
+	Message  string `json:"message,omitempty"`   // for exceptions
+	Text     string `json:"text"`
+}
+
+// traceFrame is one invocation of a goal; frame 0 stands for the query.
+// Profiled queries also get a frame for each rule body they run, below the
+// invocation of its predicate.
+type traceFrame struct {
+	goal      Term
+	predicate string // Name/Arity, qualified outside the user module
+	parent    int
+	depth     int
+	exits     int
+	traced    bool // the goal passes the predicate filter
+	pending   bool // a builtin whose call port is not reported yet
+	builtin   bool
+	clauseID  int // the rule of a rule body frame
+	cached    bool
+	factRows  int
+	ruleRows  int
+	self      time.Duration
+}
+
+type tracer struct {
+	ops       *opTable
+	reporting bool            // events are reported, not only profiled
+	filter    map[string]bool // Name or Name/Arity; nil traces every goal
+	frames    []*traceFrame
+	events    []TraceEvent
+	stream    func(TraceEvent)
+	profile   *profiler
+}
+
+// traceAbort carries an exception through the solver of a traced query.
+type traceAbort struct {
+	message string
+}
+
+// newTracer returns the tracer for a query, or nil when it is neither
+// traced nor profiled.
+func (e *Engine) newTracer(query Query, sessionID string, stream func(TraceEvent)) *tracer {
+	t := &tracer{ops: e.sessionOps(sessionID), stream: stream,
+		frames: []*traceFrame{{depth: -1}}}
+	var filter []string
+	switch spies := e.sessionSpyPoints(sessionID); {
+	case query.Trace || len(query.TraceFilter) > 0 || stream != nil:
+		t.reporting = true
+		filter = query.TraceFilter
+	case spies[traceAll]:
+		t.reporting = true
+	case len(spies) > 0:
+		t.reporting = true
+		for spec := range spies {
+			filter = append(filter, spec)
+		}
+	}
+	if query.Profile {
+		t.profile = newProfiler()
+	}
+	if !t.reporting && t.profile == nil {
+		return nil
+	}
+
+	if len(filter) > 0 {
+		t.filter = make(map[string]bool)
+		for _, spec := range filter {
+			t.filter[spec] = true
+		}
+	}
+	return t
+}
+
+func tracing(subst Substitution) bool {
+	return contextOf(subst).tracer != nil
+}
+
+// reporting tells whether the query run with subst reports trace events.
+func (e *Engine) reporting(subst Substitution) bool {
+	t, _ := e.tracerOf(subst)
+	return t != nil && t.reporting
+}
+
+// traceTransparent reports whether goal is traced through rather than as a
+// goal of its own: conjunctions and module qualifications.
+func traceTransparent(goal Term) bool {
+	return goal.Type == "compound" && len(goal.Args) == 2 && (goal.Value == "," || goal.Value == ":")
+}
+
+// startTrace runs the query whose initial substitution is subst with t.
+func startTrace(t *tracer, subst Substitution) {
+	ctx := contextOf(subst)
+	ctx.tracer, ctx.frame = t, 0
+	setContext(subst, ctx)
+}
+
+// tracerOf returns the tracer of the branch described by subst and the
+// invocation it is running in.
+func (e *Engine) tracerOf(subst Substitution) (*tracer, int) {
+	ctx := contextOf(subst)
+	return ctx.tracer, ctx.frame
+}
+
+// inFrame returns subst running in invocation frame.
+func inFrame(subst Substitution, frame int) Substitution {
+	ctx := contextOf(subst)
+	ctx.frame = frame
+	return withContext(subst, ctx)
+}
+
+// traceCall starts an invocation of goal, reporting its call port unless
+// it is a builtin not known to be one yet, and returns the invocation and
+// subst running inside it.
+func (e *Engine) traceCall(subst Substitution, goal Term, pending bool) (int, Substitution) {
+	t, current := e.tracerOf(subst)
+	if t == nil {
+		return 0, subst
+	}
+	goal = e.instantiate(goal, subst)
+	module, plain := splitModule(goal)
+	frame := &traceFrame{goal: goal, parent: current, depth: t.frames[current].depth + 1,
+		traced: t.matches(plain), pending: true, builtin: pending}
+	if plain.Type == "atom" || plain.Type == "compound" {
+		frame.predicate = indicatorKey(plain.Value.(string), len(plain.Args))
+		if module != userModule {
+			frame.predicate = module + ":" + frame.predicate
+		}
+	}
+	t.frames = append(t.frames, frame)
+	inv := len(t.frames) - 1
+	if !pending {
+		t.flush(inv)
+	}
+	t.profile.enter(t, inv)
+	return inv, inFrame(subst, inv)
+}
+
+// traceClause starts the body of a rule resolving invocation inv in a
+// profiled query.
+func (e *Engine) traceClause(subst Substitution, inv, ruleID int) Substitution {
+	t, _ := e.tracerOf(subst)
+	if t == nil || t.profile == nil {
+		return subst
+	}
+	call := t.frames[inv]
+	t.frames = append(t.frames, &traceFrame{goal: call.goal, predicate: call.predicate,
+		parent: inv, depth: call.depth, clauseID: ruleID})
+	return inFrame(subst, len(t.frames)-1)
+}
+
+// traceStep notes the invocation the solver is working for, which profiled
+// queries charge the time spent to.
+func (e *Engine) traceStep(subst Substitution) {
+	if t, current := e.tracerOf(subst); t != nil {
+		t.profile.enter(t, current)
+	}
+}
+
+// traceExitPort reports a solution of invocation inv by the fact or rule
+// kind clauseID, and returns subst running in its caller again.
+func (e *Engine) traceExitPort(subst Substitution, inv int, kind string, clauseID int) Substitution {
+	t, current := e.tracerOf(subst)
+	if t == nil {
+		return subst
+	}
+	frame := t.frames[inv]
+	if frame.exits > 0 {
+		t.report(inv, "redo", frame.goal, 0, "")
+	}
+	frame.exits++
+	if body := t.frames[current]; kind == "rule" && body.clauseID == clauseID && body.parent == inv {
+		body.exits++
+	}
+	if kind == "fact" {
+		t.profile.factExit(frame.predicate, clauseID)
+	}
+	t.report(inv, "exit", e.instantiate(frame.goal, subst), clauseID, "")
+	t.profile.enter(t, frame.parent)
+	return inFrame(subst, frame.parent)
+}
+
+// traceLoaded records the rows loaded from the store for invocation inv.
+func (e *Engine) traceLoaded(subst Substitution, inv, factRows, ruleRows int) {
+	if t, _ := e.tracerOf(subst); t != nil {
+		t.frames[inv].factRows += factRows
+		t.frames[inv].ruleRows += ruleRows
+	}
+}
+
+// traceCached records that invocation inv was answered from the cache.
+func (e *Engine) traceCached(subst Substitution, inv int) {
+	if t, _ := e.tracerOf(subst); t != nil {
+		t.frames[inv].cached = true
+	}
+}
+
+// traceFail reports the fail port of inv when it had no solution.
+func (e *Engine) traceFail(subst Substitution, inv int) {
+	if t, _ := e.tracerOf(subst); t != nil && t.frames[inv].exits == 0 {
+		t.report(inv, "fail", t.frames[inv].goal, 0, "")
+	}
+}
+
+// solveTracedBuiltin evaluates goal as a builtin in a traced query and
+// solves the remaining goals after each of its solutions; handled is false
+// when goal is not a builtin.
+func (e *Engine) solveTracedBuiltin(goal Term, remaining []Term, subst Substitution, sessionID string) ([]Substitution, bool) {
+	inv, inner := e.traceCall(subst, goal, true)
+	solutions, handled := e.tracedBuiltin(goal, inner, inv, sessionID)
+	if !handled {
+		if t, current := e.tracerOf(subst); t != nil {
+			t.profile.enter(t, current)
+			t.frames = t.frames[:inv]
+		}
+		return nil, false
+	}
+
+	var allResults []Substitution
+	for _, sol := range solutions {
+		if proving(sol) {
+			sol = e.recordProof(sol, Atom("exit"))
+		}
+		allResults = append(allResults, e.solve(remaining, e.traceExitPort(sol, inv, "", 0), sessionID)...)
+	}
+	e.traceFail(inner, inv)
+	return allResults, true
+}
+
+// tracedBuiltin evaluates a builtin in a traced query: a panic is reported
+// as an exception of the goal and of the invocations it was called from,
+// and aborts the query.
+func (e *Engine) tracedBuiltin(goal Term, subst Substitution, inv int, sessionID string) (results []Substitution, handled bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, aborted := r.(traceAbort); aborted {
+				panic(r)
+			}
+			message := fmt.Sprint(r)
+			if t, _ := e.tracerOf(subst); t != nil {
+				for frame := inv; frame != 0; frame = t.frames[frame].parent {
+					t.report(frame, "exception", t.frames[frame].goal, 0, message)
+				}
+			}
+			panic(traceAbort{message})
+		}
+	}()
+	return e.evalBuiltin(goal, subst, sessionID)
+}
+
+func (t *tracer) matches(goal Term) bool {
+	if t.filter == nil {
+		return true
+	}
+	if goal.Type != "atom" && goal.Type != "compound" {
+		return false
+	}
+	name := goal.Value.(string)
+	return t.filter[name] || t.filter[indicatorKey(name, len(goal.Args))]
+}
+
+// flush reports the call ports still pending for inv and the invocations
+// it was called from, outermost first.
+func (t *tracer) flush(inv int) {
+	var chain []int
+	for frame := inv; frame != 0 && t.frames[frame].pending; frame = t.frames[frame].parent {
+		chain = append(chain, frame)
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		frame := t.frames[chain[i]]
+		frame.pending = false
+		t.emit(frame, "call", frame.goal, 0, "")
+	}
+}
+
+func (t *tracer) report(inv int, port string, goal Term, clauseID int, message string) {
+	t.flush(inv)
+	t.emit(t.frames[inv], port, goal, clauseID, message)
+}
+
+func (t *tracer) emit(frame *traceFrame, port string, goal Term, clauseID int, message string) {
+	if !t.reporting || !frame.traced {
+		return
+	}
+	text := fmt.Sprintf("%s: (%d) %s", strings.ToUpper(port[:1])+port[1:], frame.depth, t.ops.format(goal, true))
+	if message != "" {
+		text += ": " + message
+	}
+	event := TraceEvent{Port: port, Depth: frame.depth, Goal: goal, ClauseID: clauseID, Message: message, Text: text}
+	t.events = append(t.events, event)
+	if t.stream != nil {
+		t.stream(event)
+	}
+}
+
+// SessionSpyPoints lists the predicates spied on in a session, with "*"
+// standing for trace/0.
+func (e *Engine) SessionSpyPoints(sessionID string) ([]string, error) {
+	rows, err := e.db.Query("SELECT predicate FROM session_spypoints WHERE session_id = ?", sessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	specs := []string{}
+	for rows.Next() {
+		var spec string
+		if err := rows.Scan(&spec); err != nil {
+			return nil, err
+		}
+		specs = append(specs, spec)
+	}
+	sort.Strings(specs)
+	return specs, nil
+}
+
+// sessionSpyPoints returns a session's spy points, cached until they
+// change.
+func (e *Engine) sessionSpyPoints(sessionID string) map[string]bool {
+	e.mu.Lock()
+	spies, cached := e.spypoints[sessionID]
+	e.mu.Unlock()
+	if cached {
+		return spies
+	}
+
+	specs, err := e.SessionSpyPoints(sessionID)
+	if err != nil {
+		return nil
+	}
+	spies = make(map[string]bool)
+	for _, spec := range specs {
+		spies[spec] = true
+	}
+	e.mu.Lock()
+	e.spypoints[sessionID] = spies
+	e.mu.Unlock()
+	return spies
+}
+
+// setSpyPoint adds or removes a spy point of a session.
+func (e *Engine) setSpyPoint(sessionID, spec string, on bool) error {
+	var err error
+	if on {
+		_, err = e.db.Exec("INSERT OR IGNORE INTO session_spypoints (session_id, predicate) VALUES (?, ?)", sessionID, spec)
+	} else {
+		_, err = e.db.Exec("DELETE FROM session_spypoints WHERE session_id = ? AND predicate = ?", sessionID, spec)
+	}
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	delete(e.spypoints, sessionID)
+	e.mu.Unlock()
+	return nil
+}
+
+// handleTracing implements trace/0, notrace/0, spy/1 and nospy/1. They
+// take effect from the session's next query on.
+func (e *Engine) handleTracing(goal Term, subst Substitution, sessionID string) ([]Substitution, bool) {
+	switch {
+	case goal.Type == "atom" && (goal.Value == "trace" || goal.Value == "notrace"):
+		if err := e.setSpyPoint(sessionID, traceAll, goal.Value == "trace"); err != nil {
+			return []Substitution{}, true
+		}
+		return []Substitution{subst}, true
+
+	case goal.Type == "compound" && len(goal.Args) == 1:
+		specs := []Term{e.instantiate(goal.Args[0], subst)}
+		if items, ok := e.listElements(specs[0], subst); ok {
+			specs = items
+		}
+		for _, spec := range specs {
+			var key string
+			switch {
+			case spec.Type == "atom":
+				key = spec.Value.(string)
+			case spec.Type == "compound" && spec.Value == "/" && len(spec.Args) == 2 &&
+				spec.Args[0].Type == "atom" && spec.Args[1].Type == "number":
+				key = indicatorKey(spec.Args[0].Value.(string), int(spec.Args[1].Value.(float64)))
+			default:
+				return []Substitution{}, true
+			}
+			if err := e.setSpyPoint(sessionID, key, goal.Value == "spy"); err != nil {
+				return []Substitution{}, true
+			}
+		}
+		return []Substitution{subst}, true
+	}
+	return []Substitution{}, true
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func traceText(events []TraceEvent) []string {
+	lines := []string{}
+	for _, event := range events {
+		lines = append(lines, event.Text)
+	}
+	return lines
+}
+
+func TestTracer(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+
+	if _, err := engine.Consult(sessionID, familySource); err != nil {
+		t.Fatalf("Consult failed: %v", err)
+	}
+	goals, _ := engine.ParseQuery(sessionID, "grandparent(ann, W)")
+	result := engine.Query(Query{Goals: goals, Trace: true}, sessionID)
+	if len(result.Solutions) != 2 {
+		t.Fatalf("Expected two grandchildren, got %v", result.Solutions)
+	}
+
+	// Calls of clause body goals show renamed variables, so compare ports
+	// and the goals the exits instantiate
+	expected := []string{
+		"call 0", "call 1", "exit 1 parent(ann,bob)", "call 1", "exit 1 parent(bob,cal)",
+		"exit 0 grandparent(ann,cal)", "redo 1", "exit 1 parent(bob,dee)",
+		"redo 0", "exit 0 grandparent(ann,dee)",
+	}
+	var ports []string
+	for _, event := range result.Trace {
+		port := fmt.Sprintf("%s %d", event.Port, event.Depth)
+		if event.Port == "exit" {
+			port += " " + formatTerm(event.Goal, true)
+		}
+		ports = append(ports, port)
+	}
+	if !reflect.DeepEqual(ports, expected) {
+		t.Errorf("Expected ports %v, got %v", expected, ports)
+	}
+	if result.Trace[0].Text != "Call: (0) grandparent(ann,W)" {
+		t.Errorf("Expected a text form of the event, got %q", result.Trace[0].Text)
+	}
+	if result.Trace[2].Port != "exit" || result.Trace[2].ClauseID != 1 || result.Trace[5].ClauseID != 1 {
+		t.Errorf("Expected exits to name their clauses, got %+v", result.Trace)
+	}
+
+	// Builtins have ports too, and a goal without solutions fails
+	goals, _ = engine.ParseQuery(sessionID, "sibling(cal, S)")
+	result = engine.Query(Query{Goals: goals, Trace: true, TraceFilter: []string{"dif"}}, sessionID)
+	expected = []string{
+		"Call: (1) dif(cal,cal)",
+		"Fail: (1) dif(cal,cal)",
+		"Call: (1) dif(cal,dee)",
+		"Exit: (1) dif(cal,dee)",
+	}
+	if lines := traceText(result.Trace); !reflect.DeepEqual(lines, expected) {
+		t.Errorf("Expected the filtered trace %v, got %v", expected, lines)
+	}
+
+	goals, _ = engine.ParseQuery(sessionID, "grandparent(cal, W)")
+	result = engine.Query(Query{Goals: goals, Trace: true, TraceFilter: []string{"grandparent/2"}}, sessionID)
+	expected = []string{"Call: (0) grandparent(cal,W)", "Fail: (0) grandparent(cal,W)"}
+	if lines := traceText(result.Trace); !reflect.DeepEqual(lines, expected) {
+		t.Errorf("Expected %v, got %v", expected, lines)
+	}
+
+	// Untraced queries report nothing
+	if result = engine.Query(Query{Goals: goals}, sessionID); result.Trace != nil {
+		t.Errorf("Expected no trace, got %v", result.Trace)
+	}
+
+	// A variable named like the tracer state is an ordinary variable
+	solutions := queryAll(engine, sessionID,
+		Compound("=", []Term{Variable("$trace"), Number(1)}),
+		Compound("parent", []Term{Atom("ann"), Variable("C")}))
+	if len(solutions) != 1 || solutions[0].Bindings["$trace"].Value != 1.0 {
+		t.Errorf("Expected $trace to be an ordinary variable, got %v", solutions)
+	}
+
+	// The engine's internal goals cannot be called by name
+	for _, query := range []string{"'$trace_exit'(a, b)", "'$proof_exit'", "'$attr_unify'(m, 1, X)", "'$when'(F, nonvar(X), true)"} {
+		goals, _ = engine.ParseQuery(sessionID, query)
+		if result = engine.Query(Query{Goals: goals, Trace: true}, sessionID); len(result.Solutions) != 1 || result.Solutions[0].Success {
+			t.Errorf("Expected %s to be an unknown predicate, got %v", query, result.Solutions)
+		}
+	}
+}
+
+func TestSpyPoints(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+	engine.Consult(sessionID, familySource+":- spy(grandparent/2).\n")
+
+	goals, _ := engine.ParseQuery(sessionID, "grandparent(bob, W)")
+	result := engine.Query(Query{Goals: goals}, sessionID)
+	expected := []string{"Call: (0) grandparent(bob,W)", "Fail: (0) grandparent(bob,W)"}
+	if lines := traceText(result.Trace); !reflect.DeepEqual(lines, expected) {
+		t.Errorf("Expected only the spied predicate, got %v", lines)
+	}
+	if spies, _ := engine.SessionSpyPoints(sessionID); !reflect.DeepEqual(spies, []string{"grandparent/2"}) {
+		t.Errorf("Expected [grandparent/2], got %v", spies)
+	}
+
+	queryAll(engine, sessionID, Atom("trace"))
+	if result = engine.Query(Query{Goals: goals}, sessionID); len(result.Trace) != 10 {
+		t.Errorf("Expected trace/0 to trace every goal, got %v", traceText(result.Trace))
+	}
+
+	queryAll(engine, sessionID, Atom("notrace"), Compound("nospy", []Term{List([]Term{Atom("grandparent")})}))
+	queryAll(engine, sessionID, Compound("nospy", []Term{Compound("/", []Term{Atom("grandparent"), Number(2)})}))
+	if result = engine.Query(Query{Goals: goals}, sessionID); result.Trace != nil {
+		t.Errorf("Expected tracing to be off, got %v", traceText(result.Trace))
+	}
+	if spies, _ := engine.SessionSpyPoints(sessionID); len(spies) != 0 {
+		t.Errorf("Expected no spy points, got %v", spies)
+	}
+}
+
+func TestTraceHandler(t *testing.T) {
+	router, engine := setupTestRouter(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+	engine.Consult(sessionID, familySource)
+
+	body, _ := json.Marshal(Query{Text: "grandparent(ann, dee)", TraceFilter: []string{"grandparent/2"}})
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/sessions/"+sessionID+"/trace", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("Expected a stream, got %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	type streamLine struct {
+		Event  *TraceEvent  `json:"event"`
+		Result *QueryResult `json:"result"`
+	}
+	var lines []streamLine
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		var line streamLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("Invalid line %q: %v", scanner.Text(), err)
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) != 3 || lines[0].Event.Port != "call" || lines[1].Event.Port != "exit" || lines[1].Event.ClauseID != 1 {
+		t.Fatalf("Expected call and exit events, got %s", w.Body.String())
+	}
+	if result := lines[2].Result; result == nil || !result.Solutions[0].Success || result.Trace != nil {
+		t.Errorf("Expected the result last, got %s", w.Body.String())
+	}
+}
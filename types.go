@@ -2,8 +2,11 @@ package main
 
 import "time"
 
+// listTailMarker is the Value of a list term whose last argument is its tail.
+const listTailMarker = "|"
+
 type Term struct {
-	Type  string      `json:"type"` // "atom", "variable", "compound", "list", "date", "number"
+	Type  string      `json:"type"` // "atom", "variable", "compound", "list", "date", "interval", "number"
 	Value interface{} `json:"value"`
 	Args  []Term      `json:"args,omitempty"`
 }
@@ -19,6 +22,25 @@ type Session struct {
 type CreateSessionRequest struct {
 	Name        string `json:"name" binding:"required"`
 	Description string `json:"description"`
+	APIKey      string `json:"api_key,omitempty"` // required for the session from then on
+}
+
+type EnableLibraryRequest struct {
+	Library string `json:"library" binding:"required"`
+}
+
+type AddParentRequest struct {
+	Parent string `json:"parent" binding:"required"`
+}
+
+type ConsultRequest struct {
+	Text string `json:"text" binding:"required"`
+}
+
+type ConsultResult struct {
+	Clauses    int      `json:"clauses"`
+	Directives int      `json:"directives"`
+	Warnings   []string `json:"warnings,omitempty"`
 }
 
 type Fact struct {
@@ -35,18 +57,36 @@ type Rule struct {
 }
 
 type Query struct {
-	Goals []Term `json:"goals"`
+	Goals       []Term   `json:"goals"`
+	Text        string   `json:"text,omitempty"`         // goals as Prolog text, read with the session's operators
+	Proof       bool     `json:"proof,omitempty"`        // return the derivation of each solution
+	WhyNot      bool     `json:"why_not,omitempty"`      // explain the failure when there is no solution
+	Trace       bool     `json:"trace,omitempty"`        // report the call, exit, redo and fail ports of each goal
+	TraceFilter []string `json:"trace_filter,omitempty"` // predicates to trace, as Name or Name/Arity
+	Profile     bool     `json:"profile,omitempty"`      // report per-predicate and per-clause statistics
+	Optimize    bool     `json:"optimize,omitempty"`     // reorder pure goals by estimated cost before running
+	Evaluation  string   `json:"evaluation,omitempty"`   // top_down, bottom_up or sql; the session's default when empty
 }
 
 type Substitution map[string]Term
 
 type Solution struct {
-	Bindings Substitution `json:"bindings"`
-	Success  bool         `json:"success"`
+	Bindings    Substitution `json:"bindings"`
+	Success     bool         `json:"success"`
+	Output      string       `json:"output,omitempty"`
+	Residuals   []Term       `json:"residuals,omitempty"`   // pending constraints on unbound variables
+	Proof       []ProofNode  `json:"proof,omitempty"`       // derivation of the query's goals
+	Explanation string       `json:"explanation,omitempty"` // the derivation as indented text
 }
 
 type QueryResult struct {
-	Solutions []Solution `json:"solutions"`
+	Solutions []Solution     `json:"solutions"`
+	WhyNot    *FailureReport `json:"why_not,omitempty"`
+	Trace     []TraceEvent   `json:"trace,omitempty"`
+	Profile   *Profile       `json:"profile,omitempty"`
+	Error     string         `json:"error,omitempty"`     // why the query was aborted
+	Reordered []Term         `json:"reordered,omitempty"` // the goals as run, when Optimize changed their order
+	Datalog   *DatalogStats  `json:"datalog,omitempty"`   // the evaluation of a bottom-up query
 }
 
 type TableKey struct {
@@ -75,6 +115,35 @@ func Number(n float64) Term {
 	return Term{Type: "number", Value: n}
 }
 
+// Date stores t as RFC 3339 text, which keeps its UTC offset but not the
+// name of its time zone.
 func Date(t time.Time) Term {
 	return Term{Type: "date", Value: t.Format(time.RFC3339)}
-}
\ No newline at end of file
+}
+
+func Interval(start, end time.Time) Term {
+	return Term{Type: "interval", Args: []Term{Date(start), Date(end)}}
+}
+
+// List builds a proper list. Partial lists such as [H|T] are built with
+// ListWithTail and carry the tail as their last argument.
+func List(items []Term) Term {
+	return Term{Type: "list", Args: items}
+}
+
+func ListWithTail(items []Term, tail Term) Term {
+	if len(items) == 0 {
+		return tail
+	}
+	if tail.Type == "list" {
+		if tail.Value == listTailMarker {
+			return ListWithTail(append(append([]Term{}, items...), tail.Args[:len(tail.Args)-1]...), tail.Args[len(tail.Args)-1])
+		}
+		return List(append(append([]Term{}, items...), tail.Args...))
+	}
+	if tail.Type == "atom" && tail.Value == "[]" {
+		return List(items)
+	}
+	args := append(append([]Term{}, items...), tail)
+	return Term{Type: "list", Value: listTailMarker, Args: args}
+}
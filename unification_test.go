@@ -188,4 +188,48 @@ func TestDeref(t *testing.T) {
 	if result.Type != "atom" || result.Value != "test" {
 		t.Errorf("Expected non-variable to remain unchanged, got %v", result)
 	}
-}
\ No newline at end of file
+}
+
+func TestUnifyLists(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+
+	subst := make(Substitution)
+	abc := List([]Term{Atom("a"), Atom("b"), Atom("c")})
+
+	// [H|T] = [a, b, c]
+	result, ok := engine.unify(ListWithTail([]Term{Variable("H")}, Variable("T")), abc, subst)
+	if !ok {
+		t.Fatal("Expected [H|T] to unify with [a, b, c]")
+	}
+	if result["H"].Value != "a" {
+		t.Errorf("Expected H to be bound to 'a', got '%v'", result["H"].Value)
+	}
+	tail, ok := engine.listElements(Variable("T"), result)
+	if !ok || len(tail) != 2 || tail[0].Value != "b" || tail[1].Value != "c" {
+		t.Errorf("Expected T to be [b, c], got %v", engine.instantiate(Variable("T"), result))
+	}
+
+	// [a, X, c] = [Y, b, c]
+	result, ok = engine.unify(List([]Term{Atom("a"), Variable("X"), Atom("c")}), List([]Term{Variable("Y"), Atom("b"), Atom("c")}), subst)
+	if !ok || result["X"].Value != "b" || result["Y"].Value != "a" {
+		t.Errorf("Expected X = b and Y = a, got %v", result)
+	}
+
+	// Lists of different lengths do not unify
+	if _, ok = engine.unify(abc, List([]Term{Atom("a"), Atom("b")}), subst); ok {
+		t.Error("Expected lists of different lengths to fail unification")
+	}
+
+	// The atom [] is the empty list
+	if _, ok = engine.unify(Atom("[]"), List(nil), subst); !ok {
+		t.Error("Expected [] to unify with the empty list")
+	}
+
+	// Instantiating a partial list whose tail is bound yields a proper list
+	result, _ = engine.unify(Variable("T"), List([]Term{Atom("b")}), subst)
+	full := engine.instantiate(ListWithTail([]Term{Atom("a")}, Variable("T")), result)
+	if full.Type != "list" || full.Value != nil || len(full.Args) != 2 {
+		t.Errorf("Expected proper list [a, b], got %v", full)
+	}
+}
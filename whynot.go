@@ -0,0 +1,257 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Why-not analysis. When a query run with WhyNot has no solution, the goals
+// are replayed one at a time with the ordinary solver to find the first one
+// that cannot be proved. That goal is then examined against each candidate
+// clause: a head that does not unify is reported with the argument that
+// rejected it, and a rule whose head unifies is followed into its body the
+// same way. Goals with no clause to match are suggested as missing facts.
+// The replay is read-only: goals that change the session, such as
+// retract/1, fail in it and are reported as not replayed.
+
+const (
+	maxWhyNotDepth    = 20   // rule bodies followed below the query
+	maxWhyNotBranches = 3    // bindings of earlier goals a failure is examined under
+	maxWhyNotSteps    = 1000 // goals examined in one analysis
+)
+
+// FailureReport explains why a query has no solution.
+type FailureReport struct {
+	Failures    []FailedGoal `json:"failures"`              // deepest first
+	Suggestions []Term       `json:"suggestions,omitempty"` // facts whose absence made a goal fail
+	Explanation string       `json:"explanation"`
+}
+
+// FailedGoal is a goal that could not be proved where it was called.
+type FailedGoal struct {
+	Goal       Term              `json:"goal"`
+	Depth      int               `json:"depth"`          // 0 for the query's own goals
+	Path       []Term            `json:"path,omitempty"` // the goals it was called to prove, outermost first
+	Reason     string            `json:"reason"`
+	Candidates []CandidateClause `json:"candidates,omitempty"`
+}
+
+// CandidateClause is a clause tried for a failed goal and why it was
+// rejected.
+type CandidateClause struct {
+	Kind     string `json:"kind"` // "fact" or "rule"
+	ClauseID int    `json:"clause_id"`
+	Head     Term   `json:"head"`
+	Rejected string `json:"rejected"`
+}
+
+type failureAnalysis struct {
+	e           *Engine
+	sessionID   string
+	ops         *opTable
+	steps       int
+	failures    []FailedGoal
+	suggestions []Term
+	suggested   map[string]bool
+	names       Substitution // renamed clause variables -> their names in the clause
+}
+
+// whyNot analyses goals that have no solution from subst.
+func (e *Engine) whyNot(goals []Term, subst Substitution, sessionID string) *FailureReport {
+	a := &failureAnalysis{e: e, sessionID: sessionID, ops: e.sessionOps(sessionID),
+		suggested: make(map[string]bool), names: make(Substitution)}
+	a.conjunction(goals, subst, userModule, nil)
+	for i := range a.failures {
+		a.failures[i].Goal = a.display(a.failures[i].Goal)
+		for j, goal := range a.failures[i].Path {
+			a.failures[i].Path[j] = a.display(goal)
+		}
+	}
+	for i, fact := range a.suggestions {
+		a.suggestions[i] = a.display(fact)
+	}
+
+	sort.SliceStable(a.failures, func(i, j int) bool { return a.failures[i].Depth > a.failures[j].Depth })
+	report := &FailureReport{Failures: a.failures, Suggestions: a.suggestions}
+	if report.Failures == nil {
+		report.Failures = []FailedGoal{}
+	}
+	report.Explanation = a.explain(report)
+	return report
+}
+
+// conjunction finds the first of goals that has no solution after the ones
+// before it, examines it and returns it instantiated; ok is false when the
+// goals succeed together.
+func (a *failureAnalysis) conjunction(goals []Term, subst Substitution, module string, path []Term) (Term, bool) {
+	prefix := []Substitution{subst}
+	for _, goal := range goals {
+		var next []Substitution
+		for _, s := range prefix {
+			next = append(next, a.e.solve([]Term{qualify(module, goal)}, s, a.sessionID)...)
+		}
+		if len(next) == 0 {
+			for i, s := range prefix {
+				if i == maxWhyNotBranches {
+					break
+				}
+				a.goal(goal, s, module, path)
+			}
+			return a.e.instantiate(goal, prefix[0]), true
+		}
+		prefix = next
+	}
+	return Term{}, false
+}
+
+// goal examines a goal that has no solution from subst.
+func (a *failureAnalysis) goal(goal Term, subst Substitution, module string, path []Term) {
+	a.steps++
+	if a.steps > maxWhyNotSteps {
+		return
+	}
+	goal = a.e.instantiate(goal, subst)
+	if qualified, plain := splitModule(goal); qualified != userModule {
+		module, goal = qualified, plain
+	}
+	failed := FailedGoal{Goal: goal, Depth: len(path), Path: path}
+
+	if len(path) >= maxWhyNotDepth {
+		failed.Reason = "not examined further: depth limit reached"
+		a.failures = append(a.failures, failed)
+		return
+	}
+	if goal.Type != "atom" && goal.Type != "compound" {
+		failed.Reason = "not a callable goal"
+		a.failures = append(a.failures, failed)
+		return
+	}
+
+	key := indicatorKey(goal.Value.(string), len(goal.Args))
+	switch key {
+	case ",/2":
+		a.conjunction(flattenConjunction(goal), subst, module, path)
+		return
+	case "call/1", "once/1":
+		a.goal(goal.Args[0], subst, module, path)
+		return
+	}
+	if changesSession(goal) {
+		failed.Reason = "not replayed: it changes the session"
+		a.failures = append(a.failures, failed)
+		return
+	}
+	if _, handled := a.e.evalBuiltin(qualify(module, goal), subst, a.sessionID); handled {
+		failed.Reason = "builtin failed"
+		a.failures = append(a.failures, failed)
+		return
+	}
+
+	resolved := a.e.resolveModule(a.sessionID, module, goal)
+	facts, rules := a.e.visibleClauses(goal, resolved, a.sessionID)
+	if len(facts) == 0 && len(rules) == 0 {
+		failed.Reason = fmt.Sprintf("no clauses for %s", key)
+		a.failures = append(a.failures, failed)
+		a.suggest(qualify(resolved, goal))
+		return
+	}
+
+	below := append(append([]Term{}, path...), goal)
+	for _, fact := range facts {
+		failed.Candidates = append(failed.Candidates, CandidateClause{
+			Kind: "fact", ClauseID: fact.ID, Head: fact.Predicate,
+			Rejected: a.mismatch(goal, fact.Predicate, subst),
+		})
+	}
+	headMatched := false
+	for _, rule := range rules {
+		renamed, renames := a.e.renameClause(rule)
+		for name, renamedName := range renames {
+			a.names[renamedName] = Variable(name)
+		}
+		candidate := CandidateClause{Kind: "rule", ClauseID: rule.ID, Head: rule.Head}
+		if s, ok := a.e.unify(goal, renamed.Head, subst); ok {
+			headMatched = true
+			if failing, ok := a.conjunction(renamed.Body, s, resolved, below); ok {
+				candidate.Rejected = "body goal " + a.format(failing) + " failed"
+			} else {
+				candidate.Rejected = "body succeeded, but not with bindings the rest of the query accepts"
+			}
+		} else {
+			candidate.Rejected = a.mismatch(goal, renamed.Head, subst)
+		}
+		failed.Candidates = append(failed.Candidates, candidate)
+	}
+
+	failed.Reason = "no clause matched"
+	if headMatched {
+		failed.Reason = "no clause succeeded"
+	}
+	a.failures = append(a.failures, failed)
+
+	// A goal no rule could start to prove is missing as a fact
+	if !headMatched {
+		a.suggest(qualify(resolved, goal))
+	}
+}
+
+// mismatch describes why goal does not unify with a clause head.
+func (a *failureAnalysis) mismatch(goal, head Term, subst Substitution) string {
+	if goal.Type != head.Type || goal.Value != head.Value || len(goal.Args) != len(head.Args) {
+		return "different name or arity"
+	}
+	s := subst
+	for i := range goal.Args {
+		next, ok := a.e.unify(goal.Args[i], head.Args[i], s)
+		if !ok {
+			return fmt.Sprintf("argument %d: %s does not match %s", i+1,
+				a.format(a.e.instantiate(goal.Args[i], s)), a.format(a.e.instantiate(head.Args[i], s)))
+		}
+		s = next
+	}
+	return "head does not unify"
+}
+
+// display shows the variables of renamed clauses by their names in the
+// clause.
+func (a *failureAnalysis) display(t Term) Term {
+	return a.e.instantiate(t, a.names)
+}
+
+func (a *failureAnalysis) format(t Term) string {
+	return a.ops.format(a.display(t), true)
+}
+
+func (a *failureAnalysis) suggest(fact Term) {
+	key := a.format(fact)
+	if !a.suggested[key] {
+		a.suggested[key] = true
+		a.suggestions = append(a.suggestions, fact)
+	}
+}
+
+// explain renders a report as indented text.
+func (a *failureAnalysis) explain(report *FailureReport) string {
+	var sb strings.Builder
+	for _, failed := range report.Failures {
+		fmt.Fprintf(&sb, "%s failed at depth %d: %s\n", a.ops.format(failed.Goal, true), failed.Depth, failed.Reason)
+		if len(failed.Path) > 0 {
+			steps := make([]string, len(failed.Path))
+			for i, goal := range failed.Path {
+				steps[i] = a.ops.format(goal, true)
+			}
+			fmt.Fprintf(&sb, "  while proving %s\n", strings.Join(steps, " > "))
+		}
+		for _, c := range failed.Candidates {
+			fmt.Fprintf(&sb, "  %s #%d %s: %s\n", c.Kind, c.ClauseID, a.ops.format(c.Head, true), c.Rejected)
+		}
+	}
+	if len(report.Suggestions) > 0 {
+		sb.WriteString("Missing facts that would let the failing goals succeed:\n")
+		for _, fact := range report.Suggestions {
+			sb.WriteString("  " + a.ops.format(fact, true) + ".\n")
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWhyNot(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+
+	if _, err := engine.Consult(sessionID, familySource+"uncle(U, N) :- parent(P, N), brother(U, P).\n"); err != nil {
+		t.Fatalf("Consult failed: %v", err)
+	}
+
+	goals, _ := engine.ParseQuery(sessionID, "grandparent(ann, zed)")
+	result := engine.Query(Query{Goals: goals, WhyNot: true}, sessionID)
+	report := result.WhyNot
+	if report == nil || len(report.Failures) != 2 {
+		t.Fatalf("Expected two failures, got %+v", report)
+	}
+
+	// The deepest failure comes first, with every fact that was tried
+	deepest := report.Failures[0]
+	if formatTerm(deepest.Goal, true) != "parent(bob,zed)" || deepest.Depth != 1 || len(deepest.Path) != 1 {
+		t.Errorf("Expected parent(bob,zed) below the query, got %+v", deepest)
+	}
+	if len(deepest.Candidates) != 3 || deepest.Candidates[1].Rejected != "argument 2: zed does not match cal" {
+		t.Errorf("Expected each parent/2 fact to be rejected, got %+v", deepest.Candidates)
+	}
+	if rule := report.Failures[1].Candidates[0]; rule.Kind != "rule" || rule.Rejected != "body goal parent(bob,zed) failed" {
+		t.Errorf("Expected the rule to be rejected by its body, got %+v", rule)
+	}
+	if len(report.Suggestions) != 1 || formatTerm(report.Suggestions[0], true) != "parent(bob,zed)" {
+		t.Errorf("Expected parent(bob,zed) to be suggested, got %v", report.Suggestions)
+	}
+
+	// Undefined predicates and failing builtins are reported too
+	goals, _ = engine.ParseQuery(sessionID, "uncle(X, cal)")
+	report = engine.Query(Query{Goals: goals, WhyNot: true}, sessionID).WhyNot
+	if report.Failures[0].Reason != "no clauses for brother/2" || formatTerm(report.Suggestions[0], true) != "brother(U,bob)" {
+		t.Errorf("Expected brother/2 to be missing, got %s", report.Explanation)
+	}
+	goals, _ = engine.ParseQuery(sessionID, "parent(ann, X), dif(X, bob)")
+	report = engine.Query(Query{Goals: goals, WhyNot: true}, sessionID).WhyNot
+	if len(report.Failures) != 1 || report.Failures[0].Reason != "builtin failed" || len(report.Suggestions) != 0 {
+		t.Errorf("Expected dif/2 to fail, got %s", report.Explanation)
+	}
+
+	// Nothing is analysed for successful queries or without the option
+	goals, _ = engine.ParseQuery(sessionID, "parent(ann, X)")
+	if engine.Query(Query{Goals: goals, WhyNot: true}, sessionID).WhyNot != nil {
+		t.Error("Expected no report for a successful query")
+	}
+	if queryResult := engine.Query(Query{Goals: []Term{Compound("parent", []Term{Atom("x"), Atom("y")})}}, sessionID); queryResult.WhyNot != nil {
+		t.Error("Expected no report without why_not")
+	}
+}
+
+func TestWhyNotDoesNotChangeTheSession(t *testing.T) {
+	engine := setupTestEngine(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+	if _, err := engine.Consult(sessionID, "p(1).\np(1).\np(1).\n"); err != nil {
+		t.Fatalf("Consult failed: %v", err)
+	}
+
+	goals, _ := engine.ParseQuery(sessionID, "retract(p(1)), q(1)")
+	report := engine.Query(Query{Goals: goals, WhyNot: true}, sessionID).WhyNot
+	if n := len(queryAll(engine, sessionID, Compound("p", []Term{Variable("X")}))); n != 2 {
+		t.Errorf("Expected the query alone to retract one fact, leaving 2, got %d", n)
+	}
+	if report == nil || len(report.Failures) != 1 || report.Failures[0].Reason != "not replayed: it changes the session" {
+		t.Errorf("Expected retract/1 not to be replayed, got %+v", report)
+	}
+}
+
+func TestQueryHandlerWhyNot(t *testing.T) {
+	router, engine := setupTestRouter(t)
+	defer teardownTestEngine(engine)
+	sessionID := createTestSession(t, engine)
+	engine.Consult(sessionID, familySource)
+
+	body, _ := json.Marshal(Query{Text: "grandparent(ann, zed)", WhyNot: true})
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/sessions/"+sessionID+"/query", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+
+	var result QueryResult
+	json.Unmarshal(w.Body.Bytes(), &result)
+	if result.WhyNot == nil || !strings.Contains(result.WhyNot.Explanation, "parent(bob,zed) failed at depth 1: no clause matched") {
+		t.Fatalf("Expected a why-not explanation, got %s", w.Body.String())
+	}
+	if !strings.Contains(result.WhyNot.Explanation, "Missing facts that would let the failing goals succeed:\n  parent(bob,zed).\n") {
+		t.Errorf("Expected a suggested fact, got %q", result.WhyNot.Explanation)
+	}
+}